@@ -0,0 +1,107 @@
+package recache
+
+import "time"
+
+// Default of unset AdaptiveTTLOptions.TargetHits
+const defaultTargetHits = 10
+
+// Options for adapting the TTL of records to their access frequency. See
+// FrontendOptions.AdaptiveTTL.
+type AdaptiveTTLOptions struct {
+	// Bounds of the effective TTL of records.
+	//
+	// Default to a tenth and ten times the TTL set with
+	// RecordWriter.SetTTL().
+	MinTTL, MaxTTL time.Duration
+
+	// Amount of retrievals of a record per TTL set with RecordWriter.SetTTL(),
+	// at which that TTL is kept. The TTL of records retrieved more often is
+	// extended and that of records retrieved less often shortened
+	// proportionally.
+	//
+	// Defaults to 10.
+	TargetHits uint
+}
+
+// Compute the effective TTL of a record with base TTL, that has been retrieved
+// hits times since its creation age ago
+func (o AdaptiveTTLOptions) ttl(
+	base time.Duration,
+	hits uint64,
+	age time.Duration,
+) (ttl time.Duration) {
+	min, max := o.MinTTL, o.MaxTTL
+	if min == 0 {
+		min = base / 10
+	}
+	if max == 0 {
+		max = base * 10
+	}
+	target := o.TargetHits
+	if target == 0 {
+		target = defaultTargetHits
+	}
+
+	if age > 0 {
+		// Hits per base TTL relative to target
+		rate := float64(hits) * float64(base) / float64(age) / float64(target)
+		ttl = time.Duration(float64(base) * rate)
+	}
+	switch {
+	case ttl < min:
+		ttl = min
+	case ttl > max:
+		ttl = max
+	}
+	return
+}
+
+// Schedule eviction of the record src at loc after its effective TTL computed
+// from base with FrontendOptions.AdaptiveTTL
+func (c *Cache) setAdaptiveTTL(
+	loc recordLocation,
+	src *Record,
+	base time.Duration,
+	opts AdaptiveTTLOptions,
+) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rec, ok := c.record(loc)
+	if !ok || rec.rec != src {
+		return
+	}
+	rec.baseTTL = base
+	c.frontends[loc.frontend][loc.key] = rec
+	if deadline, ok := c.adaptTTL(loc, rec, time.Now(), opts); ok {
+		c.scheduleEviction(deadline, []recordLocation{loc})
+	}
+}
+
+// Recompute the TTL of a record with an adaptive TTL and set its eviction
+// deadline, unless a sooner eviction was scheduled by other means. Returns
+// the new deadline and true, if the deadline was set and is in the future.
+// Requires lock on c.mu.
+func (c *Cache) adaptTTL(
+	loc recordLocation,
+	rec recordWithMeta,
+	now time.Time,
+	opts AdaptiveTTLOptions,
+) (deadline time.Time, ok bool) {
+	created := rec.rec.created
+	ttl := opts.ttl(rec.baseTTL, rec.hits, now.Sub(created))
+	deadline = created.Add(ttl)
+	switch {
+	case !deadline.After(now):
+		return
+	case !rec.evictAt.IsZero() &&
+		!rec.evictAt.Equal(rec.ttlDeadline) &&
+		!deadline.Before(rec.evictAt):
+		return
+	}
+	rec.evictAt = deadline
+	rec.ttlDeadline = deadline
+	c.frontends[loc.frontend][loc.key] = rec
+	rec.rec.setTTL(ttl, deadline)
+	return deadline, true
+}
@@ -0,0 +1,118 @@
+package recache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdaptiveTTLOptions(t *testing.T) {
+	t.Parallel()
+
+	const base = 10 * time.Second
+	cases := [...]struct {
+		name string
+		opts AdaptiveTTLOptions
+		hits uint64
+		age  time.Duration
+		ttl  time.Duration
+	}{
+		{"no hits", AdaptiveTTLOptions{}, 0, base, time.Second},
+		{"target rate", AdaptiveTTLOptions{}, 10, base, base},
+		{"double rate", AdaptiveTTLOptions{}, 10, base / 2, 2 * base},
+		{"max", AdaptiveTTLOptions{}, 1e6, base, 10 * base},
+		{"new record", AdaptiveTTLOptions{}, 0, 0, time.Second},
+		{
+			"bounds",
+			AdaptiveTTLOptions{MinTTL: 3 * time.Second, MaxTTL: time.Minute},
+			1e6,
+			base,
+			time.Minute,
+		},
+		{
+			"target hits",
+			AdaptiveTTLOptions{TargetHits: 5},
+			10,
+			base,
+			2 * base,
+		},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			assertEquals(t, c.opts.ttl(base, c.hits, c.age), c.ttl)
+		})
+	}
+}
+
+func TestAdaptiveTTL(t *testing.T) {
+	t.Parallel()
+
+	cache := NewCache(CacheOptions{})
+	f := cache.NewFrontendWithOptions(FrontendOptions{
+		Get: func(k Key, rw *RecordWriter) error {
+			rw.SetTTL(10 * time.Second)
+			return dummyGetter(k, rw)
+		},
+		AdaptiveTTL: &AdaptiveTTLOptions{
+			MinTTL: time.Second,
+			MaxTTL: time.Hour,
+		},
+	})
+
+	var created time.Time
+	for _, k := range [...]string{"hot", "cold"} {
+		rec, err := f.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEquals(t, rec.Meta().TTL, time.Second)
+		exp, ok := f.ExpiresAt(k)
+		assertEquals(t, ok, true)
+		assertEquals(t, exp, rec.Meta().Created.Add(time.Second))
+		created = rec.Meta().Created
+	}
+	for i := 0; i < 1000; i++ {
+		_, err := f.Get("hot")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Simulate the scheduler reaching the initial deadline
+	locs := []recordLocation{{f.id, "hot"}, {f.id, "cold"}}
+	now := created.Add(2 * time.Second)
+	remaining, extended := cache.evictScheduled(
+		now.Truncate(evictionBucketSize),
+		locs,
+		now,
+	)
+	assertEquals(t, len(remaining), 0)
+	assertEquals(t, len(extended), 1)
+	assertEquals(t, extended[0].locs, locs[:1])
+
+	rec, err := f.Get("hot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, rec.Meta().TTL, time.Hour)
+	exp, _ := f.ExpiresAt("hot")
+	assertEquals(t, exp, extended[0].deadline)
+	assertEquals(t, exp, rec.Meta().Created.Add(time.Hour))
+
+	_, ok := f.ExpiresAt("cold")
+	assertEquals(t, ok, false)
+	assertEquals(t, f.Stats().Records, 1)
+
+	// Explicit evictions are not extended
+	f.Evict(time.Millisecond, "hot")
+	exp, _ = f.ExpiresAt("hot")
+	remaining, extended = cache.evictScheduled(
+		exp.Truncate(evictionBucketSize),
+		locs[:1],
+		exp,
+	)
+	assertEquals(t, len(remaining)+len(extended), 0)
+	assertEquals(t, f.Stats().Records, 0)
+	assertConsistency(t, cache)
+}
@@ -0,0 +1,121 @@
+package recache
+
+import (
+	"errors"
+	"time"
+)
+
+// Frontend passed to Cache.Adopt() belongs to a different cache
+var ErrForeignFrontend = errors.New("frontend belongs to a different cache")
+
+// Store a copy of a populated record from any cache in frontend f of c at key
+// k without running the Getter of f. Useful for promoting speculatively
+// generated records, like ones generated in a short-lived per-request cache,
+// into a long-lived cache.
+//
+// Any existing record at k is replaced. Concurrent readers are served the
+// existing record until it is replaced.
+//
+// The data of rec is shared with the adopted record without copying. The
+// adopted record is evicted on eviction of any records rec was populated
+// from, same as rec. Dependencies on tokens registered with
+// RecordWriter.DependOn() are not carried over, but any value attached with
+// RecordWriter.SetAttachment() is.
+//
+// Blocks until rec has been populated and returns its population error, if
+// any.
+func (c *Cache) Adopt(rec *Record, f *Frontend, k Key) (*Record, error) {
+	if f.cache != c {
+		return nil, ErrForeignFrontend
+	}
+	if f.isDeleted() {
+		return nil, ErrFrontendDeleted
+	}
+	rec.semaphore.Wait()
+	if rec.populationError != nil {
+		return nil, rec.populationError
+	}
+
+	for {
+		adopted, wait, err := c.beginAdoption(f, k)
+		switch {
+		case err != nil:
+			return nil, err
+		case wait != nil:
+			wait.semaphore.Wait()
+			continue
+		}
+
+		f.completePopulation(k, adopted, func(rw *RecordWriter) error {
+			parent := intercacheRecordLocation{
+				cache:          rw.cache,
+				recordLocation: recordLocation{rw.frontend, rw.key},
+			}
+			for _, d := range rec.dependencies {
+				if d.Weak || (rw.scratch && d.Frontend.cache != c) {
+					continue
+				}
+				d.Frontend.cache.registerDependance(
+					recordLocation{d.Frontend.id, d.Key},
+					parent,
+					rw.weakDependent,
+				)
+			}
+			rw.dependencies = append(rw.dependencies, rec.dependencies...)
+			rw.level = rec.compressionLevel
+			rw.attachment = rec.Attachment()
+
+			for n := &rec.data; n != nil; n = n.next {
+				rw.append(n.component)
+			}
+			return nil
+		})
+		return adopted, adopted.populationError
+	}
+}
+
+// Create a new record of frontend f to be populated with the data of an
+// adopted record. Replaces any existing record at k.
+//
+// If the existing record or its replacement is still being populated, returns
+// the record being populated to wait on instead.
+func (c *Cache) beginAdoption(f *Frontend, k Key) (rec, wait *Record, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.frontendMeta[f.id].instance != f {
+		return nil, nil, ErrFrontendDeleted
+	}
+	if c.closed {
+		return nil, nil, ErrCacheClosed
+	}
+	if c.draining {
+		return nil, nil, ErrDraining
+	}
+
+	loc := recordLocation{f.id, k}
+	meta, ok := c.record(loc)
+	if ok && meta.epoch != c.epoch {
+		c.evictWithLock(loc, 0)
+		ok = false
+	}
+	switch {
+	case !ok:
+		meta = recordWithMeta{
+			node:     c.lruList.Prepend(loc),
+			rec:      new(Record),
+			epoch:    c.epoch,
+			lastUsed: time.Now(),
+		}
+		meta.rec.semaphore.Init()
+		c.beginPopulation(loc, meta.rec)
+		c.frontends[loc.frontend][loc.key] = meta
+		return meta.rec, nil, nil
+	case !meta.rec.semaphore.Finished():
+		return nil, meta.rec, nil
+	case meta.pending != nil:
+		return nil, meta.pending, nil
+	default:
+		return c.beginPending(loc, meta), nil, nil
+	}
+}
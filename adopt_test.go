@@ -0,0 +1,71 @@
+package recache
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAdopt(t *testing.T) {
+	t.Parallel()
+
+	var (
+		scratch  = NewCache(CacheOptions{})
+		children = scratch.NewFrontend(dummyGetter)
+		parents  = scratch.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				return rw.Include(children, k)
+			},
+		})
+
+		cache = NewCache(CacheOptions{})
+		f     = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				return errors.New("getter called")
+			},
+		})
+	)
+
+	_, err := scratch.Adopt(new(Record), f, 1)
+	assertEquals(t, err, ErrForeignFrontend)
+
+	src, err := parents.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		// Second adoption replaces the first
+		adopted, err := cache.Adopt(src, f, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEquals(t, adopted.ETag(), src.ETag())
+	}
+
+	rec, err := f.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, rec.ETag(), src.ETag())
+	var dst int
+	decodeJSON(t, rec, &dst)
+	assertEquals(t, dst, 1)
+	assertConsistency(t, cache)
+
+	// Evicted with the records the adopted record was populated from
+	children.Evict(0, 1)
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		cache.mu.Lock()
+		_, ok := cache.frontends[f.id][1]
+		cache.mu.Unlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("adopted record not evicted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertConsistency(t, cache)
+	assertConsistency(t, scratch)
+}
@@ -0,0 +1,46 @@
+//go:build !recache_offheap || !unix
+
+package recache
+
+import "sync"
+
+const (
+	// Size of each arena record data is allocated from with EnableArenas
+	arenaSize = 1 << 20
+
+	// Buffers larger than this are allocated separately to limit the space
+	// wasted at the end of arenas
+	maxArenaAllocation = arenaSize / 8
+
+	// Record data is allocated outside the Go heap
+	offHeap = false
+)
+
+// Keeps the memory of a buffer allocated. Only used by the off-heap allocator.
+type memHandle struct{}
+
+var (
+	// Arena small buffers are currently allocated from with EnableArenas.
+	// Arenas no longer current are kept alive by the buffers allocated from
+	// them.
+	arenaMu sync.Mutex
+	arena   []byte
+)
+
+// Allocate a byte slice of length n for record data. With EnableArenas set,
+// small slices are carved out of large shared arenas.
+func allocate(n int) ([]byte, memHandle) {
+	if !EnableArenas || n > maxArenaAllocation {
+		return make([]byte, n), memHandle{}
+	}
+
+	arenaMu.Lock()
+	defer arenaMu.Unlock()
+
+	if cap(arena)-len(arena) < n {
+		arena = make([]byte, 0, arenaSize)
+	}
+	l := len(arena)
+	arena = arena[:l+n]
+	return arena[l : l+n : l+n], memHandle{}
+}
@@ -0,0 +1,43 @@
+//go:build !recache_offheap || !unix
+
+package recache
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestArenas(t *testing.T) {
+	// Not parallel, as it changes global configuration
+	EnableArenas = true
+	defer func() {
+		EnableArenas = false
+	}()
+
+	f := NewCache(CacheOptions{}).NewFrontendWithOptions(FrontendOptions{
+		Get: dummyGetter,
+	})
+	var recs [2]*Record
+	for i := range recs {
+		rec, err := f.Get(fmt.Sprint(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		recs[i] = rec
+	}
+	for i, rec := range recs {
+		assertJsonStringEquals(t, rec, fmt.Sprint(i))
+	}
+
+	a, _ := allocate(3)
+	b, _ := allocate(5)
+	assertEquals(t, len(a), 3)
+	assertEquals(t, cap(a), 3)
+	arenaMu.Lock()
+	l := len(arena)
+	assertEquals(t, &arena[l-8], &a[0])
+	assertEquals(t, &arena[l-5], &b[0])
+	arenaMu.Unlock()
+	large, _ := allocate(maxArenaAllocation + 1)
+	assertEquals(t, len(large), maxArenaAllocation+1)
+}
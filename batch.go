@@ -0,0 +1,208 @@
+package recache
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// Default of unset BatchOptions.MaxKeys
+const defaultMaxBatchKeys = 100
+
+// Format of responses of Frontend.BatchHandler()
+type BatchFormat uint8
+
+const (
+	// "multipart/mixed" response with a part per fragment. Each part has
+	// "Content-ID" and "ETag" headers set to the key string and decompressed
+	// ETag of the fragment. Parts of fragments not modified or failed have a
+	// "Status" header of "304" or "500" and no body.
+	MultipartBatch BatchFormat = iota
+
+	// "application/x-ndjson" response with a JSON object per line and
+	// fragment. Objects have "key" and "etag" fields, set as in
+	// MultipartBatch, and either a "data" string with the fragment content,
+	// a "notModified": true field or an "error" string.
+	NDJSONBatch
+)
+
+// Options for Frontend.BatchHandler()
+type BatchOptions struct {
+	// Extracts the keys of the fragments to serve from the request, like
+	// BatchKeysFromJSON(). Errors are responded to as with Frontend.Handler().
+	// Required.
+	Keys func(*http.Request) ([]Key, error)
+
+	// Format of the response
+	Format BatchFormat
+
+	// Maximum amount of keys per request. Requests with more keys are
+	// responded to with status 400.
+	//
+	// Defaults to 100.
+	MaxKeys int
+}
+
+// Fragment entry of an NDJSONBatch response
+type batchEntry struct {
+	Key         string `json:"key"`
+	ETag        string `json:"etag,omitempty"`
+	Data        string `json:"data,omitempty"`
+	NotModified bool   `json:"notModified,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Result of retrieving a fragment of a batch
+type batchResult struct {
+	rec *Record
+	err error
+}
+
+// Return a handler streaming the decompressed records of the frontend by
+// keys extracted from the request in a single response, for clients
+// retrieving many fragments at once. Records are retrieved concurrently and
+// streamed in the order of the keys.
+//
+// Fragments with a decompressed ETag listed in the "If-None-Match" header of
+// the request are not sent again. Failing to retrieve a fragment does not
+// fail the rest of the response. The error is logged and reported in place of
+// the fragment instead.
+func (f *Frontend) BatchHandler(opts BatchOptions) http.Handler {
+	if opts.MaxKeys == 0 {
+		opts.MaxKeys = defaultMaxBatchKeys
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys, err := opts.Keys(r)
+		if err != nil {
+			writeKeyError(w, err)
+			return
+		}
+		if len(keys) > opts.MaxKeys {
+			http.Error(
+				w,
+				fmt.Sprintf("too many keys: %d > %d", len(keys), opts.MaxKeys),
+				http.StatusBadRequest,
+			)
+			return
+		}
+
+		known := make(map[string]struct{})
+		for _, e := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				known[e] = struct{}{}
+			}
+		}
+
+		results := make([]chan batchResult, len(keys))
+		for i, k := range keys {
+			ch := make(chan batchResult, 1)
+			results[i] = ch
+			go func(k Key) {
+				rec, err := f.getGeneratedRecord(detachSession(r.Context()), k)
+				ch <- batchResult{rec, err}
+			}(k)
+		}
+
+		var write func(k Key, res batchResult, notModified bool) error
+		switch opts.Format {
+		case NDJSONBatch:
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			enc := json.NewEncoder(w)
+			write = func(k Key, res batchResult, notModified bool) error {
+				e := batchEntry{
+					Key: f.KeyString(k),
+				}
+				switch {
+				case res.err != nil:
+					e.Error = res.err.Error()
+				case notModified:
+					e.ETag = res.rec.ETagDecompressed()
+					e.NotModified = true
+				default:
+					e.ETag = res.rec.ETagDecompressed()
+					var buf bytes.Buffer
+					_, err := buf.ReadFrom(res.rec.Decompress())
+					if err != nil {
+						e.ETag = ""
+						e.Error = err.Error()
+					} else {
+						e.Data = buf.String()
+						f.addBytesServed(res.rec, int64(buf.Len()))
+					}
+				}
+				return enc.Encode(e)
+			}
+		default:
+			mw := multipart.NewWriter(w)
+			defer mw.Close()
+			w.Header().Set(
+				"Content-Type",
+				"multipart/mixed; boundary="+mw.Boundary(),
+			)
+			write = func(k Key, res batchResult, notModified bool) error {
+				h := make(textproto.MIMEHeader)
+				h.Set("Content-ID", f.KeyString(k))
+				switch {
+				case res.err != nil:
+					h.Set("Status", "500")
+				case notModified:
+					h.Set("ETag", res.rec.ETagDecompressed())
+					h.Set("Status", "304")
+				default:
+					h.Set("ETag", res.rec.ETagDecompressed())
+				}
+				part, err := mw.CreatePart(h)
+				if err != nil || res.err != nil || notModified {
+					return err
+				}
+				n, err := io.Copy(part, res.rec.Decompress())
+				f.addBytesServed(res.rec, n)
+				return err
+			}
+		}
+
+		for i, k := range keys {
+			res := <-results[i]
+			notModified := false
+			if res.err != nil {
+				f.cache.logger.Printf(
+					"batch fragment failed: key=%s: %s",
+					f.KeyString(k),
+					res.err,
+				)
+			} else {
+				_, notModified = known[res.rec.ETagDecompressed()]
+			}
+			err := write(k, res, notModified)
+			if err != nil {
+				// Client gone. Any remaining retrievals complete in the
+				// background.
+				return
+			}
+		}
+	})
+}
+
+// Extract batch keys from a request body consisting of a JSON array of
+// strings, for BatchOptions.Keys
+func BatchKeysFromJSON(r *http.Request) ([]Key, error) {
+	var keys []string
+	err := json.NewDecoder(r.Body).Decode(&keys)
+	if err != nil {
+		return nil, &HTTPError{
+			Status: http.StatusBadRequest,
+			Err:    fmt.Errorf("invalid batch keys: %w", err),
+		}
+	}
+	res := make([]Key, len(keys))
+	for i, k := range keys {
+		res[i] = k
+	}
+	return res, nil
+}
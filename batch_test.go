@@ -0,0 +1,137 @@
+package recache
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBatchHandler(t *testing.T) {
+	t.Parallel()
+
+	f := NewCache(CacheOptions{}).NewFrontendWithOptions(FrontendOptions{
+		Get: func(k Key, rw *RecordWriter) (err error) {
+			if k.(string) == "fail" {
+				return errors.New("upstream failure")
+			}
+			_, err = fmt.Fprintf(rw, "<p>%s</p>", k)
+			return
+		},
+	})
+	aETag := func() string {
+		rec, err := f.Get("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rec.ETagDecompressed()
+	}()
+
+	serve := func(format BatchFormat, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		r.Header.Set("If-None-Match", aETag)
+		f.BatchHandler(BatchOptions{
+			Keys:    BatchKeysFromJSON,
+			Format:  format,
+			MaxKeys: 4,
+		}).ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("multipart", func(t *testing.T) {
+		t.Parallel()
+
+		w := serve(MultipartBatch, `["b", "a", "fail", "c"]`)
+		assertEquals(t, w.Code, http.StatusOK)
+		typ, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEquals(t, typ, "multipart/mixed")
+
+		type part struct {
+			id, eTag, status, body string
+		}
+		var parts []part
+		mr := multipart.NewReader(w.Body, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parts = append(parts, part{
+				id:     p.Header.Get("Content-ID"),
+				eTag:   p.Header.Get("ETag"),
+				status: p.Header.Get("Status"),
+				body:   string(body),
+			})
+		}
+		assertEquals(t, len(parts), 4)
+		assertEquals(t, parts[0].id, `"b"`)
+		assertEquals(t, parts[0].body, "<p>b</p>")
+		assertEquals(t, parts[1], part{`"a"`, aETag, "304", ""})
+		assertEquals(t, parts[2], part{`"fail"`, "", "500", ""})
+		assertEquals(t, parts[3].body, "<p>c</p>")
+	})
+
+	t.Run("ndjson", func(t *testing.T) {
+		t.Parallel()
+
+		w := serve(NDJSONBatch, `["a", "fail", "d"]`)
+		assertEquals(t, w.Header().Get("Content-Type"), "application/x-ndjson")
+		var entries []batchEntry
+		s := bufio.NewScanner(w.Body)
+		for s.Scan() {
+			var e batchEntry
+			err := json.Unmarshal(s.Bytes(), &e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, e)
+		}
+		assertEquals(t, len(entries), 3)
+		assertEquals(t, entries[0], batchEntry{
+			Key:         `"a"`,
+			ETag:        aETag,
+			NotModified: true,
+		})
+		assertEquals(t, entries[1], batchEntry{
+			Key:   `"fail"`,
+			Error: "upstream failure",
+		})
+		assertEquals(t, entries[2].Data, "<p>d</p>")
+		if entries[2].ETag == "" {
+			t.Fatal("expected ETag")
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+
+		assertEquals(
+			t,
+			serve(NDJSONBatch, `{"a": 1}`).Code,
+			http.StatusBadRequest,
+		)
+		assertEquals(
+			t,
+			serve(NDJSONBatch, `["a", "b", "c", "d", "e"]`).Code,
+			http.StatusBadRequest,
+		)
+	})
+}
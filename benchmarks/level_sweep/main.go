@@ -0,0 +1,232 @@
+// Compresses sample payloads with each deflate compression level and reports
+// compressed size and CPU time per level, grouped by frontend, with a
+// recommended level for each frontend.
+//
+// Usage:
+//
+//	go run ./benchmarks/level_sweep [-n 20] [-tolerance 0.02] path...
+//
+// Each path is either a file or a directory. All files in a directory are
+// samples of the frontend named after the directory. A file passed directly
+// is a sample of the frontend named after the file.
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// Compressing writer, that can be reused
+type compressor interface {
+	io.Writer
+	Flush() error
+	Reset(io.Writer)
+}
+
+// Compression codec to sweep the levels of
+type codec struct {
+	name   string
+	levels []int
+
+	// Create a compressor writing to w with level
+	newCompressor func(w io.Writer, level int) (compressor, error)
+}
+
+var codecs = [...]codec{
+	{
+		name: "deflate",
+		levels: []int{
+			flate.HuffmanOnly,
+			flate.NoCompression,
+			1, 2, 3, 4, 5, 6, 7, 8, 9,
+		},
+		newCompressor: func(w io.Writer, level int) (compressor, error) {
+			return flate.NewWriter(w, level)
+		},
+	},
+}
+
+// Result of compressing all samples of a frontend with a level
+type result struct {
+	codec string
+	level int
+
+	// Total uncompressed and compressed size of all samples
+	size, compressed int
+
+	// Average CPU time spent compressing all samples once
+	duration time.Duration
+}
+
+func (r result) ratio() float64 {
+	if r.size == 0 {
+		return 1
+	}
+	return float64(r.compressed) / float64(r.size)
+}
+
+func main() {
+	n := flag.Int("n", 20, "amount of times to compress each sample per level")
+	tolerance := flag.Float64(
+		"tolerance",
+		0.02,
+		"fraction of compressed size above the smallest one still accepted"+
+			" for recommending a faster level",
+	)
+	flag.Parse()
+	if flag.NArg() == 0 || *n < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	frontends, err := readSamples(flag.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+	names := make([]string, 0, len(frontends))
+	for name := range frontends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for i, name := range names {
+		results, err := sweep(frontends[name], *n)
+		if err != nil {
+			log.Fatalf("%s: %s", name, err)
+		}
+
+		if i != 0 {
+			fmt.Println()
+		}
+		fmt.Printf("frontend: %s\n", name)
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(w, "codec\tlevel\tsize\tcompressed\tratio\tCPU/op\t")
+		for _, r := range results {
+			fmt.Fprintf(
+				w,
+				"%s\t%d\t%d\t%d\t%.3f\t%s\t\n",
+				r.codec,
+				r.level,
+				r.size,
+				r.compressed,
+				r.ratio(),
+				r.duration,
+			)
+		}
+		w.Flush()
+
+		rec := recommend(results, *tolerance)
+		fmt.Printf("recommended: %s level %d\n", rec.codec, rec.level)
+	}
+}
+
+// Read sample payloads from paths grouped by frontend name
+func readSamples(paths []string) (map[string][][]byte, error) {
+	frontends := make(map[string][][]byte)
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		name := filepath.Base(filepath.Clean(p))
+
+		if !info.IsDir() {
+			buf, err := os.ReadFile(p)
+			if err != nil {
+				return nil, err
+			}
+			frontends[name] = append(frontends[name], buf)
+			continue
+		}
+
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !e.Type().IsRegular() {
+				continue
+			}
+			buf, err := os.ReadFile(filepath.Join(p, e.Name()))
+			if err != nil {
+				return nil, err
+			}
+			frontends[name] = append(frontends[name], buf)
+		}
+	}
+	return frontends, nil
+}
+
+// Compress samples n times with each level of each codec
+func sweep(samples [][]byte, n int) (results []result, err error) {
+	var w bytes.Buffer
+	for _, c := range codecs {
+		for _, level := range c.levels {
+			r := result{
+				codec: c.name,
+				level: level,
+			}
+			var cw compressor
+			cw, err = c.newCompressor(&w, level)
+			if err != nil {
+				return
+			}
+
+			start := time.Now()
+			for i := 0; i < n; i++ {
+				r.compressed = 0
+				for _, s := range samples {
+					// recache flushes compressed streams without closing
+					// them to concatenate them later
+					w.Reset()
+					cw.Reset(&w)
+					_, err = cw.Write(s)
+					if err != nil {
+						return
+					}
+					err = cw.Flush()
+					if err != nil {
+						return
+					}
+					r.compressed += w.Len()
+				}
+			}
+			r.duration = time.Since(start) / time.Duration(n)
+			for _, s := range samples {
+				r.size += len(s)
+			}
+			results = append(results, r)
+		}
+	}
+	return
+}
+
+// Recommend the fastest level with a compressed size within tolerance of the
+// smallest one
+func recommend(results []result, tolerance float64) (rec result) {
+	smallest := results[0].compressed
+	for _, r := range results {
+		if r.compressed < smallest {
+			smallest = r.compressed
+		}
+	}
+	max := float64(smallest) * (1 + tolerance)
+	first := true
+	for _, r := range results {
+		if float64(r.compressed) <= max && (first || r.duration < rec.duration) {
+			rec = r
+			first = false
+		}
+	}
+	return
+}
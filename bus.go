@@ -0,0 +1,159 @@
+package recache
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"time"
+)
+
+// Transport for broadcasting evictions between cache instances in different
+// processes, like Redis pub/sub. Must be thread-safe.
+type InvalidationBus interface {
+	// Send msg to all subscribers of the bus, including ones in this process
+	Publish(ctx context.Context, msg []byte) error
+
+	// Call handle with each message published to the bus, until ctx is done.
+	// Blocks until ctx is done or subscribing fails.
+	Subscribe(ctx context.Context, handle func(msg []byte)) error
+}
+
+// Eviction broadcast over an InvalidationBus
+type invalidationMessage struct {
+	// ID of the instance that published the message
+	Origin string
+
+	// Name of the frontend and key of the record encoded with
+	// FrontendOptions.EncodeKey
+	Frontend string
+	Key      []byte
+
+	// Eviction timer passed to Frontend.Evict()
+	After time.Duration
+}
+
+// Return a random ID identifying messages published by this cache instance
+func newInstanceID() string {
+	var buf [8]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf[:])
+}
+
+// Publish eviction of a record of f to CacheOptions.InvalidationBus in the
+// background. Only frontends with a Name are broadcast.
+func (f *Frontend) publishEviction(k Key, t time.Duration) {
+	bus := f.cache.opts.InvalidationBus
+	if bus == nil || f.opts.Name == "" {
+		return
+	}
+
+	key, err := f.encodeKey(k)
+	if err != nil {
+		f.logBusError(k, err)
+		return
+	}
+	var w bytes.Buffer
+	err = gob.NewEncoder(&w).Encode(invalidationMessage{
+		Origin:   f.cache.instanceID,
+		Frontend: f.opts.Name,
+		Key:      key,
+		After:    t,
+	})
+	if err != nil {
+		f.logBusError(k, err)
+		return
+	}
+
+	go func() {
+		err := bus.Publish(context.Background(), w.Bytes())
+		if err != nil {
+			f.logBusError(k, err)
+		}
+	}()
+}
+
+func (f *Frontend) logBusError(k Key, err error) {
+	f.cache.logger.Printf(
+		"publishing eviction failed: key=%s: %s",
+		f.KeyString(k),
+		err,
+	)
+}
+
+// Apply evictions received from bus, until the cache is drained or closed.
+// Resubscribes after a second, if subscribing fails.
+func (c *Cache) subscribeEvictions(bus InvalidationBus) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-c.stop
+		cancel()
+	}()
+
+	for {
+		err := bus.Subscribe(ctx, c.applyEviction)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			c.logger.Printf("subscribing to evictions failed: %s", err)
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Evict the record described by a message received from
+// CacheOptions.InvalidationBus. Messages published by this cache instance and
+// for unknown frontends are ignored.
+func (c *Cache) applyEviction(buf []byte) {
+	var msg invalidationMessage
+	err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&msg)
+	if err != nil {
+		c.logger.Printf("invalid eviction message: %s", err)
+		return
+	}
+	if msg.Origin == c.instanceID {
+		return
+	}
+
+	f := c.frontendByName(msg.Frontend)
+	if f == nil {
+		return
+	}
+	k, err := f.decodeKey(msg.Key)
+	if err != nil {
+		c.logger.Printf(
+			"invalid eviction message: frontend=%s: %s",
+			msg.Frontend,
+			err,
+		)
+		return
+	}
+	c.evict(recordLocation{f.id, k}, msg.After)
+}
+
+// Return the frontend named name or nil, if none
+func (c *Cache) frontendByName(name string) *Frontend {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.frontendByNameWithLock(name)
+}
+
+// Same as frontendByName(). Requires lock on c.mu.
+func (c *Cache) frontendByNameWithLock(name string) *Frontend {
+	for _, m := range c.frontendMeta {
+		if m.instance != nil && m.instance.opts.Name == name {
+			return m.instance
+		}
+	}
+	return nil
+}
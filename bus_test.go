@@ -0,0 +1,135 @@
+package recache
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// In-process InvalidationBus for tests
+type chanBus struct {
+	mu          sync.Mutex
+	subscribers map[chan []byte]struct{}
+}
+
+func newChanBus() *chanBus {
+	return &chanBus{
+		subscribers: make(map[chan []byte]struct{}),
+	}
+}
+
+func (b *chanBus) Publish(_ context.Context, msg []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		ch <- msg
+	}
+	return nil
+}
+
+func (b *chanBus) Subscribe(
+	ctx context.Context,
+	handle func(msg []byte),
+) error {
+	ch := make(chan []byte, 16)
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.subscribers, ch)
+		b.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case msg := <-ch:
+			handle(msg)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Wait for n subscribers to be registered on the bus
+func (b *chanBus) waitForSubscribers(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		b.mu.Lock()
+		l := len(b.subscribers)
+		b.mu.Unlock()
+		if l == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d subscribers", n)
+}
+
+func TestInvalidationBus(t *testing.T) {
+	t.Parallel()
+
+	bus := newChanBus()
+	newFrontends := func() (c *Cache, named, unnamed *Frontend) {
+		c = NewCache(CacheOptions{
+			InvalidationBus: bus,
+		})
+		named = c.NewFrontendWithOptions(FrontendOptions{
+			Name: "named",
+			Get:  dummyGetter,
+		})
+		unnamed = c.NewFrontendWithOptions(FrontendOptions{
+			Get: dummyGetter,
+		})
+		return
+	}
+	c1, named1, unnamed1 := newFrontends()
+	c2, named2, unnamed2 := newFrontends()
+	defer c1.Close()
+	defer c2.Close()
+	bus.waitForSubscribers(t, 2)
+
+	for _, f := range [...]*Frontend{named1, unnamed1, named2, unnamed2} {
+		for _, k := range [...]string{"a", "b"} {
+			_, err := f.Get(k)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	contains := func(f *Frontend, k Key) bool {
+		f.cache.mu.Lock()
+		defer f.cache.mu.Unlock()
+		_, ok := f.cache.frontends[f.id][k]
+		return ok
+	}
+	waitForEviction := func(f *Frontend, k Key) {
+		t.Helper()
+		for i := 0; i < 1000; i++ {
+			if !contains(f, k) {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("record not evicted: %v", k)
+	}
+
+	named1.Evict(0, "a")
+	unnamed1.Evict(0, "a")
+	assertEquals(t, contains(named1, "a"), false)
+	waitForEviction(named2, "a")
+
+	// Evictions of unnamed frontends are not broadcast. Evict a record of a
+	// named frontend after them to synchronize with the subscriber.
+	named2.Evict(0, "b")
+	waitForEviction(named1, "b")
+	assertEquals(t, contains(unnamed2, "a"), true)
+	assertEquals(t, contains(named2, "b"), false)
+	assertConsistency(t, c1, c2)
+
+	// Subscription stopped on close
+	c2.Close()
+	bus.waitForSubscribers(t, 1)
+}
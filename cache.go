@@ -2,23 +2,70 @@ package recache
 
 import (
 	"compress/flate"
+	"log"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	// Registry of all created caches. Require cacheMu to be held for access.
 	cacheMu sync.RWMutex
-	caches  = make([]*Cache, 1)
+	caches  = make(map[int]*Cache)
+
+	// ID of the last created cache. IDs are never reused, as records of other
+	// caches and scheduled evictions can still reference closed caches by ID.
+	lastCacheID int
 
 	// Global deflate compression level configuration.
 	//
 	// Can only be changed before the first Cache is constructed and must not be
 	// mutated after.
 	CompressionLevel = flate.DefaultCompression
+
+	// Also compute CRC32 checksums of stored frames to enable serving records
+	// with the gzip Content-Encoding. Gzip is preferred over deflate for
+	// clients accepting both.
+	//
+	// Can only be changed before the first Cache is constructed and must not be
+	// mutated after.
+	EnableGzip = false
+
+	// Allocate the compressed data of records from large shared arenas
+	// instead of separately for each record. Reduces the amount of heap
+	// objects the garbage collector has to track for caches with many small
+	// records. Arenas are reclaimed only once all records allocated from them
+	// have been evicted and are no longer referenced, so memory use can
+	// exceed that of the records in the cache on high record turnover.
+	//
+	// Building with the recache_offheap tag on unix systems allocates the
+	// arenas outside the Go heap with anonymous memory mappings regardless
+	// of this setting.
+	//
+	// Can only be changed before the first Cache is constructed and must not be
+	// mutated after.
+	EnableArenas = false
+
+	// Maximum amount of records populated concurrently by a single
+	// Frontend.GetMulti() call. Must be positive.
+	GetMultiConcurrency = 16
+
+	// Used for caches with no Logger set in CacheOptions
+	defaultLogger Logger = log.New(os.Stderr, "recache: ", log.LstdFlags)
 )
 
-// Get cache from registry by ID
+// Default of unset CacheOptions.MaxWeakDependents
+const defaultMaxWeakDependents = 1 << 10
+
+// Receives internal warnings from the cache engine. Must be thread-safe.
+//
+// *log.Logger implements Logger.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// Get cache from registry by ID. Returns nil for closed caches.
 func getCache(id int) *Cache {
 	cacheMu.RLock()
 	defer cacheMu.RUnlock()
@@ -33,15 +80,98 @@ type Cache struct {
 	// Global ID of cache
 	id int
 
+	// Destination of internal warnings
+	logger Logger
+
 	// Total used memory and limit
 	memoryLimit, memoryUsed int
 
+	// Rescheduling a scheduled eviction always replaces the existing timer
+	debounceEviction bool
+
+	// Maximum amount of weak dependents per record
+	maxWeakDependents int
+
+	// Amount of records to evict in a cascade before releasing the lock
+	evictionYieldInterval int
+
 	// Linked list and limit for quick LRU data order modifications and lookup
 	lruLimit time.Duration
 	lruList  linkedList
 
 	// Storage for each individual frontend
 	frontends []map[Key]recordWithMeta
+
+	// Metadata of each frontend with the same index as its storage in
+	// frontends
+	frontendMeta []frontendMeta
+
+	// IDs of deleted frontends available for reuse
+	freeFrontends []int
+
+	// Maximum amount of frontends not deleted
+	maxFrontends int
+
+	// Records depending on external resource tokens
+	tokens map[string]map[recordLocation]struct{}
+
+	// Current epoch of the cache. Records created under previous epochs are
+	// invalidated on access.
+	epoch uint64
+
+	// Total amount of record retrievals served from the cache and requiring
+	// population
+	hits, misses uint64
+
+	// Set, once the cache has started draining. No new populations are
+	// started after.
+	draining bool
+
+	// Records currently being populated and their locations
+	populating map[*Record]recordLocation
+
+	// Closed, once all populations have completed after draining started
+	drained chan struct{}
+
+	// Closed to stop background goroutines of the cache
+	stop chan struct{}
+
+	// Cache was created with NewScratchCache()
+	scratch bool
+
+	// Cache has been closed with Close()
+	closed bool
+
+	// Options the cache was created with
+	opts CacheOptions
+
+	// Random ID of the cache instance for ignoring its own messages received
+	// from CacheOptions.InvalidationBus
+	instanceID string
+}
+
+// Cache-side metadata of a frontend
+type frontendMeta struct {
+	instance *Frontend
+
+	// Memory used by all records of the frontend
+	memoryUsed int
+
+	// Amount of populated records by size bucket
+	sizeHistogram [64]int
+
+	// Total amount of record retrievals served from the cache and requiring
+	// population
+	hits, misses uint64
+
+	// Total amount of records evicted and the amount of those expired due to
+	// the LRU or memory limits of the cache
+	evictions, expirations uint64
+
+	// Read-your-writes windows of records marked with Frontend.MarkWritten()
+	// and the amount of them left after the last sweep of expired windows
+	sessionWrites      map[sessionWrite]sessionWriteWindow
+	sessionWritesSwept int
 }
 
 // Options for new cache creation
@@ -51,6 +181,75 @@ type CacheOptions struct {
 
 	// Maximum last use time of record without forcing eviction
 	LRULimit time.Duration
+
+	// Receives internal warnings, like recovered Getter panics or eviction
+	// scheduler backpressure.
+	//
+	// Defaults to logging to os.Stderr.
+	Logger Logger
+
+	// Make any subsequent scheduled eviction call on a record always replace
+	// the timer of the previous scheduled eviction, even if the new timer is
+	// greater than the time currently left. This pushes out the eviction
+	// deadline on each call, effectively debouncing evictions, for
+	// "evict t after the last change" workflows.
+	DebounceEviction bool
+
+	// Maximum amount of weak dependents registered on a single record by
+	// frontends with FrontendOptions.WeakDependent set. On reaching the
+	// limit, dependents already evicted are pruned and, if that is not
+	// enough, arbitrary dependents are evicted early.
+	//
+	// Defaults to 1024.
+	MaxWeakDependents uint
+
+	// Amount of records to evict in a single eviction cascade before briefly
+	// releasing the cache lock to let other operations on the cache proceed.
+	// Only applies to cascades started by Frontend.Evict(), scheduled
+	// evictions and evictions propagated from other caches.
+	//
+	// Zero value disables yielding.
+	EvictionYieldInterval uint
+
+	// Enables automatic tuning of the memory limit within configured bounds.
+	// MemoryLimit, if set, is used as the initial memory limit.
+	MemoryTuning *MemoryTuningOptions
+
+	// Report populations, that have had readers blocked waiting on them for
+	// longer than this duration, to Logger. Reports include the key and stack
+	// trace of the populating goroutine to help diagnose hung Getters.
+	//
+	// Zero value disables the watchdog.
+	DeadlockThreshold time.Duration
+
+	// Maximum amount of frontends, not counting deleted ones, the cache can
+	// have. Guards against unbounded growth in processes creating frontends
+	// dynamically.
+	//
+	// Zero value disables the limit.
+	MaxFrontends uint
+
+	// Human-readable name of the cache for debugging and configuration export
+	Name string
+
+	// Broadcasts Frontend.Evict() calls on frontends with a Name to all cache
+	// instances subscribed to the same bus, like other processes of a
+	// multi-instance deployment, and applies evictions received from them.
+	// Frontends are matched by Name and keys are encoded with
+	// FrontendOptions.EncodeKey.
+	//
+	// Evictions are published in the background and errors are logged.
+	// Cascading evictions of dependent records are not broadcast, as each
+	// instance evicts its dependent records itself.
+	InvalidationBus InvalidationBus
+
+	// Key for signing records written to snapshots and L2 caches with
+	// HMAC-SHA256. Records without a valid signature are rejected on load,
+	// so that parties able to write to snapshot files or L2 caches can not
+	// inject content into the cache.
+	//
+	// Zero value disables signing.
+	SigningKey []byte
 }
 
 // Create new cache with specified memory and LRU eviction limits. After either
@@ -60,67 +259,307 @@ type CacheOptions struct {
 //
 // Pass in zero values to ignore either or both eviction limits.
 func NewCache(opts CacheOptions) (c *Cache) {
+	c = newCache(opts, false)
+
+	if opts.MemoryTuning != nil {
+		tuning := *opts.MemoryTuning
+		tuning.setDefaults()
+		if c.memoryLimit == 0 {
+			c.memoryLimit = int(tuning.MaxMemoryLimit)
+		}
+		c.memoryLimit = tuning.nextMemoryLimit(c.memoryLimit, 1, 0)
+		go c.tuneMemoryLimit(tuning)
+	}
+	if opts.DeadlockThreshold != 0 {
+		go c.watchPopulations(opts.DeadlockThreshold)
+	}
+	if opts.InvalidationBus != nil {
+		c.instanceID = newInstanceID()
+		go c.subscribeEvictions(opts.InvalidationBus)
+	}
+
+	return c
+}
+
+// Create a cache and add it to the registry
+func newCache(opts CacheOptions, scratch bool) (c *Cache) {
 	cacheMu.Lock()
 	defer cacheMu.Unlock()
 
 	c = &Cache{
-		id:          len(caches),
+		opts:        opts,
+		scratch:     scratch,
 		memoryLimit: int(opts.MemoryLimit),
 		lruLimit:    opts.LRULimit,
+		logger:      opts.Logger,
+
+		debounceEviction:  opts.DebounceEviction,
+		maxWeakDependents: int(opts.MaxWeakDependents),
+
+		evictionYieldInterval: int(opts.EvictionYieldInterval),
+		maxFrontends:          int(opts.MaxFrontends),
+
+		populating: make(map[*Record]recordLocation),
+		stop:       make(chan struct{}),
+	}
+	if c.maxWeakDependents == 0 {
+		c.maxWeakDependents = defaultMaxWeakDependents
+	}
+	if c.logger == nil {
+		c.logger = defaultLogger
 	}
-	caches = append(caches, c)
+	lastCacheID++
+	c.id = lastCacheID
+	caches[c.id] = c
+
 	return c
 }
 
+// Increment the epoch of the cache and return the new epoch.
+//
+// All records created under previous epochs are considered invalid and will
+// be evicted and regenerated on their next access. This avoids the population
+// stampede of an EvictAll() call on events like configuration deployments.
+func (c *Cache) BumpEpoch() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.epoch++
+	return c.epoch
+}
+
+// Return the current epoch of the cache
+func (c *Cache) Epoch() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.epoch
+}
+
 // Create new Frontend for accessing the cache.
-// A Frontend must only be created using this method.
+// A Frontend must only be created using this method,
+// NewFrontendWithOptions() or TryNewFrontend().
 //
 // get() will be used for generating fresh cache records for the given key by
 // the cache engine. These records will be stored by the cache engine and
 // must not be modified after Get() returns. Get() must be thread-safe.
+//
+// Panics, if the cache already has CacheOptions.MaxFrontends frontends or has
+// been closed.
 func (c *Cache) NewFrontend(get Getter) *Frontend {
+	return c.NewFrontendWithOptions(FrontendOptions{Get: get})
+}
+
+// Same as NewFrontend(), but with options for the new frontend.
+// opts.Get is required.
+func (c *Cache) NewFrontendWithOptions(opts FrontendOptions) *Frontend {
+	f, err := c.TryNewFrontend(opts)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// Same as NewFrontendWithOptions(), but returns ErrTooManyFrontends or
+// ErrCacheClosed instead of panicking, if the cache already has
+// CacheOptions.MaxFrontends frontends or has been closed
+func (c *Cache) TryNewFrontend(opts FrontendOptions) (*Frontend, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if c.closed {
+		return nil, ErrCacheClosed
+	}
+	if c.maxFrontends != 0 && c.frontendCount() >= c.maxFrontends {
+		return nil, ErrTooManyFrontends
+	}
+
 	f := &Frontend{
-		id:     len(c.frontends),
-		cache:  c,
-		getter: get,
+		cache: c,
+		opts:  opts,
 	}
-	c.frontends = append(c.frontends, make(map[Key]recordWithMeta))
-	return f
+	f.reconfigurable.Store(newFrontendTunables(opts))
+	if n := len(c.freeFrontends); n != 0 {
+		f.id = c.freeFrontends[n-1]
+		c.freeFrontends = c.freeFrontends[:n-1]
+		c.frontends[f.id] = make(map[Key]recordWithMeta)
+		c.frontendMeta[f.id] = frontendMeta{
+			instance: f,
+		}
+	} else {
+		f.id = len(c.frontends)
+		c.frontends = append(c.frontends, make(map[Key]recordWithMeta))
+		c.frontendMeta = append(c.frontendMeta, frontendMeta{
+			instance: f,
+		})
+	}
+	return f, nil
 }
 
-// Get or create a new record in the cache.
+// Return amount of frontends, not counting deleted ones.
+// Requires lock on c.mu.
+func (c *Cache) frontendCount() int {
+	return len(c.frontends) - len(c.freeFrontends)
+}
+
+// Evict all records of frontend and free its storage for reuse by frontends
+// created later
+func (c *Cache) deleteFrontend(f *Frontend) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !atomic.CompareAndSwapUint32(&f.deleted, 0, 1) {
+		return
+	}
+	c.evictFrontendWithLock(f.id, 0)
+	c.frontends[f.id] = nil
+	c.frontendMeta[f.id] = frontendMeta{}
+	c.freeFrontends = append(c.freeFrontends, f.id)
+}
+
+// Get or create a new record of frontend f in the cache.
 // fresh=true, if record is freshly created and requires population.
-func (c *Cache) getRecord(loc recordLocation) (rec *Record, fresh bool) {
+// stale is set to the existing record, if rec is to replace a stale record.
+func (c *Cache) getRecord(f *Frontend, k Key) (
+	rec, stale *Record, fresh bool, err error,
+) {
+	// Expiry hooks must be called without holding the lock
+	var expired []expiry
+	defer func() {
+		callOnExpire(expired)
+	}()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rec, stale, fresh, expired, err = c.getRecordWithLock(f, k, expired)
+	return
+}
+
+// Result of getting or creating a record with Cache.getRecords()
+type recordLookup struct {
+	rec, stale *Record
+	fresh      bool
+	err        error
+}
+
+// Same as getRecord(), but for multiple keys with a single lock acquisition.
+// Lookups are returned in the order of keys.
+func (c *Cache) getRecords(f *Frontend, keys []Key) (lookups []recordLookup) {
+	var expired []expiry
+	defer func() {
+		callOnExpire(expired)
+	}()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	lookups = make([]recordLookup, len(keys))
+	for i, k := range keys {
+		l := &lookups[i]
+		l.rec, l.stale, l.fresh, expired, l.err = c.getRecordWithLock(
+			f,
+			k,
+			expired,
+		)
+	}
+	return
+}
+
+// Call FrontendOptions.OnExpire for all expired records. Must be called
+// without holding the lock on any cache.
+func callOnExpire(expired []expiry) {
+	for _, e := range expired {
+		e.frontend.opts.OnExpire(e.key, e.reason)
+	}
+}
+
+// Same as getRecord(), but appends expired records to expired instead of
+// calling their expiry hooks. Requires lock on c.mu.
+func (c *Cache) getRecordWithLock(f *Frontend, k Key, expired []expiry) (
+	rec, stale *Record, fresh bool, _ []expiry, err error,
+) {
+	// The ID of a deleted frontend may have been reused by another frontend
+	if c.frontendMeta[f.id].instance != f {
+		return nil, nil, false, expired, ErrFrontendDeleted
+	}
+
+	loc := recordLocation{f.id, k}
 	recWithMeta, ok := c.record(loc)
-	if !ok {
+	if ok && recWithMeta.epoch != c.epoch {
+		// Created under a previous epoch. Lazily invalidate on access.
+		c.evictWithLock(loc, 0)
+		ok = false
+	}
+	rec = recWithMeta.rec
+	now := time.Now()
+	if ok &&
+		!recWithMeta.staleAt.IsZero() &&
+		!now.Before(recWithMeta.staleAt) {
+		recWithMeta.stale = true
+	}
+	if ok {
+		c.hits++
+		c.frontendMeta[f.id].hits++
+		recWithMeta.hits++
+	} else {
+		c.misses++
+		c.frontendMeta[f.id].misses++
+	}
+	switch {
+	case c.closed:
+		return nil, nil, false, expired, ErrCacheClosed
+	case !ok && c.draining:
+		return nil, nil, false, expired, ErrDraining
+	case !ok:
 		recWithMeta = recordWithMeta{
-			node: c.lruList.Prepend(loc),
-			rec:  new(Record),
+			node:  c.lruList.Prepend(loc),
+			rec:   new(Record),
+			epoch: c.epoch,
 		}
 		recWithMeta.rec.semaphore.Init() // Block all reads until population
-	} else {
+		rec = recWithMeta.rec
+		fresh = true
+		c.beginPopulation(loc, rec)
+	case recWithMeta.stale && recWithMeta.pending == nil && !c.draining:
+		// Regenerate stale record. Concurrent readers will keep receiving the
+		// stale record until the regenerated one replaces it.
+		c.lruList.MoveToFront(recWithMeta.node)
+		stale = rec
+		rec = new(Record)
+		rec.semaphore.Init()
+		recWithMeta.pending = rec
+		fresh = true
+		c.beginPopulation(loc, rec)
+	default:
 		c.lruList.MoveToFront(recWithMeta.node)
 	}
-	now := time.Now()
 	recWithMeta.lastUsed = now
 	c.frontends[loc.frontend][loc.key] = recWithMeta
 
 	// Attempt to evict up to the last 2 records due to LRU or memory
 	// constraints. Doing this here simplifies locking patterns while retaining
 	// good enough eviction eventuality.
-	for i := 0; i < 2; i++ {
+	expired = c.expireOverLimits(expired, now, 2)
+
+	return rec, stale, fresh, expired, nil
+}
+
+// Expire up to max least recently used records exceeding the LRU or memory
+// limits of the cache and append them to expired. max < 0 expires all such
+// records. Requires lock on c.mu.
+func (c *Cache) expireOverLimits(
+	expired []expiry,
+	now time.Time,
+	max int,
+) []expiry {
+	for i := 0; max < 0 || i < max; i++ {
 		last, ok := c.lruList.Last()
 		if !ok {
 			break
 		}
 		if c.memoryLimit != 0 && c.memoryUsed > c.memoryLimit {
-			c.evictWithLock(last, 0)
+			expired = c.expire(expired, last, ExpiredMemoryLimit)
 			continue
 		}
 		if c.lruLimit != 0 {
@@ -129,26 +568,120 @@ func (c *Cache) getRecord(loc recordLocation) (rec *Record, fresh bool) {
 				panic("linked list points to evicted record")
 			}
 			if lruRec.lastUsed.Add(c.lruLimit).Before(now) {
-				c.evictWithLock(last, 0)
+				expired = c.expire(expired, last, ExpiredLRULimit)
 				continue
 			}
 		}
 		break
 	}
+	return expired
+}
+
+// Record expired from the cache pending an OnExpire call
+type expiry struct {
+	frontend *Frontend
+	key      Key
+	reason   ExpiryReason
+}
+
+// Evict an expired record and append it to expired, if its frontend has
+// FrontendOptions.OnExpire set. Requires lock on c.mu.
+func (c *Cache) expire(
+	expired []expiry,
+	loc recordLocation,
+	reason ExpiryReason,
+) []expiry {
+	c.frontendMeta[loc.frontend].expirations++
+	c.evictWithLock(loc, 0)
+	f := c.frontendMeta[loc.frontend].instance
+	if f.opts.OnExpire != nil {
+		expired = append(expired, expiry{f, loc.key, reason})
+	}
+	return expired
+}
+
+// Mark record as most recently used without retrieving it.
+// Returns false, if record is not in the cache.
+func (c *Cache) touch(loc recordLocation) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rec, ok := c.record(loc)
+	if !ok {
+		return false
+	}
+	c.lruList.MoveToFront(rec.node)
+	rec.lastUsed = time.Now()
+	c.frontends[loc.frontend][loc.key] = rec
+	return true
+}
+
+// Return the populated record of frontend f at k without populating missing
+// records. If touch, the record is marked as most recently used and the
+// lookup is counted as a hit or miss.
+func (c *Cache) lookup(f *Frontend, k Key, touch bool) (*Record, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.frontendMeta[f.id].instance != f || c.closed {
+		return nil, false
+	}
+	loc := recordLocation{f.id, k}
+	rec, ok := c.record(loc)
+	ok = ok && rec.populated && rec.epoch == c.epoch
+	if !touch {
+		if !ok {
+			return nil, false
+		}
+		return rec.rec, true
+	}
+
+	if !ok {
+		c.misses++
+		c.frontendMeta[f.id].misses++
+		return nil, false
+	}
+	c.hits++
+	c.frontendMeta[f.id].hits++
+	rec.hits++
+	c.lruList.MoveToFront(rec.node)
+	rec.lastUsed = time.Now()
+	c.frontends[loc.frontend][loc.key] = rec
+	return rec.rec, true
+}
 
-	return recWithMeta.rec, !ok
+func (c *Cache) version(loc recordLocation) (uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rec, ok := c.record(loc)
+	if !ok || !rec.populated {
+		return 0, false
+	}
+	return rec.rec.version, true
 }
 
 // Shorthand for retrieving record by its location.
 //
 // Requires lock on c.mu.
 func (c *Cache) record(loc recordLocation) (recordWithMeta, bool) {
+	if loc.frontend >= len(c.frontends) {
+		return recordWithMeta{}, false
+	}
 	rec, ok := c.frontends[loc.frontend][loc.key]
 	return rec, ok
 }
 
-// Set record used memory
-func (c *Cache) setUsedMemory(src *Record, loc recordLocation, memoryUsed int) {
+// Set record used memory.
+//
+// Returns the record retained at loc and the stale record src replaced, if
+// any. If src has identical content to the stale record, the stale record is
+// retained instead of src.
+func (c *Cache) setUsedMemory(
+	src *Record,
+	loc recordLocation,
+	memoryUsed int,
+) (retained, replaced *Record) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -162,27 +695,324 @@ func (c *Cache) setUsedMemory(src *Record, loc recordLocation, memoryUsed int) {
 	//
 	// All other cases of such possible concurrent evictions and overridden
 	// inclusions will simply NOP on their respective operations.
+	rec, ok := c.record(loc)
+	if !ok {
+		return src, nil
+	}
+	switch src {
+	case rec.rec:
+	case rec.pending:
+		rec.pending = nil
+		rec.stale = false
+		rec.staleAt = time.Time{}
+
+		// Deadlines of the replaced record must not carry over. Any TTL of
+		// the replacement is scheduled after this call.
+		rec.evictAt = time.Time{}
+		rec.ttlDeadline = time.Time{}
+
+		if rec.populated && rec.rec.hash == src.hash {
+			// Content unchanged, so keep the existing record and its
+			// dependents
+			c.frontends[loc.frontend][loc.key] = rec
+			return rec.rec, rec.rec
+		}
+
+		// Regenerated record replacing a stale one
+		if rec.populated {
+			replaced = rec.rec
+			c.removeRecordSize(loc.frontend, rec.memoryUsed)
+		}
+		rec.rec = src
+
+		// Content changed, so any records including this one must be evicted
+		c.evictDependents(rec)
+		rec.includedIn = nil
+		rec.weakIncludedIn = nil
+	default:
+		return src, nil
+	}
+	rec.memoryUsed = memoryUsed
+	rec.populated = true
+	c.addRecordSize(loc.frontend, memoryUsed)
+	c.frontends[loc.frontend][loc.key] = rec
+	return src, replaced
+}
+
+// Set the time after which the record at loc is considered stale, if it is
+// still src
+func (c *Cache) setStaleAt(loc recordLocation, src *Record, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	rec, ok := c.record(loc)
 	if !ok || rec.rec != src {
 		return
 	}
-	rec.memoryUsed = memoryUsed
+	rec.staleAt = t
+	c.frontends[loc.frontend][loc.key] = rec
+}
+
+// Return, if the record is due for validation after interval has passed since
+// the last validation or its creation. Records the validation time, if due.
+func (c *Cache) validationDue(
+	loc recordLocation,
+	src *Record,
+	interval time.Duration,
+) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rec, ok := c.record(loc)
+	if !ok || rec.rec != src || rec.pending != nil {
+		return false
+	}
+	now := time.Now()
+	last := rec.lastValidated
+	if last.IsZero() {
+		last = src.created
+	}
+	if interval != 0 && now.Sub(last) < interval {
+		return false
+	}
+	rec.lastValidated = now
+	c.frontends[loc.frontend][loc.key] = rec
+	return true
+}
+
+// Account for a populated record of size being added to frontend.
+// Requires lock on c.mu.
+func (c *Cache) addRecordSize(frontend, size int) {
+	c.memoryUsed += size
+	m := &c.frontendMeta[frontend]
+	m.memoryUsed += size
+	m.sizeHistogram[sizeBucket(size)]++
+}
+
+// Account for a populated record of size being removed from frontend.
+// Requires lock on c.mu.
+func (c *Cache) removeRecordSize(frontend, size int) {
+	c.memoryUsed -= size
+	m := &c.frontendMeta[frontend]
+	m.memoryUsed -= size
+	m.sizeHistogram[sizeBucket(size)]--
+}
+
+// Create a new record of frontend f to be populated to replace an existing
+// populated record. Returns the existing and new record. ok=false, if there is
+// no populated record at k or it is already being replaced.
+func (c *Cache) beginReplacement(f *Frontend, k Key) (
+	old, rec *Record, ok bool,
+) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.frontendMeta[f.id].instance != f {
+		return nil, nil, false
+	}
+	loc := recordLocation{f.id, k}
+	meta, ok := c.record(loc)
+	if !ok ||
+		c.draining ||
+		meta.pending != nil ||
+		!meta.rec.semaphore.Finished() {
+		return nil, nil, false
+	}
+	return meta.rec, c.beginPending(loc, meta), true
+}
+
+// Create a new record of frontend f to be populated by appending to an
+// existing populated record. Returns the existing and new record.
+//
+// If the record or a previous append to it is still being populated, returns
+// the record being populated to wait on instead. Returns only nil values, if
+// there is no record at k or the cache is draining.
+func (c *Cache) beginAppend(f *Frontend, k Key) (
+	old, rec, wait *Record, err error,
+) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.frontendMeta[f.id].instance != f {
+		return nil, nil, nil, ErrFrontendDeleted
+	}
+	loc := recordLocation{f.id, k}
+	meta, ok := c.record(loc)
+	switch {
+	case !ok || c.draining:
+		return
+	case meta.frozen:
+		return nil, nil, nil, ErrRecordFrozen
+	case !meta.rec.semaphore.Finished():
+		return nil, nil, meta.rec, nil
+	case meta.pending != nil:
+		return nil, nil, meta.pending, nil
+	}
+	return meta.rec, c.beginPending(loc, meta), nil, nil
+}
+
+// Create a new pending record to replace the existing record at loc.
+// Requires lock on c.mu.
+func (c *Cache) beginPending(loc recordLocation, meta recordWithMeta) *Record {
+	rec := new(Record)
+	rec.semaphore.Init()
+	c.beginPopulation(loc, rec)
+	meta.pending = rec
+	c.frontends[loc.frontend][loc.key] = meta
+	return rec
+}
+
+// Prevent any further appends to record. Returns false, if record is not in
+// the cache.
+func (c *Cache) freeze(loc recordLocation) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rec, ok := c.record(loc)
+	if !ok {
+		return false
+	}
+	rec.frozen = true
+	c.frontends[loc.frontend][loc.key] = rec
+	return true
+}
+
+// Discard a record that failed to populate. If the record was replacing an
+// existing record, the existing record is retained.
+func (c *Cache) abortPopulation(loc recordLocation, rec *Record) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	meta, ok := c.record(loc)
+	if !ok {
+		return
+	}
+	switch rec {
+	case meta.rec:
+		c.evictWithLock(loc, 0)
+	case meta.pending:
+		meta.pending = nil
+		c.frontends[loc.frontend][loc.key] = meta
+	}
+}
+
+// Flag record as stale, so that it is regenerated on next access.
+// Returns false, if record is not in the cache.
+func (c *Cache) markStale(loc recordLocation) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rec, ok := c.record(loc)
+	if !ok {
+		return false
+	}
+	rec.stale = true
+	c.frontends[loc.frontend][loc.key] = rec
+	return true
+}
+
+// Mark the record at loc as stale, if it is still src and is not already
+// stale or being regenerated. Returns, if the record was marked.
+func (c *Cache) markRecordStale(loc recordLocation, src *Record) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rec, ok := c.record(loc)
+	if !ok || rec.rec != src || rec.stale || rec.pending != nil {
+		return false
+	}
+	rec.stale = true
+	c.frontends[loc.frontend][loc.key] = rec
+	return true
+}
+
+// Register the record at loc as being used in another record.
+//
+// weak: register parent as a weak dependent
+func (c *Cache) registerDependance(
+	loc recordLocation,
+	parent intercacheRecordLocation,
+	weak bool,
+) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rec, ok := c.record(loc)
+	if !ok {
+		return // Already evicted or cache closed
+	}
+	if weak {
+		c.addWeakDependant(&rec, parent)
+	} else {
+		rec.includedIn = append(rec.includedIn, parent)
+	}
 	c.frontends[loc.frontend][loc.key] = rec
-	c.memoryUsed += memoryUsed
 }
 
-// Register a record as being used in another record
-func registerDependance(parent, child intercacheRecordLocation) {
-	c := getCache(child.cache)
+// Add a weak dependent parent to rec, keeping the amount of weak dependents
+// within limits. Requires lock on c.mu.
+func (c *Cache) addWeakDependant(
+	rec *recordWithMeta,
+	parent intercacheRecordLocation,
+) {
+	if rec.weakIncludedIn == nil {
+		rec.weakIncludedIn = make(map[intercacheRecordLocation]struct{})
+	}
+	if _, ok := rec.weakIncludedIn[parent]; ok {
+		return
+	}
+
+	if len(rec.weakIncludedIn) >= c.maxWeakDependents {
+		// Prune parents already evicted from this cache. Parents in other
+		// caches can not be checked without risking lock intersection.
+		for p := range rec.weakIncludedIn {
+			if p.cache != c.id {
+				continue
+			}
+			if _, ok := c.record(p.recordLocation); !ok {
+				delete(rec.weakIncludedIn, p)
+			}
+		}
+
+		// Still full. Evict arbitrary parents early to retain correctness.
+		for p := range rec.weakIncludedIn {
+			if len(rec.weakIncludedIn) < c.maxWeakDependents {
+				break
+			}
+			delete(rec.weakIncludedIn, p)
+			c.evictDependent(p)
+		}
+	}
+
+	rec.weakIncludedIn[parent] = struct{}{}
+}
+
+// Register a record as depending on an external resource token
+func (c *Cache) registerTokenDependance(loc recordLocation, token string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	rec, ok := c.record(child.recordLocation)
+	rec, ok := c.record(loc)
 	if !ok {
 		return // Already evicted
 	}
-	rec.includedIn = append(rec.includedIn, parent)
-	c.frontends[child.frontend][child.key] = rec
+	for _, t := range rec.tokens {
+		if t == token {
+			return
+		}
+	}
+	rec.tokens = append(rec.tokens, token)
+	c.frontends[loc.frontend][loc.key] = rec
+
+	if c.tokens == nil {
+		c.tokens = make(map[string]map[recordLocation]struct{})
+	}
+	deps := c.tokens[token]
+	if deps == nil {
+		deps = make(map[recordLocation]struct{})
+		c.tokens[token] = deps
+	}
+	deps[loc] = struct{}{}
 }
 
 // Make copy of frontend keys to prevent itterator invalidation.
@@ -195,3 +1025,33 @@ func (c *Cache) keys(frontend int) []Key {
 	}
 	return keys
 }
+
+// Return amount of goroutines blocked waiting for the population of a record
+func (c *Cache) waiters(loc recordLocation) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rec, ok := c.record(loc)
+	if !ok {
+		return 0
+	}
+	if rec.pending != nil {
+		return rec.pending.semaphore.Waiters()
+	}
+	return rec.rec.semaphore.Waiters()
+}
+
+// Return all records of frontend currently being populated mapped to the
+// amount of goroutines blocked waiting for their population to complete
+func (c *Cache) inFlight(frontend int) map[Key]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	m := make(map[Key]int)
+	for rec, loc := range c.populating {
+		if loc.frontend == frontend && c.isPopulating(loc, rec) {
+			m[loc.key] = rec.semaphore.Waiters()
+		}
+	}
+	return m
+}
@@ -1,9 +1,11 @@
 package recache
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
@@ -237,7 +239,9 @@ func prepareRecursion(memoryLimit uint, lruLimit time.Duration,
 			LRULimit:    lruLimit,
 		})
 		for j := 0; j < 3; j++ {
-			frontends[i][j] = caches[i].NewFrontend(getter)
+			frontends[i][j] = caches[i].NewFrontendWithOptions(FrontendOptions{
+				Get: getter,
+			})
 		}
 	}
 
@@ -348,8 +352,14 @@ func assertConsistency(t *testing.T, caches ...*Cache) {
 				t.Parallel()
 
 				used := 0
-				for _, b := range c.frontends {
+				for i, b := range c.frontends {
+					frontendUsed := 0
+					var hist [64]int
 					for _, rec := range b {
+						if rec.populated {
+							hist[sizeBucket(rec.memoryUsed)]++
+						}
+
 						recUsed := 0
 						for c := &rec.rec.data; c != nil; c = c.next {
 							recUsed += c.Size()
@@ -357,8 +367,15 @@ func assertConsistency(t *testing.T, caches ...*Cache) {
 						if recUsed != rec.memoryUsed {
 							t.Fatal("record used memory mismatch")
 						}
-						used += recUsed
+						frontendUsed += recUsed
 					}
+					if c.frontendMeta[i].memoryUsed != frontendUsed {
+						t.Fatal("frontend used memory mismatch")
+					}
+					if c.frontendMeta[i].sizeHistogram != hist {
+						t.Fatal("frontend size histogram mismatch")
+					}
+					used += frontendUsed
 				}
 				if c.memoryUsed != used {
 					t.Fatal("cache used memory mismatch")
@@ -392,3 +409,210 @@ func assertConsistency(t *testing.T, caches ...*Cache) {
 		})
 	}
 }
+
+func TestBumpEpoch(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu     sync.Mutex
+		counts = make(map[Key]int)
+		cache  = NewCache(CacheOptions{})
+		f      = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				mu.Lock()
+				counts[k]++
+				mu.Unlock()
+				return dummyGetter(k, rw)
+			},
+		})
+	)
+
+	get := func(k string) {
+		t.Helper()
+
+		s, err := f.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertJsonStringEquals(t, s, k)
+	}
+
+	get("key1")
+	get("key2")
+	assertEquals(t, cache.BumpEpoch(), uint64(1))
+	assertEquals(t, cache.Epoch(), uint64(1))
+
+	// Records are only invalidated lazily on access
+	assertEquals(t, len(cache.frontends[0]), 2)
+
+	get("key1")
+	get("key1")
+	assertEquals(t, counts, map[Key]int{
+		"key1": 2,
+		"key2": 1,
+	})
+	assertConsistency(t, cache)
+}
+
+func TestMaxFrontends(t *testing.T) {
+	t.Parallel()
+
+	cache := NewCache(CacheOptions{
+		MaxFrontends: 2,
+	})
+	var frontends [2]*Frontend
+	for i := range frontends {
+		f, err := cache.TryNewFrontend(FrontendOptions{Get: dummyGetter})
+		if err != nil {
+			t.Fatal(err)
+		}
+		frontends[i] = f
+	}
+
+	_, err := cache.TryNewFrontend(FrontendOptions{Get: dummyGetter})
+	assertEquals(t, err, ErrTooManyFrontends)
+	func() {
+		defer func() {
+			assertEquals(t, recover(), ErrTooManyFrontends)
+		}()
+		cache.NewFrontend(dummyGetter)
+	}()
+
+	s := cache.SnapshotStats()
+	assertEquals(t, s.FrontendCount, 2)
+	assertEquals(t, s.MaxFrontends, 2)
+
+	frontends[0].Delete()
+	assertEquals(t, cache.SnapshotStats().FrontendCount, 1)
+	_, err = cache.TryNewFrontend(FrontendOptions{Get: dummyGetter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, cache.SnapshotStats().FrontendCount, 2)
+}
+
+func TestClose(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache    = NewCache(CacheOptions{})
+		children = cache.NewFrontend(dummyGetter)
+
+		other   = NewCache(CacheOptions{})
+		parents = other.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				return rw.Include(children, k)
+			},
+		})
+	)
+
+	_, err := parents.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := cache.id
+	cache.Close()
+	cache.Close()
+
+	_, err = children.Get(1)
+	assertEquals(t, err, ErrCacheClosed)
+	_, err = cache.TryNewFrontend(FrontendOptions{Get: dummyGetter})
+	assertEquals(t, err, ErrCacheClosed)
+	if getCache(id) == cache {
+		t.Fatal("cache not removed from registry")
+	}
+	assertEquals(t, cache.SnapshotStats().Records, 0)
+	assertEquals(t, cache.Drain(context.Background()), nil)
+
+	// Dependent records in other caches are evicted
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		other.mu.Lock()
+		n := len(other.frontends[parents.id])
+		other.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("dependent record not evicted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertConsistency(t, other)
+}
+
+func TestCloseScheduledEviction(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache = NewCache(CacheOptions{})
+		fs    [3]*Frontend
+	)
+	for i := range fs {
+		fs[i] = cache.NewFrontend(dummyGetter)
+	}
+	_, err := fs[2].Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs[2].Evict(time.Second, 1)
+	id := cache.id
+	cache.Close()
+
+	// Scheduled evictions of the closed cache must not resolve to a new cache
+	next := NewCache(CacheOptions{})
+	defer next.Close()
+	if next.id == id {
+		t.Fatal("cache ID reused")
+	}
+	f := next.NewFrontend(dummyGetter)
+	_, err = f.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(3 * time.Second)
+	_, ok := f.ExpiresAt(1)
+	assertEquals(t, ok, false)
+	next.mu.Lock()
+	n := len(next.frontends[f.id])
+	next.mu.Unlock()
+	assertEquals(t, n, 1)
+	assertConsistency(t, next)
+}
+
+// Measures the duration of a full garbage collection with a cache holding many
+// small records
+func BenchmarkGCPause(b *testing.B) {
+	for _, arenas := range [...]bool{false, true} {
+		b.Run(fmt.Sprintf("arenas=%t", arenas), func(b *testing.B) {
+			EnableArenas = arenas
+			defer func() {
+				EnableArenas = false
+			}()
+
+			cache := NewCache(CacheOptions{})
+			defer cache.Close()
+			f := cache.NewFrontendWithOptions(FrontendOptions{
+				Get: dummyGetter,
+			})
+			for i := 0; i < 1e5; i++ {
+				_, err := f.Get(i)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			runtime.GC()
+
+			b.ResetTimer()
+			var total time.Duration
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				runtime.GC()
+				total += time.Since(start)
+			}
+			b.ReportMetric(float64(total)/float64(b.N), "ns/gc")
+			runtime.KeepAlive(f)
+		})
+	}
+}
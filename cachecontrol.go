@@ -0,0 +1,147 @@
+package recache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Caching headers written with responses by Frontend.WriteHTTP() and
+// Frontend.ServeContent(). See FrontendOptions.HTTPCachePolicy.
+type HTTPCachePolicy struct {
+	// Values of the "max-age", "s-maxage" and "stale-while-revalidate"
+	// directives of the "Cache-Control" header. Zero values omit the
+	// directive.
+	MaxAge, SharedMaxAge, StaleWhileRevalidate time.Duration
+
+	// Add the "public", "private", "no-cache" and "immutable" directives
+	Public, Private, NoCache, Immutable bool
+
+	// Derive "max-age" from the time left until the TTL of the record set
+	// with RecordWriter.SetTTL() passes and the record becomes stale or is
+	// evicted. Evictions scheduled by other means and CacheOptions.LRULimit
+	// are not taken into account. MaxAge, if set, caps the derived value and
+	// is used for records without a TTL.
+	MaxAgeFromTTL bool
+
+	// Also set the "Expires" header to the time "max-age" runs out for
+	// HTTP/1.0 caches
+	Expires bool
+}
+
+// Return the value of the "Cache-Control" header for a response. "max-age" is
+// set to maxAge, if setMaxAge.
+func (p HTTPCachePolicy) cacheControl(maxAge time.Duration, setMaxAge bool) (
+	string, bool,
+) {
+	var dirs []string
+	for _, d := range [...]struct {
+		name string
+		set  bool
+	}{
+		{"public", p.Public},
+		{"private", p.Private},
+		{"no-cache", p.NoCache},
+		{"immutable", p.Immutable},
+	} {
+		if d.set {
+			dirs = append(dirs, d.name)
+		}
+	}
+	for _, d := range [...]struct {
+		name string
+		val  time.Duration
+		set  bool
+	}{
+		{"max-age", maxAge, setMaxAge},
+		{"s-maxage", p.SharedMaxAge, p.SharedMaxAge > 0},
+		{
+			"stale-while-revalidate",
+			p.StaleWhileRevalidate,
+			p.StaleWhileRevalidate > 0,
+		},
+	} {
+		if d.set {
+			dirs = append(
+				dirs,
+				d.name+"="+strconv.FormatInt(int64(d.val/time.Second), 10),
+			)
+		}
+	}
+	return strings.Join(dirs, ", "), len(dirs) != 0
+}
+
+// Return the HTTP caching policy for the record rec by key k, if any
+func (f *Frontend) httpCachePolicy(k Key, rec *Record) (HTTPCachePolicy, bool) {
+	switch {
+	case f.opts.HTTPCachePolicyFunc != nil:
+		return f.opts.HTTPCachePolicyFunc(k, rec.Meta()), true
+	case f.opts.HTTPCachePolicy != nil:
+		return *f.opts.HTTPCachePolicy, true
+	default:
+		return HTTPCachePolicy{}, false
+	}
+}
+
+// Set the caching headers of the response for the record rec by key k from
+// the HTTP caching policy of the frontend, restricted by the fills of any
+// placeholders of rec. Headers already set on h are kept.
+func (f *Frontend) setCacheHeaders(k Key, rec *Record, h http.Header) {
+	if h.Get("Cache-Control") != "" {
+		return
+	}
+	if rec.fillNoStore {
+		h.Set("Cache-Control", "no-store")
+		return
+	}
+	p, ok := f.httpCachePolicy(k, rec)
+	if rec.fillPrivate {
+		p.Public = false
+		p.Private = true
+		ok = true
+	}
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	maxAge, setMaxAge := p.MaxAge, p.MaxAge > 0
+	if p.MaxAgeFromTTL {
+		if exp, ok := rec.ttlExpiresAt(); ok {
+			left := exp.Sub(now)
+			if left < 0 {
+				left = 0
+			}
+			if !setMaxAge || left < maxAge {
+				maxAge = left
+			}
+			setMaxAge = true
+		}
+	}
+
+	cc, ok := p.cacheControl(maxAge, setMaxAge)
+	if !ok {
+		return
+	}
+	h.Set("Cache-Control", cc)
+	if p.Expires && setMaxAge {
+		h.Set(
+			"Expires",
+			now.Add(maxAge.Truncate(time.Second)).UTC().Format(http.TimeFormat),
+		)
+	}
+}
+
+// Add name to the "Vary" header of h, unless already listed
+func addVary(h http.Header, name string) {
+	for _, v := range h.Values("Vary") {
+		for _, n := range strings.Split(v, ",") {
+			n = strings.TrimSpace(n)
+			if n == "*" || strings.EqualFold(n, name) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", name)
+}
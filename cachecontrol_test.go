@@ -0,0 +1,215 @@
+package recache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPCachePolicy(t *testing.T) {
+	t.Parallel()
+
+	cache := NewCache(CacheOptions{})
+	newFrontend := func(opts FrontendOptions) *Frontend {
+		opts.Get = func(k Key, rw *RecordWriter) error {
+			if ttl, ok := k.(time.Duration); ok {
+				rw.SetTTL(ttl)
+			}
+			return dummyGetter(k, rw)
+		}
+		return cache.NewFrontendWithOptions(opts)
+	}
+	serve := func(
+		f *Frontend,
+		k Key,
+		prepare func(w http.ResponseWriter, r *http.Request),
+	) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		if prepare != nil {
+			prepare(w, r)
+		}
+		_, err := f.WriteHTTP(k, w, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	t.Run("static", func(t *testing.T) {
+		t.Parallel()
+
+		f := newFrontend(FrontendOptions{
+			HTTPCachePolicy: &HTTPCachePolicy{
+				Public:               true,
+				MaxAge:               time.Minute,
+				SharedMaxAge:         5 * time.Minute,
+				StaleWhileRevalidate: 30 * time.Second,
+				Expires:              true,
+			},
+		})
+		start := time.Now().Truncate(time.Second)
+		w := serve(f, "a", nil)
+		assertEquals(
+			t,
+			w.Header().Get("Cache-Control"),
+			"public, max-age=60, s-maxage=300, stale-while-revalidate=30",
+		)
+		exp, err := http.ParseTime(w.Header().Get("Expires"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := exp.Sub(start); d < time.Minute || d > time.Minute+time.Second {
+			t.Fatalf("unexpected Expires: %s", exp)
+		}
+
+		// Also sent with 304 responses
+		w = serve(f, "a", func(_ http.ResponseWriter, r *http.Request) {
+			r.Header.Set("If-None-Match", w.Header().Get("ETag"))
+		})
+		assertEquals(t, w.Code, 304)
+		assertEquals(
+			t,
+			w.Header().Get("Cache-Control"),
+			"public, max-age=60, s-maxage=300, stale-while-revalidate=30",
+		)
+
+		// Headers set by the caller are kept
+		w = serve(f, "a", func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Cache-Control", "no-store")
+		})
+		assertEquals(t, w.Header().Get("Cache-Control"), "no-store")
+		assertEquals(t, w.Header().Get("Expires"), "")
+	})
+
+	t.Run("max-age from TTL", func(t *testing.T) {
+		t.Parallel()
+
+		f := newFrontend(FrontendOptions{
+			HTTPCachePolicy: &HTTPCachePolicy{
+				Private:       true,
+				MaxAge:        10 * time.Minute,
+				MaxAgeFromTTL: true,
+			},
+		})
+		maxAge := func(w *httptest.ResponseRecorder) int {
+			t.Helper()
+			cc := w.Header().Get("Cache-Control")
+			i := strings.Index(cc, "max-age=")
+			if i == -1 {
+				t.Fatalf("no max-age: %s", cc)
+			}
+			n, err := strconv.Atoi(cc[i+len("max-age="):])
+			if err != nil {
+				t.Fatal(err)
+			}
+			return n
+		}
+
+		assertEquals(t, maxAge(serve(f, "no TTL", nil)), 600)
+		assertEquals(t, maxAge(serve(f, time.Hour, nil)), 600)
+		if n := maxAge(serve(f, time.Minute, nil)); n < 58 || n > 60 {
+			t.Fatalf("unexpected max-age: %d", n)
+		}
+
+		// Records are stale after their TTL with StaleWhileRevalidate
+		swr := newFrontend(FrontendOptions{
+			StaleWhileRevalidate: true,
+			HTTPCachePolicy: &HTTPCachePolicy{
+				Private:       true,
+				MaxAge:        10 * time.Minute,
+				MaxAgeFromTTL: true,
+			},
+		})
+		if n := maxAge(serve(swr, time.Minute, nil)); n < 58 || n > 60 {
+			t.Fatalf("unexpected max-age: %d", n)
+		}
+	})
+
+	t.Run("func", func(t *testing.T) {
+		t.Parallel()
+
+		f := newFrontend(FrontendOptions{
+			HTTPCachePolicy: &HTTPCachePolicy{
+				MaxAge: time.Minute,
+			},
+			HTTPCachePolicyFunc: func(k Key, _ RecordMeta) HTTPCachePolicy {
+				if k.(string) == "static" {
+					return HTTPCachePolicy{
+						Public:    true,
+						MaxAge:    365 * 24 * time.Hour,
+						Immutable: true,
+					}
+				}
+				return HTTPCachePolicy{}
+			},
+		})
+		assertEquals(
+			t,
+			serve(f, "static", nil).Header().Get("Cache-Control"),
+			"public, immutable, max-age=31536000",
+		)
+		assertEquals(t, serve(f, "other", nil).Header().Get("Cache-Control"), "")
+	})
+
+	t.Run("ServeContent", func(t *testing.T) {
+		t.Parallel()
+
+		f := newFrontend(FrontendOptions{
+			HTTPCachePolicy: &HTTPCachePolicy{
+				NoCache: true,
+			},
+		})
+		w := httptest.NewRecorder()
+		err := f.ServeContent("a", w, httptest.NewRequest("GET", "/", nil), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEquals(t, w.Header().Get("Cache-Control"), "no-cache")
+	})
+
+	t.Run("Vary", func(t *testing.T) {
+		t.Parallel()
+
+		f := newFrontend(FrontendOptions{
+			HTTPCachePolicy: &HTTPCachePolicy{
+				Public: true,
+				MaxAge: time.Minute,
+			},
+		})
+		vary := func(prepare func(http.ResponseWriter, *http.Request)) string {
+			t.Helper()
+			h := serve(f, "a", prepare).Header()
+			return strings.Join(h.Values("Vary"), ", ")
+		}
+
+		assertEquals(t, vary(nil), "Accept-Encoding")
+		assertEquals(
+			t,
+			vary(func(_ http.ResponseWriter, r *http.Request) {
+				r.Header.Set("Accept-Encoding", "deflate")
+			}),
+			"Accept-Encoding",
+		)
+
+		// Merged with existing values
+		assertEquals(
+			t,
+			vary(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Vary", "Accept-Language")
+			}),
+			"Accept-Language, Accept-Encoding",
+		)
+		assertEquals(
+			t,
+			vary(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Vary", "Origin, accept-encoding")
+			}),
+			"Origin, accept-encoding",
+		)
+	})
+}
@@ -0,0 +1,108 @@
+package recache
+
+import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// Start a canary population of the record rec by key k retrieved from the
+// cache with probability FrontendOptions.CanaryRate
+func (f *Frontend) sampleCanary(k Key, rec *Record) {
+	rate := f.tunables().canaryRate
+	if rate <= 0 ||
+		rec.populationError != nil ||
+		len(rec.holes) != 0 ||
+		rand.Float64() >= rate ||
+		!f.startCanary(k) {
+		return
+	}
+	go func() {
+		defer f.endCanary(k)
+		f.canary(k, rec)
+	}()
+}
+
+// Register a canary population of the record by key k. Returns false, if one
+// is already in progress for k or FrontendOptions.MaxConcurrentCanaries are.
+func (f *Frontend) startCanary(k Key) bool {
+	max := int(f.opts.MaxConcurrentCanaries)
+	if max == 0 {
+		max = defaultMaxConcurrentCanaries
+	}
+
+	f.canaryMu.Lock()
+	defer f.canaryMu.Unlock()
+
+	if _, ok := f.canaryKeys[k]; ok || len(f.canaryKeys) >= max {
+		return false
+	}
+	if f.canaryKeys == nil {
+		f.canaryKeys = make(map[Key]struct{})
+	}
+	f.canaryKeys[k] = struct{}{}
+	return true
+}
+
+// Unregister a canary population started with startCanary()
+func (f *Frontend) endCanary(k Key) {
+	f.canaryMu.Lock()
+	defer f.canaryMu.Unlock()
+	delete(f.canaryKeys, k)
+}
+
+// Regenerate the record cached by key k with FrontendOptions.Get without
+// storing it and report, if its content differs from cached
+func (f *Frontend) canary(k Key, cached *Record) {
+	fresh, err := f.populateDetached(
+		context.Background(),
+		k,
+		cached.compressionLevel,
+	)
+	if err != nil {
+		f.cache.logger.Printf(
+			"canary population failed: key=%s: %s",
+			f.KeyString(k),
+			err,
+		)
+		return
+	}
+
+	// The cached record was replaced or marked stale during the canary
+	// population, so any difference is expected
+	if !f.cache.isCurrent(recordLocation{f.id, k}, cached) {
+		return
+	}
+
+	atomic.AddUint64(&f.canaries, 1)
+	if fresh.hash == cached.hash {
+		return
+	}
+	atomic.AddUint64(&f.canaryMismatches, 1)
+	diff := diffRecords(cached, fresh)
+	if f.opts.OnCanaryMismatch != nil {
+		f.opts.OnCanaryMismatch(k, diff)
+	} else {
+		f.cache.logger.Printf(
+			"canary mismatch: key=%s cached=%s fresh=%s",
+			f.KeyString(k),
+			diff.OldETag,
+			diff.NewETag,
+		)
+	}
+}
+
+// Return, if rec is the current record at loc and is not stale
+func (c *Cache) isCurrent(loc recordLocation, rec *Record) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r, ok := c.record(loc)
+	return ok &&
+		r.rec == rec &&
+		r.epoch == c.epoch &&
+		!r.stale &&
+		r.pending == nil &&
+		(r.staleAt.IsZero() || time.Now().Before(r.staleAt))
+}
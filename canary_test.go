@@ -0,0 +1,171 @@
+package recache
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCanary(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu         sync.Mutex
+		upstream   = map[string]string{"a": "1"}
+		mismatches = make(chan RecordDiff, 1)
+		cache      = NewCache(CacheOptions{})
+	)
+	children := cache.NewFrontendWithOptions(FrontendOptions{
+		Get: func(k Key, rw *RecordWriter) (err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			_, err = rw.Write([]byte(upstream[k.(string)]))
+			return
+		},
+		CanaryRate: 1,
+		OnCanaryMismatch: func(_ Key, d RecordDiff) {
+			select {
+			case mismatches <- d:
+			default:
+			}
+		},
+	})
+	parents := cache.NewFrontendWithOptions(FrontendOptions{
+		Get: func(k Key, rw *RecordWriter) error {
+			return rw.Include(children, k)
+		},
+		CanaryRate: 1,
+	})
+
+	waitForChecks := func(f *Frontend, n uint64) FrontendStats {
+		t.Helper()
+		for i := 0; i < 1000; i++ {
+			s := f.Stats()
+			if s.CanaryChecks >= n {
+				return s
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("expected %d canary checks", n)
+		return FrontendStats{}
+	}
+
+	// Misses do not start canary populations
+	cached, err := parents.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = parents.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := waitForChecks(parents, 1)
+	assertEquals(t, s.CanaryMismatches, uint64(0))
+
+	// Including records from canary populations are hits on the included
+	// records
+	s = waitForChecks(children, 1)
+	assertEquals(t, s.CanaryMismatches, uint64(0))
+
+	// Upstream changed without evicting the record
+	mu.Lock()
+	upstream["a"] = "2"
+	mu.Unlock()
+	rec, err := children.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case d := <-mismatches:
+		assertEquals(t, d.OldETag, rec.ETag())
+		if d.NewETag == d.OldETag {
+			t.Fatal("expected ETags to differ")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("canary mismatch not reported")
+	}
+	s = waitForChecks(children, 2)
+	if s.CanaryMismatches == 0 {
+		t.Fatal("expected canary mismatches")
+	}
+
+	// Canary populations do not register dependencies
+	assertConsistency(t, cache)
+	children.Evict(0, "a")
+	cache.mu.Lock()
+	_, ok := cache.record(recordLocation{parents.id, "a"})
+	cache.mu.Unlock()
+	assertEquals(t, ok, false)
+
+	rec, err = parents.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.ETag() == cached.ETag() {
+		t.Fatal("expected regenerated record")
+	}
+}
+
+func TestCanaryConcurrency(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu       sync.Mutex
+		blocking bool
+		started  = make(chan Key, 10)
+		release  = make(chan struct{})
+	)
+	f := NewCache(CacheOptions{}).NewFrontendWithOptions(FrontendOptions{
+		Get: func(k Key, rw *RecordWriter) error {
+			mu.Lock()
+			block := blocking
+			mu.Unlock()
+			if block {
+				started <- k
+				<-release
+			}
+			return dummyGetter(k, rw)
+		},
+		CanaryRate:            1,
+		MaxConcurrentCanaries: 2,
+	})
+
+	for i := 0; i < 4; i++ {
+		_, err := f.Get(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.Lock()
+	blocking = true
+	mu.Unlock()
+
+	// Only one canary population per key and at most 2 in total
+	for _, k := range [...]int{0, 0, 0, 1, 1, 2, 3} {
+		_, err := f.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := make(map[Key]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case k := <-started:
+			got[k] = true
+		case <-time.After(time.Second):
+			t.Fatal("canary population not started")
+		}
+	}
+	assertEquals(t, got, map[Key]bool{0: true, 1: true})
+	select {
+	case k := <-started:
+		t.Fatalf("unexpected canary population: key=%v", k)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	for i := 0; i < 1000 && f.Stats().CanaryChecks < 2; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assertEquals(t, f.Stats().CanaryChecks, uint64(2))
+}
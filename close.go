@@ -0,0 +1,57 @@
+package recache
+
+import "errors"
+
+// A record or frontend was requested from a cache closed with Cache.Close()
+var ErrCacheClosed = errors.New("cache closed")
+
+// Evict all records of the cache, stop its background goroutines and remove it
+// from the global cache registry, allowing short-lived caches to be garbage
+// collected. Records of other caches including records of this cache are
+// evicted as with EvictAll(). Records of scratch caches created with
+// NewScratchCache() are dropped without evicting records of other caches.
+//
+// Any subsequent record retrieval from the cache returns ErrCacheClosed.
+// Populations in progress are completed, but their records are not stored.
+//
+// Safe to call multiple times.
+func (c *Cache) Close() {
+	if !c.close() {
+		return
+	}
+
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+
+	delete(caches, c.id)
+}
+
+// Drop all records of the cache and stop its background goroutines.
+// Returns false, if the cache was already closed.
+func (c *Cache) close() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return false
+	}
+	c.closed = true
+	c.startDraining()
+
+	if !c.scratch {
+		for i := range c.frontends {
+			c.evictFrontendWithLock(i, 0)
+		}
+	}
+	for i, m := range c.frontends {
+		if m != nil {
+			c.frontends[i] = make(map[Key]recordWithMeta)
+		}
+		c.frontendMeta[i].memoryUsed = 0
+		c.frontendMeta[i].sizeHistogram = [64]int{}
+	}
+	c.lruList = linkedList{}
+	c.memoryUsed = 0
+	c.tokens = nil
+	return true
+}
@@ -4,17 +4,88 @@ import (
 	"bytes"
 	"compress/flate"
 	"crypto/sha1"
+	"fmt"
 	"io"
+	"runtime"
 )
 
+// Type of a record component
+type ComponentType uint8
+
+const (
+	// Component containing data of the record itself
+	BufferComponent ComponentType = iota
+
+	// Component referencing another included record
+	ReferenceComponent
+
+	// Component marking a placeholder filled at serve time
+	PlaceholderComponent
+)
+
+func (t ComponentType) String() string {
+	switch t {
+	case BufferComponent:
+		return "buffer"
+	case ReferenceComponent:
+		return "reference"
+	case PlaceholderComponent:
+		return "placeholder"
+	default:
+		return fmt.Sprintf("ComponentType(%d)", uint8(t))
+	}
+}
+
+// Describes a single constituent component of a record
+type ComponentInfo struct {
+	Type ComponentType
+
+	// Compressed size of the data stored in the component.
+	// Always 0 for references, as these do not store any data themselves.
+	Size int
+
+	// Uncompressed size of the component's data. For references this is the
+	// uncompressed size of the referenced record.
+	UncompressedSize int
+
+	// Descriptor of the component's deflate frame. For references this
+	// describes the entire referenced record.
+	FrameDescriptor FrameDescriptor
+
+	// SHA1 hash of the component's data
+	SHA1 [sha1.Size]byte
+
+	// Frontend and key of the referenced record. Only set for references.
+	Frontend *Frontend
+	Key      Key
+
+	// Name of the placeholder. Only set for placeholders.
+	Placeholder string
+
+	// Offset and length of the component's compressed data in the
+	// compressed stream of the record, as written by Record.WriteTo().
+	// For references the length includes all data of the referenced record.
+	//
+	// Frontend.WriteHTTP() prepends a 2 byte zlib header to this stream.
+	Offset, Length int64
+}
+
 // Contains either a buffer or a reference to another record
 type component interface {
 	io.WriterTo
 	NewReader() io.Reader
 	Size() int
 	Hash() [sha1.Size]byte
-	GetFrameDescriptor() frameDescriptor
+	GetFrameDescriptor() FrameDescriptor
 	Decompress() io.Reader
+
+	// Length of the compressed data of the component including any
+	// referenced records
+	length() int64
+
+	// Write at most max bytes of the compressed data of the component to w,
+	// starting at offset off
+	writeRange(w io.Writer, off, max int64) (int64, error)
 }
 
 // Common part of both buffer and reference components
@@ -28,26 +99,44 @@ func (c componentCommon) Hash() [sha1.Size]byte {
 
 // Contains a deflate-compressed buffer
 type buffer struct {
+	// Keeps data allocated, if allocated off-heap. Kept first, as it has
+	// zero size, unless built with the recache_offheap tag.
+	mem memHandle
+
 	componentCommon
-	frameDescriptor
-	data []byte
+	frame FrameDescriptor
+	data  []byte
 }
 
 func (b buffer) WriteTo(w io.Writer) (int64, error) {
 	n, err := w.Write(b.data)
+	runtime.KeepAlive(b.mem)
 	return int64(n), err
 }
 
 func (b buffer) NewReader() io.Reader {
-	return bytes.NewReader(b.data)
+	return &bufferReader{
+		Reader: bytes.NewReader(b.data),
+		mem:    b.mem,
+	}
 }
 
 func (b buffer) Size() int {
 	return len(b.data)
 }
 
-func (b buffer) GetFrameDescriptor() frameDescriptor {
-	return b.frameDescriptor
+func (b buffer) GetFrameDescriptor() FrameDescriptor {
+	return b.frame
+}
+
+func (b buffer) length() int64 {
+	return int64(len(b.data))
+}
+
+func (b buffer) writeRange(w io.Writer, off, max int64) (int64, error) {
+	n, err := writeSliceRange(w, b.data, off, max)
+	runtime.KeepAlive(b.mem)
+	return n, err
 }
 
 // Read component as decompressed stream
@@ -55,10 +144,36 @@ func (b buffer) Decompress() io.Reader {
 	return flate.NewReader(b.NewReader())
 }
 
+// Reader of the data of a buffer. Keeps the data allocated for the lifetime of
+// the reader, even after the record of the buffer becomes unreachable.
+type bufferReader struct {
+	*bytes.Reader
+	mem memHandle
+}
+
+func (r *bufferReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	runtime.KeepAlive(r.mem)
+	return
+}
+
+func (r *bufferReader) WriteTo(w io.Writer) (n int64, err error) {
+	n, err = r.Reader.WriteTo(w)
+	runtime.KeepAlive(r.mem)
+	return
+}
+
 // Reference to another record
 type recordReference struct {
 	componentCommon
 	*Record
+
+	// Location of the referenced record
+	frontend *Frontend
+	key      Key
+
+	// Included with RecordWriter.IncludeWeak()
+	weak bool
 }
 
 func (r recordReference) Size() int {
@@ -66,6 +181,79 @@ func (r recordReference) Size() int {
 	return 0
 }
 
-func (r recordReference) GetFrameDescriptor() frameDescriptor {
-	return r.frameDescriptor
+func (r recordReference) WriteTo(w io.Writer) (int64, error) {
+	// Only count bytes served directly from records
+	return r.Record.writeTo(w)
+}
+
+func (r recordReference) GetFrameDescriptor() FrameDescriptor {
+	return r.Record.frame
+}
+
+func (r recordReference) length() int64 {
+	return r.Record.length
+}
+
+func (r recordReference) writeRange(w io.Writer, off, max int64) (
+	int64, error,
+) {
+	return r.Record.writeRange(w, off, max)
+}
+
+// Write at most max bytes of b to w, starting at offset off
+func writeSliceRange(w io.Writer, b []byte, off, max int64) (int64, error) {
+	if off >= int64(len(b)) || max <= 0 {
+		return 0, nil
+	}
+	b = b[off:]
+	if int64(len(b)) > max {
+		b = b[:max]
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// Named placeholder filled at serve time. Contains no data and is served
+// empty, unless filled. See RecordWriter.Placeholder().
+type placeholder struct {
+	componentCommon
+	name string
+}
+
+func newPlaceholder(name string) placeholder {
+	return placeholder{
+		componentCommon: componentCommon{
+			hash: sha1.Sum([]byte("placeholder:" + name)),
+		},
+		name: name,
+	}
+}
+
+func (p placeholder) WriteTo(w io.Writer) (int64, error) {
+	return 0, nil
+}
+
+func (p placeholder) NewReader() io.Reader {
+	return bytes.NewReader(nil)
+}
+
+func (p placeholder) Size() int {
+	return 0
+}
+
+func (p placeholder) GetFrameDescriptor() FrameDescriptor {
+	// Adler32 checksum of no data is 1
+	return FrameDescriptor{checksum: 1}
+}
+
+func (p placeholder) Decompress() io.Reader {
+	return bytes.NewReader(nil)
+}
+
+func (p placeholder) length() int64 {
+	return 0
+}
+
+func (p placeholder) writeRange(w io.Writer, off, max int64) (int64, error) {
+	return 0, nil
 }
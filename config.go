@@ -0,0 +1,171 @@
+package recache
+
+import (
+	"compress/flate"
+	"time"
+)
+
+// Effective configuration of a Cache with defaults applied. Serializable with
+// encoding/json.
+type CacheConfig struct {
+	ID   int
+	Name string
+
+	// Scratch cache created with NewScratchCache()
+	Scratch bool
+
+	// Current memory limit, which may differ from the configured one with
+	// MemoryTuning set. 0, if not limited.
+	MemoryLimit int
+
+	LRULimit              time.Duration
+	DebounceEviction      bool
+	MaxWeakDependents     int
+	EvictionYieldInterval int
+	MaxFrontends          int
+	DeadlockThreshold     time.Duration
+	MemoryTuning          *MemoryTuningOptions
+
+	// Global configuration shared by all caches
+	CompressionLevel      int
+	CompressionSampleSize int
+	EnableGzip            bool
+	EnableArenas          bool
+
+	// Configuration of each frontend, not counting deleted ones, in order of
+	// frontend creation
+	Frontends []FrontendConfig
+}
+
+// Effective configuration of a Frontend with defaults applied
+type FrontendConfig struct {
+	ID   int
+	Name string
+
+	SlowGetterThreshold        time.Duration
+	GetterTimeout              time.Duration
+	IncludeTimeout             time.Duration
+	PopulationTimeout          time.Duration
+	ValidateInterval           time.Duration
+	WeakDependent              bool
+	IncludedETagsHeader        string
+	EdgeIncludes               EdgeIncludeSyntax
+	StaleWhileRevalidate       bool
+	VerifyChecksums            bool
+	Brotli                     bool
+	CompressionBudget          time.Duration
+	DowngradedCompressionLevel int
+	CompressionBudgetCooldown  time.Duration
+	HoleTTL                    time.Duration
+	CanaryRate                 float64
+	AdaptiveTTL                *AdaptiveTTLOptions
+	HTTPCachePolicy            *HTTPCachePolicy
+
+	// Names of optional callbacks set in FrontendOptions, like "Validate"
+	Callbacks []string
+}
+
+// Return the effective configuration of the cache and its frontends. Useful
+// for debug endpoints and tooling inspecting caches at runtime.
+func (c *Cache) Config() CacheConfig {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	conf := CacheConfig{
+		ID:                    c.id,
+		Name:                  c.opts.Name,
+		Scratch:               c.scratch,
+		MemoryLimit:           c.memoryLimit,
+		LRULimit:              c.lruLimit,
+		DebounceEviction:      c.debounceEviction,
+		MaxWeakDependents:     c.maxWeakDependents,
+		EvictionYieldInterval: c.evictionYieldInterval,
+		MaxFrontends:          c.maxFrontends,
+		DeadlockThreshold:     c.opts.DeadlockThreshold,
+		CompressionLevel:      CompressionLevel,
+		CompressionSampleSize: CompressionSampleSize,
+		EnableGzip:            EnableGzip,
+		EnableArenas:          EnableArenas,
+	}
+	if c.opts.MemoryTuning != nil {
+		tuning := *c.opts.MemoryTuning
+		tuning.setDefaults()
+		conf.MemoryTuning = &tuning
+	}
+	for _, m := range c.frontendMeta {
+		if m.instance != nil {
+			conf.Frontends = append(conf.Frontends, m.instance.config())
+		}
+	}
+	return conf
+}
+
+// Return the effective configuration of the frontend
+func (f *Frontend) config() FrontendConfig {
+	o := f.opts
+	t := f.tunables()
+	conf := FrontendConfig{
+		ID:                         f.id,
+		Name:                       o.Name,
+		SlowGetterThreshold:        o.SlowGetterThreshold,
+		GetterTimeout:              o.GetterTimeout,
+		IncludeTimeout:             o.IncludeTimeout,
+		PopulationTimeout:          o.PopulationTimeout,
+		ValidateInterval:           o.ValidateInterval,
+		WeakDependent:              o.WeakDependent,
+		IncludedETagsHeader:        o.IncludedETagsHeader,
+		EdgeIncludes:               o.EdgeIncludes,
+		StaleWhileRevalidate:       o.StaleWhileRevalidate,
+		VerifyChecksums:            o.VerifyChecksums,
+		Brotli:                     o.Brotli,
+		CompressionBudget:          t.compressionBudget,
+		DowngradedCompressionLevel: t.downgradedCompressionLevel,
+		CompressionBudgetCooldown:  t.compressionBudgetCooldown,
+		HoleTTL:                    t.holeTTL,
+		CanaryRate:                 t.canaryRate,
+	}
+	if conf.DowngradedCompressionLevel == 0 {
+		conf.DowngradedCompressionLevel = flate.BestSpeed
+	}
+	if conf.CompressionBudgetCooldown == 0 {
+		conf.CompressionBudgetCooldown = defaultCompressionBudgetCooldown
+	}
+	if conf.HoleTTL == 0 {
+		conf.HoleTTL = defaultHoleTTL
+	}
+	if t.adaptiveTTL != nil {
+		adaptive := *t.adaptiveTTL
+		if adaptive.TargetHits == 0 {
+			adaptive.TargetHits = defaultTargetHits
+		}
+		conf.AdaptiveTTL = &adaptive
+	}
+	if o.HTTPCachePolicy != nil {
+		policy := *o.HTTPCachePolicy
+		conf.HTTPCachePolicy = &policy
+	}
+
+	for _, c := range [...]struct {
+		name string
+		set  bool
+	}{
+		{"OnSlowGetter", o.OnSlowGetter != nil},
+		{"Validate", o.Validate != nil},
+		{"KeyString", o.KeyString != nil},
+		{"OnExpire", o.OnExpire != nil},
+		{"OnReplace", o.OnReplace != nil},
+		{"OnCanaryMismatch", o.OnCanaryMismatch != nil},
+		{"URL", o.URL != nil},
+		{"EncodeKey", o.EncodeKey != nil},
+		{"DecodeKey", o.DecodeKey != nil},
+		{"L2", o.L2 != nil},
+		{"HTTPCachePolicyFunc", o.HTTPCachePolicyFunc != nil},
+		{"FillPlaceholder", o.FillPlaceholder != nil},
+		{"Transform", o.Transform != nil},
+	} {
+		if c.set {
+			conf.Callbacks = append(conf.Callbacks, c.name)
+		}
+	}
+	return conf
+}
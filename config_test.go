@@ -0,0 +1,52 @@
+package recache
+
+import (
+	"compress/flate"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestConfig(t *testing.T) {
+	t.Parallel()
+
+	cache := NewCache(CacheOptions{
+		Name:        "pages",
+		MemoryLimit: 1 << 20,
+		LRULimit:    time.Hour,
+	})
+	deleted := cache.NewFrontend(dummyGetter)
+	cache.NewFrontendWithOptions(FrontendOptions{
+		Get:           dummyGetter,
+		Name:          "articles",
+		GetterTimeout: time.Second,
+		Validate: func(Key, RecordMeta) (bool, error) {
+			return true, nil
+		},
+	})
+	deleted.Delete()
+
+	conf := cache.Config()
+	assertEquals(t, conf.ID, cache.id)
+	assertEquals(t, conf.Name, "pages")
+	assertEquals(t, conf.MemoryLimit, 1<<20)
+	assertEquals(t, conf.LRULimit, time.Hour)
+	assertEquals(t, conf.MaxWeakDependents, 1024)
+	assertEquals(t, conf.CompressionLevel, CompressionLevel)
+	assertEquals(t, conf.Frontends, []FrontendConfig{
+		{
+			ID:                         1,
+			Name:                       "articles",
+			GetterTimeout:              time.Second,
+			DowngradedCompressionLevel: flate.BestSpeed,
+			CompressionBudgetCooldown:  time.Minute,
+			HoleTTL:                    10 * time.Second,
+			Callbacks:                  []string{"Validate"},
+		},
+	})
+
+	_, err := json.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
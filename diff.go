@@ -0,0 +1,45 @@
+package recache
+
+// Summary of the changes between a stale record and the regenerated record
+// replacing it. Passed to FrontendOptions.OnReplace.
+type RecordDiff struct {
+	// ETags of the stale and regenerated record. Equal, if the content is
+	// unchanged and the stale record was kept.
+	OldETag, NewETag string
+
+	// Compressed sizes of the stale and regenerated record, not counting any
+	// included records
+	OldSize, NewSize int
+
+	// Amount of components of the stale and regenerated record
+	OldComponents, NewComponents int
+
+	// Indices of components of the regenerated record, that differ from the
+	// component at the same index of the stale record, in order. Components
+	// past the end of the stale record are always included.
+	Changed []int
+}
+
+// Summarize the changes from old to new
+func diffRecords(old, new *Record) RecordDiff {
+	d := RecordDiff{
+		OldETag: old.eTag,
+		NewETag: new.eTag,
+		OldSize: old.memoryUsed,
+		NewSize: new.memoryUsed,
+	}
+	o := &old.data
+	for n := &new.data; n != nil; n = n.next {
+		if o == nil || o.Hash() != n.Hash() {
+			d.Changed = append(d.Changed, d.NewComponents)
+		}
+		if o != nil {
+			o = o.next
+		}
+		d.NewComponents++
+	}
+	for o := &old.data; o != nil; o = o.next {
+		d.OldComponents++
+	}
+	return d
+}
@@ -0,0 +1,74 @@
+package recache
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	// A record not in the cache was requested from a draining cache
+	ErrDraining = errors.New("cache is draining")
+)
+
+// Stop admitting new populations, stop background goroutines of the cache and
+// wait for all in-flight populations to complete or ctx to be done.
+//
+// After Drain() is called, records already in the cache are still served, but
+// retrieving records not in the cache returns ErrDraining. Stale records are
+// served without being regenerated. Populations in progress are allowed to
+// complete, unless they include records not yet in the cache.
+//
+// Safe to call multiple times.
+func (c *Cache) Drain(ctx context.Context) error {
+	c.mu.Lock()
+	c.startDraining()
+	drained := c.drained
+	c.mu.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stop admitting new populations and stop background goroutines of the cache,
+// if not already done. Requires lock on c.mu.
+func (c *Cache) startDraining() {
+	if c.draining {
+		return
+	}
+	c.draining = true
+	c.drained = make(chan struct{})
+	close(c.stop)
+	if len(c.populating) == 0 {
+		close(c.drained)
+	}
+}
+
+// Record the start of the population of rec at loc. Requires lock on c.mu.
+func (c *Cache) beginPopulation(loc recordLocation, rec *Record) {
+	c.populating[rec] = loc
+}
+
+// Record completion of the population of rec
+func (c *Cache) endPopulation(rec *Record) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.populating, rec)
+	if c.draining && len(c.populating) == 0 {
+		close(c.drained)
+	}
+}
+
+// Return, if rec is still being populated as the record or pending replacement
+// record at loc. Requires lock on c.mu.
+func (c *Cache) isPopulating(loc recordLocation, rec *Record) bool {
+	if rec.semaphore.Finished() {
+		return false
+	}
+	r, ok := c.record(loc)
+	return ok && (r.rec == rec || r.pending == rec)
+}
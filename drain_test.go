@@ -0,0 +1,61 @@
+package recache
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	t.Parallel()
+
+	var (
+		started = make(chan struct{})
+		release = make(chan struct{})
+		cache   = NewCache(CacheOptions{})
+		f       = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				if k == "blocking" {
+					close(started)
+					<-release
+				}
+				return dummyGetter(k, rw)
+			},
+		})
+	)
+
+	_, err := f.Get("cached")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := make(chan error)
+	go func() {
+		_, err := f.Get("blocking")
+		res <- err
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assertEquals(t, cache.Drain(ctx), context.DeadlineExceeded)
+
+	_, err = f.Get("new")
+	assertEquals(t, err, ErrDraining)
+
+	f.MarkStale("cached")
+	_, err = f.Get("cached")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	close(release)
+	if err := <-res; err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, cache.Drain(context.Background()), nil)
+	assertEquals(t, cache.Drain(context.Background()), nil)
+
+	assertEquals(t, len(cache.populating), 0)
+	assertConsistency(t, cache)
+}
@@ -0,0 +1,123 @@
+package recache
+
+// Record, that would be evicted by an eviction
+type EvictionCandidate struct {
+	// Location of the record
+	Frontend *Frontend
+	Key      Key
+
+	// Record would only be evicted as a dependent of another evicted record
+	Cascaded bool
+}
+
+// Return all records, that would be evicted together with the records at
+// roots, including records in other caches. Must not be called with any cache
+// lock held.
+//
+// As the caches are locked one record at a time, the result is not an atomic
+// snapshot under concurrent modification.
+func dryRunEviction(roots []intercacheRecordLocation) (
+	candidates []EvictionCandidate,
+) {
+	var (
+		visited = make(map[intercacheRecordLocation]struct{})
+		queue   []intercacheRecordLocation
+	)
+
+	visit := func(loc intercacheRecordLocation, cascaded bool) {
+		if _, ok := visited[loc]; ok {
+			return
+		}
+		visited[loc] = struct{}{}
+
+		c := getCache(loc.cache)
+		if c == nil {
+			return // Closed cache
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		rec, ok := c.record(loc.recordLocation)
+		if !ok {
+			return
+		}
+		candidates = append(candidates, EvictionCandidate{
+			Frontend: c.frontendMeta[loc.frontend].instance,
+			Key:      loc.key,
+			Cascaded: cascaded,
+		})
+		queue = append(queue, rec.includedIn...)
+		for loc := range rec.weakIncludedIn {
+			queue = append(queue, loc)
+		}
+	}
+
+	for _, loc := range roots {
+		visit(loc, false)
+	}
+	for len(queue) != 0 {
+		loc := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		visit(loc, true)
+	}
+	return
+}
+
+// Report records, that Evict() would evict for key k, including records
+// evicted as dependents, without evicting them
+func (f *Frontend) DryRunEvict(k Key) []EvictionCandidate {
+	if f.isDeleted() {
+		return nil
+	}
+	return dryRunEviction([]intercacheRecordLocation{
+		{
+			cache:          f.cache.id,
+			recordLocation: recordLocation{f.id, k},
+		},
+	})
+}
+
+// Report records, that EvictByFunc() would evict with matcher function fn,
+// including records evicted as dependents, without evicting them
+func (f *Frontend) DryRunEvictByFunc(fn func(Key) (bool, error)) (
+	[]EvictionCandidate, error,
+) {
+	if f.isDeleted() {
+		return nil, ErrFrontendDeleted
+	}
+
+	f.cache.mu.Lock()
+	keys := f.cache.keys(f.id)
+	f.cache.mu.Unlock()
+
+	var roots []intercacheRecordLocation
+	for _, k := range keys {
+		evict, err := fn(k)
+		if err != nil {
+			return nil, err
+		}
+		if evict {
+			roots = append(roots, intercacheRecordLocation{
+				cache:          f.cache.id,
+				recordLocation: recordLocation{f.id, k},
+			})
+		}
+	}
+	return dryRunEviction(roots), nil
+}
+
+// Report records, that InvalidateToken() would evict for token, including
+// records evicted as dependents, without evicting them
+func (c *Cache) DryRunInvalidateToken(token string) []EvictionCandidate {
+	c.mu.Lock()
+	roots := make([]intercacheRecordLocation, 0, len(c.tokens[token]))
+	for loc := range c.tokens[token] {
+		roots = append(roots, intercacheRecordLocation{
+			cache:          c.id,
+			recordLocation: loc,
+		})
+	}
+	c.mu.Unlock()
+
+	return dryRunEviction(roots)
+}
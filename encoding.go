@@ -0,0 +1,76 @@
+package recache
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Build the zlib header of the record served as a zlib stream
+func zlibHeader(rec *Record) ([]byte, error) {
+	header := []byte{
+		0: 0x78, // Deflate compression with default window size
+		1: 0,
+	}
+
+	// Writes compression level into first 2 bits of byte 2
+	switch rec.compressionLevel {
+	case -2, 0, 1:
+		header[1] = 0 << 6 // fastest
+	case 2, 3, 4, 5:
+		header[1] = 1 << 6 // fast
+	case 6, -1:
+		header[1] = 2 << 6 // default
+	case 7, 8, 9:
+		header[1] = 3 << 6 // best
+	default:
+		return nil, fmt.Errorf(
+			"unknown compression level: %d",
+			rec.compressionLevel,
+		)
+	}
+
+	// Writes mod-31 checksum into last 5 bytes of header
+	header[1] += uint8(31 - (uint16(header[0])<<8+uint16(header[1]))%31)
+
+	return header, nil
+}
+
+// Build the zlib footer of the record served as a zlib stream: final empty
+// deflate block and Adler32 checksum
+func zlibFooter(rec *Record) []byte {
+	footer := make([]byte, 6)
+	footer[0] = 0x03
+	binary.BigEndian.PutUint32(footer[2:], rec.frame.checksum)
+	return footer
+}
+
+// Build the gzip header of the record served as a gzip stream
+func gzipHeader(rec *Record) []byte {
+	header := []byte{
+		0: 0x1f, 1: 0x8b, // Magic
+		2: 8, // Deflate compression
+		// 3: No flags
+		// 4-7: No modification time
+		9: 255, // Unknown OS
+	}
+
+	// Extra flags hinting the compression level
+	switch rec.compressionLevel {
+	case 1:
+		header[8] = 4 // fastest
+	case 9:
+		header[8] = 2 // best
+	}
+
+	return header
+}
+
+// Build the gzip footer of the record served as a gzip stream: final empty
+// deflate block, CRC32 checksum and uncompressed size
+func gzipFooter(rec *Record) []byte {
+	footer := make([]byte, 10)
+	footer[0] = 0x03
+	binary.LittleEndian.PutUint32(footer[2:], rec.frame.crc32)
+	binary.LittleEndian.PutUint32(footer[6:], rec.frame.size)
+	return footer
+}
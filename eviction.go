@@ -1,37 +1,97 @@
 package recache
 
-import "time"
+import (
+	"runtime"
+	"time"
+)
 
 var (
-	// Schedule and debounce eventual cache eviction of record.
+	// Schedule eventual cache eviction of records.
 	// Buffered to reduce lock contention on scheduling and deadlocks
 	evictAfter = make(chan evictionReq, 1<<10)
 )
 
+// Granularity of scheduled eviction deadlines
+const evictionBucketSize = time.Second
+
+// Memory used before and after an eviction. Scheduled evictions and evictions
+// of dependent records in other caches happen after the eviction call returns
+// and are not reflected.
+type EvictionResult struct {
+	MemoryBefore, MemoryAfter int
+}
+
+// Return the amount of memory reclaimed by the eviction
+func (r EvictionResult) Reclaimed() int {
+	return r.MemoryBefore - r.MemoryAfter
+}
+
+// Request to evict records of a cache at deadline
 type evictionReq struct {
-	loc   intercacheRecordLocation
-	timer time.Duration
+	cache    int
+	locs     []recordLocation
+	deadline time.Time
 }
 
+// Records scheduled for eviction in the same time bucket by cache ID
+type evictionBucket map[int][]recordLocation
+
 func init() {
 	go func() {
-		pending := make(map[intercacheRecordLocation]time.Time)
-		scan := time.Tick(time.Second)
+		// Records are stored in buckets by their deadline truncated to
+		// evictionBucketSize, so that only due buckets need to be scanned and
+		// large amounts of records sharing a deadline can be scheduled with a
+		// single request.
+		//
+		// The actual deadlines are stored on the records themselves and
+		// checked on eviction. This makes cancelling or replacing a scheduled
+		// eviction not require any communication with the scheduler.
+		buckets := make(map[time.Time]evictionBucket)
+		scan := time.Tick(evictionBucketSize)
+
+		add := func(key time.Time, cache int, locs []recordLocation) {
+			b := buckets[key]
+			if b == nil {
+				b = make(evictionBucket)
+				buckets[key] = b
+			}
+			b[cache] = append(b[cache], locs...)
+		}
 
 		for {
 			select {
 			case req := <-evictAfter:
-				existing, ok := pending[req.loc]
-				deadline := time.Now().Add(req.timer)
-				if !ok || deadline.Before(existing) {
-					pending[req.loc] = deadline
+				add(
+					req.deadline.Truncate(evictionBucketSize),
+					req.cache,
+					req.locs,
+				)
+			case now := <-scan:
+				var due []time.Time
+				for key := range buckets {
+					if !key.After(now) {
+						due = append(due, key)
+					}
 				}
-			case <-scan:
-				now := time.Now()
-				for loc, deadline := range pending {
-					if deadline.Before(now) {
-						delete(pending, loc)
-						evict(loc, 0)
+				for _, key := range due {
+					b := buckets[key]
+					delete(buckets, key)
+					for id, locs := range b {
+						c := getCache(id)
+						if c == nil {
+							continue // Closed cache
+						}
+						locs, extended := c.evictScheduled(key, locs, now)
+						if len(locs) != 0 {
+							add(key, id, locs)
+						}
+						for _, req := range extended {
+							add(
+								req.deadline.Truncate(evictionBucketSize),
+								id,
+								req.locs,
+							)
+						}
 					}
 				}
 			}
@@ -41,60 +101,255 @@ func init() {
 
 // Evict record from cache after t
 func evict(loc intercacheRecordLocation, t time.Duration) {
-	getCache(loc.cache).evict(loc.recordLocation, t)
+	if c := getCache(loc.cache); c != nil {
+		c.evict(loc.recordLocation, t)
+	}
 }
 
-// Evict record from cache after t
+// Evict record from cache after t.
+//
+// Unlike evictWithLock(), may periodically release the lock on c.mu during
+// large eviction cascades.
 func (c *Cache) evict(loc recordLocation, t time.Duration) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.evictWithLock(loc, t)
+
+	if t != 0 {
+		c.evictWithLock(loc, t)
+	} else {
+		c.evictCascade([]recordLocation{loc}, true)
+	}
 }
 
 // Evict record from cache after t. Requires lock on c.mu.
 func (c *Cache) evictWithLock(loc recordLocation, t time.Duration) {
+	if t == 0 {
+		c.evictCascade([]recordLocation{loc}, false)
+		return
+	}
+
+	deadline := time.Now().Add(t)
+	if c.setEvictionDeadline(loc, deadline) {
+		c.scheduleEviction(deadline, []recordLocation{loc})
+	}
+}
+
+// Evict records from cache after t. Records sharing the same deadline are
+// scheduled with a single request. Requires lock on c.mu.
+func (c *Cache) evictBatchWithLock(locs []recordLocation, t time.Duration) {
+	if t == 0 {
+		c.evictCascade(locs, false)
+		return
+	}
+
+	deadline := time.Now().Add(t)
+	scheduled := locs[:0]
+	for _, loc := range locs {
+		if c.setEvictionDeadline(loc, deadline) {
+			scheduled = append(scheduled, loc)
+		}
+	}
+	c.scheduleEviction(deadline, scheduled)
+}
+
+// Set the scheduled eviction deadline of a record, unless it already has a
+// sooner one and CacheOptions.DebounceEviction is not set.
+// Returns, if the deadline was set. Requires lock on c.mu.
+func (c *Cache) setEvictionDeadline(
+	loc recordLocation,
+	deadline time.Time,
+) bool {
 	rec, ok := c.record(loc)
 	if !ok {
+		return false
+	}
+	if !rec.evictAt.IsZero() &&
+		!c.debounceEviction &&
+		!deadline.Before(rec.evictAt) {
+		return false
+	}
+	rec.evictAt = deadline
+	c.frontends[loc.frontend][loc.key] = rec
+	return true
+}
+
+// Send records to the eviction scheduler to be evicted at deadline.
+// Requires lock on c.mu.
+func (c *Cache) scheduleEviction(deadline time.Time, locs []recordLocation) {
+	if len(locs) == 0 {
 		return
 	}
-	if t != 0 {
-		evictAfter <- evictionReq{
-			loc: intercacheRecordLocation{
-				cache:          c.id,
-				recordLocation: loc,
-			},
-			timer: t,
+
+	req := evictionReq{
+		cache:    c.id,
+		locs:     locs,
+		deadline: deadline,
+	}
+	select {
+	case evictAfter <- req:
+	default:
+		c.logger.Printf(
+			"eviction scheduler backpressure: blocking on scheduling "+
+				"eviction of key %s and %d other records",
+			c.frontendMeta[locs[0].frontend].instance.KeyString(locs[0].key),
+			len(locs)-1,
+		)
+		evictAfter <- req
+	}
+}
+
+// Evict records from the scheduler bucket with key, whose scheduled eviction
+// deadline has passed. Returns records still due for eviction later in the
+// same bucket and records with an adaptive TTL, whose eviction deadline was
+// extended.
+func (c *Cache) evictScheduled(
+	key time.Time,
+	locs []recordLocation,
+	now time.Time,
+) (remaining []recordLocation, extended []evictionReq) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	due := make([]recordLocation, 0, len(locs))
+	for _, loc := range locs {
+		rec, ok := c.record(loc)
+		switch {
+		case !ok || rec.evictAt.IsZero():
+			// Evicted or cancelled
+		case !rec.evictAt.After(now):
+			opts := c.frontendMeta[loc.frontend].instance.tunables().adaptiveTTL
+			if opts != nil && rec.evictAt.Equal(rec.ttlDeadline) {
+				deadline, ok := c.adaptTTL(loc, rec, now, *opts)
+				if ok {
+					extended = append(extended, evictionReq{
+						cache:    c.id,
+						locs:     []recordLocation{loc},
+						deadline: deadline,
+					})
+					continue
+				}
+			}
+			due = append(due, loc)
+		case rec.evictAt.Truncate(evictionBucketSize).Equal(key):
+			remaining = append(remaining, loc)
 		}
-		return
+		// Otherwise the deadline was replaced and the record was scheduled
+		// in a different bucket
 	}
+	c.evictCascade(due, true)
+	return
+}
+
+// Immediately evict records from cache together with all records depending on
+// them. Requires lock on c.mu.
+//
+// Uses a worklist instead of recursion to support arbitrarily deep dependency
+// chains.
+//
+// yield: allow periodically releasing the lock on c.mu, as configured by
+// CacheOptions.EvictionYieldInterval. The caller must not retain any state
+// read under the lock across this call.
+func (c *Cache) evictCascade(queue []recordLocation, yield bool) {
+	for evicted := 0; len(queue) != 0; {
+		loc := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+
+		rec, ok := c.record(loc)
+		if !ok {
+			continue
+		}
+
+		delete(c.frontends[loc.frontend], loc.key)
+		c.lruList.Remove(rec.node)
+		c.frontendMeta[loc.frontend].evictions++
+		if rec.populated {
+			c.removeRecordSize(loc.frontend, rec.memoryUsed)
+		}
+
+		for _, t := range rec.tokens {
+			deps := c.tokens[t]
+			delete(deps, loc)
+			if len(deps) == 0 {
+				delete(c.tokens, t)
+			}
+		}
+
+		queue = c.appendDependents(queue, rec)
 
-	delete(c.frontends[loc.frontend], loc.key)
-	c.lruList.Remove(rec.node)
-	c.memoryUsed -= rec.memoryUsed
+		evicted++
+		if yield &&
+			c.evictionYieldInterval != 0 &&
+			evicted%c.evictionYieldInterval == 0 &&
+			len(queue) != 0 {
+			// Let other operations on the cache proceed. Any records
+			// recreated at the queued locations in the meantime will also be
+			// evicted, which is safe.
+			c.mu.Unlock()
+			runtime.Gosched()
+			c.mu.Lock()
+		}
+	}
+}
 
-	for _, ch := range rec.includedIn {
-		if ch.cache == c.id {
+// Append locations of all records of this cache including rec to queue and
+// schedule eviction of those in other caches. Requires lock on c.mu.
+func (c *Cache) appendDependents(
+	queue []recordLocation,
+	rec recordWithMeta,
+) []recordLocation {
+	add := func(loc intercacheRecordLocation) {
+		if loc.cache == c.id {
 			// Hot path to reduce lock contention
-			c.evictWithLock(ch.recordLocation, 0)
+			queue = append(queue, loc.recordLocation)
 		} else {
 			// Separate goroutine to prevent lock intersection
-			go evict(ch, 0)
+			go evict(loc, 0)
 		}
 	}
+	for _, loc := range rec.includedIn {
+		add(loc)
+	}
+	for loc := range rec.weakIncludedIn {
+		add(loc)
+	}
+	return queue
+}
+
+// Evict all records including rec. Requires lock on c.mu.
+func (c *Cache) evictDependents(rec recordWithMeta) {
+	c.evictCascade(c.appendDependents(nil, rec), false)
+}
+
+// Evict record including a record of this cache. Requires lock on c.mu.
+func (c *Cache) evictDependent(loc intercacheRecordLocation) {
+	if loc.cache == c.id {
+		c.evictCascade([]recordLocation{loc.recordLocation}, false)
+	} else {
+		go evict(loc, 0)
+	}
 }
 
 // Evict all keys of specific frontend after t
-func (c *Cache) evictFrontend(frontend int, t time.Duration) {
+func (c *Cache) evictFrontend(frontend int, t time.Duration) (
+	res EvictionResult,
+) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+
+	res.MemoryBefore = c.frontendMeta[frontend].memoryUsed
 	c.evictFrontendWithLock(frontend, t)
+	res.MemoryAfter = c.frontendMeta[frontend].memoryUsed
+	return
 }
 
 // Evict all keys of specific frontend after t. Requires lock on c.mu.
 func (c *Cache) evictFrontendWithLock(frontend int, t time.Duration) {
-	for _, k := range c.keys(frontend) {
-		c.evictWithLock(recordLocation{frontend, k}, t)
+	keys := c.keys(frontend)
+	locs := make([]recordLocation, len(keys))
+	for i, k := range keys {
+		locs[i] = recordLocation{frontend, k}
 	}
+	c.evictBatchWithLock(locs, t)
 }
 
 // Evict keys from frontend using matcher function fn after t.
@@ -109,9 +364,14 @@ func (c *Cache) evictByFunc(
 	defer c.mu.Unlock()
 
 	var (
-		b     = c.frontends[frontend]
-		evict bool
+		b         = c.frontends[frontend]
+		evict     bool
+		scheduled []recordLocation
 	)
+	defer func() {
+		c.evictBatchWithLock(scheduled, t)
+	}()
+
 	for _, k := range c.keys(frontend) {
 		// Check, if key not already evicted by recursive eviction, to reduce
 		// potentially expensive matcher function calls
@@ -123,8 +383,14 @@ func (c *Cache) evictByFunc(
 		if err != nil {
 			return
 		}
-		if evict {
-			c.evictWithLock(recordLocation{frontend, k}, t)
+		if !evict {
+			continue
+		}
+		loc := recordLocation{frontend, k}
+		if t == 0 {
+			c.evictWithLock(loc, 0)
+		} else {
+			scheduled = append(scheduled, loc)
 		}
 	}
 
@@ -141,17 +407,38 @@ func (c *Cache) evictByFunc(
 //
 // Any subsequent scheduled eviction calls on matching records with a greater t
 // value than is currently left from a previous scheduled eviction on the
-// record will have no effect.
+// record will have no effect, unless CacheOptions.DebounceEviction is set.
 //
 // A scheduled eviction with a smaller timer than currently left on the record
 // will replace the existing timer.
-func (c *Cache) EvictAll(t time.Duration) {
+//
+// Returns the memory used by the cache before and after the eviction.
+func (c *Cache) EvictAll(t time.Duration) (res EvictionResult) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	res.MemoryBefore = c.memoryUsed
 	for i := range c.frontends {
 		c.evictFrontendWithLock(i, t)
 	}
+	res.MemoryAfter = c.memoryUsed
+	return
+}
+
+// Evict all records, that registered a dependency on token using
+// RecordWriter.DependOn(), from the cache immediately
+func (c *Cache) InvalidateToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	deps := c.tokens[token]
+	locs := make([]recordLocation, 0, len(deps))
+	for loc := range deps {
+		locs = append(locs, loc)
+	}
+	for _, loc := range locs {
+		c.evictWithLock(loc, 0)
+	}
 }
 
 // Evict a record by key after t amount of time, if the matched are still in
@@ -164,12 +451,75 @@ func (c *Cache) EvictAll(t time.Duration) {
 //
 // Any subsequent scheduled eviction calls on matching records with a greater t
 // value than is currently left from a previous scheduled eviction on the
-// record will have no effect.
+// record will have no effect, unless CacheOptions.DebounceEviction is set.
 //
 // A scheduled eviction with a smaller timer than currently left on the record
 // will replace the existing timer.
+//
+// With CacheOptions.InvalidationBus set, the eviction is also broadcast to
+// other cache instances.
 func (f *Frontend) Evict(t time.Duration, k Key) {
+	if f.isDeleted() {
+		return
+	}
 	f.cache.evict(recordLocation{f.id, k}, t)
+	f.publishEviction(k, t)
+}
+
+// Cancel any pending scheduled eviction of a record by key.
+//
+// Has no effect on records not scheduled for eviction or on evictions with
+// t = 0.
+func (f *Frontend) CancelEviction(k Key) {
+	if f.isDeleted() {
+		return
+	}
+	f.cache.cancelEviction(recordLocation{f.id, k})
+}
+
+// Cancel any pending scheduled eviction of record
+func (c *Cache) cancelEviction(loc recordLocation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if rec, ok := c.record(loc); ok {
+		rec.evictAt = time.Time{}
+		c.frontends[loc.frontend][loc.key] = rec
+	}
+}
+
+// Return time of the earliest scheduled or LRU limit eviction of record.
+// ok=false, if record is not in the cache or has no eviction deadline.
+func (c *Cache) expiresAt(loc recordLocation) (t time.Time, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rec, ok := c.record(loc)
+	if !ok {
+		return
+	}
+	t = rec.evictAt
+	if c.lruLimit != 0 {
+		lru := rec.lastUsed.Add(c.lruLimit)
+		if t.IsZero() || lru.Before(t) {
+			t = lru
+		}
+	}
+	return t, !t.IsZero()
+}
+
+// Return the time a record is due to be evicted, either by a pending scheduled
+// eviction or by exceeding CacheOptions.LRULimit, whichever is sooner.
+//
+// Returns false, if the record is not in the cache or is not due for eviction.
+//
+// Note that LRU eviction is eventual and the record might remain in the cache
+// for some time past the returned deadline.
+func (f *Frontend) ExpiresAt(k Key) (time.Time, bool) {
+	if f.isDeleted() {
+		return time.Time{}, false
+	}
+	return f.cache.expiresAt(recordLocation{f.id, k})
 }
 
 // Evict all records from frontend after t amount of time, if the matched are
@@ -182,12 +532,18 @@ func (f *Frontend) Evict(t time.Duration, k Key) {
 //
 // Any subsequent scheduled eviction calls on matching records with a greater t
 // value than is currently left from a previous scheduled eviction on the
-// record will have no effect.
+// record will have no effect, unless CacheOptions.DebounceEviction is set.
 //
 // A scheduled eviction with a smaller timer than currently left on the record
 // will replace the existing timer.
-func (f *Frontend) EvictAll(t time.Duration) {
-	f.cache.evictFrontend(f.id, t)
+//
+// Returns the memory used by records of the frontend before and after the
+// eviction.
+func (f *Frontend) EvictAll(t time.Duration) EvictionResult {
+	if f.isDeleted() {
+		return EvictionResult{}
+	}
+	return f.cache.evictFrontend(f.id, t)
 }
 
 // Evict records from frontend using matcher function fn after t amount of time,
@@ -200,11 +556,14 @@ func (f *Frontend) EvictAll(t time.Duration) {
 //
 // Any subsequent scheduled eviction calls on matching records with a greater t
 // value than is currently left from a previous scheduled eviction on the
-// record will have no effect.
+// record will have no effect, unless CacheOptions.DebounceEviction is set.
 //
 // A scheduled eviction with a smaller timer than currently left on the record
 // will replace the existing timer.
 func (f *Frontend) EvictByFunc(t time.Duration, fn func(Key) (bool, error),
 ) error {
+	if f.isDeleted() {
+		return ErrFrontendDeleted
+	}
 	return f.cache.evictByFunc(f.id, t, fn)
 }
@@ -1,6 +1,7 @@
 package recache
 
 import (
+	"fmt"
 	"sync"
 	"testing"
 	"time"
@@ -197,3 +198,666 @@ func TestEviction(t *testing.T) {
 		})
 	}
 }
+
+func TestCancelEviction(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache = NewCache(CacheOptions{})
+		f     = cache.NewFrontend(dummyGetter)
+	)
+
+	for _, k := range [...]string{"cancelled", "evicted"} {
+		_, err := f.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Evict(time.Millisecond*10, k)
+	}
+	f.CancelEviction("cancelled")
+
+	// Wait for scheduler scan
+	time.Sleep(time.Second * 2)
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if _, ok := cache.frontends[0]["cancelled"]; !ok {
+		t.Fatal("key evicted")
+	}
+	if _, ok := cache.frontends[0]["evicted"]; ok {
+		t.Fatal("key not evicted")
+	}
+}
+
+func TestScheduledBatchEviction(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache = NewCache(CacheOptions{})
+		f     = cache.NewFrontend(dummyGetter)
+	)
+
+	for i := 0; i < 1000; i++ {
+		_, err := f.Get(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.CancelEviction(0)
+	f.EvictAll(time.Millisecond * 10)
+	f.CancelEviction(1)
+	err := f.EvictByFunc(time.Hour, func(k Key) (bool, error) {
+		return k.(int) == 2, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for scheduler scan
+	time.Sleep(time.Second * 2)
+
+	cache.mu.Lock()
+	_, ok := cache.frontends[0][1]
+	remaining := len(cache.frontends[0])
+	cache.mu.Unlock()
+
+	if !ok {
+		t.Fatal("key evicted")
+	}
+	assertEquals(t, remaining, 1)
+	assertConsistency(t, cache)
+}
+
+func TestDebounceEviction(t *testing.T) {
+	t.Parallel()
+
+	cases := [...]struct {
+		name     string
+		debounce bool
+	}{
+		{"default", false},
+		{"debounced", true},
+	}
+
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			var (
+				cache = NewCache(CacheOptions{
+					DebounceEviction: c.debounce,
+				})
+				f = cache.NewFrontend(dummyGetter)
+			)
+
+			const key = "key1"
+			_, err := f.Get(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Evict(time.Millisecond*10, key)
+			f.Evict(time.Hour, key)
+
+			// Wait for scheduler scan
+			time.Sleep(time.Second * 2)
+
+			cache.mu.Lock()
+			defer cache.mu.Unlock()
+
+			_, ok := cache.frontends[0][key]
+			assertEquals(t, ok, c.debounce)
+		})
+	}
+}
+
+func TestExpiresAt(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache = NewCache(CacheOptions{
+			LRULimit: time.Hour,
+		})
+		f = cache.NewFrontend(dummyGetter)
+	)
+
+	const key = "key1"
+
+	_, ok := f.ExpiresAt(key)
+	if ok {
+		t.Fatal("missing record has expiry")
+	}
+
+	start := time.Now()
+	_, err := f.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertWithin := func(t *testing.T, min, max time.Duration) {
+		t.Helper()
+
+		exp, ok := f.ExpiresAt(key)
+		if !ok {
+			t.Fatal("no expiry")
+		}
+		if d := exp.Sub(start); d < min || d > max {
+			t.Fatalf("unexpected expiry in %s", d)
+		}
+	}
+
+	t.Run("LRU limit", func(t *testing.T) {
+		assertWithin(t, time.Hour, time.Hour+time.Second)
+	})
+
+	t.Run("scheduled", func(t *testing.T) {
+		f.Evict(time.Minute, key)
+		assertWithin(t, time.Minute, time.Minute+time.Second)
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		f.CancelEviction(key)
+		assertWithin(t, time.Hour, time.Hour+time.Second)
+	})
+}
+
+func TestInvalidateToken(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache = NewCache(CacheOptions{})
+		f     = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				switch k.(string) {
+				case "users", "both":
+					rw.DependOn("users")
+				}
+				switch k.(string) {
+				case "posts", "both":
+					rw.DependOn("posts")
+				}
+				return dummyGetter(k, rw)
+			},
+		})
+	)
+
+	keys := [...]string{"users", "posts", "both", "none"}
+	for _, k := range keys {
+		_, err := f.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache.InvalidateToken("users")
+	assertConsistency(t, cache)
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	for _, k := range keys {
+		_, ok := cache.frontends[0][k]
+		assertEquals(t, ok, k == "posts" || k == "none")
+	}
+	assertEquals(t, cache.tokens, map[string]map[recordLocation]struct{}{
+		"posts": {
+			{0, "posts"}: {},
+		},
+	})
+}
+
+func TestWeakDependents(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache = NewCache(CacheOptions{
+			MaxWeakDependents: 4,
+		})
+		config = cache.NewFrontend(dummyGetter)
+		pages  = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				return rw.Include(config, nil)
+			},
+			WeakDependent: true,
+		})
+	)
+
+	assertWeakDependents := func(t *testing.T, n int) {
+		t.Helper()
+
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+
+		rec, ok := cache.record(recordLocation{config.id, nil})
+		if !ok {
+			t.Fatal("included record evicted")
+		}
+		assertEquals(t, len(rec.includedIn), 0)
+		assertEquals(t, len(rec.weakIncludedIn), n)
+	}
+
+	get := func(t *testing.T, k int) {
+		t.Helper()
+
+		_, err := pages.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Deduplicated
+	for i := 0; i < 2; i++ {
+		for k := 0; k < 4; k++ {
+			get(t, k)
+		}
+	}
+	assertWeakDependents(t, 4)
+
+	// Evicted parents pruned
+	pages.Evict(0, 0)
+	pages.Evict(0, 1)
+	get(t, 4)
+	assertWeakDependents(t, 3)
+
+	// Live parents evicted early
+	get(t, 5)
+	get(t, 6)
+	assertWeakDependents(t, 4)
+	assertEquals(t, len(cache.frontends[pages.id]), 4)
+	assertConsistency(t, cache)
+
+	// Weak dependents still evicted on eviction of included record
+	config.Evict(0, nil)
+	assertEquals(t, len(cache.frontends[pages.id]), 0)
+	assertConsistency(t, cache)
+}
+
+// Measure the cost of evictions cascading through dependent records
+func BenchmarkEvictionCascade(b *testing.B) {
+	// Populate records in the cache before each eviction
+	run := func(b *testing.B, populate func(), evict func()) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			populate()
+			b.StartTimer()
+			evict()
+		}
+	}
+
+	for _, n := range [...]int{10, 100, 1000, 10000} {
+		n := n
+
+		// Single record included by n parents
+		for _, weak := range [...]bool{false, true} {
+			name := fmt.Sprintf("fan-out/parents=%d", n)
+			if weak {
+				name += "/weak"
+			}
+			b.Run(name, func(b *testing.B) {
+				var (
+					cache = NewCache(CacheOptions{
+						MaxWeakDependents: uint(n),
+					})
+					child = cache.NewFrontendWithOptions(FrontendOptions{
+						Get: dummyGetter,
+					})
+					parents = cache.NewFrontendWithOptions(FrontendOptions{
+						Get: func(k Key, rw *RecordWriter) error {
+							return rw.Include(child, nil)
+						},
+						WeakDependent: weak,
+					})
+				)
+				run(
+					b,
+					func() {
+						for i := 0; i < n; i++ {
+							_, err := parents.Get(i)
+							if err != nil {
+								b.Fatal(err)
+							}
+						}
+					},
+					func() {
+						child.Evict(0, nil)
+					},
+				)
+			})
+		}
+
+		// Chain of n records, each including the previous one
+		b.Run(fmt.Sprintf("depth=%d", n), func(b *testing.B) {
+			var (
+				cache = NewCache(CacheOptions{})
+				f     *Frontend
+			)
+			f = cache.NewFrontendWithOptions(FrontendOptions{
+				Get: func(k Key, rw *RecordWriter) error {
+					if k.(int) == 0 {
+						return dummyGetter(k, rw)
+					}
+					return rw.Include(f, k.(int)-1)
+				},
+			})
+			run(
+				b,
+				func() {
+					_, err := f.Get(n - 1)
+					if err != nil {
+						b.Fatal(err)
+					}
+				},
+				func() {
+					f.Evict(0, 0)
+				},
+			)
+		})
+	}
+}
+
+func TestEvictionCascade(t *testing.T) {
+	t.Parallel()
+
+	cases := [...]struct {
+		name          string
+		yieldInterval uint
+	}{
+		{"no yielding", 0},
+		{"yielding", 3},
+	}
+
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			var (
+				cache = NewCache(CacheOptions{
+					EvictionYieldInterval: c.yieldInterval,
+				})
+				f *Frontend
+			)
+			f = cache.NewFrontendWithOptions(FrontendOptions{
+				Get: func(k Key, rw *RecordWriter) error {
+					// Deep chain of records. Negative keys create an
+					// additional parent for a record in the chain.
+					i := k.(int)
+					switch {
+					case i == 0:
+						return dummyGetter(k, rw)
+					case i < 0:
+						return rw.Include(f, -i)
+					default:
+						return rw.Include(f, i-1)
+					}
+				},
+			})
+
+			var wg sync.WaitGroup
+			wg.Add(2)
+			for _, k := range [...]int{1000, -990} {
+				go func(k int) {
+					defer wg.Done()
+					_, err := f.Get(k)
+					if err != nil {
+						t.Error(err)
+					}
+				}(k)
+			}
+			wg.Wait()
+
+			// Concurrent operations on the cache during eviction
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					f.Touch(i)
+				}
+			}()
+			f.Evict(0, 0)
+			wg.Wait()
+
+			assertEquals(t, len(cache.frontends[0]), 0)
+			assertConsistency(t, cache)
+		})
+	}
+}
+
+func TestOnExpire(t *testing.T) {
+	t.Parallel()
+
+	type expiry struct {
+		key    Key
+		reason ExpiryReason
+	}
+
+	cases := [...]struct {
+		name   string
+		opts   CacheOptions
+		reason ExpiryReason
+	}{
+		{
+			name:   "LRU limit",
+			opts:   CacheOptions{LRULimit: time.Millisecond},
+			reason: ExpiredLRULimit,
+		},
+		{
+			name:   "memory limit",
+			opts:   CacheOptions{MemoryLimit: 1},
+			reason: ExpiredMemoryLimit,
+		},
+	}
+
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			var (
+				mu      sync.Mutex
+				expired []expiry
+				cache   = NewCache(c.opts)
+				f       = cache.NewFrontendWithOptions(FrontendOptions{
+					Get: dummyGetter,
+					OnExpire: func(k Key, reason ExpiryReason) {
+						mu.Lock()
+						defer mu.Unlock()
+						expired = append(expired, expiry{k, reason})
+					},
+				})
+			)
+
+			get := func(k Key) {
+				t.Helper()
+				_, err := f.Get(k)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			get("explicit")
+			f.Evict(0, "explicit")
+
+			get("expired")
+			time.Sleep(5 * time.Millisecond)
+			get("new")
+
+			mu.Lock()
+			defer mu.Unlock()
+			assertEquals(t, expired, []expiry{{"expired", c.reason}})
+
+			s := f.Stats()
+			assertEquals(t, s.Expirations, uint64(1))
+			assertEquals(t, s.Evictions, uint64(2))
+		})
+	}
+}
+
+func TestExpiryReasonString(t *testing.T) {
+	t.Parallel()
+
+	assertEquals(t, ExpiredLRULimit.String(), "LRU limit")
+	assertEquals(t, ExpiredMemoryLimit.String(), "memory limit")
+	assertEquals(t, ExpiryReason(9).String(), "ExpiryReason(9)")
+}
+
+func TestDryRunEviction(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache  = NewCache(CacheOptions{})
+		cache2 = NewCache(CacheOptions{})
+		f      *Frontend
+		f2     = cache2.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				rw.DependOn("tok")
+				return rw.Include(f, k)
+			},
+		})
+	)
+	f = cache.NewFrontendWithOptions(FrontendOptions{
+		Get: func(k Key, rw *RecordWriter) error {
+			i := k.(int)
+			if i == 0 {
+				return dummyGetter(k, rw)
+			}
+			return rw.Include(f, i-1)
+		},
+	})
+
+	_, err := f2.Get(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Get(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := func(cands []EvictionCandidate) (own, cascaded, cross int) {
+		for _, c := range cands {
+			if c.Frontend == f2 {
+				cross++
+			}
+			if c.Cascaded {
+				cascaded++
+			} else {
+				own++
+			}
+		}
+		return
+	}
+
+	own, cascaded, cross := count(f.DryRunEvict(3))
+	assertEquals(t, own, 1)
+	assertEquals(t, cascaded, 2)
+	assertEquals(t, cross, 0)
+
+	own, cascaded, cross = count(f.DryRunEvict(1))
+	assertEquals(t, own, 1)
+	assertEquals(t, cascaded, 5)
+	assertEquals(t, cross, 1)
+
+	cands, err := f.DryRunEvictByFunc(func(k Key) (bool, error) {
+		return k.(int) >= 4, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	own, cascaded, cross = count(cands)
+	assertEquals(t, own, 2)
+	assertEquals(t, cascaded, 0)
+	assertEquals(t, cross, 0)
+
+	own, cascaded, cross = count(cache2.DryRunInvalidateToken("tok"))
+	assertEquals(t, own, 1)
+	assertEquals(t, cascaded, 0)
+	assertEquals(t, cross, 1)
+
+	// Nothing must have been evicted
+	assertEquals(t, len(cache.frontends[0]), 6)
+	assertEquals(t, len(cache2.frontends[0]), 1)
+	assertConsistency(t, cache)
+	assertConsistency(t, cache2)
+}
+
+func TestSetTTL(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache = NewCache(CacheOptions{})
+		f     = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				if k.(int) != 0 {
+					rw.SetTTL(time.Duration(k.(int)) * time.Second)
+				}
+				return dummyGetter(k, rw)
+			},
+		})
+	)
+
+	for _, k := range [...]int{0, 1, 3600} {
+		_, err := f.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, ok := f.ExpiresAt(0)
+	assertEquals(t, ok, false)
+	exp, ok := f.ExpiresAt(3600)
+	assertEquals(t, ok, true)
+	if d := time.Until(exp); d < 59*time.Minute || d > time.Hour {
+		t.Fatalf("unexpected expiry in %s", d)
+	}
+
+	contains := func(k int) bool {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		_, ok := cache.frontends[0][k]
+		return ok
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); contains(1); {
+		if time.Now().After(deadline) {
+			t.Fatal("record not evicted after TTL")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertEquals(t, contains(0), true)
+	assertEquals(t, contains(3600), true)
+	assertConsistency(t, cache)
+}
+
+func TestSetTTLRegenerated(t *testing.T) {
+	t.Parallel()
+
+	f := NewCache(CacheOptions{}).NewFrontendWithOptions(FrontendOptions{
+		Get: func(k Key, rw *RecordWriter) error {
+			rw.SetTTL(time.Hour)
+			return dummyGetter(k, rw)
+		},
+	})
+
+	_, err := f.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, ok := f.ExpiresAt(1)
+	assertEquals(t, ok, true)
+
+	// The regenerated record must get a fresh TTL instead of the deadline of
+	// the stale one
+	time.Sleep(10 * time.Millisecond)
+	assertEquals(t, f.MarkStale(1), true)
+	_, err = f.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp, ok := f.ExpiresAt(1)
+	assertEquals(t, ok, true)
+	if !exp.After(first) {
+		t.Fatalf("deadline not reset: %s <= %s", exp, first)
+	}
+}
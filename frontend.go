@@ -1,20 +1,55 @@
 package recache
 
 import (
+	"compress/flate"
+	"context"
 	"crypto/sha1"
 	"encoding/base64"
-	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/adler32"
 	"io"
 	"net/http"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/andybalholm/brotli"
 )
 
 var (
 	// Indicates no components have been written and no error has been returned
 	// in a call to Getter. This is not allowed.
 	ErrEmptyRecord = errors.New("empty record created")
+
+	// Getter panicked during record population. The panic is recovered,
+	// logged and returned wrapped in this error to all readers of the record.
+	ErrGetterPanic = errors.New("getter panicked")
+
+	// A record was requested from within its own population on the same
+	// goroutine, either directly or through a cycle of included records.
+	// Waiting for such a population to complete would deadlock.
+	ErrReentrantGet = errors.New("reentrant record retrieval")
+
+	// A record was requested from a frontend deleted with Frontend.Delete()
+	ErrFrontendDeleted = errors.New("frontend deleted")
+
+	// Creating a frontend would exceed CacheOptions.MaxFrontends
+	ErrTooManyFrontends = errors.New("too many frontends")
+
+	// Appending to a record frozen with Frontend.Freeze()
+	ErrRecordFrozen = errors.New("record frozen")
+
+	// Decompressed content of a record does not match its stored Adler32
+	// checksum or uncompressed size
+	ErrChecksumMismatch = errors.New("record checksum mismatch")
+
+	// Population of a record being waited on exceeded
+	// FrontendOptions.PopulationTimeout
+	ErrPopulationTimeout = errors.New("population timeout exceeded")
 )
 
 // Value used to store entries in the cache. Must be a type suitable for being a
@@ -25,21 +60,389 @@ type Key interface{}
 // Getter must be thread-safe.
 type Getter func(Key, *RecordWriter) error
 
+// Options for new frontend creation
+type FrontendOptions struct {
+	// Generates fresh cache records for the given key. Required.
+	Get Getter
+
+	// Record populations taking longer than this will be reported to
+	// OnSlowGetter.
+	//
+	// Zero value disables reporting.
+	SlowGetterThreshold time.Duration
+
+	// Maximum duration of a population of a record of this frontend. The
+	// context returned by RecordWriter.Context() is cancelled after it
+	// elapses and the population fails with a *TimeoutError, if Getter
+	// returns an error. Records included or bound during population share the
+	// same deadline.
+	//
+	// Zero value disables the timeout.
+	GetterTimeout time.Duration
+
+	// Maximum duration of retrieving each record included or bound during
+	// population of a record of this frontend, bounded by any remaining
+	// GetterTimeout. Keeps one slow included record from consuming the entire
+	// time budget of the population. The included record's retrieval fails
+	// with a *TimeoutError wrapped in an *IncludeError, once exceeded.
+	//
+	// Zero value disables the timeout.
+	IncludeTimeout time.Duration
+
+	// Maximum duration concurrent readers wait on the population of a record
+	// of this frontend, measured from the start of the population. Unlike
+	// GetterTimeout, also applies to Getters that ignore the cancellation of
+	// RecordWriter.Context() and hang. Once exceeded, the waiting readers
+	// fail with ErrPopulationTimeout and the record being populated is
+	// evicted, so that the next retrieval starts a new population. The
+	// result of the timed out population is discarded.
+	//
+	// Zero value disables the timeout.
+	PopulationTimeout time.Duration
+
+	// Called with the key, duration of population and memory used by the
+	// resulting record, when a population exceeds SlowGetterThreshold.
+	// Must be thread-safe.
+	//
+	// Defaults to writing a warning to the Logger of the Cache.
+	OnSlowGetter func(k Key, dur time.Duration, size int)
+
+	// Optional callback for checking cached records are still valid, like
+	// comparing the record's creation time to the modification time of the
+	// upstream data. Consulted on each cache hit, unless limited with
+	// ValidateInterval. Must be thread-safe.
+	//
+	// Returning false causes the record to be regenerated. Any concurrent
+	// readers during regeneration will still be served the invalid record,
+	// same as with Frontend.MarkStale().
+	//
+	// An error is returned to the caller as is.
+	Validate func(Key, RecordMeta) (bool, error)
+
+	// Minimum amount of time between Validate calls for the same record
+	ValidateInterval time.Duration
+
+	// Produces stable human-readable names of keys for logging and debugging
+	// output. Useful for non-string keys. Must be thread-safe.
+	//
+	// Defaults to formatting keys with fmt.Sprintf("%#v", k).
+	KeyString func(Key) string
+
+	// Register records of this frontend as weak dependents of any records
+	// they include or bind to. Weak dependents are stored deduplicated and
+	// bounded by CacheOptions.MaxWeakDependents of the included record's
+	// cache.
+	//
+	// Useful for frontends with a large amount of records all including the
+	// same few records, like pages including a site-wide configuration.
+	WeakDependent bool
+
+	// Called with the key of a record, when the record is evicted because of
+	// the LRU or memory limits of the cache, but not on explicit evictions or
+	// evictions propagated from included records. Must be thread-safe.
+	OnExpire func(Key, ExpiryReason)
+
+	// Called with the key of a stale record and a summary of the changes,
+	// when the record is replaced by a regenerated one, like after
+	// MarkStale(), Rebuild() or Append(). Useful for tuning the granularity
+	// of included records. Called before the regenerated record is served,
+	// so must return quickly. Must be thread-safe.
+	OnReplace func(Key, RecordDiff)
+
+	// Fraction of cache hits in range [0, 1], that additionally regenerate
+	// the record in the background with Get and compare it to the cached
+	// record without replacing it. Detects missing evictions causing stale
+	// data to be served. Records with holes are not checked.
+	//
+	// Regeneration is deterministic only, if Get writes the same data in the
+	// same order for the same upstream state. Records modified with Append()
+	// or Rebuild() are likely to differ from regenerated ones.
+	//
+	// Counted in FrontendStats.CanaryChecks and
+	// FrontendStats.CanaryMismatches.
+	CanaryRate float64
+
+	// Maximum amount of canary populations sampled with CanaryRate running
+	// concurrently. Only one canary population runs per key at a time.
+	// Samples exceeding either limit are skipped.
+	//
+	// Defaults to 4.
+	MaxConcurrentCanaries uint
+
+	// Called with the key of a cached record and the differences of a record
+	// regenerated with CanaryRate from it, when their content differs. Must
+	// be thread-safe.
+	//
+	// Defaults to logging the mismatch to the Logger of the cache.
+	OnCanaryMismatch func(Key, RecordDiff)
+
+	// Name of header to write the comma-separated ETags of records directly
+	// included in the served record to in WriteHTTP(), in order of
+	// inclusion. Enables edge-side include style revalidation of composed
+	// records. The ETag of a record is already derived deterministically from
+	// the ETags of included records and its own data.
+	//
+	// Zero value disables the header.
+	IncludedETagsHeader string
+
+	// Returns the URL a record of this frontend is served at. Required for
+	// records of this frontend to be included as edge includes.
+	URL func(Key) string
+
+	// Emit edge include tags referencing the URLs of included records,
+	// instead of embedding their data, when including records from frontends
+	// with URL set. This lets CDNs supporting edge includes compose records
+	// of this frontend at the edge, while recache caches the included
+	// records.
+	//
+	// No dependency on records included as edge includes is registered, as
+	// their data is not part of the including record.
+	EdgeIncludes EdgeIncludeSyntax
+
+	// Serve stale records immediately and regenerate them in a background
+	// goroutine, instead of blocking the retrieval triggering regeneration.
+	// The regenerated record replaces the stale one, once populated. Removes
+	// latency spikes on hot keys during regeneration.
+	//
+	// Applies to records marked stale with MarkStale(), failing Validate or
+	// past a TTL set with RecordWriter.SetTTL(). Records past their TTL are
+	// kept until regenerated instead of being evicted.
+	StaleWhileRevalidate bool
+
+	// Verify the Adler32 checksum and uncompressed size of records
+	// decompressed by WriteHTTP() for clients not supporting deflate
+	// compression. On mismatch, the error is logged and WriteHTTP() returns
+	// an error wrapping ErrChecksumMismatch. As the response is streamed, any
+	// data already written to the client can not be retracted.
+	VerifyChecksums bool
+
+	// Serve records with "Content-Encoding: br" to clients supporting brotli
+	// compression in WriteHTTP(). Brotli gives better compression ratios
+	// than deflate, but brotli streams can not be concatenated from the
+	// stored deflate frames, so the record is decompressed and recompressed
+	// on every such response. Single byte ranges are not served for brotli
+	// responses.
+	Brotli bool
+
+	// Population duration, above which records of this frontend are
+	// compressed with DowngradedCompressionLevel instead of the global
+	// CompressionLevel for CompressionBudgetCooldown after the slow
+	// population. Reduces tail latency of populations during traffic spikes.
+	//
+	// Zero value disables downgrading.
+	CompressionBudget time.Duration
+
+	// Compression level to use, while the compression level is downgraded.
+	//
+	// Zero value defaults to flate.BestSpeed.
+	DowngradedCompressionLevel int
+
+	// Duration to keep the compression level downgraded for after the last
+	// population exceeding CompressionBudget.
+	//
+	// Zero value defaults to 1 minute.
+	CompressionBudgetCooldown time.Duration
+
+	// Time to live of records with holes written by
+	// RecordWriter.IncludeOrFallback(). Applies, if shorter than any TTL set
+	// with RecordWriter.SetTTL(). Lets records recover from transient
+	// failures of included records.
+	//
+	// Zero value defaults to 10 seconds.
+	HoleTTL time.Duration
+
+	// Adapt the TTL of records set with RecordWriter.SetTTL() to their access
+	// frequency. Extends the TTL of frequently retrieved records to improve
+	// the hit rate and shortens it for rarely retrieved ones to improve their
+	// freshness. The TTL is recomputed from the access frequency each time
+	// it is reached, within the bounds set in the options. Records with holes
+	// and frontends with StaleWhileRevalidate set are not affected.
+	//
+	// The effective TTL is exposed in RecordMeta.TTL.
+	AdaptiveTTL *AdaptiveTTLOptions
+
+	// "Cache-Control" and "Expires" headers to write with responses of
+	// WriteHTTP() and ServeContent(), unless "Cache-Control" is already set
+	// on the response.
+	HTTPCachePolicy *HTTPCachePolicy
+
+	// Compute the HTTP caching policy of each response from the key and
+	// metadata of the served record. Overrides HTTPCachePolicy. Must be
+	// thread-safe.
+	HTTPCachePolicyFunc func(Key, RecordMeta) HTTPCachePolicy
+
+	// Fill the placeholders written with RecordWriter.Placeholder() into the
+	// record by key k, or records included in it, for the request r on
+	// serving with WriteHTTP() and ServeContent(). Allows caching pages with
+	// parts varying by request, like the name of the logged in user,
+	// without per-user keys. The ETag of the response is derived from the
+	// hashes of the record and all fills. See Fill for per-placeholder
+	// caching policies. Must be thread-safe.
+	//
+	// Placeholders are served empty, if not set or when serving records by
+	// other means.
+	FillPlaceholder func(r *http.Request, k Key, name string) (Fill, error)
+
+	// Transform the decompressed content of records served with WriteHTTP()
+	// per request, like injecting a CSRF token into cached HTML, so per-user
+	// dynamic parts do not require per-user keys. The returned writer must
+	// write the transformed content to w and is closed after the content is
+	// written. Returning nil serves the record untransformed. Must be
+	// thread-safe.
+	//
+	// Transformed responses are not compressed and have no ETag, as their
+	// content varies per request. Range and conditional requests are not
+	// supported for them. See ReplaceTransform() for a streaming
+	// placeholder replacement.
+	Transform Transform
+
+	// Human-readable name of the frontend for debugging and configuration
+	// export. Also used to match frontends on restoring snapshots with
+	// Cache.Restore().
+	Name string
+
+	// Encode and decode keys of records of this frontend for Cache.Snapshot()
+	// and Cache.Restore(). Must be thread-safe.
+	//
+	// Default to encoding/gob, which requires key types other than builtin
+	// ones to be registered with gob.Register().
+	EncodeKey func(Key) ([]byte, error)
+	DecodeKey func([]byte) (Key, error)
+
+	// Second-level cache to check for records missing from the cache before
+	// populating them with Get. Freshly populated records are written to L2
+	// in the background. Errors of L2 are logged and otherwise ignored.
+	//
+	// Records are stored in L2 with any included records flattened into
+	// them and with keys encoded with EncodeKey. Records read from L2 have
+	// the same ETag as the stored ones, but do not depend on any other
+	// records, so evicting records they included does not evict them.
+	// Records read from L2 expire at the same time as the stored ones, when
+	// their TTL was set with RecordWriter.SetTTL(), so the clocks of all
+	// instances sharing L2 should be synchronized.
+	// Stale records are always regenerated with Get. Records read from L2
+	// are verified against their checksums and discarded on mismatch. With
+	// CacheOptions.SigningKey set, records are also signed with the key and
+	// records read from L2 without a valid signature are discarded.
+	L2 L2
+
+	// Prefix of the keys of records of this frontend in L2. Must be unique
+	// for each frontend sharing the same L2.
+	L2Prefix string
+
+	// Time to live of records in L2. Records with a shorter TTL set with
+	// RecordWriter.SetTTL() are stored with their TTL instead.
+	//
+	// Zero value stores records without expiry.
+	L2TTL time.Duration
+}
+
+// Defaults of unset FrontendOptions
+const (
+	defaultCompressionBudgetCooldown = time.Minute
+	defaultHoleTTL                   = 10 * time.Second
+	defaultMaxConcurrentCanaries     = 4
+)
+
+// Syntax of edge include tags emitted by RecordWriter.Include()
+type EdgeIncludeSyntax uint8
+
+const (
+	// Embed the data of included records. The default.
+	NoEdgeIncludes EdgeIncludeSyntax = iota
+
+	// Edge Side Includes: <esi:include src="url"/>
+	ESIIncludes
+
+	// Server Side Includes: <!--#include virtual="url" -->
+	SSIIncludes
+)
+
+// Reason for a record expiring from the cache
+type ExpiryReason uint8
+
+const (
+	// Record was not used for longer than CacheOptions.LRULimit
+	ExpiredLRULimit ExpiryReason = iota
+
+	// Record was the least recently used one, when the cache exceeded
+	// CacheOptions.MemoryLimit
+	ExpiredMemoryLimit
+)
+
+func (r ExpiryReason) String() string {
+	switch r {
+	case ExpiredLRULimit:
+		return "LRU limit"
+	case ExpiredMemoryLimit:
+		return "memory limit"
+	default:
+		return fmt.Sprintf("ExpiryReason(%d)", uint8(r))
+	}
+}
+
 // A frontend for accessing the cache contents
 type Frontend struct {
-	id     int
-	cache  *Cache
-	getter Getter
+	// Total bytes written by Record.WriteTo() and WriteHTTP() on records of
+	// this frontend. Accessed atomically and kept first for 64 bit alignment.
+	bytesServed uint64
+
+	// Total amount of successful populations and time spent on them in
+	// nanoseconds. Accessed atomically.
+	populations, populationTime uint64
+
+	// Total amount of canary populations compared to cached records and of
+	// those differing from them. Accessed atomically.
+	canaries, canaryMismatches uint64
+
+	// Last version assigned to a populated record. Accessed atomically.
+	version uint64
+
+	// Bytes served from records of this frontend by record age at serve time.
+	// See FrontendStats.AgeHistogram. Accessed atomically.
+	ageHistogram [ageBuckets]uint64
+
+	// Unix time in nanoseconds until which the compression level is
+	// downgraded. Accessed atomically.
+	downgradedUntil int64
+
+	// Set, once the frontend is deleted. Accessed atomically.
+	deleted uint32
+
+	// Stores frontendTunables with the parameters of the frontend
+	// changeable with Cache.Reconfigure()
+	reconfigurable atomic.Value
+
+	// Keys of records with canary populations in progress
+	canaryMu   sync.Mutex
+	canaryKeys map[Key]struct{}
+
+	id    int
+	cache *Cache
+	opts  FrontendOptions
 }
 
-// Populates a record using the registered Getter
-func (f *Frontend) populate(k Key, rec *Record) (err error) {
+// Populates a record by writing to a RecordWriter with fill
+func (f *Frontend) populate(
+	k Key,
+	rec *Record,
+	fill func(*RecordWriter) error,
+) (err error) {
+	start := time.Now()
+	rec.frontend = f
 	rw := RecordWriter{
-		cache:    f.cache.id,
-		frontend: f.id,
-		key:      k,
+		ctx:           context.Background(),
+		cache:         f.cache.id,
+		frontend:      f.id,
+		key:           k,
+		weakDependent: f.opts.WeakDependent,
+		edgeIncludes:  f.opts.EdgeIncludes,
+		scratch:       f.cache.scratch,
+		level:         f.compressionLevel(start),
+
+		includeTimeout: f.opts.IncludeTimeout,
 	}
-	err = f.getter(k, &rw)
+	err = fill(&rw)
 	if err != nil {
 		return
 	}
@@ -56,20 +459,119 @@ func (f *Frontend) populate(k Key, rec *Record) (err error) {
 		return ErrEmptyRecord
 	}
 
-	rec.data = rw.data
-	rec.frameDescriptor = rw.data.GetFrameDescriptor()
-	memoryUsed := 0
-	if rec.data.next == nil {
+	memoryUsed := rec.assemble(&rw)
+	rec.attachment.Store(attachment{rw.attachment})
+	rec.version = atomic.AddUint64(&f.version, 1)
+	rec.created = rw.created
+	if rec.created.IsZero() {
+		rec.created = time.Now()
+	}
+	atomic.StoreInt64(&rec.refreshed, rec.created.UnixNano())
+	rec.memoryUsed = memoryUsed
+
+	retained, replaced := f.cache.setUsedMemory(
+		rec,
+		recordLocation{f.id, k},
+		memoryUsed,
+	)
+	if retained != rec {
+		// Identical content to the replaced stale record, which is kept in
+		// the cache. Keep the creation time and version consistent with it.
+		rec.created = retained.created
+		rec.version = retained.version
+		retained.attachment.Store(attachment{rw.attachment})
+		atomic.StoreInt64(&retained.refreshed, rec.refreshed)
+	}
+	tunables := f.tunables()
+	ttl := rw.ttl
+	if len(rw.holes) != 0 {
+		holeTTL := tunables.holeTTL
+		if holeTTL == 0 {
+			holeTTL = defaultHoleTTL
+		}
+		if ttl == 0 || holeTTL < ttl {
+			ttl = holeTTL
+		}
+	}
+	if ttl > 0 {
+		deadline := time.Now().Add(ttl)
+		rec.setTTL(ttl, deadline)
+		if retained != rec {
+			retained.setTTL(ttl, deadline)
+		}
+		if tunables.adaptiveTTL != nil &&
+			!f.opts.StaleWhileRevalidate &&
+			len(rw.holes) == 0 {
+			f.cache.setAdaptiveTTL(
+				recordLocation{f.id, k},
+				retained,
+				ttl,
+				*tunables.adaptiveTTL,
+			)
+		} else if f.opts.StaleWhileRevalidate {
+			f.cache.setStaleAt(recordLocation{f.id, k}, retained, deadline)
+		} else {
+			f.cache.evict(recordLocation{f.id, k}, ttl)
+		}
+	}
+
+	if f.opts.L2 != nil && !rw.fromL2 && len(rw.holes) == 0 {
+		go f.storeL2(k, rec, ttl)
+	}
+	if replaced != nil && f.opts.OnReplace != nil {
+		f.opts.OnReplace(k, diffRecords(replaced, rec))
+	}
+
+	dur := time.Since(start)
+	atomic.AddUint64(&f.populations, 1)
+	atomic.AddUint64(&f.populationTime, uint64(dur))
+	if tunables.compressionBudget != 0 && dur > tunables.compressionBudget {
+		cooldown := tunables.compressionBudgetCooldown
+		if cooldown == 0 {
+			cooldown = defaultCompressionBudgetCooldown
+		}
+		atomic.StoreInt64(
+			&f.downgradedUntil,
+			time.Now().Add(cooldown).UnixNano(),
+		)
+	}
+	if f.opts.SlowGetterThreshold != 0 {
+		if dur > f.opts.SlowGetterThreshold {
+			if f.opts.OnSlowGetter != nil {
+				f.opts.OnSlowGetter(k, dur, memoryUsed)
+			} else {
+				f.cache.logger.Printf(
+					"slow getter: key=%s duration=%s size=%d",
+					f.KeyString(k), dur, memoryUsed,
+				)
+			}
+		}
+	}
+
+	return
+}
+
+// Set the data of r from the components written to rw and compute its hash
+// and ETag. Returns the memory used by the data.
+func (r *Record) assemble(rw *RecordWriter) (memoryUsed int) {
+	r.data = rw.data
+	r.compressionLevel = rw.level
+	r.dependencies = rw.dependencies
+	r.holes = rw.holes
+	r.frame = rw.data.GetFrameDescriptor()
+	if r.data.next == nil {
 		// Most records will have only one component, so this is a hotpath
-		memoryUsed = rec.data.Size()
-		rec.hash = rec.data.Hash()
+		memoryUsed = r.data.Size()
+		r.length = r.data.length()
+		r.hash = r.data.Hash()
 	} else {
 		h := sha1.New()
 		first := true
-		for c := &rec.data; c != nil; c = c.next {
+		for c := &r.data; c != nil; c = c.next {
 			memoryUsed += c.Size()
+			r.length += c.length()
 			if !first {
-				rec.frameDescriptor.append(c.GetFrameDescriptor())
+				r.frame.Append(c.GetFrameDescriptor())
 			} else {
 				first = false
 			}
@@ -78,139 +580,919 @@ func (f *Frontend) populate(k Key, rec *Record) (err error) {
 			arr := c.Hash()
 			h.Write(arr[:])
 		}
-		copy(rec.hash[:], h.Sum(nil))
+		copy(r.hash[:], h.Sum(nil))
+	}
+	r.eTag = formatETag(r.hash)
+
+	for c := &r.data; c != nil; c = c.next {
+		switch c := c.component.(type) {
+		case placeholder:
+			r.placeholders = true
+		case recordReference:
+			r.placeholders = r.placeholders || c.Record.placeholders
+		}
 	}
+	return
+}
 
+// Format the strong ETag of content with the SHA1 hash
+func formatETag(hash [sha1.Size]byte) string {
 	// Known size, so using array on the stack instead of heap allocation
 	var b [27 + 2]byte
 	b[0] = '"'
-	base64.RawStdEncoding.Encode(b[1:], rec.hash[:])
+	base64.RawStdEncoding.Encode(b[1:], hash[:])
 	b[28] = '"'
-	rec.eTag = string(b[:])
+	return string(b[:])
+}
+
+// Return compression level to use for a population started at now
+func (f *Frontend) compressionLevel(now time.Time) int {
+	tunables := f.tunables()
+	if tunables.compressionBudget == 0 ||
+		now.UnixNano() >= atomic.LoadInt64(&f.downgradedUntil) {
+		return CompressionLevel
+	}
+	if tunables.downgradedCompressionLevel == 0 {
+		return flate.BestSpeed
+	}
+	return tunables.downgradedCompressionLevel
+}
 
-	f.cache.setUsedMemory(rec, recordLocation{f.id, k}, memoryUsed)
+// Run populate(), recovering any panics in fill and converting them to errors
+func (f *Frontend) populateRecovering(
+	k Key,
+	rec *Record,
+	fill func(*RecordWriter) error,
+) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			f.cache.logger.Printf(
+				"recovered getter panic: key=%s: %v\n%s",
+				f.KeyString(k), e, debug.Stack(),
+			)
+			err = fmt.Errorf("%w: %v", ErrGetterPanic, e)
+		}
+	}()
+	return f.populate(k, rec, fill)
+}
 
+// Populate a freshly created record using fill and unblock any readers
+// waiting on it
+func (f *Frontend) completePopulation(
+	k Key,
+	rec *Record,
+	fill func(*RecordWriter) error,
+) {
+	atomic.StoreUint64(&rec.populator, goroutineID())
+	atomic.StoreInt64(&rec.populationStarted, time.Now().UnixNano())
+	err := f.populateRecovering(k, rec, fill)
+	if err != nil {
+		// Propagate error to any concurrent readers
+		rec.populationError = err
+
+		f.cache.abortPopulation(recordLocation{f.id, k}, rec)
+	}
+
+	// Also unblock any concurrent readers, even on error.
+	// Having it here also protects from data races on rec.populationError.
+	rec.semaphore.Unblock()
+
+	f.cache.endPopulation(rec)
+}
+
+// Run FrontendOptions.Get for key k into a record not stored in the cache.
+// Included and bound records are retrieved as usual, but the record is not
+// registered as their dependent.
+func (f *Frontend) populateDetached(
+	ctx context.Context,
+	k Key,
+	level int,
+) (rec *Record, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			f.cache.logger.Printf(
+				"recovered getter panic: key=%s: %v\n%s",
+				f.KeyString(k), e, debug.Stack(),
+			)
+			err = fmt.Errorf("%w: %v", ErrGetterPanic, e)
+		}
+	}()
+
+	rw := RecordWriter{
+		ctx:          ctx,
+		cache:        f.cache.id,
+		frontend:     f.id,
+		key:          k,
+		detached:     true,
+		edgeIncludes: f.opts.EdgeIncludes,
+		scratch:      f.cache.scratch,
+		level:        level,
+
+		includeTimeout: f.opts.IncludeTimeout,
+	}
+	err = f.get(k, &rw)
+	if err != nil {
+		return
+	}
+	err = rw.flush(true)
+	if err != nil {
+		return
+	}
+	if rw.data.component == nil {
+		return nil, ErrEmptyRecord
+	}
+
+	rec = &Record{
+		frontend: f,
+		created:  time.Now(),
+	}
+	rec.memoryUsed = rec.assemble(&rw)
+	rec.attachment.Store(attachment{rw.attachment})
 	return
 }
 
-// Get a record by key and block until it has been generated
-func (f *Frontend) getGeneratedRecord(k Key) (rec *Record, err error) {
-	loc := recordLocation{f.id, k}
-	rec, fresh := f.cache.getRecord(loc)
+// Get a record by key and block until it has been generated.
+// Validates the record with FrontendOptions.Validate, if set.
+func (f *Frontend) getGeneratedRecord(ctx context.Context, k Key) (
+	rec *Record, err error,
+) {
+	rec, fresh, err := f.getOrPopulate(ctx, k)
+	if err != nil {
+		return
+	}
+	return f.checkRecord(ctx, k, rec, fresh)
+}
+
+// Regenerate the retrieved record rec by key k, if it predates a write of the
+// session of ctx or is invalidated by FrontendOptions.Validate, and sample it
+// for canary checks
+func (f *Frontend) checkRecord(
+	ctx context.Context,
+	k Key,
+	rec *Record,
+	fresh bool,
+) (_ *Record, err error) {
+	if f.predatesSessionWrite(ctx, k, rec) {
+		return f.populateDetached(ctx, k, f.compressionLevel(time.Now()))
+	}
 	if fresh {
-		err = f.populate(k, rec)
+		return rec, nil
+	}
+	f.sampleCanary(k, rec)
+	if f.opts.Validate == nil {
+		return rec, nil
+	}
+
+	loc := recordLocation{f.id, k}
+	if !f.cache.validationDue(loc, rec, f.opts.ValidateInterval) {
+		return rec, nil
+	}
+	valid, err := f.opts.Validate(k, rec.Meta())
+	if err != nil {
+		return
+	}
+	if valid {
+		return rec, nil
+	}
+
+	f.cache.markStale(loc)
+	rec, _, err = f.getOrPopulate(ctx, k)
+	return rec, err
+}
+
+// Get a record by key and block until it has been generated.
+// fresh=true, if the record was populated or its background regeneration
+// started by this call.
+func (f *Frontend) getOrPopulate(ctx context.Context, k Key) (
+	rec *Record, fresh bool, err error,
+) {
+	rec, stale, fresh, err := f.cache.getRecord(f, k)
+	if err != nil {
+		return
+	}
+	return f.awaitRecord(ctx, k, rec, stale, fresh)
+}
+
+// Populate the record rec by key k returned by Cache.getRecord(), if fresh,
+// and block until it has been generated
+func (f *Frontend) awaitRecord(
+	ctx context.Context,
+	k Key,
+	rec, stale *Record,
+	fresh bool,
+) (_ *Record, _ bool, err error) {
+	for {
+		if fresh && stale != nil && f.opts.StaleWhileRevalidate {
+			go f.revalidate(k, rec, stale)
+			rec = stale
+		} else if fresh {
+			f.completePopulation(k, rec, func(rw *RecordWriter) error {
+				rw.ctx = ctx
+				rw.previous = stale
+				if f.opts.L2 != nil && stale == nil && f.getL2(k, rw) {
+					return nil
+				}
+				return f.get(k, rw)
+			})
+		} else if !rec.semaphore.Finished() &&
+			atomic.LoadUint64(&rec.populator) == goroutineID() {
+			return nil, false, ErrReentrantGet
+		}
+
+		// Prevents a record being read concurrently before it is populated.
+		// A record is immutable after initial population and this will not
+		// block after it.
+		err = f.waitPopulation(ctx, k, rec)
 		if err != nil {
-			// Propagate error to any concurrent readers
-			rec.populationError = err
+			return nil, false, err
+		}
+		err = rec.populationError
 
-			f.cache.evict(loc, 0)
+		// A concurrent population was cancelled by the context of the
+		// retrieval that started it and its record discarded. Retry, as ctx
+		// is not done. Populations exceeding their own time budget are not
+		// retried.
+		var te *TimeoutError
+		if !fresh &&
+			isContextError(err) &&
+			!errors.As(err, &te) &&
+			ctx.Err() == nil {
+			rec, stale, fresh, err = f.cache.getRecord(f, k)
+			if err != nil {
+				return nil, false, err
+			}
+			continue
 		}
+		return rec, fresh, err
+	}
+}
+
+// Returns, if err was caused by a context being cancelled or its deadline
+// being exceeded
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
 
-		// Also unblock any concurrent readers, even on error.
-		// Having it here also protects from data races on rec.populationError.
-		rec.semaphore.Unblock()
+// Regenerate a stale record in the background with FrontendOptions.Get.
+// rec replaces the stale record on success.
+func (f *Frontend) revalidate(k Key, rec, stale *Record) {
+	f.completePopulation(k, rec, func(rw *RecordWriter) error {
+		rw.previous = stale
+		return f.get(k, rw)
+	})
+	if rec.populationError != nil {
+		f.cache.logger.Printf(
+			"background revalidation failed: key=%s: %s",
+			f.KeyString(k), rec.populationError,
+		)
 	}
+}
 
-	// Prevents a record being read concurrently before it is populated.
-	// A record is immutable after initial population and this will not block
-	// after it.
-	rec.semaphore.Wait()
-	err = rec.populationError
+// Retrieve or generate records by keys and return them in the order of keys.
+// Missing records are populated concurrently, with at most
+// GetMultiConcurrency populations run at once. Cheaper than calling Get()
+// for each key, as the cache is only locked once for looking up all keys.
+//
+// Returns the first error in the order of keys, if retrieving any record
+// failed.
+func (f *Frontend) GetMulti(keys ...Key) ([]*Record, error) {
+	return f.GetMultiContext(context.Background(), keys...)
+}
 
-	return
+// Same as GetMulti(), but with a context, like GetContext()
+func (f *Frontend) GetMultiContext(ctx context.Context, keys ...Key) (
+	[]*Record, error,
+) {
+	var (
+		lookups = f.cache.getRecords(f, keys)
+		recs    = make([]*Record, len(keys))
+		errs    = make([]error, len(keys))
+		wg      sync.WaitGroup
+		sem     = make(chan struct{}, GetMultiConcurrency)
+		gid     = goroutineID()
+	)
+	for i := range lookups {
+		l := lookups[i]
+		switch {
+		case l.err != nil:
+			errs[i] = l.err
+			continue
+		case !l.fresh && !l.rec.semaphore.Finished() &&
+			atomic.LoadUint64(&l.rec.populator) == gid:
+			// Must be checked on this goroutine
+			errs[i] = ErrReentrantGet
+			continue
+		case !l.fresh && l.rec.semaphore.Finished():
+			// Already populated records do not block
+			recs[i], errs[i] = f.retrieved(ctx, keys[i], l)
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() {
+				<-sem
+			}()
+			recs[i], errs[i] = f.retrieved(ctx, keys[i], l)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return recs, nil
+}
+
+// Complete the retrieval of a record by key k looked up with
+// Cache.getRecords()
+func (f *Frontend) retrieved(ctx context.Context, k Key, l recordLookup) (
+	*Record, error,
+) {
+	rec, fresh, err := f.awaitRecord(ctx, k, l.rec, l.stale, l.fresh)
+	if err != nil {
+		return nil, err
+	}
+	return f.checkRecord(ctx, k, rec, fresh)
 }
 
 // Retrieve or generate data by key and return cache Record
 func (f *Frontend) Get(k Key) (*Record, error) {
-	return f.getGeneratedRecord(k)
+	return f.getGeneratedRecord(context.Background(), k)
+}
+
+// Same as Get(), but passes ctx to the Getter through RecordWriter.Context()
+// and stops waiting for a concurrent population of the record, once ctx is
+// done. The concurrent population is not affected by abandoning the wait.
+//
+// Records included or bound by the Getter are retrieved with the same ctx and
+// RecordWriter.Include() and RecordWriter.Bind() fail with ctx.Err() without
+// starting any retrievals, once ctx is done. Cancelling ctx thereby cancels
+// the population of the whole tree of records not yet in the cache. Waiters
+// on a population cancelled by the context of another retrieval retry the
+// population with their own context.
+func (f *Frontend) GetContext(ctx context.Context, k Key) (*Record, error) {
+	return f.getGeneratedRecord(ctx, k)
+}
+
+// Regenerate only the components of a cached record not included from other
+// records, while retaining all included records as is. Avoids a full
+// regeneration, when only the data surrounding included records has changed.
+//
+// The record is split into segments of its own data around each included
+// record. regenerateOwned is called for each of these segments in order and
+// must write the new data of the segment to the passed RecordWriter.
+// RecordWriter.Segment() returns the index of the current segment.
+// A record with n included records has n+1 segments, some of which may be
+// empty.
+//
+// Concurrent readers are served the existing record until it is replaced.
+// Records including the rebuilt record are evicted, once it is replaced,
+// unless its content is unchanged.
+//
+// If the record is not in the cache, is being populated or the cache is
+// draining, regenerateOwned is not called and the record is retrieved or
+// generated as with Get().
+func (f *Frontend) Rebuild(
+	k Key,
+	regenerateOwned func(*RecordWriter) error,
+) (*Record, error) {
+	old, rec, ok := f.cache.beginReplacement(f, k)
+	if !ok {
+		return f.getGeneratedRecord(context.Background(), k)
+	}
+
+	f.completePopulation(k, rec, func(rw *RecordWriter) (err error) {
+		// Included records are reused, so carry over their provenance
+		for _, d := range old.dependencies {
+			if d.Included {
+				rw.dependencies = append(rw.dependencies, d)
+			}
+		}
+
+		for c := &old.data; ; c = c.next {
+			// Skip to next included record
+			for c != nil {
+				if _, ok := c.component.(recordReference); ok {
+					break
+				}
+				c = c.next
+			}
+
+			err = regenerateOwned(rw)
+			if err != nil {
+				return
+			}
+			rw.segment++
+
+			if c == nil {
+				return
+			}
+			err = rw.flush(false)
+			if err != nil {
+				return
+			}
+			rw.append(c.component)
+		}
+	})
+	return rec, rec.populationError
+}
+
+// Append data to an existing record without regenerating it. fill must write
+// only the data to be appended to the passed RecordWriter. Useful for cheaply
+// growing cached append-only lists, like feeds.
+//
+// The resulting record replaces the existing one and has a new ETag.
+// Concurrent readers are served the existing record until it is replaced.
+// Records including the appended record are evicted, once it is replaced.
+// Concurrent appends to the same record are applied in sequence.
+//
+// Returns ErrRecordFrozen, if the record was frozen with Freeze().
+// If the record is not in the cache, fill is not called and the record is
+// generated as with Get().
+func (f *Frontend) Append(
+	k Key,
+	fill func(*RecordWriter) error,
+) (*Record, error) {
+	for {
+		old, rec, wait, err := f.cache.beginAppend(f, k)
+		switch {
+		case err != nil:
+			return nil, err
+		case wait != nil:
+			wait.semaphore.Wait()
+			continue
+		case rec == nil:
+			return f.getGeneratedRecord(context.Background(), k)
+		}
+
+		f.completePopulation(k, rec, func(rw *RecordWriter) error {
+			for c := &old.data; c != nil; c = c.next {
+				rw.append(c.component)
+			}
+			rw.dependencies = append(rw.dependencies, old.dependencies...)
+			return fill(rw)
+		})
+		return rec, rec.populationError
+	}
+}
+
+// Store a record populated by fill at key k without calling the Getter of the
+// frontend. Useful for write-through caching, where the new data is already
+// at hand after updating the source of truth.
+//
+// Any existing record at k is replaced. Concurrent readers are served the
+// existing record until it is replaced and records including it are evicted,
+// once it is replaced. If a record at k is still being populated, it is
+// waited on and replaced after. If fill returns an error, the existing
+// record is retained.
+func (f *Frontend) Set(
+	k Key,
+	fill func(*RecordWriter) error,
+) (*Record, error) {
+	for {
+		rec, wait, err := f.cache.beginAdoption(f, k)
+		switch {
+		case err != nil:
+			return nil, err
+		case wait != nil:
+			wait.semaphore.Wait()
+			continue
+		}
+
+		f.completePopulation(k, rec, fill)
+		return rec, rec.populationError
+	}
+}
+
+// Prevent any further Append() calls on a record, until it is evicted.
+//
+// Returns false, if the record is not in the cache.
+func (f *Frontend) Freeze(k Key) bool {
+	if f.isDeleted() {
+		return false
+	}
+	return f.cache.freeze(recordLocation{f.id, k})
+}
+
+// Add n bytes served from rec to the total amount of bytes served from records
+// of the frontend
+func (f *Frontend) addBytesServed(rec *Record, n int64) {
+	atomic.AddUint64(&f.bytesServed, uint64(n))
+	atomic.AddUint64(
+		&f.ageHistogram[ageBucket(time.Since(rec.created))],
+		uint64(n),
+	)
+}
+
+// Format key as a human-readable string using FrontendOptions.KeyString
+func (f *Frontend) KeyString(k Key) string {
+	if f.opts.KeyString != nil {
+		return f.opts.KeyString(k)
+	}
+	return fmt.Sprintf("%#v", k)
+}
+
+// Return the record by key k, only if it is already cached. Unlike Get(),
+// missing records are not populated. The record is marked as most recently
+// used and the lookup is counted in the hit and miss statistics.
+//
+// Returns false, if the record is not in the cache or has not finished its
+// first population. Stale records are returned as is without being
+// regenerated.
+func (f *Frontend) GetCached(k Key) (*Record, bool) {
+	if f.isDeleted() {
+		return nil, false
+	}
+	return f.cache.lookup(f, k, true)
+}
+
+// Same as GetCached(), but neither affects the LRU position of the record nor
+// the hit and miss statistics. Useful for health checks and debugging.
+func (f *Frontend) Peek(k Key) (*Record, bool) {
+	if f.isDeleted() {
+		return nil, false
+	}
+	return f.cache.lookup(f, k, false)
+}
+
+// Mark a record as most recently used without reading it, protecting it from
+// LRU eviction. Useful for hinting a record will soon be needed.
+//
+// Returns false, if the record is not in the cache. Touch does not populate
+// missing records.
+func (f *Frontend) Touch(k Key) bool {
+	if f.isDeleted() {
+		return false
+	}
+	return f.cache.touch(recordLocation{f.id, k})
+}
+
+// Return the version of the record by key k. Versions are assigned from a
+// counter of the frontend incremented on each population and regeneration of
+// a record, so the version of a key increases every time its record is
+// replaced, including after eviction. Regenerating a record with identical
+// content keeps the version of the replaced record, same as its ETag.
+//
+// Cheaper than comparing ETags for clients polling for changes and usable as
+// a component of version vectors.
+//
+// Returns false, if the record is not in the cache or has not finished its
+// first population. Version does not populate missing records.
+func (f *Frontend) Version(k Key) (uint64, bool) {
+	if f.isDeleted() {
+		return 0, false
+	}
+	return f.cache.version(recordLocation{f.id, k})
+}
+
+// Flag a record as stale, so that the next Get() or WriteHTTP() call
+// regenerates it. Unlike eviction, any concurrent readers during regeneration
+// will still be served the stale record, until it is replaced.
+//
+// Records including the stale record are evicted, once it is replaced. If the
+// regenerated record has identical content, the stale record, its ETag and its
+// creation time are kept instead and records including it are not evicted.
+//
+// Returns false, if the record is not in the cache.
+func (f *Frontend) MarkStale(k Key) bool {
+	if f.isDeleted() {
+		return false
+	}
+	return f.cache.markStale(recordLocation{f.id, k})
+}
+
+// Return the amount of goroutines currently blocked waiting for the population
+// of the record by key k to complete.
+// Returns 0, if the record is not currently being populated.
+func (f *Frontend) Waiters(k Key) int {
+	if f.isDeleted() {
+		return 0
+	}
+	return f.cache.waiters(recordLocation{f.id, k})
+}
+
+// Return keys of all records currently being populated mapped to the amount of
+// goroutines blocked waiting for their population to complete.
+// Can be used to monitor thundering herd pressure on individual keys.
+func (f *Frontend) InFlight() map[Key]int {
+	if f.isDeleted() {
+		return map[Key]int{}
+	}
+	return f.cache.inFlight(f.id)
+}
+
+// Evict all records of the frontend and remove it from its cache, allowing its
+// storage to be reused by frontends created later. Useful for long-lived
+// processes creating frontends dynamically.
+//
+// Any subsequent retrieval of records from the frontend returns
+// ErrFrontendDeleted. Other operations on the frontend have no effect.
+func (f *Frontend) Delete() {
+	f.cache.deleteFrontend(f)
+}
+
+// Returns, if the frontend has been deleted
+func (f *Frontend) isDeleted() bool {
+	return atomic.LoadUint32(&f.deleted) == 1
+}
+
+// Parse the value of a Range header with a single byte range for a response of
+// size bytes. Returns the offset and length of the range.
+// ok=false, if the header is invalid or contains multiple ranges.
+// Returns length 0, if the range is not satisfiable.
+func parseRange(s string, size int64) (off, length int64, ok bool) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(s, prefix) {
+		return
+	}
+	s = strings.TrimSpace(s[len(prefix):])
+	i := strings.IndexByte(s, '-')
+	if i == -1 || strings.IndexByte(s, ',') != -1 {
+		return
+	}
+	start, end := strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:])
+
+	if start == "" {
+		// Suffix range of the last n bytes
+		n, err := strconv.ParseInt(end, 10, 64)
+		if err != nil || n < 0 {
+			return
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true
+	}
+
+	off, err := strconv.ParseInt(start, 10, 64)
+	if err != nil || off < 0 {
+		return 0, 0, false
+	}
+	if off >= size {
+		return off, 0, true
+	}
+	last := size - 1
+	if end != "" {
+		last, err = strconv.ParseInt(end, 10, 64)
+		if err != nil || last < off {
+			return 0, 0, false
+		}
+		if last >= size {
+			last = size - 1
+		}
+	}
+	return off, last - off + 1, true
 }
 
 // Retrieve or generate data by key and write it to w.
 // Writes ETag to w and returns 304 on ETag match without writing data.
 // Sets "Content-Encoding" header to "deflate", if client support deflate
-// compressions
+// compressions, "gzip", if EnableGzip is set and the client supports gzip
+// compression, or "br", if FrontendOptions.Brotli is set and the client
+// supports brotli compression. "Accept-Encoding" is added to the "Vary"
+// header of such negotiated responses.
+//
+// For clients supporting compression, a single byte range of the
+// compressed response can be requested with the "Range" header to resume
+// interrupted transfers.
+//
+// Caching headers are set from FrontendOptions.HTTPCachePolicy, if any.
+// Sessions attached to the context of r with WithSession() are respected.
+// Placeholders are filled with FrontendOptions.FillPlaceholder.
 func (f *Frontend) WriteHTTP(k Key, w http.ResponseWriter, r *http.Request,
 ) (n int64, err error) {
-	rec, err := f.getGeneratedRecord(k)
+	rec, err := f.getGeneratedRecord(detachSession(r.Context()), k)
 	if err != nil {
 		return
 	}
+	return f.WriteRecordHTTP(k, rec, w, r)
+}
 
-	supportsDeflate := strings.Contains(
-		r.Header.Get("Accept-Encoding"),
-		"deflate",
-	)
+// Same as WriteHTTP(), but writes rec retrieved by key k from the frontend
+// beforehand, like with GetContext(). Avoids looking up the record again,
+// when it is needed before writing the response.
+func (f *Frontend) WriteRecordHTTP(
+	k Key,
+	rec *Record,
+	w http.ResponseWriter,
+	r *http.Request,
+) (n int64, err error) {
+	rec, err = f.fillPlaceholders(detachSession(r.Context()), r, k, rec)
+	if err != nil {
+		return
+	}
+	defer func() {
+		f.addBytesServed(rec, n)
+	}()
 
-	eTag := rec.eTag
-	if !supportsDeflate {
-		// Different eTag to maintain strong eTag byte-equivalence guarantee by
-		// differing it from the compressed eTag.
-		eTag = rec.ETagDecompressed()
+	if f.opts.Transform != nil {
+		var ok bool
+		f.setCacheHeaders(k, rec, w.Header())
+		n, ok, err = f.writeTransformed(k, rec, w, r)
+		if ok {
+			return
+		}
+	}
+
+	acceptEncoding := r.Header.Get("Accept-Encoding")
+	supportsBrotli := f.opts.Brotli && strings.Contains(acceptEncoding, "br")
+	supportsGzip := !supportsBrotli &&
+		EnableGzip &&
+		strings.Contains(acceptEncoding, "gzip")
+	supportsDeflate := !supportsBrotli &&
+		!supportsGzip &&
+		strings.Contains(acceptEncoding, "deflate")
+
+	// Different eTags maintain the strong eTag byte-equivalence guarantee by
+	// differing the eTags of all encodings of the same content
+	convertETag := func(eTag string) string {
+		switch {
+		case supportsBrotli:
+			return brotliETag(eTag)
+		case supportsGzip:
+			return gzipETag(eTag)
+		case supportsDeflate:
+			return eTag
+		default:
+			return decompressedETag(eTag)
+		}
 	}
+
+	eTag := convertETag(rec.eTag)
+	h := w.Header()
+	f.setCacheHeaders(k, rec, h)
+
+	// The encoding of the response is negotiated, so shared caches must not
+	// serve it to clients with different encoding support
+	addVary(h, "Accept-Encoding")
 	if r.Header.Get("If-None-Match") == eTag {
 		w.WriteHeader(304)
 		return
 	}
-	h := w.Header()
 	h.Set("ETag", eTag)
+	if f.opts.IncludedETagsHeader != "" {
+		eTags := rec.IncludedETags()
+		if len(eTags) != 0 {
+			for i, e := range eTags {
+				eTags[i] = convertETag(e)
+			}
+			h.Set(f.opts.IncludedETagsHeader, strings.Join(eTags, ", "))
+		}
+	}
 
-	if supportsDeflate {
-		// If client accepts deflate compression use efficient deflate stream
-		// concatenation
-		h.Set("Content-Encoding", "deflate")
-
-		// Deflate compression, as specified by the HTTP spec, actually expects
-		// the zlib file format. Write the zlib header and footer here.
-		header := [2]byte{
-			0: 0x78, // Deflate compression with default window size
-		}
-
-		// Writes compression level into first 2 bits of byte 2
-		switch CompressionLevel {
-		case -2, 0, 1:
-			header[1] = 0 << 6 // fastest
-		case 2, 3, 4, 5:
-			header[1] = 1 << 6 // fast
-		case 6, -1:
-			header[1] = 2 << 6 // default
-		case 7, 8, 9:
-			header[1] = 3 << 6 // best
-		default:
-			err = fmt.Errorf("unknown compression level: %d", CompressionLevel)
-			return
+	if supportsGzip || supportsDeflate {
+		// If client accepts compression use efficient deflate stream
+		// concatenation and only write the header and footer of the
+		// compressed stream here
+		var header, footer []byte
+		if supportsGzip {
+			h.Set("Content-Encoding", "gzip")
+			header, footer = gzipHeader(rec), gzipFooter(rec)
+		} else {
+			// Deflate compression, as specified by the HTTP spec, actually
+			// expects the zlib file format.
+			h.Set("Content-Encoding", "deflate")
+			header, err = zlibHeader(rec)
+			if err != nil {
+				return
+			}
+			footer = zlibFooter(rec)
 		}
 
-		// Writes mod-31 checksum into last 5 bytes of header
-		header[1] += uint8(31 - (uint16(header[0])<<8+uint16(header[1]))%31)
+		// The compressed stream is byte-stable for a given ETag, so a single
+		// byte range of it can be served to resume interrupted transfers.
+		// Components before the range are skipped without being read.
+		h.Set("Accept-Ranges", "bytes")
+		total := int64(len(header)) + rec.length + int64(len(footer))
+		off, max := int64(0), total
+		if rng := r.Header.Get("Range"); rng != "" {
+			ifRange := r.Header.Get("If-Range")
+			if start, l, ok := parseRange(rng, total); ok &&
+				(ifRange == "" || ifRange == eTag) {
+				if l == 0 {
+					h.Set("Content-Range", fmt.Sprintf("bytes */%d", total))
+					w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+					return
+				}
+				off, max = start, l
+				h.Set(
+					"Content-Range",
+					fmt.Sprintf("bytes %d-%d/%d", off, off+max-1, total),
+				)
+				w.WriteHeader(http.StatusPartialContent)
+			}
+		}
 
-		_, err = w.Write(header[:])
-		if err != nil {
+		// Write the part of the next l bytes of the response within the
+		// range using fn
+		write := func(
+			l int64,
+			fn func(off, max int64) (int64, error),
+		) (err error) {
+			if off >= l {
+				off -= l
+				return
+			}
+			m, err := fn(off, max)
+			n += m
+			max -= m
+			off = 0
 			return
 		}
-		n = 2
 
-		var m int64
-		m, err = rec.WriteTo(w)
+		err = write(int64(len(header)), func(off, max int64) (int64, error) {
+			return writeSliceRange(w, header, off, max)
+		})
 		if err != nil {
 			return
 		}
-		n += m
-
-		// Final empty deflate block and adler32 checksum
-		footer := [6]byte{
-			0: 0x03,
-		}
-		binary.BigEndian.PutUint32(footer[2:], rec.checksum)
-		_, err = w.Write(footer[:])
+		err = write(rec.length, func(off, max int64) (int64, error) {
+			return rec.writeRange(w, off, max)
+		})
 		if err != nil {
 			return
 		}
-		n += 6
+		err = write(int64(len(footer)), func(off, max int64) (int64, error) {
+			return writeSliceRange(w, footer, off, max)
+		})
 	} else {
 		// Streaming decompression for clients that don't support deflate
-		// compression
-		n, err = io.Copy(w, rec.Decompress())
+		// compression or are served brotli recompressed from it
+		var r io.Reader = rec.Decompress()
+		if f.opts.VerifyChecksums {
+			r = &checksumVerifier{
+				Reader: r,
+				hasher: adler32.New(),
+				want:   rec.frame,
+			}
+		}
+		if supportsBrotli {
+			h.Set("Content-Encoding", "br")
+			cw := countingResponseWriter{ResponseWriter: w}
+			bw := brotli.NewWriterLevel(&cw, brotli.DefaultCompression)
+			_, err = io.Copy(bw, r)
+			if err == nil {
+				err = bw.Close()
+			}
+			n = cw.n
+		} else {
+			n, err = io.Copy(w, r)
+		}
+		if errors.Is(err, ErrChecksumMismatch) {
+			f.cache.logger.Printf("%s: key=%s", err, f.KeyString(k))
+		}
+	}
+
+	return
+}
+
+// Retrieve or generate data by key and serve its decompressed content with
+// http.ServeContent(). This delegates range requests and conditional request
+// handling to the standard library, at the cost of not serving compressed
+// content.
+//
+// name is used for deducing the "Content-Type" header, if not set.
+func (f *Frontend) ServeContent(
+	k Key,
+	w http.ResponseWriter,
+	r *http.Request,
+	name string,
+) (err error) {
+	ctx := detachSession(r.Context())
+	rec, err := f.getGeneratedRecord(ctx, k)
+	if err != nil {
+		return
 	}
+	rec, err = f.fillPlaceholders(ctx, r, k, rec)
+	if err != nil {
+		return
+	}
+
+	cw := countingResponseWriter{ResponseWriter: w}
+	defer func() {
+		f.addBytesServed(rec, cw.n)
+	}()
+
+	f.setCacheHeaders(k, rec, w.Header())
+	w.Header().Set("ETag", rec.ETagDecompressed())
+	http.ServeContent(&cw, r, name, rec.created, rec.NewReadSeeker())
+	return
+}
+
+// Counts bytes written to the wrapped http.ResponseWriter
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n int64
+}
 
+func (w *countingResponseWriter) Write(p []byte) (n int, err error) {
+	n, err = w.ResponseWriter.Write(p)
+	w.n += int64(n)
 	return
 }
@@ -2,16 +2,25 @@ package recache
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
 	"compress/zlib"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"net/http/httptest"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
 )
 
 // Simply writes the key to the record
@@ -256,3 +265,2016 @@ func TestWriteHTTP(t *testing.T) {
 		})
 	}
 }
+
+func TestSlowGetterReporting(t *testing.T) {
+	t.Parallel()
+
+	type report struct {
+		key  Key
+		size int
+	}
+
+	var (
+		mu      sync.Mutex
+		reports []report
+		cache   = NewCache(CacheOptions{})
+		f       = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				if k.(string) == "slow" {
+					time.Sleep(time.Millisecond * 20)
+				}
+				return dummyGetter(k, rw)
+			},
+			SlowGetterThreshold: time.Millisecond * 10,
+			OnSlowGetter: func(k Key, dur time.Duration, size int) {
+				if dur < time.Millisecond*10 {
+					t.Errorf("reported duration below threshold: %s", dur)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				reports = append(reports, report{k, size})
+			},
+		})
+	)
+
+	for _, k := range [...]string{"fast", "slow"} {
+		_, err := f.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reports) != 1 {
+		t.Fatalf("expected 1 report, got %d", len(reports))
+	}
+	assertEquals(t, reports[0].key, "slow")
+	if reports[0].size == 0 {
+		t.Fatal("no record size reported")
+	}
+}
+
+func TestPopulationWaiters(t *testing.T) {
+	t.Parallel()
+
+	var (
+		wg      sync.WaitGroup
+		started = make(chan struct{})
+		release = make(chan struct{})
+		cache   = NewCache(CacheOptions{})
+		f       = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				close(started)
+				<-release
+				return dummyGetter(k, rw)
+			},
+		})
+	)
+
+	const key = "key1"
+
+	get := func() {
+		defer wg.Done()
+		_, err := f.Get(key)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	wg.Add(4)
+	go get()
+	<-started
+	for i := 0; i < 3; i++ {
+		go get()
+	}
+
+	// Wait for all readers to block on the population
+	for i := 0; f.Waiters(key) != 3; i++ {
+		if i == 1000 {
+			t.Fatalf("expected 3 waiters, got %d", f.Waiters(key))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assertEquals(t, f.InFlight(), map[Key]int{key: 3})
+
+	close(release)
+	wg.Wait()
+
+	assertEquals(t, f.Waiters(key), 0)
+	assertEquals(t, f.InFlight(), map[Key]int{})
+}
+
+func TestGetterPanic(t *testing.T) {
+	t.Parallel()
+
+	var (
+		log   testLogger
+		cache = NewCache(CacheOptions{
+			Logger: &log,
+		})
+		f = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				panic("getter failure")
+			},
+		})
+	)
+
+	for i := 0; i < 2; i++ {
+		_, err := f.Get("key1")
+		if !errors.Is(err, ErrGetterPanic) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	msgs := log.Messages()
+	assertEquals(t, len(msgs), 2)
+	if !strings.Contains(msgs[0], "getter failure") {
+		t.Fatalf("panic not logged: %s", msgs[0])
+	}
+
+	// Failed record must be evicted
+	assertEquals(t, len(cache.frontends[0]), 0)
+}
+
+func TestGetMulti(t *testing.T) {
+	t.Parallel()
+
+	var (
+		running, maxRunning, populations int32
+		errOdd                           = errors.New("odd key")
+		cache                            = NewCache(CacheOptions{})
+	)
+	var f *Frontend
+	f = cache.NewFrontendWithOptions(FrontendOptions{
+		Get: func(k Key, rw *RecordWriter) (err error) {
+			atomic.AddInt32(&populations, 1)
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if n <= max ||
+					atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+
+			switch i := k.(int); {
+			case i < 0:
+				// Reentrant retrieval of own key
+				_, err = f.GetMulti(0, k)
+				return
+			case i%2 != 0:
+				return errOdd
+			default:
+				_, err = fmt.Fprint(rw, i)
+				return
+			}
+		},
+	})
+
+	_, err := f.Get(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]Key, 0, 2*GetMultiConcurrency)
+	for i := 0; i < 2*GetMultiConcurrency; i += 2 {
+		keys = append(keys, i)
+	}
+	keys = append(keys, 2) // Duplicate
+	recs, err := f.GetMulti(keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, len(recs), len(keys))
+	for i, rec := range recs {
+		var b stringCodec
+		s, err := b.Decode(rec.Decompress())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEquals(t, s, strconv.Itoa(keys[i].(int)))
+	}
+	assertEquals(t, recs[1], recs[len(recs)-1])
+	assertEquals(t, int(atomic.LoadInt32(&populations)), len(keys)-1)
+	max := atomic.LoadInt32(&maxRunning)
+	if max < 2 || int(max) > GetMultiConcurrency {
+		t.Fatalf("unexpected population concurrency: %d", max)
+	}
+
+	// Errors are returned and failed records not cached
+	_, err = f.GetMulti(0, 1, 2)
+	if !errors.Is(err, errOdd) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = f.GetMulti(-2)
+	if !errors.Is(err, ErrReentrantGet) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertConsistency(t, cache)
+}
+
+func TestTouch(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache = NewCache(CacheOptions{})
+		f     = cache.NewFrontend(dummyGetter)
+	)
+
+	if f.Touch("key1") {
+		t.Fatal("missing record touched")
+	}
+	assertEquals(t, len(cache.frontends[0]), 0)
+
+	for _, k := range [...]string{"key1", "key2"} {
+		_, err := f.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache.mu.Lock()
+	before := cache.frontends[0]["key1"].lastUsed
+	cache.mu.Unlock()
+
+	if !f.Touch("key1") {
+		t.Fatal("record not touched")
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	assertEquals(t, cache.lruList.front.location.key, "key1")
+	if !cache.frontends[0]["key1"].lastUsed.After(before) {
+		t.Fatal("last use time not updated")
+	}
+}
+
+func TestGetCached(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache = NewCache(CacheOptions{})
+		f     = cache.NewFrontend(dummyGetter)
+	)
+
+	for _, fn := range [...]func(Key) (*Record, bool){f.GetCached, f.Peek} {
+		if _, ok := fn("key1"); ok {
+			t.Fatal("missing record returned")
+		}
+	}
+	assertEquals(t, len(cache.frontends[0]), 0)
+	assertEquals(t, f.Stats().Misses, uint64(1))
+
+	var recs []*Record
+	for _, k := range [...]string{"key1", "key2"} {
+		rec, err := f.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+	stats := f.Stats()
+
+	// Peek has no side effects
+	rec, ok := f.Peek("key1")
+	assertEquals(t, ok, true)
+	assertEquals(t, rec, recs[0])
+	assertEquals(t, f.Stats().Hits, stats.Hits)
+	cache.mu.Lock()
+	assertEquals(t, cache.lruList.front.location.key, "key2")
+	cache.mu.Unlock()
+
+	rec, ok = f.GetCached("key1")
+	assertEquals(t, ok, true)
+	assertEquals(t, rec, recs[0])
+	assertEquals(t, f.Stats().Hits, stats.Hits+1)
+	cache.mu.Lock()
+	assertEquals(t, cache.lruList.front.location.key, "key1")
+	cache.mu.Unlock()
+}
+
+func TestMarkStale(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu       sync.Mutex
+		version  int
+		started  = make(chan struct{}, 1)
+		release  = make(chan struct{})
+		cache    = NewCache(CacheOptions{})
+		children = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				mu.Lock()
+				v := version
+				version++
+				mu.Unlock()
+
+				if v != 0 {
+					started <- struct{}{}
+					<-release
+				}
+				return json.NewEncoder(rw).Encode(fmt.Sprintf("v%d", v))
+			},
+		})
+		parents = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				return rw.Include(children, k)
+			},
+		})
+	)
+
+	const key = "key1"
+
+	assertVersion := func(t *testing.T, f *Frontend, v string) {
+		t.Helper()
+
+		rec, err := f.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertJsonStringEquals(t, rec, v)
+	}
+
+	if children.MarkStale(key) {
+		t.Fatal("missing record marked stale")
+	}
+
+	assertVersion(t, parents, "v0")
+	if !children.MarkStale(key) {
+		t.Fatal("record not marked stale")
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		rec, err := children.Get(key)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var res string
+		err = rec.DecodeJSON(&res)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if res != "v1" {
+			t.Errorf("unexpected regenerated content: %s", res)
+		}
+	}()
+
+	// Concurrent readers get the stale record during regeneration
+	<-started
+	assertVersion(t, children, "v0")
+	assertEquals(t, children.InFlight(), map[Key]int{key: 0})
+
+	close(release)
+	wg.Wait()
+
+	assertVersion(t, children, "v1")
+	assertConsistency(t, cache)
+
+	// Parent must have been evicted on replacement
+	cache.mu.Lock()
+	_, ok := cache.frontends[parents.id][key]
+	cache.mu.Unlock()
+	if ok {
+		t.Fatal("parent record not evicted")
+	}
+}
+
+func TestPrevious(t *testing.T) {
+	t.Parallel()
+
+	for _, swr := range [...]bool{false, true} {
+		swr := swr
+		t.Run(fmt.Sprintf("stale_while_revalidate=%t", swr), func(t *testing.T) {
+			t.Parallel()
+
+			// Each population appends a character to the previous record
+			f := NewCache(CacheOptions{}).NewFrontendWithOptions(
+				FrontendOptions{
+					StaleWhileRevalidate: swr,
+					Get: func(k Key, rw *RecordWriter) (err error) {
+						if prev := rw.Previous(); prev != nil {
+							_, err = io.Copy(rw, prev.Decompress())
+							if err != nil {
+								return
+							}
+						}
+						_, err = rw.Write([]byte("x"))
+						return
+					},
+				},
+			)
+
+			assertContent := func(std string) {
+				t.Helper()
+
+				// Wait for any background regeneration
+				var res string
+				for i := 0; i < 1000; i++ {
+					rec, err := f.Get("key")
+					if err != nil {
+						t.Fatal(err)
+					}
+					var buf bytes.Buffer
+					_, err = buf.ReadFrom(rec.Decompress())
+					if err != nil {
+						t.Fatal(err)
+					}
+					res = buf.String()
+					if res == std {
+						return
+					}
+					time.Sleep(time.Millisecond)
+				}
+				t.Fatalf("unexpected content: %s != %s", res, std)
+			}
+
+			assertContent("x")
+			f.MarkStale("key")
+			assertContent("xx")
+			f.Evict(0, "key")
+			assertContent("x")
+		})
+	}
+}
+
+func TestVersion(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu      sync.Mutex
+		content = "a"
+	)
+	f := NewCache(CacheOptions{}).NewFrontendWithOptions(FrontendOptions{
+		Get: func(k Key, rw *RecordWriter) (err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			_, err = rw.Write([]byte(content))
+			return
+		},
+	})
+	get := func() uint64 {
+		t.Helper()
+		rec, err := f.Get("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, ok := f.Version("key")
+		assertEquals(t, ok, true)
+		assertEquals(t, rec.Meta().Version, v)
+		return v
+	}
+
+	_, ok := f.Version("key")
+	assertEquals(t, ok, false)
+	v1 := get()
+	assertEquals(t, get(), v1)
+
+	// Identical content keeps the version
+	f.MarkStale("key")
+	assertEquals(t, get(), v1)
+
+	mu.Lock()
+	content = "b"
+	mu.Unlock()
+	f.MarkStale("key")
+	v2 := get()
+	if v2 <= v1 {
+		t.Fatalf("version not incremented: %d <= %d", v2, v1)
+	}
+
+	// Versions keep increasing after eviction
+	f.Evict(0, "key")
+	_, ok = f.Version("key")
+	assertEquals(t, ok, false)
+	if v3 := get(); v3 <= v2 {
+		t.Fatalf("version not incremented: %d <= %d", v3, v2)
+	}
+}
+
+func TestCoalesceIdenticalContent(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache    = NewCache(CacheOptions{})
+		children = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: dummyGetter,
+		})
+		parents = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				return rw.Include(children, k)
+			},
+		})
+	)
+
+	_, err := parents.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	std, err := children.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond)
+	children.MarkStale("a")
+	rec, err := children.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, rec.ETag(), std.ETag())
+	assertEquals(t, rec.Meta().Created.Equal(std.Meta().Created), true)
+
+	// Previous record retained without evicting dependents
+	rec, err = children.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec != std {
+		t.Fatal("previous record not retained")
+	}
+	cache.mu.Lock()
+	_, ok := cache.frontends[parents.id]["a"]
+	cache.mu.Unlock()
+	assertEquals(t, ok, true)
+	assertConsistency(t, cache)
+}
+
+func TestOnReplace(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu       sync.Mutex
+		version  = "v0"
+		diffs    []RecordDiff
+		cache    = NewCache(CacheOptions{})
+		children = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: dummyGetter,
+		})
+		parents = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) (err error) {
+				_, err = rw.Write([]byte("<"))
+				if err != nil {
+					return
+				}
+				err = rw.Include(children, k)
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				v := version
+				mu.Unlock()
+				_, err = rw.Write([]byte(v + ">"))
+				return
+			},
+			OnReplace: func(k Key, d RecordDiff) {
+				mu.Lock()
+				defer mu.Unlock()
+				diffs = append(diffs, d)
+			},
+		})
+	)
+
+	regenerate := func(v string) *Record {
+		t.Helper()
+
+		mu.Lock()
+		version = v
+		mu.Unlock()
+		parents.MarkStale("a")
+		rec, err := parents.Get("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+
+	v0, err := parents.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1 := regenerate("v1")
+	regenerate("v1")
+
+	mu.Lock()
+	defer mu.Unlock()
+	assertEquals(t, diffs, []RecordDiff{
+		{
+			OldETag:       v0.ETag(),
+			NewETag:       v1.ETag(),
+			OldSize:       v0.Meta().Size,
+			NewSize:       v1.Meta().Size,
+			OldComponents: 3,
+			NewComponents: 3,
+			Changed:       []int{2},
+		},
+		{
+			OldETag:       v1.ETag(),
+			NewETag:       v1.ETag(),
+			OldSize:       v1.Meta().Size,
+			NewSize:       v1.Meta().Size,
+			OldComponents: 3,
+			NewComponents: 3,
+		},
+	})
+}
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+
+	cases := [...]struct {
+		name     string
+		interval time.Duration
+		// Expected Validate and Getter call counts after 3 Get() calls
+		validations, populations int
+	}{
+		{"every hit", 0, 2, 3},
+		{"rate limited", time.Hour, 0, 1},
+	}
+
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			var (
+				mu                       sync.Mutex
+				validations, populations int
+			)
+			f := NewCache(CacheOptions{}).NewFrontendWithOptions(
+				FrontendOptions{
+					Get: func(k Key, rw *RecordWriter) error {
+						mu.Lock()
+						populations++
+						mu.Unlock()
+						return dummyGetter(k, rw)
+					},
+					Validate: func(k Key, meta RecordMeta) (bool, error) {
+						if meta.Created.IsZero() || meta.ETag == "" ||
+							meta.Size == 0 {
+							t.Errorf("invalid record metadata: %+v", meta)
+						}
+						mu.Lock()
+						validations++
+						mu.Unlock()
+						return false, nil
+					},
+					ValidateInterval: c.interval,
+				},
+			)
+
+			const key = "key1"
+			for i := 0; i < 3; i++ {
+				rec, err := f.Get(key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				assertJsonStringEquals(t, rec, key)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			assertEquals(t, validations, c.validations)
+			assertEquals(t, populations, c.populations)
+		})
+	}
+
+	t.Run("error", func(t *testing.T) {
+		t.Parallel()
+
+		f := NewCache(CacheOptions{}).NewFrontendWithOptions(FrontendOptions{
+			Get: dummyGetter,
+			Validate: func(k Key, meta RecordMeta) (bool, error) {
+				return false, errSample
+			},
+		})
+
+		_, err := f.Get("key1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Get("key1")
+		assertEquals(t, err, errSample)
+	})
+}
+
+func TestKeyString(t *testing.T) {
+	t.Parallel()
+
+	var (
+		log   testLogger
+		cache = NewCache(CacheOptions{
+			Logger: &log,
+		})
+		plain = cache.NewFrontend(dummyGetter)
+		named = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				time.Sleep(time.Millisecond * 2)
+				return dummyGetter(k, rw)
+			},
+			SlowGetterThreshold: time.Millisecond,
+			KeyString: func(k Key) string {
+				d := k.(recursiveData)
+				return fmt.Sprintf("%d/%d/%d", d.Cache, d.Frontend, d.Key)
+			},
+		})
+		key = recursiveData{1, 2, 3}
+	)
+
+	assertEquals(t, plain.KeyString("key1"), `"key1"`)
+	assertEquals(t, named.KeyString(key), "1/2/3")
+
+	_, err := named.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := log.Messages()
+	assertEquals(t, len(msgs), 1)
+	if !strings.Contains(msgs[0], "key=1/2/3 ") {
+		t.Fatalf("key name not logged: %s", msgs[0])
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu          sync.Mutex
+		populations = make(map[string]int)
+		cache       = NewCache(CacheOptions{})
+		count       = func(name string) {
+			mu.Lock()
+			populations[name]++
+			mu.Unlock()
+		}
+		children = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) (err error) {
+				count("child")
+				_, err = rw.Write([]byte(k.(string)))
+				return
+			},
+		})
+		parents = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) (err error) {
+				count("parent")
+				_, err = rw.Write([]byte("<"))
+				if err != nil {
+					return
+				}
+				err = rw.Include(children, "a")
+				if err != nil {
+					return
+				}
+				err = rw.Include(children, "b")
+				if err != nil {
+					return
+				}
+				_, err = rw.Write([]byte(">"))
+				return
+			},
+		})
+	)
+
+	assertContent := func(t *testing.T, rec *Record, std string) {
+		t.Helper()
+
+		var w bytes.Buffer
+		_, err := io.Copy(&w, rec.Decompress())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEquals(t, w.String(), std)
+	}
+
+	orig, err := parents.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertContent(t, orig, "<ab>")
+
+	rec, err := parents.Rebuild(nil, func(rw *RecordWriter) (err error) {
+		_, err = rw.Write([]byte(fmt.Sprintf("[%d]", rw.Segment())))
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertContent(t, rec, "[0]a[1]b[2]")
+	if rec.ETag() == orig.ETag() {
+		t.Fatal("ETag not changed")
+	}
+
+	rec, err = parents.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertContent(t, rec, "[0]a[1]b[2]")
+	assertEquals(t, populations, map[string]int{
+		"parent": 1,
+		"child":  2,
+	})
+	assertConsistency(t, cache)
+
+	t.Run("error", func(t *testing.T) {
+		_, err := parents.Rebuild(nil, func(rw *RecordWriter) error {
+			return errSample
+		})
+		assertEquals(t, err, errSample)
+
+		// Existing record retained
+		rec, err := parents.Get(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertContent(t, rec, "[0]a[1]b[2]")
+	})
+
+	t.Run("not cached", func(t *testing.T) {
+		children.EvictAll(0)
+		rec, err := parents.Rebuild(nil, func(rw *RecordWriter) error {
+			t.Fatal("called for missing record")
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertContent(t, rec, "<ab>")
+	})
+}
+
+func TestReentrantGet(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache = NewCache(CacheOptions{})
+		f     *Frontend
+	)
+	f = cache.NewFrontendWithOptions(FrontendOptions{
+		Get: func(k Key, rw *RecordWriter) (err error) {
+			switch k.(string) {
+			case "direct":
+				_, err = f.Get(k)
+			case "include":
+				err = rw.Include(f, k)
+			case "cycle1":
+				err = rw.Include(f, "cycle2")
+			case "cycle2":
+				err = rw.Include(f, "cycle1")
+			}
+			return
+		},
+	})
+
+	for _, k := range [...]string{"direct", "include", "cycle1"} {
+		t.Run(k, func(t *testing.T) {
+			_, err := f.Get(k)
+			if !errors.Is(err, ErrReentrantGet) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+
+	assertEquals(t, len(cache.frontends[0]), 0)
+}
+
+func TestGoroutineID(t *testing.T) {
+	t.Parallel()
+
+	id := goroutineID()
+	if id == 0 {
+		t.Fatal("no goroutine ID")
+	}
+	assertEquals(t, goroutineID(), id)
+
+	ch := make(chan uint64)
+	go func() {
+		ch <- goroutineID()
+	}()
+	if other := <-ch; other == id || other == 0 {
+		t.Fatalf("invalid goroutine ID: %d", other)
+	}
+}
+
+func TestDeleteFrontend(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache   = NewCache(CacheOptions{})
+		deleted = cache.NewFrontend(dummyGetter)
+		kept    = cache.NewFrontend(dummyGetter)
+	)
+
+	for _, f := range [...]*Frontend{deleted, kept} {
+		_, err := f.Get("key1")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deleted.Delete()
+	deleted.Delete()
+
+	_, err := deleted.Get("key1")
+	assertEquals(t, err, ErrFrontendDeleted)
+	assertEquals(t, deleted.Touch("key1"), false)
+	assertEquals(t, deleted.EvictByFunc(0, nil), ErrFrontendDeleted)
+
+	s := cache.SnapshotStats()
+	assertEquals(t, s.Records, 1)
+	assertEquals(t, s.Frontends[0], FrontendStats{})
+
+	// Storage of the deleted frontend is reused
+	reused := cache.NewFrontend(dummyGetter)
+	assertEquals(t, reused.id, deleted.id)
+	_, err = reused.Get("key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = deleted.Get("key1")
+	assertEquals(t, err, ErrFrontendDeleted)
+	_, err = deleted.Rebuild("key1", nil)
+	assertEquals(t, err, ErrFrontendDeleted)
+	assertEquals(t, reused.Touch("key1"), true)
+
+	assertConsistency(t, cache)
+}
+
+func TestAppend(t *testing.T) {
+	t.Parallel()
+
+	var (
+		populations int32
+		cache       = NewCache(CacheOptions{})
+		items       = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) (err error) {
+				_, err = rw.Write([]byte(k.(string)))
+				return
+			},
+		})
+		feeds = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) (err error) {
+				atomic.AddInt32(&populations, 1)
+				_, err = rw.Write([]byte("["))
+				if err != nil {
+					return
+				}
+				return rw.Include(items, "a")
+			},
+		})
+		parents = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				return rw.Include(feeds, nil)
+			},
+		})
+	)
+
+	assertContent := func(t *testing.T, rec *Record, std string) {
+		t.Helper()
+
+		var w bytes.Buffer
+		_, err := io.Copy(&w, rec.Decompress())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEquals(t, w.String(), std)
+	}
+	appendItem := func(item string) (*Record, error) {
+		return feeds.Append(nil, func(rw *RecordWriter) (err error) {
+			_, err = rw.Write([]byte(item))
+			return
+		})
+	}
+
+	// Not in cache, so generated as with Get()
+	orig, err := appendItem("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertContent(t, orig, "[a")
+	_, err = parents.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	for _, item := range [...]string{"b", "c"} {
+		go func(item string) {
+			defer wg.Done()
+			_, err := appendItem(item)
+			if err != nil {
+				t.Error(err)
+			}
+		}(item)
+	}
+	wg.Wait()
+
+	rec, err := feeds.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var w bytes.Buffer
+	_, err = io.Copy(&w, rec.Decompress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := w.String(); s != "[abc" && s != "[acb" {
+		t.Fatalf("unexpected content: %s", s)
+	}
+	if rec.ETag() == orig.ETag() {
+		t.Fatal("ETag not updated")
+	}
+	assertEquals(t, atomic.LoadInt32(&populations), int32(1))
+
+	// Dependencies on included records are retained
+	items.Evict(0, "a")
+	_, err = feeds.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, atomic.LoadInt32(&populations), int32(2))
+
+	// Records including the appended record are evicted
+	_, err = parents.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = appendItem("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, parents.Touch(nil), false)
+
+	assertEquals(t, feeds.Freeze(nil), true)
+	_, err = appendItem("e")
+	assertEquals(t, err, ErrRecordFrozen)
+	assertEquals(t, feeds.Freeze("missing"), false)
+
+	assertConsistency(t, cache)
+}
+
+func TestSet(t *testing.T) {
+	t.Parallel()
+
+	var (
+		populations int32
+		cache       = NewCache(CacheOptions{})
+		items       = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) (err error) {
+				atomic.AddInt32(&populations, 1)
+				_, err = rw.Write([]byte("getter"))
+				return
+			},
+		})
+		parents = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				return rw.Include(items, k)
+			},
+		})
+	)
+
+	set := func(data string) (*Record, error) {
+		return items.Set("a", func(rw *RecordWriter) (err error) {
+			_, err = rw.Write([]byte(data))
+			return
+		})
+	}
+	read := func(f *Frontend) string {
+		t.Helper()
+		rec, err := f.Get("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		_, err = io.Copy(&buf, rec.Decompress())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+	contains := func(f *Frontend) bool {
+		f.cache.mu.Lock()
+		defer f.cache.mu.Unlock()
+		_, ok := f.cache.frontends[f.id]["a"]
+		return ok
+	}
+
+	rec, err := set("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, read(items), "1")
+	assertEquals(t, read(parents), "1")
+	assertEquals(t, atomic.LoadInt32(&populations), int32(0))
+
+	// Replacing the record evicts its dependents
+	replaced, err := set("2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced.ETag() == rec.ETag() {
+		t.Fatal("ETag not changed")
+	}
+	assertEquals(t, contains(parents), false)
+	assertEquals(t, read(parents), "2")
+
+	// Failed sets retain the existing record
+	_, err = items.Set("a", func(rw *RecordWriter) error {
+		return errors.New("failed")
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	assertEquals(t, read(items), "2")
+	assertEquals(t, contains(parents), true)
+	assertEquals(t, atomic.LoadInt32(&populations), int32(0))
+	assertConsistency(t, cache)
+}
+
+func TestWriteHTTPRange(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache    = NewCache(CacheOptions{})
+		children = cache.NewFrontend(dummyGetter)
+		parents  = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) (err error) {
+				for i := 0; i < 3; i++ {
+					_, err = rw.Write([]byte(strings.Repeat("abc", 100)))
+					if err != nil {
+						return
+					}
+					err = rw.Include(children, i)
+					if err != nil {
+						return
+					}
+				}
+				return
+			},
+		})
+	)
+
+	serve := func(t *testing.T, header map[string]string,
+	) *httptest.ResponseRecorder {
+		t.Helper()
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", "deflate")
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		_, err := parents.WriteHTTP(nil, rec, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+
+	full := serve(t, nil)
+	assertEquals(t, full.Code, 200)
+	assertEquals(t, full.Header().Get("Accept-Ranges"), "bytes")
+	body := full.Body.Bytes()
+	size := len(body)
+	eTag := full.Header().Get("ETag")
+
+	cases := [...]struct {
+		name, rng  string
+		start, end int // Inclusive end
+	}{
+		{"open", "bytes=5-", 5, size - 1},
+		{"bounded", "bytes=1-40", 1, 40},
+		{"header", "bytes=0-0", 0, 0},
+		{"footer", "bytes=-6", size - 6, size - 1},
+		{
+			"clamped",
+			fmt.Sprintf("bytes=%d-%d", size-3, size*2),
+			size - 3,
+			size - 1,
+		},
+	}
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			res := serve(t, map[string]string{
+				"Range":    c.rng,
+				"If-Range": eTag,
+			})
+			assertEquals(t, res.Code, 206)
+			assertEquals(
+				t,
+				res.Header().Get("Content-Range"),
+				fmt.Sprintf("bytes %d-%d/%d", c.start, c.end, size),
+			)
+			assertEquals(t, res.Body.Bytes(), body[c.start:c.end+1])
+		})
+	}
+
+	// Resuming at each component boundary
+	rec, err := parents.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range rec.Components() {
+		res := serve(t, map[string]string{
+			"Range": fmt.Sprintf("bytes=%d-", c.Offset+2),
+		})
+		assertEquals(t, res.Code, 206)
+		assertEquals(t, res.Body.Bytes(), body[c.Offset+2:])
+	}
+
+	t.Run("unsatisfiable", func(t *testing.T) {
+		t.Parallel()
+
+		res := serve(t, map[string]string{
+			"Range": fmt.Sprintf("bytes=%d-", size),
+		})
+		assertEquals(t, res.Code, 416)
+		assertEquals(
+			t,
+			res.Header().Get("Content-Range"),
+			fmt.Sprintf("bytes */%d", size),
+		)
+	})
+
+	ignored := map[string]map[string]string{
+		"If-Range mismatch": {"Range": "bytes=5-", "If-Range": `"foo"`},
+		"multiple ranges":   {"Range": "bytes=1-2,4-5"},
+		"invalid":           {"Range": "bytes=5-1"},
+	}
+	for name, header := range ignored {
+		header := header
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			res := serve(t, header)
+			assertEquals(t, res.Code, 200)
+			assertEquals(t, res.Body.Bytes(), body)
+		})
+	}
+}
+
+func TestServeContent(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache = NewCache(CacheOptions{})
+		f     = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) (err error) {
+				_, err = rw.Write([]byte("<p>content</p>"))
+				return
+			},
+		})
+	)
+
+	serve := func(t *testing.T, header map[string]string,
+	) *httptest.ResponseRecorder {
+		t.Helper()
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		err := f.ServeContent(nil, rec, req, "index.html")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+
+	res := serve(t, nil)
+	assertEquals(t, res.Code, 200)
+	assertEquals(t, res.Body.String(), "<p>content</p>")
+	assertEquals(
+		t,
+		res.Header().Get("Content-Type"),
+		"text/html; charset=utf-8",
+	)
+	eTag := res.Header().Get("ETag")
+	if !strings.HasSuffix(eTag, `-uc"`) {
+		t.Fatalf("unexpected ETag: %s", eTag)
+	}
+
+	res = serve(t, map[string]string{"Range": "bytes=3-9"})
+	assertEquals(t, res.Code, 206)
+	assertEquals(t, res.Body.String(), "content")
+
+	res = serve(t, map[string]string{"If-None-Match": eTag})
+	assertEquals(t, res.Code, 304)
+
+	assertEquals(t, cache.SnapshotStats().Frontends[0].BytesServed, uint64(21))
+}
+
+func TestIncludedETagsHeader(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache    = NewCache(CacheOptions{})
+		children = cache.NewFrontend(dummyGetter)
+		parents  = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) (err error) {
+				for _, k := range [...]string{"a", "b"} {
+					err = rw.Include(children, k)
+					if err != nil {
+						return
+					}
+				}
+				return
+			},
+			IncludedETagsHeader: "X-Included-ETags",
+		})
+	)
+
+	var included [2]*Record
+	for i, k := range [...]string{"a", "b"} {
+		rec, err := children.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		included[i] = rec
+	}
+	rec, err := parents.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(
+		t,
+		rec.IncludedETags(),
+		[]string{included[0].ETag(), included[1].ETag()},
+	)
+
+	cases := [...]struct {
+		name       string
+		useDeflate bool
+		std        string
+	}{
+		{
+			"deflate",
+			true,
+			included[0].ETag() + ", " + included[1].ETag(),
+		},
+		{
+			"uncompressed",
+			false,
+			included[0].ETagDecompressed() + ", " + included[1].ETagDecompressed(),
+		},
+	}
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/", nil)
+			if c.useDeflate {
+				req.Header.Set("Accept-Encoding", "deflate")
+			}
+			_, err := parents.WriteHTTP(nil, res, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEquals(t, res.Header().Get("X-Included-ETags"), c.std)
+		})
+	}
+
+	res := httptest.NewRecorder()
+	_, err = children.WriteHTTP("a", res, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, len(res.Header()["X-Included-Etags"]), 0)
+}
+
+// Not parallel, as it mutates the EnableGzip global
+func TestWriteHTTPGzip(t *testing.T) {
+	EnableGzip = true
+	defer func() {
+		EnableGzip = false
+	}()
+
+	var (
+		cache    = NewCache(CacheOptions{})
+		children = cache.NewFrontend(dummyGetter)
+		parents  = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) (err error) {
+				for _, k := range [...]string{"a", "b"} {
+					_, err = fmt.Fprintf(rw, "<%s>", k)
+					if err != nil {
+						return
+					}
+					err = rw.Include(children, k)
+					if err != nil {
+						return
+					}
+				}
+				return
+			},
+		})
+	)
+
+	rec, err := parents.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var std bytes.Buffer
+	_, err = std.ReadFrom(rec.Decompress())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	_, err = parents.WriteHTTP(nil, res, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, res.Header().Get("Content-Encoding"), "gzip")
+	assertEquals(t, res.Header().Get("ETag"), rec.ETagGzip())
+
+	// gzip.Reader verifies the CRC32 checksum and size
+	r, err := gzip.NewReader(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, string(buf), std.String())
+	assertEquals(t, rec.FrameDescriptor().CRC32(), crc32.ChecksumIEEE(buf))
+
+	res = httptest.NewRecorder()
+	req.Header.Set("Accept-Encoding", "deflate")
+	_, err = parents.WriteHTTP(nil, res, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, res.Header().Get("Content-Encoding"), "deflate")
+	assertEquals(t, res.Header().Get("ETag"), rec.ETag())
+}
+
+func TestWriteHTTPBrotli(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache = NewCache(CacheOptions{})
+		f     = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) (err error) {
+				_, err = rw.Write(bytes.Repeat([]byte("<p>brotli</p>"), 1<<10))
+				return
+			},
+			IncludedETagsHeader: "X-Included",
+			Brotli:              true,
+		})
+	)
+
+	rec, err := f.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var std bytes.Buffer
+	_, err = std.ReadFrom(rec.Decompress())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
+	req.Header.Set("Range", "bytes=0-9")
+	n, err := f.WriteHTTP(nil, res, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, res.Code, 200)
+	assertEquals(t, res.Header().Get("Content-Encoding"), "br")
+	assertEquals(t, res.Header().Get("ETag"), rec.ETagBrotli())
+	assertEquals(t, res.Header().Get("Vary"), "Accept-Encoding")
+	assertEquals(t, n, int64(res.Body.Len()))
+	if n >= rec.length {
+		t.Fatalf("brotli response not smaller than deflate: %d", n)
+	}
+
+	buf, err := io.ReadAll(brotli.NewReader(res.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, string(buf), std.String())
+
+	res = httptest.NewRecorder()
+	req.Header.Set("If-None-Match", rec.ETagBrotli())
+	_, err = f.WriteHTTP(nil, res, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, res.Code, 304)
+
+	// Frontends without Brotli set keep serving deflate
+	res = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "deflate, br")
+	_, err = cache.NewFrontend(dummyGetter).WriteHTTP(nil, res, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, res.Header().Get("Content-Encoding"), "deflate")
+}
+
+func TestCompressionBudget(t *testing.T) {
+	t.Parallel()
+
+	cache := NewCache(CacheOptions{})
+	f := cache.NewFrontendWithOptions(FrontendOptions{
+		Get: func(k Key, rw *RecordWriter) error {
+			if k.(int) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			return dummyGetter(k, rw)
+		},
+		CompressionBudget: time.Millisecond,
+	})
+
+	for i, level := range [...]int{CompressionLevel, flate.BestSpeed} {
+		rec, err := f.Get(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEquals(t, rec.Meta().CompressionLevel, level)
+
+		var dst int
+		decodeJSON(t, rec, &dst)
+		assertEquals(t, dst, i)
+	}
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	t.Parallel()
+
+	var (
+		log   testLogger
+		cache = NewCache(CacheOptions{
+			Logger: &log,
+		})
+		f = cache.NewFrontendWithOptions(FrontendOptions{
+			Get:             dummyGetter,
+			VerifyChecksums: true,
+		})
+	)
+
+	serve := func() (*httptest.ResponseRecorder, error) {
+		w := httptest.NewRecorder()
+		_, err := f.WriteHTTP(1, w, httptest.NewRequest("GET", "/", nil))
+		return w, err
+	}
+
+	w, err := serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, w.Body.String(), "1\n")
+
+	rec, err := f.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.frame.checksum++
+
+	_, err = serve()
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertEquals(t, len(log.Messages()), 1)
+}
+
+func TestVerifyChecksumsGzip(t *testing.T) {
+	EnableGzip = true
+	defer func() {
+		EnableGzip = false
+	}()
+
+	var (
+		cache = NewCache(CacheOptions{})
+		f     = cache.NewFrontendWithOptions(FrontendOptions{
+			Get:             dummyGetter,
+			VerifyChecksums: true,
+		})
+		w = httptest.NewRecorder()
+	)
+
+	_, err := f.WriteHTTP(1, w, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, w.Body.String(), "1\n")
+}
+
+func TestGetContext(t *testing.T) {
+	t.Parallel()
+
+	type ctxKey struct{}
+
+	var (
+		release = make(chan struct{})
+		cache   = NewCache(CacheOptions{})
+		f       = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				ctx := rw.Context()
+				if k.(int) == 1 {
+					select {
+					case <-release:
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+				}
+				_, err := fmt.Fprint(rw, ctx.Value(ctxKey{}))
+				return err
+			},
+		})
+	)
+
+	// Getter is passed the context
+	ctx := context.WithValue(context.Background(), ctxKey{}, "foo")
+	rec, err := f.GetContext(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	_, err = buf.ReadFrom(rec.Decompress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, buf.String(), "foo")
+
+	// Cancelled population is not cached
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = f.GetContext(cancelled, 1)
+	assertEquals(t, err, context.Canceled)
+
+	// Waiter abandons the wait on cancellation without affecting the
+	// population
+	populated := make(chan error)
+	go func() {
+		_, err := f.GetContext(ctx, 1)
+		populated <- err
+	}()
+	for len(f.InFlight()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	waiter, cancel := context.WithCancel(ctx)
+	abandoned := make(chan error)
+	go func() {
+		_, err := f.GetContext(waiter, 1)
+		abandoned <- err
+	}()
+	for f.Waiters(1) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	assertEquals(t, <-abandoned, context.Canceled)
+	assertEquals(t, f.Waiters(1), 0)
+
+	close(release)
+	err = <-populated
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err = f.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	_, err = buf.ReadFrom(rec.Decompress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, buf.String(), "foo")
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	t.Parallel()
+
+	var (
+		calls   uint32
+		release = make(chan struct{})
+		cache   = NewCache(CacheOptions{})
+		f       = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				n := atomic.AddUint32(&calls, 1)
+				if n > 1 {
+					<-release
+				}
+				rw.SetTTL(time.Hour)
+				return json.NewEncoder(rw).Encode(n)
+			},
+			StaleWhileRevalidate: true,
+		})
+	)
+
+	get := func() (n uint32) {
+		t.Helper()
+
+		rec, err := f.Get(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decodeJSON(t, rec, &n)
+		return
+	}
+
+	assertEquals(t, get(), uint32(1))
+
+	// Records past their TTL are not evicted
+	_, ok := f.ExpiresAt(1)
+	assertEquals(t, ok, false)
+
+	// Stale record served without blocking on regeneration
+	assertEquals(t, f.MarkStale(1), true)
+	assertEquals(t, get(), uint32(1))
+	assertEquals(t, get(), uint32(1))
+
+	close(release)
+	for deadline := time.Now().Add(5 * time.Second); get() != 2; {
+		if time.Now().After(deadline) {
+			t.Fatal("record not revalidated")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assertEquals(t, atomic.LoadUint32(&calls), uint32(2))
+
+	// Past TTL
+	cache.mu.Lock()
+	rec, _ := cache.record(recordLocation{f.id, 1})
+	rec.staleAt = time.Now()
+	cache.frontends[f.id][1] = rec
+	cache.mu.Unlock()
+	assertEquals(t, get(), uint32(2))
+	for deadline := time.Now().Add(5 * time.Second); get() != 3; {
+		if time.Now().After(deadline) {
+			t.Fatal("record not revalidated after TTL")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assertConsistency(t, cache)
+}
+
+func TestContextPropagation(t *testing.T) {
+	t.Parallel()
+
+	type blockKey struct{}
+
+	var (
+		childCalls uint32
+		cache      = NewCache(CacheOptions{})
+		children   = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				atomic.AddUint32(&childCalls, 1)
+				ctx := rw.Context()
+				if ctx.Value(blockKey{}) != nil {
+					<-ctx.Done()
+					return ctx.Err()
+				}
+				return dummyGetter(k, rw)
+			},
+		})
+		parents = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				return rw.Include(children, k)
+			},
+		})
+	)
+
+	blocking := context.WithValue(context.Background(), blockKey{}, true)
+
+	t.Run("cancel tree", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(blocking, 10*time.Millisecond)
+		defer cancel()
+		_, err := parents.GetContext(ctx, 1)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assertEquals(t, len(children.InFlight()), 0)
+		assertEquals(t, children.Stats().Records, 0)
+		assertEquals(t, parents.Stats().Records, 0)
+	})
+
+	t.Run("no retrievals after cancellation", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		before := atomic.LoadUint32(&childCalls)
+		_, err := parents.GetContext(ctx, 2)
+		assertEquals(t, err, context.Canceled)
+		assertEquals(t, atomic.LoadUint32(&childCalls), before)
+	})
+
+	t.Run("waiter retries", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(blocking)
+		defer cancel()
+		abandoned := make(chan error)
+		go func() {
+			_, err := children.GetContext(ctx, 3)
+			abandoned <- err
+		}()
+		for len(children.InFlight()) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		retried := make(chan error)
+		go func() {
+			_, err := children.Get(3)
+			retried <- err
+		}()
+		for children.Waiters(3) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		cancel()
+		assertEquals(t, <-abandoned, context.Canceled)
+		assertEquals(t, <-retried, nil)
+	})
+}
+
+func TestTimeouts(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache    = NewCache(CacheOptions{})
+		children = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				if strings.HasPrefix(k.(string), "slow") {
+					<-rw.Context().Done()
+					return rw.Context().Err()
+				}
+				return dummyGetter(k, rw)
+			},
+		})
+	)
+
+	assertTimeout := func(
+		t *testing.T,
+		err error,
+		budget time.Duration,
+		include bool,
+	) {
+		t.Helper()
+
+		var te *TimeoutError
+		if !errors.As(err, &te) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assertEquals(t, te.Budget, budget)
+		assertEquals(t, te.Include, include)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	t.Run("getter timeout", func(t *testing.T) {
+		t.Parallel()
+
+		f := cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				return rw.Include(children, "slow1")
+			},
+			GetterTimeout: 10 * time.Millisecond,
+		})
+		_, err := f.Get(nil)
+		assertTimeout(t, err, 10*time.Millisecond, false)
+		_, ok := err.(*TimeoutError)
+		assertEquals(t, ok, true)
+	})
+
+	t.Run("include timeout", func(t *testing.T) {
+		t.Parallel()
+
+		f := cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				return rw.Include(children, k)
+			},
+			IncludeTimeout: 10 * time.Millisecond,
+		})
+		_, err := f.Get("fast")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = f.Get("slow2")
+		assertTimeout(t, err, 10*time.Millisecond, true)
+		ie, ok := err.(*IncludeError)
+		if !ok {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assertEquals(t, ie.Frontend, children)
+		assertEquals(t, ie.Key, "slow2")
+	})
+
+	t.Run("split timeout", func(t *testing.T) {
+		t.Parallel()
+
+		var budgets []time.Duration
+		probe := cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				deadline, _ := rw.Context().Deadline()
+				budgets = append(budgets, time.Until(deadline))
+				return dummyGetter(k, rw)
+			},
+		})
+		f := cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) (err error) {
+				rw.SplitTimeout(2)
+				for i := 0; i < 2; i++ {
+					err = rw.Include(probe, i)
+					if err != nil {
+						return
+					}
+				}
+				return
+			},
+			GetterTimeout: time.Minute,
+		})
+		_, err := f.Get(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEquals(t, len(budgets), 2)
+		if budgets[0] > 30*time.Second || budgets[0] < 29*time.Second {
+			t.Fatalf("unexpected first budget: %s", budgets[0])
+		}
+		if budgets[1] < 59*time.Second {
+			t.Fatalf("unexpected second budget: %s", budgets[1])
+		}
+	})
+}
+
+func TestPopulationTimeout(t *testing.T) {
+	t.Parallel()
+
+	var (
+		hang    = true
+		mu      sync.Mutex
+		started = make(chan struct{})
+		release = make(chan struct{})
+		cache   = NewCache(CacheOptions{})
+		f       = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				mu.Lock()
+				h := hang
+				hang = false
+				mu.Unlock()
+
+				// Ignores context cancellation
+				if h {
+					close(started)
+					<-release
+				}
+				return dummyGetter(k, rw)
+			},
+			PopulationTimeout: 10 * time.Millisecond,
+		})
+	)
+
+	hung := make(chan error)
+	go func() {
+		_, err := f.Get("a")
+		hung <- err
+	}()
+	<-started
+
+	_, err := f.Get("a")
+	assertEquals(t, err, ErrPopulationTimeout)
+
+	// Hung record evicted and populated anew
+	rec, err := f.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJsonStringEquals(t, rec, "a")
+
+	// Result of the hung population is discarded
+	close(release)
+	err = <-hung
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached, err := f.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached != rec {
+		t.Fatal("record replaced by timed out population")
+	}
+	assertConsistency(t, cache)
+}
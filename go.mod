@@ -1,8 +1,9 @@
 module github.com/bakape/recache/v6
 
-go 1.13
+go 1.18
 
 require (
+	github.com/andybalholm/brotli v1.1.0
 	github.com/bakape/recache/v5 v5.1.0
 	github.com/bradfitz/gomemcache v0.0.0-20190913173617-a41fca850d0b
 	github.com/davecgh/go-spew v1.1.1 // indirect
@@ -0,0 +1,253 @@
+package recache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Record in a dependency graph
+type GraphNode struct {
+	Frontend *Frontend
+	Key      Key
+}
+
+// Return the location of the record formatted as in IncludeError
+func (n GraphNode) String() string {
+	return fmt.Sprintf(
+		"cache%d/frontend%d/key(%s)",
+		n.Frontend.cache.id,
+		n.Frontend.id,
+		n.Frontend.KeyString(n.Key),
+	)
+}
+
+// Registered dependency of a record on a record it included or bound to.
+// Evicting the dependency evicts the dependent.
+type GraphEdge struct {
+	Dependency, Dependent GraphNode
+
+	// Dependent was registered by a frontend with
+	// FrontendOptions.WeakDependent set
+	Weak bool
+}
+
+// Records of a cache and the dependencies between them, including dependent
+// records in other caches. Created with Cache.DependencyGraph().
+type DependencyGraph struct {
+	Nodes []GraphNode
+	Edges []GraphEdge
+}
+
+// Dependent of a record collected from a cache for resolving
+type rawDependent struct {
+	loc  intercacheRecordLocation
+	weak bool
+}
+
+// Return the records depending on the record by key k, including ones in
+// other caches. These are evicted together with the record. Does not include
+// records depending on them in turn.
+//
+// Returns nil, if the record is not in the cache or has no dependents.
+func (f *Frontend) Dependents(k Key) (dependents []GraphNode) {
+	c := f.cache
+	c.mu.Lock()
+	var raw []rawDependent
+	if c.frontendMeta[f.id].instance == f {
+		if rec, ok := c.record(recordLocation{f.id, k}); ok {
+			raw = collectDependents(rec)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, d := range resolveDependents(raw) {
+		dependents = append(dependents, d.node)
+	}
+	return
+}
+
+// Capture the dependency graph of all records in the cache. Edges to
+// dependents in other caches are included together with their nodes, but
+// their own dependents are not.
+//
+// As other caches are locked separately, the result is not an atomic
+// snapshot under concurrent modification. Useful for debugging eviction
+// cascades. See DependencyGraph.WriteDOT().
+func (c *Cache) DependencyGraph() (g DependencyGraph) {
+	type entry struct {
+		node GraphNode
+		raw  []rawDependent
+	}
+
+	c.mu.Lock()
+	var entries []entry
+	for i, m := range c.frontendMeta {
+		if m.instance == nil {
+			continue
+		}
+		for k, rec := range c.frontends[i] {
+			entries = append(entries, entry{
+				node: GraphNode{m.instance, k},
+				raw:  collectDependents(rec),
+			})
+		}
+	}
+	c.mu.Unlock()
+
+	seen := make(map[string]struct{}, len(entries))
+	addNode := func(n GraphNode) {
+		id := n.String()
+		if _, ok := seen[id]; !ok {
+			seen[id] = struct{}{}
+			g.Nodes = append(g.Nodes, n)
+		}
+	}
+	for _, e := range entries {
+		addNode(e.node)
+	}
+	for _, e := range entries {
+		for _, d := range resolveDependents(e.raw) {
+			addNode(d.node)
+			g.Edges = append(g.Edges, GraphEdge{
+				Dependency: e.node,
+				Dependent:  d.node,
+				Weak:       d.weak,
+			})
+		}
+	}
+
+	// Map iteration order is random
+	sort.Slice(g.Nodes, func(i, j int) bool {
+		return g.Nodes[i].String() < g.Nodes[j].String()
+	})
+	sort.Slice(g.Edges, func(i, j int) bool {
+		a, b := g.Edges[i], g.Edges[j]
+		if s, t := a.Dependency.String(), b.Dependency.String(); s != t {
+			return s < t
+		}
+		return a.Dependent.String() < b.Dependent.String()
+	})
+	return
+}
+
+// Collect the deduplicated dependents of rec. Requires lock on the cache of
+// rec.
+func collectDependents(rec recordWithMeta) (raw []rawDependent) {
+	seen := make(map[intercacheRecordLocation]struct{}, len(rec.includedIn))
+	for _, loc := range rec.includedIn {
+		if _, ok := seen[loc]; !ok {
+			seen[loc] = struct{}{}
+			raw = append(raw, rawDependent{loc: loc})
+		}
+	}
+	for loc := range rec.weakIncludedIn {
+		if _, ok := seen[loc]; !ok {
+			seen[loc] = struct{}{}
+			raw = append(raw, rawDependent{loc: loc, weak: true})
+		}
+	}
+	return
+}
+
+// Dependent resolved to a node
+type resolvedDependent struct {
+	node GraphNode
+	weak bool
+}
+
+// Resolve dependents to nodes, dropping ones already evicted or in closed
+// caches. Must not be called with any cache lock held.
+func resolveDependents(raw []rawDependent) (res []resolvedDependent) {
+	for _, d := range raw {
+		c := getCache(d.loc.cache)
+		if c == nil {
+			continue // Closed cache
+		}
+		c.mu.Lock()
+		if _, ok := c.record(d.loc.recordLocation); ok {
+			res = append(res, resolvedDependent{
+				node: GraphNode{
+					Frontend: c.frontendMeta[d.loc.frontend].instance,
+					Key:      d.loc.key,
+				},
+				weak: d.weak,
+			})
+		}
+		c.mu.Unlock()
+	}
+	return
+}
+
+// Render the graph in the Graphviz DOT language. Records are grouped by cache
+// and edges point from dependencies to their dependents, in the direction
+// evictions cascade. Edges of weak dependents are dashed.
+func (g DependencyGraph) WriteDOT(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("digraph recache {\n")
+
+	var (
+		caches  []*Cache
+		byCache = make(map[*Cache][]GraphNode)
+	)
+	for _, n := range g.Nodes {
+		c := n.Frontend.cache
+		if _, ok := byCache[c]; !ok {
+			caches = append(caches, c)
+		}
+		byCache[c] = append(byCache[c], n)
+	}
+	for _, c := range caches {
+		label := fmt.Sprintf("cache%d", c.id)
+		if c.opts.Name != "" {
+			label += " " + c.opts.Name
+		}
+		fmt.Fprintf(
+			bw,
+			"\tsubgraph cluster_%d {\n\t\tlabel=%s;\n",
+			c.id,
+			dotQuote(label),
+		)
+		for _, n := range byCache[c] {
+			label := fmt.Sprintf("frontend%d", n.Frontend.id)
+			if n.Frontend.opts.Name != "" {
+				label = n.Frontend.opts.Name
+			}
+			label += "\n" + n.Frontend.KeyString(n.Key)
+			fmt.Fprintf(
+				bw,
+				"\t\t%s [label=%s];\n",
+				dotQuote(n.String()),
+				dotQuote(label),
+			)
+		}
+		bw.WriteString("\t}\n")
+	}
+
+	for _, e := range g.Edges {
+		fmt.Fprintf(
+			bw,
+			"\t%s -> %s",
+			dotQuote(e.Dependency.String()),
+			dotQuote(e.Dependent.String()),
+		)
+		if e.Weak {
+			bw.WriteString(" [style=dashed]")
+		}
+		bw.WriteString(";\n")
+	}
+
+	bw.WriteString("}\n")
+	return bw.Flush()
+}
+
+// Quote s as a DOT string
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(
+		`\`, `\\`,
+		`"`, `\"`,
+		"\n", `\n`,
+	).Replace(s) + `"`
+}
@@ -0,0 +1,101 @@
+package recache
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDependencyGraph(t *testing.T) {
+	t.Parallel()
+
+	c1 := NewCache(CacheOptions{Name: "fragments"})
+	c2 := NewCache(CacheOptions{})
+	children := c1.NewFrontendWithOptions(FrontendOptions{
+		Name: "children",
+		Get:  dummyGetter,
+	})
+	include := func(k Key, rw *RecordWriter) error {
+		return rw.Include(children, k)
+	}
+	parents := c1.NewFrontendWithOptions(FrontendOptions{
+		Get: include,
+	})
+	weak := c2.NewFrontendWithOptions(FrontendOptions{
+		Name:          "weak",
+		Get:           include,
+		WeakDependent: true,
+	})
+	for _, f := range [...]*Frontend{parents, weak} {
+		_, err := f.Get("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := children.Get("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEquals(t, children.Dependents("a"), []GraphNode{
+		{parents, "a"},
+		{weak, "a"},
+	})
+	assertEquals(t, len(children.Dependents("b")), 0)
+	assertEquals(t, len(children.Dependents("missing")), 0)
+
+	g := c1.DependencyGraph()
+	assertEquals(t, g.Nodes, []GraphNode{
+		{children, "a"},
+		{children, "b"},
+		{parents, "a"},
+		{weak, "a"},
+	})
+	assertEquals(t, g.Edges, []GraphEdge{
+		{
+			Dependency: GraphNode{children, "a"},
+			Dependent:  GraphNode{parents, "a"},
+		},
+		{
+			Dependency: GraphNode{children, "a"},
+			Dependent:  GraphNode{weak, "a"},
+			Weak:       true,
+		},
+	})
+
+	var w strings.Builder
+	err = g.WriteDOT(&w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dot := w.String()
+	for _, s := range [...]string{
+		"digraph recache {\n",
+		fmt.Sprintf("label=\"cache%d fragments\";", c1.id),
+		fmt.Sprintf(
+			`"cache%d/frontend0/key(\"a\")" [label="children\n\"a\""];`,
+			c1.id,
+		),
+		fmt.Sprintf(
+			`"cache%d/frontend0/key(\"a\")" -> "cache%d/frontend1/key(\"a\")";`,
+			c1.id,
+			c1.id,
+		),
+		fmt.Sprintf(
+			`-> "cache%d/frontend0/key(\"a\")" [style=dashed];`,
+			c2.id,
+		),
+	} {
+		if !strings.Contains(dot, s) {
+			t.Fatalf("%s\nnot found in:\n%s", s, dot)
+		}
+	}
+
+	// Evicted dependents are dropped
+	weak.Evict(0, "a")
+	assertEquals(t, children.Dependents("a"), []GraphNode{
+		{parents, "a"},
+	})
+	children.Delete()
+	assertEquals(t, len(children.Dependents("a")), 0)
+}
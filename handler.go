@@ -0,0 +1,109 @@
+package recache
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Error returned from key derivation functions of Frontend.Handler() to
+// respond with a specific status code, like 404 for unknown resources
+type HTTPError struct {
+	// HTTP status code in range [400, 500). Other codes are responded to
+	// with 400.
+	Status int
+
+	Err error
+}
+
+func (e *HTTPError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
+
+// Return a handler serving records of the frontend with WriteHTTP() by keys
+// derived from the request with key, like with KeyFromRequest(). Makes the
+// frontend usable as a caching layer with any router.
+//
+// Errors of key are responded to with status 400 or the status of a wrapped
+// *HTTPError. Requests with methods other than GET and HEAD are responded to
+// with status 405. Errors retrieving the record are logged and responded to
+// with status 500, if no response data has been written yet.
+func (f *Frontend) Handler(key func(*http.Request) (Key, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(
+				w,
+				http.StatusText(http.StatusMethodNotAllowed),
+				http.StatusMethodNotAllowed,
+			)
+			return
+		}
+
+		k, err := key(r)
+		if err != nil {
+			writeKeyError(w, err)
+			return
+		}
+
+		n, err := f.WriteHTTP(k, w, r)
+		if err != nil {
+			f.cache.logger.Printf(
+				"serving record failed: key=%s: %s",
+				f.KeyString(k),
+				err,
+			)
+			if n == 0 {
+				http.Error(
+					w,
+					http.StatusText(http.StatusInternalServerError),
+					http.StatusInternalServerError,
+				)
+			}
+		}
+	})
+}
+
+// Return a key derivation function for Frontend.Handler(), that produces
+// string keys from the path, query parameters and the listed headers of the
+// request. Query parameters are sorted, so that requests differing only in
+// parameter order share records.
+func KeyFromRequest(headers ...string) func(*http.Request) (Key, error) {
+	headers = append([]string(nil), headers...)
+	for i, h := range headers {
+		headers[i] = http.CanonicalHeaderKey(h)
+	}
+	sort.Strings(headers)
+
+	return func(r *http.Request) (Key, error) {
+		var w strings.Builder
+		w.WriteString(r.URL.EscapedPath())
+		if q := r.URL.Query(); len(q) != 0 {
+			w.WriteByte('?')
+			w.WriteString(q.Encode())
+		}
+		for _, h := range headers {
+			w.WriteByte('\n')
+			w.WriteString(h)
+			w.WriteString(": ")
+			w.WriteString(strings.Join(r.Header.Values(h), ", "))
+		}
+		return w.String(), nil
+	}
+}
+
+// Respond to an error of a key derivation function with status 400 or the
+// status of a wrapped *HTTPError
+func writeKeyError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	var he *HTTPError
+	if errors.As(err, &he) && he.Status >= 400 && he.Status < 500 {
+		status = he.Status
+	}
+	http.Error(w, err.Error(), status)
+}
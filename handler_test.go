@@ -0,0 +1,80 @@
+package recache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache = NewCache(CacheOptions{})
+		keys  []Key
+	)
+	f := cache.NewFrontendWithOptions(FrontendOptions{
+		Get: func(k Key, rw *RecordWriter) (err error) {
+			keys = append(keys, k)
+			if k.(string) == "/fail" {
+				return errors.New("upstream failure")
+			}
+			_, err = fmt.Fprintf(rw, "record %s", k)
+			return
+		},
+	})
+	derive := KeyFromRequest("accept-language")
+	h := f.Handler(func(r *http.Request) (Key, error) {
+		switch r.URL.Path {
+		case "/missing":
+			return nil, &HTTPError{
+				Status: http.StatusNotFound,
+				Err:    errors.New("not found"),
+			}
+		case "/invalid":
+			return nil, errors.New("invalid key")
+		case "/fail":
+			return r.URL.Path, nil
+		}
+		return derive(r)
+	})
+
+	serve := func(method, url, lang string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, url, nil)
+		if lang != "" {
+			r.Header.Set("Accept-Language", lang)
+		}
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve("GET", "/a?y=2&x=1", "en")
+	assertEquals(t, w.Code, http.StatusOK)
+	assertEquals(t, w.Body.String(), "record /a?x=1&y=2\nAccept-Language: en")
+
+	// Same key regardless of query parameter order
+	w = serve("GET", "/a?x=1&y=2", "en")
+	assertEquals(t, w.Code, http.StatusOK)
+	w = serve("HEAD", "/a?x=1&y=2", "en")
+	assertEquals(t, w.Code, http.StatusOK)
+	serve("GET", "/a?x=1&y=2", "de")
+	assertEquals(t, keys, []Key{
+		"/a?x=1&y=2\nAccept-Language: en",
+		"/a?x=1&y=2\nAccept-Language: de",
+	})
+
+	assertEquals(t, serve("GET", "/missing", "").Code, http.StatusNotFound)
+	assertEquals(t, serve("GET", "/invalid", "").Code, http.StatusBadRequest)
+	assertEquals(
+		t,
+		serve("GET", "/fail", "").Code,
+		http.StatusInternalServerError,
+	)
+
+	w = serve("POST", "/a", "")
+	assertEquals(t, w.Code, http.StatusMethodNotAllowed)
+	assertEquals(t, w.Header().Get("Allow"), "GET, HEAD")
+}
@@ -0,0 +1,292 @@
+package recache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Version of the record encoding stored in L2 caches
+const l2Version = 3
+
+// Kinds of components of records encoded for L2 caches
+const (
+	l2Data uint8 = iota
+	l2Placeholder
+)
+
+var (
+	// Record read from an L2 cache could not be decoded
+	errL2Corrupt = errors.New("corrupt L2 record")
+
+	// Record read from an L2 cache was stored without EnableGzip set, while
+	// EnableGzip is set now
+	errL2Gzip = errors.New("L2 record stored without gzip checksums")
+
+	// Record read from an L2 cache was stored with a TTL that has already
+	// passed
+	errL2Expired = errors.New("L2 record expired")
+)
+
+// Second-level cache shared between processes, like Redis. Checked on misses
+// before populating records with the Getter of a frontend, so that multiple
+// instances can share the work of populating records. Must be thread-safe.
+type L2 interface {
+	// Return the data stored at key. ok=false, if there is none.
+	Get(ctx context.Context, key string) (data []byte, ok bool, err error)
+
+	// Store data at key for ttl. Zero ttl means the data does not expire.
+	Set(ctx context.Context, key string, data []byte, ttl time.Duration) error
+}
+
+// Populate a record from FrontendOptions.L2. Returns false, if the record was
+// not found in the L2 cache or retrieving it failed.
+func (f *Frontend) getL2(k Key, rw *RecordWriter) bool {
+	key, err := f.l2Key(k)
+	if err != nil {
+		f.logL2Error("get", k, err)
+		return false
+	}
+	data, ok, err := f.opts.L2.Get(rw.ctx, key)
+	if err != nil {
+		f.logL2Error("get", k, err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+	data, err = f.cache.verifyL2(key, data)
+	if err != nil {
+		f.logL2Error("get", k, err)
+		return false
+	}
+	err = decodeL2(data, rw)
+	if err != nil {
+		f.logL2Error("get", k, err)
+		return false
+	}
+	rw.fromL2 = true
+	return true
+}
+
+// Write a freshly populated record to FrontendOptions.L2
+func (f *Frontend) storeL2(k Key, rec *Record, ttl time.Duration) {
+	key, err := f.l2Key(k)
+	if err != nil {
+		f.logL2Error("set", k, err)
+		return
+	}
+	var expires time.Time
+	if ttl != 0 {
+		expires = time.Now().Add(ttl)
+	}
+	data, err := encodeL2(rec, expires)
+	if err != nil {
+		f.logL2Error("set", k, err)
+		return
+	}
+	if ttl == 0 || (f.opts.L2TTL != 0 && f.opts.L2TTL < ttl) {
+		ttl = f.opts.L2TTL
+	}
+	data = f.cache.signL2(key, data)
+	err = f.opts.L2.Set(context.Background(), key, data, ttl)
+	if err != nil {
+		f.logL2Error("set", k, err)
+	}
+}
+
+// Return the key of a record in FrontendOptions.L2
+func (f *Frontend) l2Key(k Key) (string, error) {
+	buf, err := f.encodeKey(k)
+	if err != nil {
+		return "", err
+	}
+	return f.opts.L2Prefix + string(buf), nil
+}
+
+// Append the signature of data stored at key in an L2 cache, if
+// CacheOptions.SigningKey is set
+func (c *Cache) signL2(key string, data []byte) []byte {
+	mac, ok := c.newMAC()
+	if !ok {
+		return data
+	}
+	mac.string(key)
+	mac.bytes(data)
+	return mac.Sum(data)
+}
+
+// Verify and strip the signature of data read from key in an L2 cache, if
+// CacheOptions.SigningKey is set
+func (c *Cache) verifyL2(key string, data []byte) ([]byte, error) {
+	mac, ok := c.newMAC()
+	if !ok {
+		return data, nil
+	}
+	if len(data) < sha256.Size {
+		return nil, ErrInvalidSignature
+	}
+	data, sig := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	mac.string(key)
+	mac.bytes(data)
+	return data, mac.verify(sig)
+}
+
+func (f *Frontend) logL2Error(op string, k Key, err error) {
+	f.cache.logger.Printf("L2 %s failed: key=%s: %s", op, f.KeyString(k), err)
+}
+
+// Encode record for storage in an L2 cache. Records included by rec are
+// flattened into single components, that retain the hash of the included
+// record, so that the decoded record has the same ETag as rec. Included
+// records containing placeholders are flattened into their own components
+// instead to retain the placeholders.
+//
+// expires: time the TTL of rec passes at. Zero value, if rec has no TTL.
+func encodeL2(rec *Record, expires time.Time) ([]byte, error) {
+	var (
+		w   bytes.Buffer
+		arr [binary.MaxVarintLen64]byte
+	)
+	w.WriteByte(l2Version)
+	if EnableGzip {
+		w.WriteByte(1)
+	} else {
+		w.WriteByte(0)
+	}
+	w.Write(arr[:binary.PutVarint(arr[:], int64(rec.compressionLevel))])
+	var deadline int64
+	if !expires.IsZero() {
+		deadline = expires.UnixNano()
+	}
+	w.Write(arr[:binary.PutVarint(arr[:], deadline)])
+	err := encodeL2Components(&w, rec)
+	if err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+// Encode the components of rec for storage in an L2 cache into w
+func encodeL2Components(w *bytes.Buffer, rec *Record) error {
+	var arr [binary.MaxVarintLen64]byte
+	for n := &rec.data; n != nil; n = n.next {
+		kind := l2Data
+		var data []byte
+		switch c := n.component.(type) {
+		case buffer:
+			data = c.data
+		case recordReference:
+			if c.Record.placeholders {
+				err := encodeL2Components(w, c.Record)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			var buf bytes.Buffer
+			_, err := c.Record.writeTo(&buf)
+			if err != nil {
+				return err
+			}
+			data = buf.Bytes()
+		case placeholder:
+			kind = l2Placeholder
+			data = []byte(c.name)
+		}
+
+		w.WriteByte(kind)
+		frame := n.GetFrameDescriptor()
+		hash := n.Hash()
+		w.Write(hash[:])
+		for _, u := range [...]uint32{frame.checksum, frame.crc32, frame.size} {
+			binary.LittleEndian.PutUint32(arr[:], u)
+			w.Write(arr[:4])
+		}
+		w.Write(arr[:binary.PutUvarint(arr[:], uint64(len(data)))])
+		w.Write(data)
+	}
+	return nil
+}
+
+// Decode record encoded with encodeL2() into rw. The data of each component is
+// verified against its checksum. The remaining TTL of the record, if any, is
+// set on rw.
+func decodeL2(data []byte, rw *RecordWriter) error {
+	if len(data) < 2 || data[0] != l2Version {
+		return errL2Corrupt
+	}
+	if EnableGzip && data[1] == 0 {
+		return errL2Gzip
+	}
+	level, n := binary.Varint(data[2:])
+	if n <= 0 {
+		return errL2Corrupt
+	}
+	data = data[2+n:]
+	deadline, n := binary.Varint(data)
+	if n <= 0 {
+		return errL2Corrupt
+	}
+	data = data[n:]
+	var ttl time.Duration
+	if deadline != 0 {
+		ttl = time.Until(time.Unix(0, deadline))
+		if ttl <= 0 {
+			return errL2Expired
+		}
+	}
+
+	var components []component
+	for len(data) != 0 {
+		const headerSize = 1 + sha1.Size + 3*4
+		if len(data) < headerSize {
+			return errL2Corrupt
+		}
+		kind := data[0]
+		data = data[1:]
+		var b buffer
+		copy(b.hash[:], data)
+		data = data[sha1.Size:]
+		b.frame.checksum = binary.LittleEndian.Uint32(data)
+		b.frame.crc32 = binary.LittleEndian.Uint32(data[4:])
+		b.frame.size = binary.LittleEndian.Uint32(data[8:])
+		data = data[12:]
+
+		l, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < l {
+			return errL2Corrupt
+		}
+		b.data = data[n : n+int(l)]
+		data = data[n+int(l):]
+		switch kind {
+		case l2Data:
+			err := verifyCompressed(b.data, b.frame)
+			if err != nil {
+				return err
+			}
+			components = append(components, b)
+		case l2Placeholder:
+			if len(b.data) == 0 {
+				return errL2Corrupt
+			}
+			components = append(components, newPlaceholder(string(b.data)))
+		default:
+			return errL2Corrupt
+		}
+	}
+	if len(components) == 0 {
+		return errL2Corrupt
+	}
+
+	rw.level = int(level)
+	rw.ttl = ttl
+	for _, c := range components {
+		rw.append(c)
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+package recache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// In-memory L2 cache for tests
+type mapL2 struct {
+	mu   sync.Mutex
+	data map[string][]byte
+	ttls map[string]time.Duration
+}
+
+func newMapL2() *mapL2 {
+	return &mapL2{
+		data: make(map[string][]byte),
+		ttls: make(map[string]time.Duration),
+	}
+}
+
+func (m *mapL2) Get(_ context.Context, key string) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	buf, ok := m.data[key]
+	return buf, ok, nil
+}
+
+func (m *mapL2) Set(
+	_ context.Context,
+	key string,
+	data []byte,
+	ttl time.Duration,
+) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data[key] = data
+	m.ttls[key] = ttl
+	return nil
+}
+
+func (m *mapL2) waitFor(t *testing.T, key string) time.Duration {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		m.mu.Lock()
+		ttl, ok := m.ttls[key]
+		m.mu.Unlock()
+		if ok {
+			return ttl
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("key not written to L2: %s", key)
+	return 0
+}
+
+func TestL2(t *testing.T) {
+	t.Parallel()
+
+	var (
+		l2    = newMapL2()
+		calls int
+		mu    sync.Mutex
+	)
+	newFrontends := func() (children, parents *Frontend) {
+		cache := NewCache(CacheOptions{})
+		children = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				mu.Lock()
+				calls++
+				mu.Unlock()
+				return dummyGetter(k, rw)
+			},
+			L2:       l2,
+			L2Prefix: "children:",
+			L2TTL:    time.Hour,
+		})
+		parents = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) (err error) {
+				mu.Lock()
+				calls++
+				mu.Unlock()
+				if k.(string) == "short" {
+					rw.SetTTL(time.Minute)
+				}
+				_, err = rw.Write([]byte("<"))
+				if err != nil {
+					return
+				}
+				err = rw.Include(children, k)
+				if err != nil {
+					return
+				}
+				_, err = rw.Write([]byte(">"))
+				return
+			},
+			L2:       l2,
+			L2Prefix: "parents:",
+			L2TTL:    time.Hour,
+		})
+		return
+	}
+
+	children, parents := newFrontends()
+	keys := [...]string{"a", "short"}
+	var std [len(keys)]*Record
+	for i, k := range keys {
+		rec, err := parents.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		std[i] = rec
+	}
+	assertEquals(t, calls, 4)
+
+	l2Key := func(f *Frontend, k Key) string {
+		t.Helper()
+		key, err := f.l2Key(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	for _, k := range keys {
+		assertEquals(t, l2.waitFor(t, l2Key(children, k)), time.Hour)
+	}
+	assertEquals(t, l2.waitFor(t, l2Key(parents, "a")), time.Hour)
+	assertEquals(t, l2.waitFor(t, l2Key(parents, "short")), time.Minute)
+
+	// Second instance served from L2 without running getters
+	_, parents = newFrontends()
+	for i, k := range keys {
+		rec, err := parents.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEquals(t, rec.ETag(), std[i].ETag())
+		assertEquals(t, rec.FrameDescriptor(), std[i].FrameDescriptor())
+
+		var dec bytes.Buffer
+		_, err = dec.ReadFrom(rec.Decompress())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEquals(t, dec.String(), fmt.Sprintf("<\"%s\"\n>", k))
+	}
+	mu.Lock()
+	assertEquals(t, calls, 4)
+	mu.Unlock()
+
+	// TTLs carry over to the second instance
+	_, ok := parents.ExpiresAt("a")
+	assertEquals(t, ok, false)
+	exp, ok := parents.ExpiresAt("short")
+	assertEquals(t, ok, true)
+	if d := time.Until(exp); d <= 0 || d > time.Minute {
+		t.Fatalf("unexpected expiry in %s", d)
+	}
+
+	// Corrupt L2 records are regenerated
+	l2.Set(context.Background(), l2Key(parents, "b"), []byte{l2Version, 0}, 0)
+	rec, err := parents.Get("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dec bytes.Buffer
+	_, err = dec.ReadFrom(rec.Decompress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, dec.String(), "<\"b\"\n>")
+	mu.Lock()
+	assertEquals(t, calls, 6)
+	mu.Unlock()
+}
+
+func TestL2Signed(t *testing.T) {
+	t.Parallel()
+
+	var (
+		l2    = newMapL2()
+		calls int
+		mu    sync.Mutex
+	)
+	newFrontend := func(key string) *Frontend {
+		return NewCache(CacheOptions{
+			SigningKey: []byte(key),
+		}).NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				mu.Lock()
+				calls++
+				mu.Unlock()
+				return dummyGetter(k, rw)
+			},
+			L2:       l2,
+			L2Prefix: "signed:",
+		})
+	}
+	assertCalls := func(n int) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		assertEquals(t, calls, n)
+	}
+
+	f := newFrontend("key")
+	_, err := f.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := f.l2Key(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2.waitFor(t, key)
+	assertCalls(1)
+
+	// Served from L2 with the same key
+	_, err = newFrontend("key").Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertCalls(1)
+
+	// Regenerated with a different key
+	_, err = newFrontend("other").Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertCalls(2)
+
+	// Regenerated after tampering
+	l2.mu.Lock()
+	data := append([]byte(nil), l2.data[key]...)
+	data[len(data)-sha256.Size-1]++
+	l2.data[key] = data
+	l2.mu.Unlock()
+	_, err = newFrontend("key").Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertCalls(3)
+}
+
+func TestL2Corrupt(t *testing.T) {
+	t.Parallel()
+
+	var (
+		l2    = newMapL2()
+		calls int
+		mu    sync.Mutex
+	)
+	newFrontend := func() *Frontend {
+		return NewCache(CacheOptions{}).NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				mu.Lock()
+				calls++
+				mu.Unlock()
+				return dummyGetter(k, rw)
+			},
+			L2:       l2,
+			L2Prefix: "corrupt:",
+		})
+	}
+
+	f := newFrontend()
+	_, err := f.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := f.l2Key(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2.waitFor(t, key)
+
+	// Corrupt the checksum of the first component
+	l2.mu.Lock()
+	data := append([]byte(nil), l2.data[key]...)
+	_, n := binary.Varint(data[2:])
+	_, m := binary.Varint(data[2+n:])
+	data[2+n+m+1+sha1.Size]++
+	l2.data[key] = data
+	l2.mu.Unlock()
+
+	// Regenerated without a signing key
+	_, err = newFrontend().Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	assertEquals(t, calls, 2)
+}
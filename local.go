@@ -0,0 +1,62 @@
+package recache
+
+// Small unsynchronized first level cache of records retrieved from any
+// frontends, intended to live for a single request or goroutine. Repeated
+// retrievals of the same record do not lock the shared cache.
+//
+// Records retrieved from frontends are promoted into the LocalCache
+// automatically. As records are immutable, a record retrieved through a
+// LocalCache stays valid for the lifetime of the LocalCache, even if evicted
+// from its frontend, giving a consistent view of records for the duration of
+// a request.
+//
+// Must not be used concurrently.
+type LocalCache struct {
+	limit   int
+	records map[localKey]*Record
+}
+
+// Key of a record in a LocalCache
+type localKey struct {
+	frontend *Frontend
+	key      Key
+}
+
+// Create a new LocalCache storing at most limit records.
+// Zero value disables the limit.
+func NewLocalCache(limit uint) *LocalCache {
+	return &LocalCache{
+		limit:   int(limit),
+		records: make(map[localKey]*Record),
+	}
+}
+
+// Retrieve a record by key from the LocalCache or from frontend f, if not
+// stored in the LocalCache. Records retrieved from f are stored in the
+// LocalCache, unless it is full.
+func (c *LocalCache) Get(f *Frontend, k Key) (*Record, error) {
+	lk := localKey{f, k}
+	if rec, ok := c.records[lk]; ok {
+		return rec, nil
+	}
+
+	rec, err := f.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	if c.limit == 0 || len(c.records) < c.limit {
+		c.records[lk] = rec
+	}
+	return rec, nil
+}
+
+// Remove a record by key of frontend f from the LocalCache. The record is
+// retrieved from f again on the next retrieval.
+func (c *LocalCache) Forget(f *Frontend, k Key) {
+	delete(c.records, localKey{f, k})
+}
+
+// Return the amount of records stored in the LocalCache
+func (c *LocalCache) Len() int {
+	return len(c.records)
+}
@@ -0,0 +1,55 @@
+package recache
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestLocalCache(t *testing.T) {
+	t.Parallel()
+
+	var (
+		calls uint32
+		cache = NewCache(CacheOptions{})
+		f     = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				atomic.AddUint32(&calls, 1)
+				return dummyGetter(k, rw)
+			},
+		})
+		local = NewLocalCache(2)
+	)
+
+	first, err := local.Get(f, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Served from the local cache after eviction from the frontend
+	f.Evict(0, 1)
+	rec, err := local.Get(f, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, rec, first)
+	assertEquals(t, atomic.LoadUint32(&calls), uint32(1))
+
+	for _, k := range [...]int{2, 3} {
+		_, err := local.Get(f, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertEquals(t, local.Len(), 2)
+
+	local.Forget(f, 1)
+	assertEquals(t, local.Len(), 1)
+	rec, err = local.Get(f, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec == first {
+		t.Fatal("forgotten record served")
+	}
+	assertEquals(t, atomic.LoadUint32(&calls), uint32(4))
+}
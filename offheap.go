@@ -0,0 +1,89 @@
+//go:build recache_offheap && unix
+
+package recache
+
+import (
+	"runtime"
+	"sync"
+	"syscall"
+)
+
+const (
+	// Size of each anonymous memory mapping small buffers are allocated from
+	arenaSize = 1 << 20
+
+	// Buffers larger than this get their own mapping
+	maxArenaAllocation = arenaSize / 8
+
+	// Record data is allocated outside the Go heap
+	offHeap = true
+)
+
+// Anonymous memory mapping record data is allocated from. Unmapped by a
+// finalizer, once no buffer references it.
+type mapping struct {
+	mem []byte
+}
+
+// Keeps the mapping the data of a buffer was allocated from mapped
+type memHandle *mapping
+
+var (
+	// Mapping small buffers are currently allocated from and the amount of
+	// its bytes allocated
+	arenaMu  sync.Mutex
+	arena    *mapping
+	arenaLen int
+)
+
+// Allocate a byte slice of length n for record data outside the Go heap. The
+// slice stays valid as long as the returned handle is reachable. Panics, if
+// mapping memory fails.
+//
+// Memory outside the Go heap is neither scanned by the garbage collector nor
+// counted towards the heap size it paces collections by. Records are read
+// after eviction and their data is shared by records created with
+// Cache.Adopt(), Frontend.Rebuild() and Frontend.Append(), so mappings are
+// released by the garbage collector once unreachable instead of explicitly on
+// eviction. Readers of record data must hold the handle for their lifetime.
+func allocate(n int) ([]byte, memHandle) {
+	if n == 0 {
+		return nil, nil
+	}
+	if n > maxArenaAllocation {
+		m := newMapping(n)
+		return m.mem[:n:n], m
+	}
+
+	arenaMu.Lock()
+	defer arenaMu.Unlock()
+
+	if arena == nil || len(arena.mem)-arenaLen < n {
+		arena = newMapping(arenaSize)
+		arenaLen = 0
+	}
+	l := arenaLen
+	arenaLen += n
+	return arena.mem[l : l+n : l+n], arena
+}
+
+// Map at least n bytes of anonymous memory
+func newMapping(n int) *mapping {
+	page := syscall.Getpagesize()
+	n = (n + page - 1) / page * page
+	mem, err := syscall.Mmap(
+		-1,
+		0,
+		n,
+		syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_ANON|syscall.MAP_PRIVATE,
+	)
+	if err != nil {
+		panic(err)
+	}
+	m := &mapping{mem}
+	runtime.SetFinalizer(m, func(m *mapping) {
+		syscall.Munmap(m.mem)
+	})
+	return m
+}
@@ -0,0 +1,118 @@
+//go:build recache_offheap && unix
+
+package recache
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"math/rand"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestOffHeap(t *testing.T) {
+	t.Parallel()
+
+	cache := NewCache(CacheOptions{})
+	f := cache.NewFrontendWithOptions(FrontendOptions{
+		Get: dummyGetter,
+	})
+	var recs [100]*Record
+	for i := range recs {
+		rec, err := f.Get(fmt.Sprint(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		recs[i] = rec
+	}
+
+	a, ha := allocate(3)
+	b, hb := allocate(5)
+	assertEquals(t, len(a), 3)
+	assertEquals(t, cap(a), 3)
+	assertEquals(t, ha, hb)
+	large, hl := allocate(maxArenaAllocation + 1)
+	assertEquals(t, len(large), maxArenaAllocation+1)
+	if hl == ha {
+		t.Fatal("large allocation not mapped separately")
+	}
+	copy(b, "bytes")
+	assertEquals(t, string(b), "bytes")
+	runtime.KeepAlive(ha)
+
+	// Evicted records remain readable, until unreachable
+	cache.EvictAll(0)
+	for i := 0; i < 3; i++ {
+		runtime.GC()
+	}
+	for i, rec := range recs {
+		assertJsonStringEquals(t, rec, fmt.Sprint(i))
+	}
+}
+
+func TestOffHeapReaderAfterEviction(t *testing.T) {
+	t.Parallel()
+
+	// Incompressible data larger than maxArenaAllocation gets its own mapping,
+	// that is not kept alive by the current arena
+	data := make([]byte, 2*maxArenaAllocation)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	cache := NewCache(CacheOptions{})
+	f := cache.NewFrontend(func(k Key, rw *RecordWriter) error {
+		_, err := rw.Write(data)
+		return err
+	})
+
+	cases := [...]struct {
+		name       string
+		open       func(rec *Record) io.Reader
+		compressed bool
+	}{
+		{"NewReader", (*Record).NewReader, true},
+		{"Decompress", (*Record).Decompress, false},
+		{
+			"Open",
+			func(rec *Record) io.Reader {
+				r, _ := rec.Open()
+				return r
+			},
+			false,
+		},
+		{
+			"NewReadSeeker",
+			func(rec *Record) io.Reader {
+				return rec.NewReadSeeker()
+			},
+			false,
+		},
+	}
+
+	for i, c := range cases {
+		rec, err := f.Get(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := c.open(rec)
+		rec = nil
+		f.Evict(0, i)
+		for i := 0; i < 3; i++ {
+			runtime.GC()
+			time.Sleep(10 * time.Millisecond) // Let finalizers run
+		}
+
+		if c.compressed {
+			r = flate.NewReader(r)
+		}
+		buf, err := io.ReadAll(r)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, data) {
+			t.Fatalf("%s: record data corrupted", c.name)
+		}
+	}
+}
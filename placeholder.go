@@ -0,0 +1,215 @@
+package recache
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/sha1"
+	"hash/adler32"
+	"hash/crc32"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Content filling a placeholder written with RecordWriter.Placeholder() at
+// serve time and its caching policy. Either Frontend and Key or Data are used.
+//
+// Policies apply to each fill separately, so a mostly static page can embed
+// both per-user and long-lived per-locale content without fragmenting the
+// cache of the page itself.
+type Fill struct {
+	// Record to fill the placeholder with, retrieved or generated as with
+	// Frontend.Get(). Placeholders in this record are not filled.
+	Frontend *Frontend
+	Key      Key
+
+	// Data to fill the placeholder with, if Frontend is nil
+	Data []byte
+
+	// Generate the record of Frontend for each response without storing it
+	// in the cache, like for content varying by user
+	Bypass bool
+
+	// Maximum age of the record of Frontend to fill the placeholder with.
+	// Older records are marked stale and regenerated as with
+	// Frontend.MarkStale(), so records including them are only evicted, if
+	// the content changed. Concurrent retrievals and retrievals from
+	// frontends with FrontendOptions.StaleWhileRevalidate are served the
+	// older record until it is replaced. 0 to use records until they are
+	// evicted.
+	TTL time.Duration
+
+	// Add the "private" directive to the "Cache-Control" header of responses
+	// containing the fill, replacing any "public" directive
+	Private bool
+
+	// Set the "Cache-Control" header of responses containing the fill to
+	// "no-store"
+	NoStore bool
+}
+
+// Retrieve or generate the record of the fill
+func (fill Fill) record(ctx context.Context) (rec *Record, err error) {
+	f := fill.Frontend
+	if fill.Bypass {
+		rec, err = f.populateDetached(
+			ctx,
+			fill.Key,
+			f.compressionLevel(time.Now()),
+		)
+	} else {
+		rec, err = f.getGeneratedRecord(ctx, fill.Key)
+		if err == nil &&
+			fill.TTL > 0 &&
+			time.Since(rec.refreshedAt()) >= fill.TTL &&
+			f.cache.markRecordStale(recordLocation{f.id, fill.Key}, rec) {
+			rec, err = f.getGeneratedRecord(ctx, fill.Key)
+		}
+	}
+	if err != nil {
+		err = &IncludeError{
+			Frontend: f,
+			Key:      fill.Key,
+			Err:      err,
+		}
+	}
+	return
+}
+
+// Return a record with all placeholders of rec by key k and records included
+// in it filled for the request r with FrontendOptions.FillPlaceholder.
+// Returns rec, if there is nothing to fill.
+//
+// The returned record is not stored in the cache and its ETag is derived from
+// the hashes of rec and all fills. Restrictions on HTTP caching of the fills
+// are recorded in it.
+func (f *Frontend) fillPlaceholders(
+	ctx context.Context,
+	r *http.Request,
+	k Key,
+	rec *Record,
+) (*Record, error) {
+	if !rec.placeholders || f.opts.FillPlaceholder == nil {
+		return rec, nil
+	}
+	var private, noStore bool
+	filled, err := fillRecord(rec, func(name string) (component, error) {
+		fill, err := f.opts.FillPlaceholder(r, k, name)
+		if err != nil {
+			return nil, err
+		}
+		private = private || fill.Private
+		noStore = noStore || fill.NoStore
+		if fill.Frontend == nil {
+			return compressFill(fill.Data)
+		}
+
+		frag, err := fill.record(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return recordReference{
+			componentCommon: componentCommon{
+				hash: frag.hash,
+			},
+			Record:   frag,
+			frontend: fill.Frontend,
+			key:      fill.Key,
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	filled.fillPrivate = private
+	filled.fillNoStore = noStore
+	return filled, nil
+}
+
+// Copy rec with all placeholders of it and included records replaced with
+// the component returned by fill for the placeholder name
+func fillRecord(
+	rec *Record,
+	fill func(name string) (component, error),
+) (filled *Record, err error) {
+	if !rec.placeholders {
+		return rec, nil
+	}
+
+	filled = &Record{
+		frontend:         rec.frontend,
+		created:          rec.created,
+		version:          rec.version,
+		ttl:              atomic.LoadInt64(&rec.ttl),
+		expires:          atomic.LoadInt64(&rec.expires),
+		dependencies:     rec.dependencies,
+		holes:            rec.holes,
+		compressionLevel: rec.compressionLevel,
+	}
+	filled.attachment.Store(attachment{rec.Attachment()})
+	var (
+		last *componentNode
+		h    = sha1.New()
+	)
+	for c := &rec.data; c != nil; c = c.next {
+		comp := c.component
+		switch c := comp.(type) {
+		case placeholder:
+			comp, err = fill(c.name)
+		case recordReference:
+			c.Record, err = fillRecord(c.Record, fill)
+			if err == nil {
+				c.componentCommon.hash = c.Record.hash
+				comp = c
+			}
+		}
+		if err != nil {
+			return
+		}
+
+		if last == nil {
+			filled.data.component = comp
+			last = &filled.data
+			filled.frame = comp.GetFrameDescriptor()
+		} else {
+			last.next = &componentNode{component: comp}
+			last = last.next
+			filled.frame.Append(comp.GetFrameDescriptor())
+		}
+		filled.length += comp.length()
+		arr := comp.Hash()
+		h.Write(arr[:])
+	}
+	copy(filled.hash[:], h.Sum(nil))
+	filled.eTag = formatETag(filled.hash)
+	return
+}
+
+// Compress data filling a placeholder into a buffer component
+func compressFill(data []byte) (component, error) {
+	var (
+		b   buffer
+		out bytes.Buffer
+	)
+	w, err := flate.NewWriter(&out, CompressionLevel)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	b.data = out.Bytes()
+	b.hash = sha1.Sum(b.data)
+	b.frame.size = uint32(len(data))
+	b.frame.checksum = adler32.Checksum(data)
+	if EnableGzip {
+		b.frame.crc32 = crc32.ChecksumIEEE(data)
+	}
+	return b, nil
+}
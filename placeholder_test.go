@@ -0,0 +1,313 @@
+package recache
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPlaceholders(t *testing.T) {
+	t.Parallel()
+
+	cache := NewCache(CacheOptions{})
+	footerOpts := FrontendOptions{
+		Get: func(k Key, rw *RecordWriter) (err error) {
+			_, err = rw.Write([]byte("<footer>"))
+			if err != nil {
+				return
+			}
+			err = rw.Placeholder("nav")
+			if err != nil {
+				return
+			}
+			_, err = rw.Write([]byte("</footer>"))
+			return
+		},
+	}
+	footers := cache.NewFrontendWithOptions(footerOpts)
+	navs := cache.NewFrontendWithOptions(FrontendOptions{
+		Get: func(k Key, rw *RecordWriter) error {
+			_, err := rw.Write([]byte("<nav>" + k.(string) + "</nav>"))
+			return err
+		},
+	})
+	pageOpts := FrontendOptions{
+		Get: func(k Key, rw *RecordWriter) (err error) {
+			_, err = rw.Write([]byte("<p>Hello, "))
+			if err != nil {
+				return
+			}
+			err = rw.Placeholder("user")
+			if err != nil {
+				return
+			}
+			_, err = rw.Write([]byte("!</p>"))
+			if err != nil {
+				return
+			}
+			return rw.Include(footers, k)
+		},
+		FillPlaceholder: func(r *http.Request, k Key, name string) (
+			Fill, error,
+		) {
+			user := r.Header.Get("X-User")
+			switch name {
+			case "user":
+				if user == "" {
+					return Fill{}, errors.New("no user")
+				}
+				return Fill{Data: []byte(user)}, nil
+			case "nav":
+				return Fill{Frontend: navs, Key: user}, nil
+			default:
+				return Fill{}, errors.New("unknown placeholder: " + name)
+			}
+		},
+	}
+	pages := cache.NewFrontendWithOptions(pageOpts)
+
+	expected := func(user string) string {
+		return "<p>Hello, " + user + "!</p><footer><nav>" + user +
+			"</nav></footer>"
+	}
+	serve := func(user, encoding, eTag string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-User", user)
+		if encoding != "" {
+			r.Header.Set("Accept-Encoding", encoding)
+		}
+		if eTag != "" {
+			r.Header.Set("If-None-Match", eTag)
+		}
+		_, err := pages.WriteHTTP("a", w, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	eTags := make(map[string]string)
+	for _, user := range [...]string{"alice", "bob"} {
+		w := serve(user, "", "")
+		assertEquals(t, w.Body.String(), expected(user))
+		eTags[user] = w.Header().Get("ETag")
+
+		w = serve(user, "deflate", "")
+		zr, err := zlib.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEquals(t, string(buf), expected(user))
+	}
+	if eTags["alice"] == eTags["bob"] {
+		t.Fatal("ETag does not vary by fill")
+	}
+	assertEquals(t, serve("alice", "", "").Header().Get("ETag"), eTags["alice"])
+	assertEquals(t, serve("alice", "", eTags["alice"]).Code, 304)
+	assertEquals(t, serve("bob", "", eTags["alice"]).Code, 200)
+	assertEquals(t, pages.Stats().Populations, uint64(1))
+
+	// Fill errors are returned
+	_, err := pages.WriteHTTP(
+		"a",
+		httptest.NewRecorder(),
+		httptest.NewRequest("GET", "/", nil),
+	)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	// Unfilled placeholders are empty
+	rec, err := pages.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadAll(rec.Decompress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, string(buf), "<p>Hello, !</p><footer></footer>")
+	comps := rec.Components()
+	assertEquals(t, comps[1].Type, PlaceholderComponent)
+	assertEquals(t, comps[1].Placeholder, "user")
+	if err := (&RecordWriter{}).Placeholder(""); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// Placeholders are retained in L2 caches
+	data, err := encodeL2(rec, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rw RecordWriter
+	err = decodeL2(data, &rw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dec Record
+	dec.assemble(&rw)
+	assertEquals(t, dec.placeholders, true)
+	var names []string
+	for _, c := range dec.Components() {
+		if c.Type == PlaceholderComponent {
+			names = append(names, c.Placeholder)
+		}
+	}
+	assertEquals(t, names, []string{"user", "nav"})
+
+	// Placeholders are retained in snapshots
+	var snap bytes.Buffer
+	err = cache.Snapshot(&snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, fs, err := LoadCache(
+		&snap,
+		CacheOptions{},
+		footerOpts,
+		FrontendOptions{Get: navs.opts.Get},
+		pageOpts,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err = fs[2].Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, rec.placeholders, true)
+	assertEquals(t, rec.Components()[1].Placeholder, "user")
+}
+
+func TestFillPolicies(t *testing.T) {
+	t.Parallel()
+
+	var userPopulations, localePopulations int32
+	cache := NewCache(CacheOptions{})
+	users := cache.NewFrontendWithOptions(FrontendOptions{
+		Get: func(k Key, rw *RecordWriter) error {
+			atomic.AddInt32(&userPopulations, 1)
+			_, err := rw.Write([]byte(k.(string)))
+			return err
+		},
+	})
+	locales := cache.NewFrontendWithOptions(FrontendOptions{
+		Get: func(k Key, rw *RecordWriter) error {
+			atomic.AddInt32(&localePopulations, 1)
+			_, err := rw.Write([]byte(k.(string)))
+			return err
+		},
+	})
+	wrappers := cache.NewFrontend(func(k Key, rw *RecordWriter) error {
+		return rw.Include(locales, k)
+	})
+	pages := cache.NewFrontendWithOptions(FrontendOptions{
+		Get: func(k Key, rw *RecordWriter) (err error) {
+			err = rw.Placeholder("user")
+			if err != nil {
+				return
+			}
+			_, err = rw.Write([]byte("/"))
+			if err != nil {
+				return
+			}
+			return rw.Placeholder("locale")
+		},
+		HTTPCachePolicy: &HTTPCachePolicy{
+			Public: true,
+			MaxAge: time.Minute,
+		},
+		FillPlaceholder: func(r *http.Request, k Key, name string) (
+			Fill, error,
+		) {
+			switch name {
+			case "user":
+				return Fill{
+					Frontend: users,
+					Key:      r.Header.Get("X-User"),
+					Bypass:   true,
+					NoStore:  r.Header.Get("X-User") != "",
+				}, nil
+			default:
+				ttl := time.Hour
+				if r.Header.Get("X-Refresh") != "" {
+					ttl = time.Nanosecond
+				}
+				return Fill{
+					Frontend: locales,
+					Key:      "en",
+					TTL:      ttl,
+					Private:  true,
+				}, nil
+			}
+		},
+	})
+
+	serve := func(user string, refresh bool) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-User", user)
+		if refresh {
+			r.Header.Set("X-Refresh", "1")
+		}
+		_, err := pages.WriteHTTP("a", w, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	// Bypassed fills are generated for each response and not stored
+	for i := 0; i < 2; i++ {
+		w := serve("alice", false)
+		assertEquals(t, w.Body.String(), "alice/en")
+		assertEquals(t, w.Header().Get("Cache-Control"), "no-store")
+	}
+	assertEquals(t, atomic.LoadInt32(&userPopulations), int32(2))
+	assertEquals(t, atomic.LoadInt32(&localePopulations), int32(1))
+	if _, ok := users.Version("alice"); ok {
+		t.Fatal("bypassed fill stored")
+	}
+
+	// Private fills restrict the page caching policy
+	w := serve("", false)
+	assertEquals(t, w.Body.String(), "/en")
+	assertEquals(t, w.Header().Get("Cache-Control"), "private, max-age=60")
+
+	// Fill records older than their TTL are regenerated without evicting
+	// records including them, if their content did not change
+	_, err := wrappers.Get("en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshed := time.Now()
+	serve("", true)
+	assertEquals(t, atomic.LoadInt32(&localePopulations), int32(2))
+	assertEquals(t, pages.Stats().Populations, uint64(1))
+	if _, ok := wrappers.Version("en"); !ok {
+		t.Fatal("including record evicted")
+	}
+
+	// The age of retained records counts from their regeneration
+	rec, err := locales.Get("en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.refreshedAt().Before(refreshed) {
+		t.Fatal("regeneration time not recorded")
+	}
+	assertConsistency(t, cache)
+}
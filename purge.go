@@ -0,0 +1,134 @@
+package recache
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Operation on the cache requested through an externally exposed surface
+type Operation uint8
+
+const (
+	// Evicting a record by key
+	EvictOperation Operation = iota
+
+	// Evicting all records depending on a token. The key passed to an
+	// Authorizer is the token.
+	InvalidateTokenOperation
+)
+
+func (o Operation) String() string {
+	switch o {
+	case EvictOperation:
+		return "evict"
+	case InvalidateTokenOperation:
+		return "invalidate token"
+	default:
+		return fmt.Sprintf("Operation(%d)", uint8(o))
+	}
+}
+
+// Authorizes an operation on a record of a frontend by key requested through
+// an externally exposed surface, like Frontend.PurgeHandler(). r is the request
+// of the operation, for identifying the requesting party by its credentials or
+// its context. Returning an error denies the operation. Must be thread-safe.
+type Authorizer func(r *http.Request, op Operation, f *Frontend, k Key) error
+
+// Options for Frontend.PurgeHandler()
+type PurgeOptions struct {
+	// HTTP method of requests evicting a single record.
+	//
+	// Defaults to "PURGE".
+	PurgeMethod string
+
+	// Extracts the key of the record to evict from a purge request. An error
+	// is responded to with status 400. Required.
+	Key func(*http.Request) (Key, error)
+
+	// HTTP method of requests evicting all records depending on any of the
+	// space-separated tokens in the "Surrogate-Key" header of the request, as
+	// with Cache.InvalidateToken().
+	//
+	// Defaults to "BAN".
+	BanMethod string
+
+	// Authorizes each eviction or token invalidation. Denied requests are
+	// responded to with status 403 and no operations are performed.
+	Authorize Authorizer
+}
+
+// Wrap next with a handler translating Varnish-style purge requests into
+// evictions, so existing CDN invalidation tooling can be pointed at the
+// server. Requests with other methods are passed on to next.
+//
+// Purge requests are not authorized without PurgeOptions.Authorize, so the
+// handler must be wrapped with access control of its own in that case, if
+// exposed publicly.
+func (f *Frontend) PurgeHandler(
+	next http.Handler,
+	opts PurgeOptions,
+) http.Handler {
+	if opts.PurgeMethod == "" {
+		opts.PurgeMethod = "PURGE"
+	}
+	if opts.BanMethod == "" {
+		opts.BanMethod = "BAN"
+	}
+
+	// Returns, if the operation is authorized. Responds to the request, if
+	// not.
+	authorize := func(
+		w http.ResponseWriter,
+		r *http.Request,
+		op Operation,
+		k Key,
+	) bool {
+		if opts.Authorize == nil {
+			return true
+		}
+		err := opts.Authorize(r, op, f, k)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case opts.PurgeMethod:
+			k, err := opts.Key(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !authorize(w, r, EvictOperation, k) {
+				return
+			}
+			f.Evict(0, k)
+		case opts.BanMethod:
+			tokens := strings.Fields(r.Header.Get("Surrogate-Key"))
+			if len(tokens) == 0 {
+				http.Error(
+					w,
+					"no Surrogate-Key header",
+					http.StatusBadRequest,
+				)
+				return
+			}
+			for _, t := range tokens {
+				if !authorize(w, r, InvalidateTokenOperation, t) {
+					return
+				}
+			}
+			for _, t := range tokens {
+				f.cache.InvalidateToken(t)
+			}
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
@@ -0,0 +1,153 @@
+package recache
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestPurgeHandler(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache = NewCache(CacheOptions{})
+		f     = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				rw.DependOn("tag-" + k.(string))
+				return dummyGetter(k, rw)
+			},
+		})
+		h = f.PurgeHandler(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusTeapot)
+			}),
+			PurgeOptions{
+				Key: func(r *http.Request) (Key, error) {
+					if r.URL.Path == "/" {
+						return nil, errors.New("no key")
+					}
+					return r.URL.Path[1:], nil
+				},
+			},
+		)
+	)
+
+	serve := func(t *testing.T, method, path, tags string) int {
+		t.Helper()
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		if tags != "" {
+			req.Header.Set("Surrogate-Key", tags)
+		}
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for _, k := range [...]string{"a", "b", "c", "d"} {
+		_, err := f.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertEquals(t, serve(t, "GET", "/a", ""), http.StatusTeapot)
+	assertEquals(t, f.Touch("a"), true)
+
+	assertEquals(t, serve(t, "PURGE", "/a", ""), http.StatusOK)
+	assertEquals(t, f.Touch("a"), false)
+	assertEquals(t, serve(t, "PURGE", "/", ""), http.StatusBadRequest)
+
+	assertEquals(t, serve(t, "BAN", "/", "tag-b  tag-c"), http.StatusOK)
+	assertEquals(t, serve(t, "BAN", "/", ""), http.StatusBadRequest)
+	for k, ok := range map[string]bool{"b": false, "c": false, "d": true} {
+		assertEquals(t, f.Touch(k), ok)
+	}
+}
+
+func TestPurgeHandlerAuthorize(t *testing.T) {
+	t.Parallel()
+
+	type request struct {
+		op Operation
+		k  Key
+	}
+
+	var (
+		mu        sync.Mutex
+		requests  []request
+		errDenied = errors.New("denied")
+		cache     = NewCache(CacheOptions{})
+		f         *Frontend
+	)
+	f = cache.NewFrontendWithOptions(FrontendOptions{
+		Get: func(k Key, rw *RecordWriter) error {
+			rw.DependOn("tag-" + k.(string))
+			return dummyGetter(k, rw)
+		},
+	})
+	h := f.PurgeHandler(nil, PurgeOptions{
+		Key: func(r *http.Request) (Key, error) {
+			return r.URL.Path[1:], nil
+		},
+		Authorize: func(
+			r *http.Request,
+			op Operation,
+			frontend *Frontend,
+			k Key,
+		) error {
+			if frontend != f {
+				t.Error("unexpected frontend")
+			}
+			if r.Header.Get("Authorization") != "Bearer token" {
+				t.Error("request not passed to Authorizer")
+			}
+			mu.Lock()
+			requests = append(requests, request{op, k})
+			mu.Unlock()
+			if k == "denied" || k == "tag-denied" {
+				return errDenied
+			}
+			return nil
+		},
+	})
+
+	serve := func(t *testing.T, method, path, tags string) int {
+		t.Helper()
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Surrogate-Key", tags)
+		req.Header.Set("Authorization", "Bearer token")
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for _, k := range [...]string{"a", "b", "denied"} {
+		_, err := f.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertEquals(t, serve(t, "PURGE", "/denied", ""), http.StatusForbidden)
+	assertEquals(
+		t,
+		serve(t, "BAN", "/", "tag-b tag-denied"),
+		http.StatusForbidden,
+	)
+	assertEquals(t, serve(t, "PURGE", "/a", ""), http.StatusOK)
+	for k, ok := range map[string]bool{"a": false, "b": true, "denied": true} {
+		assertEquals(t, f.Touch(k), ok)
+	}
+
+	assertEquals(t, requests, []request{
+		{EvictOperation, "denied"},
+		{InvalidateTokenOperation, "tag-b"},
+		{InvalidateTokenOperation, "tag-denied"},
+		{EvictOperation, "a"},
+	})
+	assertEquals(t, InvalidateTokenOperation.String(), "invalidate token")
+}
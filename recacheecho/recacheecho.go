@@ -0,0 +1,44 @@
+// Package recacheecho adapts recache frontends to the Echo web framework.
+//
+// Kept in a separate module to not require Echo for all users of recache.
+package recacheecho
+
+import (
+	"github.com/bakape/recache/v6"
+	"github.com/labstack/echo/v4"
+)
+
+// Return a handler serving records of f with Frontend.WriteHTTP() by keys
+// extracted from the request with key
+func Handler(
+	f *recache.Frontend,
+	key func(echo.Context) (recache.Key, error),
+) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		k, err := key(c)
+		if err != nil {
+			return err
+		}
+		_, err = f.WriteHTTP(k, c.Response(), c.Request())
+		return err
+	}
+}
+
+// Return a middleware serving records of f with Frontend.WriteHTTP() by keys
+// extracted from the request with key. Requests, for which key returns
+// ok=false, are passed on to the next handler.
+func Middleware(
+	f *recache.Frontend,
+	key func(echo.Context) (k recache.Key, ok bool),
+) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			k, ok := key(c)
+			if !ok {
+				return next(c)
+			}
+			_, err := f.WriteHTTP(k, c.Response(), c.Request())
+			return err
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package recacheecho
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bakape/recache/v6"
+	"github.com/labstack/echo/v4"
+)
+
+func newFrontend() *recache.Frontend {
+	return recache.NewCache(recache.CacheOptions{}).NewFrontendWithOptions(
+		recache.FrontendOptions{
+			Get: func(k recache.Key, rw *recache.RecordWriter) (err error) {
+				_, err = rw.Write([]byte("record " + k.(string)))
+				return
+			},
+		},
+	)
+}
+
+func serve(t *testing.T, e *echo.Echo, path string) string {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", path, nil)
+	req.Header.Set("Accept-Encoding", "deflate")
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", rec.Code)
+	}
+	if rec.Header().Get("Content-Encoding") != "deflate" {
+		return rec.Body.String()
+	}
+
+	r, err := zlib.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	_, err = io.Copy(&b, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestHandler(t *testing.T) {
+	f := newFrontend()
+	e := echo.New()
+	e.GET("/:id", Handler(f, func(c echo.Context) (recache.Key, error) {
+		return c.Param("id"), nil
+	}))
+
+	if s := serve(t, e, "/foo"); s != "record foo" {
+		t.Fatalf("unexpected body: %s", s)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	f := newFrontend()
+	e := echo.New()
+	e.Use(Middleware(f, func(c echo.Context) (recache.Key, bool) {
+		p := c.Request().URL.Path
+		if !strings.HasPrefix(p, "/cached/") {
+			return nil, false
+		}
+		return strings.TrimPrefix(p, "/cached/"), true
+	}))
+	e.GET("/*", func(c echo.Context) error {
+		return c.String(http.StatusOK, "uncached")
+	})
+
+	if s := serve(t, e, "/cached/foo"); s != "record foo" {
+		t.Fatalf("unexpected body: %s", s)
+	}
+	if s := serve(t, e, "/other"); s != "uncached" {
+		t.Fatalf("unexpected body: %s", s)
+	}
+}
@@ -0,0 +1,77 @@
+// Package recachegin adapts recache frontends to the Gin web framework.
+//
+// Kept in a separate module to not require Gin for all users of recache.
+package recachegin
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/bakape/recache/v6"
+	"github.com/gin-gonic/gin"
+)
+
+// Return a handler serving records of f with Frontend.WriteHTTP() by keys
+// extracted from the request with key.
+//
+// Errors are attached to the context with gin.Context.Error(). Errors
+// returned by key abort the request with status 400 or the status of a wrapped
+// *recache.HTTPError, same as with Frontend.Handler(). Errors retrieving the
+// record abort the request with status 500, if no response data has been
+// written yet.
+func Handler(
+	f *recache.Frontend,
+	key func(*gin.Context) (recache.Key, error),
+) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		k, err := key(c)
+		if err != nil {
+			c.AbortWithError(keyErrorStatus(err), err)
+			return
+		}
+		serve(c, f, k)
+	}
+}
+
+// Return a middleware serving records of f with Frontend.WriteHTTP() by keys
+// extracted from the request with key. Requests, for which key returns
+// ok=false, are passed on to the next handler. Served requests are aborted.
+//
+// Errors are attached to the context with gin.Context.Error(). Errors
+// retrieving the record abort the request with status 500, if no response data
+// has been written yet.
+func Middleware(
+	f *recache.Frontend,
+	key func(*gin.Context) (k recache.Key, ok bool),
+) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		k, ok := key(c)
+		if !ok {
+			c.Next()
+			return
+		}
+		serve(c, f, k)
+		c.Abort()
+	}
+}
+
+// Serve record of f by key k
+func serve(c *gin.Context, f *recache.Frontend, k recache.Key) {
+	n, err := f.WriteHTTP(k, c.Writer, c.Request)
+	if err != nil {
+		c.Error(err)
+		if n == 0 && !c.Writer.Written() {
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}
+	}
+}
+
+// Return the status to respond to an error of a key function with. Mirrors
+// Frontend.Handler().
+func keyErrorStatus(err error) int {
+	var he *recache.HTTPError
+	if errors.As(err, &he) && he.Status >= 400 && he.Status < 500 {
+		return he.Status
+	}
+	return http.StatusBadRequest
+}
@@ -0,0 +1,126 @@
+package recachegin
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bakape/recache/v6"
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func newFrontend() *recache.Frontend {
+	return recache.NewCache(recache.CacheOptions{}).NewFrontendWithOptions(
+		recache.FrontendOptions{
+			Get: func(k recache.Key, rw *recache.RecordWriter) (err error) {
+				_, err = rw.Write([]byte("record " + k.(string)))
+				return
+			},
+		},
+	)
+}
+
+func doRequest(t *testing.T, r *gin.Engine, path string) string {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", path, nil)
+	req.Header.Set("Accept-Encoding", "deflate")
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", rec.Code)
+	}
+	if rec.Header().Get("Content-Encoding") != "deflate" {
+		return rec.Body.String()
+	}
+
+	zr, err := zlib.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	_, err = io.Copy(&b, zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestHandler(t *testing.T) {
+	f := newFrontend()
+	r := gin.New()
+	r.GET("/:id", Handler(f, func(c *gin.Context) (recache.Key, error) {
+		return c.Param("id"), nil
+	}))
+
+	if s := doRequest(t, r, "/foo"); s != "record foo" {
+		t.Fatalf("unexpected body: %s", s)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	f := newFrontend()
+	r := gin.New()
+	r.Use(Middleware(f, func(c *gin.Context) (recache.Key, bool) {
+		p := c.Request.URL.Path
+		if !strings.HasPrefix(p, "/cached/") {
+			return nil, false
+		}
+		return strings.TrimPrefix(p, "/cached/"), true
+	}))
+	r.GET("/*path", func(c *gin.Context) {
+		c.String(http.StatusOK, "uncached")
+	})
+
+	if s := doRequest(t, r, "/cached/foo"); s != "record foo" {
+		t.Fatalf("unexpected body: %s", s)
+	}
+	if s := doRequest(t, r, "/other"); s != "uncached" {
+		t.Fatalf("unexpected body: %s", s)
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	f := recache.NewCache(recache.CacheOptions{}).NewFrontendWithOptions(
+		recache.FrontendOptions{
+			Get: func(k recache.Key, rw *recache.RecordWriter) error {
+				return errors.New("upstream failure")
+			},
+		},
+	)
+	r := gin.New()
+	r.GET("/:id", Handler(f, func(c *gin.Context) (recache.Key, error) {
+		switch id := c.Param("id"); id {
+		case "bad":
+			return nil, errors.New("bad key")
+		case "missing":
+			return nil, &recache.HTTPError{
+				Status: http.StatusNotFound,
+				Err:    errors.New("not found"),
+			}
+		default:
+			return id, nil
+		}
+	}))
+
+	for path, status := range map[string]int{
+		"/bad":     http.StatusBadRequest,
+		"/missing": http.StatusNotFound,
+		"/fail":    http.StatusInternalServerError,
+	} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != status {
+			t.Fatalf("%s: unexpected status: %d", path, rec.Code)
+		}
+	}
+}
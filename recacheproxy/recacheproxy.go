@@ -0,0 +1,414 @@
+// Package recacheproxy provides a caching reverse proxy storing responses of
+// an origin server in recache records.
+//
+// Responses are stored compressed and served with
+// recache.Frontend.WriteRecordHTTP(), so clients get correct ETag,
+// Content-Encoding and range request handling regardless of the origin.
+package recacheproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bakape/recache/v6"
+)
+
+// Response headers of the origin not stored with records. Headers describing
+// the encoding of the response are set by recache.Frontend.WriteHTTP() and
+// the rest are hop-by-hop or specific to a single response.
+var skippedHeaders = map[string]struct{}{
+	"Accept-Ranges":      {},
+	"Age":                {},
+	"Connection":         {},
+	"Content-Encoding":   {},
+	"Content-Length":     {},
+	"Content-Range":      {},
+	"Date":               {},
+	"Etag":               {},
+	"Keep-Alive":         {},
+	"Proxy-Authenticate": {},
+	"Proxy-Connection":   {},
+	"Te":                 {},
+	"Trailer":            {},
+	"Transfer-Encoding":  {},
+	"Upgrade":            {},
+}
+
+// Options of a Proxy
+type Options struct {
+	// Origin server to forward cache misses to. Required.
+	Origin *url.URL
+
+	// Options of the frontend storing responses. Get is set by the proxy.
+	Frontend recache.FrontendOptions
+
+	// Request headers, that select different responses of the origin, like
+	// "Accept-Language". Requests with different values of these headers are
+	// cached separately and the headers are forwarded to the origin.
+	VaryHeaders []string
+
+	// Time to live of responses without a "max-age" or "s-maxage" directive
+	// in their "Cache-Control" header.
+	//
+	// Zero value keeps such responses until evicted.
+	DefaultTTL time.Duration
+
+	// Customizes the underlying reverse proxy, like setting its Transport.
+	// Called once on creation.
+	ModifyProxy func(*httputil.ReverseProxy)
+}
+
+// Caching reverse proxy. Serves GET and HEAD requests from the cache and
+// forwards cache misses to the origin. Only successful responses without
+// "Set-Cookie" headers and not marked "private", "no-store", "no-cache" or
+// "max-age=0" are cached. Other responses and requests with other methods or
+// an "Authorization" header are passed through.
+//
+// Stale records, like ones marked with recache.Frontend.MarkStale() or past
+// their TTL with recache.FrontendOptions.StaleWhileRevalidate, are
+// revalidated with conditional requests to the origin and reused, if not
+// modified.
+type Proxy struct {
+	frontend *recache.Frontend
+	proxy    *httputil.ReverseProxy
+	key      func(*http.Request) (recache.Key, error)
+	opts     Options
+}
+
+// Response headers of the origin attached to a record with
+// recache.RecordWriter.SetAttachment()
+type storedHeaders struct {
+	// Headers replayed to clients with the record
+	header http.Header
+
+	// ETag of the origin response for revalidating the record with the origin
+	etag string
+}
+
+// Response of the origin that must not be cached. Returned as the population
+// error of the record after streaming the response to the client, that
+// started the population. Other clients waiting on the record forward their
+// requests to the origin themselves, as uncacheable responses must not be
+// shared.
+type passthroughError struct {
+	status int
+}
+
+// Key of the client of a request in the context passed to
+// recache.Frontend.GetContext()
+type clientKey struct{}
+
+// Client request, that uncacheable responses of the origin are streamed to
+type client struct {
+	w http.ResponseWriter
+
+	// Response of the origin was written to w
+	served bool
+}
+
+func (e *passthroughError) Error() string {
+	return fmt.Sprintf("uncacheable origin response: status=%d", e.status)
+}
+
+// Create a caching reverse proxy storing responses in a new frontend of cache
+func New(cache *recache.Cache, opts Options) *Proxy {
+	p := &Proxy{
+		proxy: httputil.NewSingleHostReverseProxy(opts.Origin),
+		key:   recache.KeyFromRequest(opts.VaryHeaders...),
+		opts:  opts,
+	}
+	if opts.ModifyProxy != nil {
+		opts.ModifyProxy(p.proxy)
+	}
+	fopts := opts.Frontend
+	fopts.Get = p.get
+	p.frontend = cache.NewFrontendWithOptions(fopts)
+	return p
+}
+
+// Return the frontend storing responses for inspecting statistics and
+// evicting records. Keys are produced by recache.KeyFromRequest() with
+// Options.VaryHeaders.
+func (p *Proxy) Frontend() *recache.Frontend {
+	return p.frontend
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) ||
+		r.Header.Get("Authorization") != "" {
+		p.proxy.ServeHTTP(w, r)
+		return
+	}
+
+	k, err := p.key(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Populate with the context of the request, so that abandoned requests
+	// do not keep fetching from the origin
+	c := &client{w: w}
+	rec, err := p.frontend.GetContext(
+		context.WithValue(r.Context(), clientKey{}, c),
+		k,
+	)
+	if err != nil {
+		var pe *passthroughError
+		switch {
+		case c.served:
+			// Uncacheable response streamed by the population
+		case errors.As(err, &pe):
+			p.proxy.ServeHTTP(w, r)
+		default:
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		}
+		return
+	}
+
+	if h, ok := rec.Attachment().(storedHeaders); ok {
+		copyHeader(w.Header(), h.header)
+	}
+	p.frontend.WriteRecordHTTP(k, rec, w, r)
+}
+
+// Fetch the response for key k from the origin and stream it into rw. Stale
+// records being replaced are revalidated with the origin and reused, if not
+// modified.
+func (p *Proxy) get(k recache.Key, rw *recache.RecordWriter) (err error) {
+	req, err := requestFromKey(k.(string))
+	if err != nil {
+		return
+	}
+	req = req.WithContext(rw.Context())
+
+	var (
+		prev         = rw.Previous()
+		stored       storedHeaders
+		revalidating bool
+	)
+	if prev != nil {
+		stored, _ = prev.Attachment().(storedHeaders)
+		if stored.etag != "" {
+			req.Header.Set("If-None-Match", stored.etag)
+			revalidating = true
+		}
+		if lm := stored.header.Get("Last-Modified"); lm != "" {
+			req.Header.Set("If-Modified-Since", lm)
+			revalidating = true
+		}
+	}
+
+	c, _ := rw.Context().Value(clientKey{}).(*client)
+	w := &recordResponseWriter{
+		rw:           rw,
+		client:       c,
+		header:       make(http.Header),
+		revalidating: revalidating,
+	}
+	p.proxy.ServeHTTP(w, req)
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	switch {
+	case w.err != nil:
+		return w.err
+	case revalidating && w.status == http.StatusNotModified:
+		// Reuse the content of the stale record with headers refreshed from
+		// the origin
+		h := stored.header.Clone()
+		for name, values := range w.header {
+			h[name] = values
+		}
+		if h.Get("Etag") == "" && stored.etag != "" {
+			h.Set("Etag", stored.etag)
+		}
+		if !cacheable(http.StatusOK, h) {
+			return &passthroughError{status: http.StatusOK}
+		}
+		_, err = rw.ReadFrom(prev.Decompress())
+		if err != nil {
+			return
+		}
+		w.header = h
+	case !w.cacheable:
+		return &passthroughError{status: w.status}
+	case !w.written:
+		// Records must not be empty
+		w.pass()
+		return &passthroughError{status: w.status}
+	}
+
+	if ttl, ok := maxAge(w.header.Get("Cache-Control")); ok {
+		rw.SetTTL(ttl)
+	} else if p.opts.DefaultTTL != 0 {
+		rw.SetTTL(p.opts.DefaultTTL)
+	}
+	rw.SetAttachment(newStoredHeaders(w.header))
+	return
+}
+
+// Select the response headers of the origin to store with a record
+func newStoredHeaders(src http.Header) storedHeaders {
+	h := make(http.Header, len(src))
+	for name, values := range src {
+		if _, ok := skippedHeaders[name]; !ok {
+			h[name] = values
+		}
+	}
+	return storedHeaders{
+		header: h,
+		etag:   src.Get("Etag"),
+	}
+}
+
+// Reconstruct the request to forward to the origin from a key produced by
+// recache.KeyFromRequest()
+func requestFromKey(k string) (req *http.Request, err error) {
+	lines := strings.Split(k, "\n")
+	req, err = http.NewRequest(http.MethodGet, lines[0], nil)
+	if err != nil {
+		return
+	}
+	for _, l := range lines[1:] {
+		i := strings.Index(l, ": ")
+		if i == -1 {
+			return nil, fmt.Errorf("invalid key: %q", k)
+		}
+		if v := l[i+2:]; v != "" {
+			req.Header.Set(l[:i], v)
+		}
+	}
+	return
+}
+
+// Return the TTL of a response from the "s-maxage" or "max-age" directive of
+// its "Cache-Control" header, preferring the former
+func maxAge(cc string) (ttl time.Duration, ok bool) {
+	for _, dir := range strings.Split(cc, ",") {
+		dir = strings.TrimSpace(dir)
+		i := strings.IndexByte(dir, '=')
+		if i == -1 {
+			continue
+		}
+		name := strings.ToLower(dir[:i])
+		if name != "s-maxage" && (name != "max-age" || ok) {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.Trim(dir[i+1:], `"`), 10, 64)
+		if err != nil || n < 0 {
+			continue
+		}
+		ttl, ok = time.Duration(n)*time.Second, true
+		if name == "s-maxage" {
+			return
+		}
+	}
+	return
+}
+
+// Return, if a response of the origin with status and header can be cached.
+// Responses, that must be revalidated on each use, are not cached.
+func cacheable(status int, header http.Header) bool {
+	if status != http.StatusOK || len(header.Values("Set-Cookie")) != 0 {
+		return false
+	}
+	cc := header.Get("Cache-Control")
+	for _, dir := range strings.Split(cc, ",") {
+		switch strings.ToLower(strings.TrimSpace(dir)) {
+		case "no-store", "no-cache", "private":
+			return false
+		}
+	}
+	if ttl, ok := maxAge(cc); ok && ttl == 0 {
+		return false
+	}
+	return true
+}
+
+func copyHeader(dst, src http.Header) {
+	for name, values := range src {
+		if _, ok := dst[name]; !ok {
+			dst[name] = values
+		}
+	}
+}
+
+// Streams cacheable origin responses into a RecordWriter and uncacheable ones
+// to the client, that started the population, if any
+type recordResponseWriter struct {
+	rw           *recache.RecordWriter
+	client       *client
+	header       http.Header
+	status       int
+	wroteHeader  bool
+	cacheable    bool
+	revalidating bool
+	written      bool
+	err          error
+}
+
+func (w *recordResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *recordResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+	w.cacheable = cacheable(status, w.header)
+
+	// Responses to revalidation are handled after the origin responds
+	if !w.cacheable &&
+		!(w.revalidating && status == http.StatusNotModified) {
+		w.pass()
+	}
+}
+
+// Write the response headers to the client, if any
+func (w *recordResponseWriter) pass() {
+	if w.client == nil {
+		return
+	}
+	copyHeader(w.client.w.Header(), w.header)
+	w.client.w.WriteHeader(w.status)
+	w.client.served = true
+}
+
+func (w *recordResponseWriter) Write(p []byte) (n int, err error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.cacheable {
+		if w.client == nil || !w.client.served {
+			return len(p), nil
+		}
+		return w.client.w.Write(p)
+	}
+	if len(p) != 0 {
+		w.written = true
+	}
+	n, err = w.rw.Write(p)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return
+}
+
+// Flush streamed uncacheable responses to the client
+func (w *recordResponseWriter) Flush() {
+	if w.client != nil && w.client.served {
+		if f, ok := w.client.w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+}
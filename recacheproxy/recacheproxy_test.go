@@ -0,0 +1,312 @@
+package recacheproxy
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bakape/recache/v6"
+)
+
+func newProxy(t *testing.T) (p *Proxy, requests *int64) {
+	t.Helper()
+
+	requests = new(int64)
+	origin := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(requests, 1)
+			h := w.Header()
+			switch r.URL.Path {
+			case "/stream":
+				// Blocks after the first chunk until the client disconnects
+				h.Set("Cache-Control", "no-store")
+				w.Write([]byte("first"))
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+				return
+			case "/missing":
+				http.NotFound(w, r)
+				return
+			case "/private":
+				h.Set("Cache-Control", "private")
+			case "/no-cache":
+				h.Set("Cache-Control", "no-cache")
+			case "/no-store":
+				h.Set("Cache-Control", "no-store")
+			case "/max-age-0":
+				h.Set("Cache-Control", "public, max-age=0")
+			case "/s-maxage-0":
+				h.Set("Cache-Control", "max-age=60, s-maxage=0")
+			case "/cookie":
+				h.Set("Set-Cookie", "a=b")
+			case "/ttl":
+				h.Set("Cache-Control", "public, max-age=60, s-maxage=3600")
+			case "/revalidate":
+				if r.Header.Get("If-None-Match") == `"origin"` {
+					h.Set("X-Revalidated", "1")
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+			}
+			h.Set("Content-Type", "text/plain")
+			h.Set("ETag", `"origin"`)
+			fmt.Fprintf(
+				w,
+				"%s %s %s",
+				r.Method,
+				r.URL.RequestURI(),
+				r.Header.Get("Accept-Language"),
+			)
+		},
+	))
+	t.Cleanup(origin.Close)
+
+	u, err := url.Parse(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p = New(recache.NewCache(recache.CacheOptions{}), Options{
+		Origin:      u,
+		VaryHeaders: []string{"Accept-Language"},
+	})
+	return
+}
+
+func serve(
+	p *Proxy,
+	method, path string,
+	header map[string]string,
+) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, path, nil)
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	p.ServeHTTP(w, r)
+	return w
+}
+
+func TestProxy(t *testing.T) {
+	t.Parallel()
+
+	p, requests := newProxy(t)
+
+	w := serve(p, "GET", "/a?y=1&x=2", nil)
+	assertEquals(t, w.Code, http.StatusOK)
+	assertEquals(t, w.Body.String(), "GET /a?x=2&y=1 ")
+	assertEquals(t, w.Header().Get("Content-Type"), "text/plain")
+	eTag := w.Header().Get("ETag")
+	if eTag == `"origin"` || eTag == "" {
+		t.Fatalf("unexpected ETag: %s", eTag)
+	}
+
+	// Served compressed from the cache
+	w = serve(p, "GET", "/a?x=2&y=1", map[string]string{
+		"Accept-Encoding": "deflate",
+	})
+	assertEquals(t, w.Code, http.StatusOK)
+	assertEquals(t, w.Header().Get("Content-Encoding"), "deflate")
+	assertEquals(t, w.Header().Get("Content-Type"), "text/plain")
+	r, err := zlib.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dec bytes.Buffer
+	_, err = io.Copy(&dec, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, dec.String(), "GET /a?x=2&y=1 ")
+
+	w = serve(p, "HEAD", "/a?x=2&y=1", map[string]string{
+		"If-None-Match": eTag,
+	})
+	assertEquals(t, w.Code, http.StatusNotModified)
+	assertEquals(t, atomic.LoadInt64(requests), int64(1))
+
+	// Varying headers are forwarded and cached separately
+	w = serve(p, "GET", "/a?x=2&y=1", map[string]string{
+		"Accept-Language": "de",
+	})
+	assertEquals(t, w.Body.String(), "GET /a?x=2&y=1 de")
+	assertEquals(t, atomic.LoadInt64(requests), int64(2))
+
+	// Each request looks up the record once
+	s := p.Frontend().Stats()
+	assertEquals(t, s.Hits, uint64(2))
+	assertEquals(t, s.Misses, uint64(2))
+}
+
+func TestProxyStreamPassthrough(t *testing.T) {
+	t.Parallel()
+
+	p, _ := newProxy(t)
+	srv := httptest.NewServer(p)
+	t.Cleanup(srv.Close)
+
+	client := http.Client{Timeout: 5 * time.Second}
+	res, err := client.Get(srv.URL + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	assertEquals(t, res.Header.Get("Cache-Control"), "no-store")
+
+	// Received before the origin finishes the response
+	buf := make([]byte, len("first"))
+	_, err = io.ReadFull(res.Body, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, string(buf), "first")
+}
+
+func TestProxyPassthrough(t *testing.T) {
+	t.Parallel()
+
+	p, requests := newProxy(t)
+
+	cases := [...]struct {
+		name, method, path string
+		header             map[string]string
+		status             int
+	}{
+		{"not found", "GET", "/missing", nil, http.StatusNotFound},
+		{"private", "GET", "/private", nil, http.StatusOK},
+		{"no-cache", "GET", "/no-cache", nil, http.StatusOK},
+		{"no-store", "GET", "/no-store", nil, http.StatusOK},
+		{"max-age=0", "GET", "/max-age-0", nil, http.StatusOK},
+		{"s-maxage=0", "GET", "/s-maxage-0", nil, http.StatusOK},
+		{"cookie", "GET", "/cookie", nil, http.StatusOK},
+		{"post", "POST", "/a", nil, http.StatusOK},
+		{
+			"authorization",
+			"GET",
+			"/a",
+			map[string]string{"Authorization": "Bearer x"},
+			http.StatusOK,
+		},
+	}
+	for _, c := range cases {
+		before := atomic.LoadInt64(requests)
+		for i := 0; i < 2; i++ {
+			w := serve(p, c.method, c.path, c.header)
+			assertEquals(t, w.Code, c.status)
+		}
+		if n := atomic.LoadInt64(requests) - before; n != 2 {
+			t.Fatalf("%s: expected 2 origin requests, got %d", c.name, n)
+		}
+	}
+	assertEquals(t, p.Frontend().Stats().Records, 0)
+
+	w := serve(p, "GET", "/cookie", nil)
+	assertEquals(t, w.Header().Get("Set-Cookie"), "a=b")
+	assertEquals(t, w.Body.String(), "GET /cookie ")
+}
+
+func TestProxyTTL(t *testing.T) {
+	t.Parallel()
+
+	p, _ := newProxy(t)
+	start := time.Now()
+	serve(p, "GET", "/ttl", nil)
+
+	k, err := recache.KeyFromRequest("Accept-Language")(
+		httptest.NewRequest("GET", "/ttl", nil),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp, ok := p.Frontend().ExpiresAt(k)
+	assertEquals(t, ok, true)
+	if d := exp.Sub(start); d < time.Hour || d > time.Hour+time.Second {
+		t.Fatalf("unexpected expiry: %s", d)
+	}
+}
+
+func TestProxyRevalidation(t *testing.T) {
+	t.Parallel()
+
+	p, requests := newProxy(t)
+	w := serve(p, "GET", "/revalidate", nil)
+	assertEquals(t, w.Body.String(), "GET /revalidate ")
+
+	k, err := recache.KeyFromRequest("Accept-Language")(
+		httptest.NewRequest("GET", "/revalidate", nil),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, p.Frontend().MarkStale(k), true)
+
+	w = serve(p, "GET", "/revalidate", nil)
+	assertEquals(t, w.Code, http.StatusOK)
+	assertEquals(t, w.Body.String(), "GET /revalidate ")
+	assertEquals(t, w.Header().Get("X-Revalidated"), "1")
+	assertEquals(t, w.Header().Get("Content-Type"), "text/plain")
+	assertEquals(t, atomic.LoadInt64(requests), int64(2))
+
+	// Origin ETag retained for further revalidation
+	assertEquals(t, p.Frontend().MarkStale(k), true)
+	w = serve(p, "GET", "/revalidate", nil)
+	assertEquals(t, w.Body.String(), "GET /revalidate ")
+	assertEquals(t, atomic.LoadInt64(requests), int64(3))
+	rec, ok := p.Frontend().Peek(k)
+	assertEquals(t, ok, true)
+	assertEquals(t, rec.Attachment().(storedHeaders).etag, `"origin"`)
+}
+
+func TestProxyHeadersAfterEviction(t *testing.T) {
+	t.Parallel()
+
+	p, _ := newProxy(t)
+	for i := 0; i < 100; i++ {
+		serve(p, "GET", fmt.Sprintf("/%d", i), nil)
+	}
+	p.Frontend().EvictAll(0)
+
+	// Headers of the record being populated are stored with it
+	for i := 0; i < 2; i++ {
+		w := serve(p, "GET", "/new", nil)
+		assertEquals(t, w.Body.String(), "GET /new ")
+		assertEquals(t, w.Header().Get("Content-Type"), "text/plain")
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	t.Parallel()
+
+	cases := [...]struct {
+		cc  string
+		ttl time.Duration
+		ok  bool
+	}{
+		{"", 0, false},
+		{"no-cache", 0, false},
+		{"max-age=60", time.Minute, true},
+		{"max-age=0", 0, true},
+		{"max-age=0, s-maxage=60", time.Minute, true},
+		{"max-age=60, s-maxage=3600", time.Hour, true},
+		{"s-maxage=3600, max-age=60", time.Hour, true},
+		{"max-age=x", 0, false},
+	}
+	for _, c := range cases {
+		ttl, ok := maxAge(c.cc)
+		assertEquals(t, ttl, c.ttl)
+		assertEquals(t, ok, c.ok)
+	}
+}
+
+func assertEquals(t *testing.T, res, std interface{}) {
+	t.Helper()
+	if res != std {
+		t.Fatalf("\nexpected: %#v\ngot:      %#v", std, res)
+	}
+}
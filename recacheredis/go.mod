@@ -0,0 +1,16 @@
+module github.com/bakape/recache/v6/recacheredis
+
+go 1.18
+
+require (
+	github.com/bakape/recache/v6 v6.0.0
+	github.com/go-redis/redis/v8 v8.1.3
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.1.1 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	go.opentelemetry.io/otel v0.11.0 // indirect
+)
+
+replace github.com/bakape/recache/v6 => ../
@@ -0,0 +1,90 @@
+// Package recacheredis provides a Redis-backed recache.L2 cache and
+// recache.InvalidationBus.
+//
+// Kept in a separate module to not require a Redis client for all users of
+// recache.
+package recacheredis
+
+import (
+	"context"
+	"time"
+
+	"github.com/bakape/recache/v6"
+	"github.com/go-redis/redis/v8"
+)
+
+// Redis-backed second-level cache. Set as FrontendOptions.L2 of frontends to
+// share records between instances connected to the same Redis server.
+type L2 struct {
+	client redis.UniversalClient
+}
+
+var _ recache.L2 = L2{}
+
+// Create an L2 cache storing records with client
+func New(client redis.UniversalClient) L2 {
+	return L2{client}
+}
+
+func (l L2) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	buf, err := l.client.Get(ctx, key).Bytes()
+	switch err {
+	case nil:
+		return buf, true, nil
+	case redis.Nil:
+		return nil, false, nil
+	default:
+		return nil, false, err
+	}
+}
+
+func (l L2) Set(
+	ctx context.Context,
+	key string,
+	data []byte,
+	ttl time.Duration,
+) error {
+	return l.client.Set(ctx, key, data, ttl).Err()
+}
+
+// Redis pub/sub invalidation bus. Set as CacheOptions.InvalidationBus of caches
+// to broadcast evictions between instances connected to the same Redis server.
+type Bus struct {
+	client  redis.UniversalClient
+	channel string
+}
+
+var _ recache.InvalidationBus = Bus{}
+
+// Create an invalidation bus publishing evictions on channel with client
+func NewBus(client redis.UniversalClient, channel string) Bus {
+	return Bus{client, channel}
+}
+
+func (b Bus) Publish(ctx context.Context, msg []byte) error {
+	return b.client.Publish(ctx, b.channel, msg).Err()
+}
+
+func (b Bus) Subscribe(ctx context.Context, handle func(msg []byte)) error {
+	sub := b.client.Subscribe(ctx, b.channel)
+	defer sub.Close()
+
+	// Wait for the subscription to be confirmed to return connection errors
+	_, err := sub.Receive(ctx)
+	if err != nil {
+		return err
+	}
+
+	ch := sub.Channel()
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			handle([]byte(msg.Payload))
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package recacheredis
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bakape/recache/v6"
+	"github.com/go-redis/redis/v8"
+)
+
+func newClient(t *testing.T) *redis.Client {
+	t.Helper()
+
+	addr := os.Getenv("REDIS_ADDRESS")
+	if addr == "" {
+		addr = "localhost:6379"
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	err := client.Ping(context.Background()).Err()
+	if err != nil {
+		client.Close()
+		t.Skipf("redis not reachable at %s: %s", addr, err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestL2(t *testing.T) {
+	client := newClient(t)
+	l2 := New(client)
+	ctx := context.Background()
+	key := "recacheredis:test:" + time.Now().String()
+	defer client.Del(ctx, key)
+
+	_, ok, err := l2.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("unexpected value")
+	}
+
+	err = l2.Set(ctx, key, []byte("value"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, ok, err := l2.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || string(buf) != "value" {
+		t.Fatalf("unexpected value: %q %v", buf, ok)
+	}
+}
+
+func TestFrontend(t *testing.T) {
+	l2 := New(newClient(t))
+	prefix := "recacheredis:frontend:" + time.Now().String() + ":"
+	newFrontend := func(calls *int) *recache.Frontend {
+		return recache.NewCache(recache.CacheOptions{}).NewFrontendWithOptions(
+			recache.FrontendOptions{
+				Get: func(k recache.Key, rw *recache.RecordWriter) (err error) {
+					*calls++
+					_, err = rw.Write([]byte("record " + k.(string)))
+					return
+				},
+				L2:       l2,
+				L2Prefix: prefix,
+				L2TTL:    time.Minute,
+			},
+		)
+	}
+
+	var calls int
+	std, err := newFrontend(&calls).Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Written to L2 in the background
+	var (
+		rec    *recache.Record
+		fromL2 bool
+	)
+	for i := 0; i < 100 && !fromL2; i++ {
+		var otherCalls int
+		rec, err = newFrontend(&otherCalls).Get("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fromL2 = otherCalls == 0
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !fromL2 {
+		t.Fatal("record not served from L2")
+	}
+	if rec.ETag() != std.ETag() {
+		t.Fatalf("ETag mismatch: %s != %s", rec.ETag(), std.ETag())
+	}
+	var b bytes.Buffer
+	_, err = b.ReadFrom(rec.Decompress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != "record a" {
+		t.Fatalf("unexpected record: %s", b.String())
+	}
+}
+
+func TestBus(t *testing.T) {
+	bus := NewBus(newClient(t), "recacheredis:bus:"+time.Now().String())
+	newFrontend := func() *recache.Frontend {
+		return recache.NewCache(recache.CacheOptions{
+			InvalidationBus: bus,
+		}).NewFrontendWithOptions(recache.FrontendOptions{
+			Name: "records",
+			Get: func(k recache.Key, rw *recache.RecordWriter) (err error) {
+				_, err = rw.Write([]byte("record " + k.(string)))
+				return
+			},
+		})
+	}
+	f1 := newFrontend()
+	f2 := newFrontend()
+
+	_, err := f2.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Subscriptions are established in the background, so keep publishing
+	// until the eviction is received
+	for i := 0; i < 100; i++ {
+		f1.Evict(0, "a")
+		time.Sleep(10 * time.Millisecond)
+		if f2.Stats().Records == 0 {
+			return
+		}
+	}
+	t.Fatal("eviction not received")
+}
@@ -1,10 +1,17 @@
 package recache
 
 import (
+	"bytes"
 	"compress/flate"
 	"crypto/sha1"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/adler32"
 	"io"
+	"sort"
+	"sync/atomic"
 	"time"
 )
 
@@ -26,9 +33,25 @@ type recordWithMeta struct {
 	// storage infrastructure metadata.
 	memoryUsed int
 
+	// Record has been populated and its size accounted for
+	populated bool
+
 	// Time of most recent use of record
 	lastUsed time.Time
 
+	// Deadline of pending scheduled eviction, if any
+	evictAt time.Time
+
+	// Amount of retrievals served from the cache at this location
+	hits uint64
+
+	// TTL set with RecordWriter.SetTTL() for records of frontends with
+	// FrontendOptions.AdaptiveTTL set and the eviction deadline last
+	// computed from it. The TTL is recomputed on reaching the deadline,
+	// unless it was replaced by another scheduled eviction.
+	baseTTL     time.Duration
+	ttlDeadline time.Time
+
 	// Keep pointer to node in LRU list, so we can modify the list without
 	// itterating it to find this record's node.
 	node *node
@@ -37,6 +60,33 @@ type recordWithMeta struct {
 	// eviction
 	includedIn []intercacheRecordLocation
 
+	// Same as includedIn, but for records of frontends with
+	// FrontendOptions.WeakDependent set. Deduplicated and bounded.
+	weakIncludedIn map[intercacheRecordLocation]struct{}
+
+	// External resource tokens this record depends on
+	tokens []string
+
+	// Cache epoch the record was created under
+	epoch uint64
+
+	// Time of the last FrontendOptions.Validate call on the record
+	lastValidated time.Time
+
+	// Record is to be regenerated on next access
+	stale bool
+
+	// Time after which the record is considered stale. Set by
+	// RecordWriter.SetTTL() for frontends with
+	// FrontendOptions.StaleWhileRevalidate.
+	staleAt time.Time
+
+	// Regenerated record being populated to replace a stale one
+	pending *Record
+
+	// Record can no longer be appended to with Frontend.Append()
+	frozen bool
+
 	// The record itself. Has a separate lock and can be modified without the
 	// lock on the cache mutex held.
 	//
@@ -46,13 +96,64 @@ type recordWithMeta struct {
 
 // Data storage unit in the cache. Linked to a single Key on a Frontend.
 type Record struct {
+	// ID of goroutine populating the record and Unix time in nanoseconds of
+	// population start. Accessed atomically, so kept first for 64 bit
+	// alignment on 32 bit platforms.
+	populator         uint64
+	populationStarted int64
+
+	// Time to live of the record from its creation and Unix time in
+	// nanoseconds it passes at. Accessed atomically.
+	ttl, expires int64
+
+	// Unix time in nanoseconds the content of the record was last generated
+	// at. Later than the creation time, if a regeneration of the record
+	// produced identical content and the record was retained. Accessed
+	// atomically.
+	refreshed int64
+
 	semaphore semaphore
 
+	// Frontend the record belongs to
+	frontend *Frontend
+
 	// Contained data and metainformation
-	data componentNode
-	frameDescriptor
-	hash [sha1.Size]byte
-	eTag string // generated from hash
+	data  componentNode
+	frame FrameDescriptor
+	hash  [sha1.Size]byte
+	eTag  string // generated from hash
+
+	// Time of population completion
+	created time.Time
+
+	// Population sequence number of the record within its frontend
+	version uint64
+
+	// Memory used by the record, not counting any contained references
+	memoryUsed int
+
+	// Length of the compressed stream of the record including any contained
+	// references
+	length int64
+
+	// Records bound or included during population
+	dependencies []Dependency
+
+	// Failed includes replaced with fallback data during population
+	holes []Hole
+
+	// Record or any record included in it contains placeholders
+	placeholders bool
+
+	// Restrictions on HTTP caching of a record with filled placeholders. See
+	// Fill.
+	fillPrivate, fillNoStore bool
+
+	// Value set with RecordWriter.SetAttachment(). Stores an attachment.
+	attachment atomic.Value
+
+	// Deflate compression level data of the record was compressed with
+	compressionLevel int
 
 	// Error that occurred during initial data population. This will also be
 	// returned on any readers that are concurrent with population.
@@ -61,6 +162,68 @@ type Record struct {
 	populationError error
 }
 
+// Metadata of a populated record
+type RecordMeta struct {
+	// Time the record finished populating
+	Created time.Time
+
+	// Strong ETag of content, if served as a compressed stream
+	ETag string
+
+	// Compressed size of the record, not counting any included records
+	Size int
+
+	// Records bound or included during population in order. Must not be
+	// modified.
+	Dependencies []Dependency
+
+	// Deflate compression level data written during population was
+	// compressed with. Data reused from a previous record by
+	// Frontend.Rebuild() or Frontend.Append() retains its level.
+	CompressionLevel int
+
+	// Includes that failed during population and were replaced with
+	// fallback data by RecordWriter.IncludeOrFallback() in order. Must not be
+	// modified.
+	Holes []Hole
+
+	// Time to live of the record from Created. With
+	// FrontendOptions.AdaptiveTTL set, the effective TTL last computed from
+	// the access frequency of the record. 0, if the record has no TTL.
+	TTL time.Duration
+
+	// Version of the record. See Frontend.Version().
+	Version uint64
+}
+
+// Failed include replaced with fallback data
+type Hole struct {
+	// Location of the record that failed to be included
+	Frontend *Frontend
+	Key      Key
+
+	// Error retrieving the record failed with
+	Err error
+}
+
+// Record bound or included during the population of another record
+type Dependency struct {
+	// Location of the record
+	Frontend *Frontend
+	Key      Key
+
+	// Time spent retrieving or generating the record during population of the
+	// parent record
+	Duration time.Duration
+
+	// Record was included with RecordWriter.Include(), rather than only bound
+	Included bool
+
+	// Record was included with RecordWriter.IncludeWeak() and its eviction
+	// does not evict the parent record
+	Weak bool
+}
+
 // Linked list node for storing components. This is optimal, as most of the time
 // a record will only have one component and will never have zero components.
 type componentNode struct {
@@ -70,6 +233,13 @@ type componentNode struct {
 
 // Implements io.WrWriteTo
 func (r *Record) WriteTo(w io.Writer) (n int64, err error) {
+	n, err = r.writeTo(w)
+	r.frontend.addBytesServed(r, n)
+	return
+}
+
+// Same as WriteTo(), but does not count the written bytes as served
+func (r *Record) writeTo(w io.Writer) (n int64, err error) {
 	for c, m := &r.data, int64(0); c != nil; c = c.next {
 		m, err = c.WriteTo(w)
 		if err != nil {
@@ -80,6 +250,29 @@ func (r *Record) WriteTo(w io.Writer) (n int64, err error) {
 	return
 }
 
+// Write at most max bytes of the compressed data of the record to w, starting
+// at offset off. Components entirely before off are skipped without being
+// read.
+func (r *Record) writeRange(w io.Writer, off, max int64) (n int64, err error) {
+	for c := &r.data; c != nil && max > 0; c = c.next {
+		l := c.length()
+		if off >= l {
+			off -= l
+			continue
+		}
+
+		var m int64
+		m, err = c.writeRange(w, off, max)
+		n += m
+		max -= m
+		if err != nil {
+			return
+		}
+		off = 0
+	}
+	return
+}
+
 // Create a new io.Reader for this stream.
 // Multiple instances of such an io.Reader can exist and be read
 // concurrently.
@@ -95,6 +288,39 @@ func (r *Record) Decompress() io.Reader {
 	return eofCaster{flate.NewReader(r.NewReader())}
 }
 
+// Open the decompressed content of the record for reading and return its exact
+// decompressed length. Useful for APIs requiring both a closable reader and a
+// known content length.
+func (r *Record) Open() (rc io.ReadCloser, size int64) {
+	fr := flate.NewReader(r.NewReader())
+	return recordDecompressor{eofCaster{fr}, fr}, r.decompressedLength()
+}
+
+// Create a new io.ReadSeeker for the decompressed content of the record.
+// Together with Meta().Created as the modification time, suitable for
+// http.ServeContent().
+//
+// Seeking skips all components before the new position without decompressing
+// them.
+func (r *Record) NewReadSeeker() io.ReadSeeker {
+	s := new(recordReadSeeker)
+	s.appendBuffers(r)
+	return s
+}
+
+// Return the exact length of the decompressed content of the record
+func (r *Record) decompressedLength() (n int64) {
+	for c := &r.data; c != nil; c = c.next {
+		if ref, ok := c.component.(recordReference); ok {
+			// Frame sizes of records are allowed to overflow
+			n += ref.Record.decompressedLength()
+		} else {
+			n += int64(c.GetFrameDescriptor().size)
+		}
+	}
+	return
+}
+
 // Convenience method for efficiently decoding stream contents as JSON into
 // the destination variable.
 //
@@ -115,7 +341,138 @@ func (r *Record) ETag() string {
 
 // Return strong ETag of content, if served as a decompressed stream
 func (r *Record) ETagDecompressed() string {
-	return r.eTag[:len(r.eTag)-1] + `-uc"`
+	return decompressedETag(r.eTag)
+}
+
+// Convert ETag of compressed content to the ETag of the same content served
+// as a decompressed stream
+func decompressedETag(eTag string) string {
+	return eTag[:len(eTag)-1] + `-uc"`
+}
+
+// Return strong ETag of content, if served as a gzip stream.
+// Only served with EnableGzip set.
+func (r *Record) ETagGzip() string {
+	return gzipETag(r.eTag)
+}
+
+// Convert ETag of compressed content to the ETag of the same content served
+// as a gzip stream
+func gzipETag(eTag string) string {
+	return eTag[:len(eTag)-1] + `-gz"`
+}
+
+// Return strong ETag of content, if served as a brotli stream.
+// Only served with FrontendOptions.Brotli set.
+func (r *Record) ETagBrotli() string {
+	return brotliETag(r.eTag)
+}
+
+// Convert ETag of compressed content to the ETag of the same content served
+// as a brotli stream
+func brotliETag(eTag string) string {
+	return eTag[:len(eTag)-1] + `-br"`
+}
+
+// Return ETags of records directly included in the record in order of
+// inclusion, as if served as compressed streams
+func (r *Record) IncludedETags() (eTags []string) {
+	for c := &r.data; c != nil; c = c.next {
+		if ref, ok := c.component.(recordReference); ok {
+			eTags = append(eTags, ref.eTag)
+		}
+	}
+	return
+}
+
+// Return metadata of the record
+func (r *Record) Meta() RecordMeta {
+	return RecordMeta{
+		Created: r.created,
+		ETag:    r.eTag,
+		Size:    r.memoryUsed,
+
+		Dependencies:     r.dependencies,
+		CompressionLevel: r.compressionLevel,
+		Holes:            r.holes,
+		TTL:              time.Duration(atomic.LoadInt64(&r.ttl)),
+		Version:          r.version,
+	}
+}
+
+// Return the time the content of the record was last generated at
+func (r *Record) refreshedAt() time.Time {
+	if ns := atomic.LoadInt64(&r.refreshed); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return r.created
+}
+
+// Set the time to live of the record and the time it passes at
+func (r *Record) setTTL(ttl time.Duration, deadline time.Time) {
+	atomic.StoreInt64(&r.ttl, int64(ttl))
+	atomic.StoreInt64(&r.expires, deadline.UnixNano())
+}
+
+// Return the time the TTL of the record passes at, after which the record is
+// stale with FrontendOptions.StaleWhileRevalidate or due for eviction
+// otherwise. Returns false, if the record has no TTL.
+func (r *Record) ttlExpiresAt() (time.Time, bool) {
+	ns := atomic.LoadInt64(&r.expires)
+	if ns == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ns), true
+}
+
+// Return the value attached to the record with RecordWriter.SetAttachment()
+// during its last population or nil, if none
+func (r *Record) Attachment() interface{} {
+	a, _ := r.attachment.Load().(attachment)
+	return a.v
+}
+
+// Value attached to a record. Wrapped to allow storing values of different
+// types and nil in an atomic.Value.
+type attachment struct {
+	v interface{}
+}
+
+// Return the descriptor of the deflate frame of the entire record, including
+// any included records
+func (r *Record) FrameDescriptor() FrameDescriptor {
+	return r.frame
+}
+
+// Describe the constituent components of the record in order.
+// Useful for debugging record composition.
+func (r *Record) Components() []ComponentInfo {
+	var (
+		infos  []ComponentInfo
+		offset int64
+	)
+	for c := &r.data; c != nil; c = c.next {
+		info := ComponentInfo{
+			Size:             c.Size(),
+			UncompressedSize: int(c.GetFrameDescriptor().size),
+			FrameDescriptor:  c.GetFrameDescriptor(),
+			SHA1:             c.Hash(),
+			Offset:           offset,
+			Length:           c.length(),
+		}
+		offset += info.Length
+		switch c := c.component.(type) {
+		case recordReference:
+			info.Type = ReferenceComponent
+			info.Frontend = c.frontend
+			info.Key = c.key
+		case placeholder:
+			info.Type = PlaceholderComponent
+			info.Placeholder = c.name
+		}
+		infos = append(infos, info)
+	}
+	return infos
 }
 
 // Adapter for reading data from record w/o mutating it
@@ -146,6 +503,145 @@ func (r *recordReader) Read(p []byte) (n int, err error) {
 	return
 }
 
+// Seekable reader of the decompressed content of a record
+type recordReadSeeker struct {
+	// All buffers of the record and records included in it in order and
+	// their decompressed start offsets
+	buffers []buffer
+	offsets []int64
+
+	size, pos int64
+
+	// Decompressor of the buffer containing pos, if any, and index of the
+	// buffer after it
+	current io.Reader
+	next    int
+}
+
+// Append all buffers of r and records included in it
+func (s *recordReadSeeker) appendBuffers(r *Record) {
+	for c := &r.data; c != nil; c = c.next {
+		switch c := c.component.(type) {
+		case buffer:
+			s.buffers = append(s.buffers, c)
+			s.offsets = append(s.offsets, s.size)
+			s.size += int64(c.frame.size)
+		case recordReference:
+			s.appendBuffers(c.Record)
+		}
+	}
+}
+
+func (s *recordReadSeeker) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return
+	}
+	if s.pos >= s.size {
+		return 0, io.EOF
+	}
+
+	if s.current == nil {
+		// Find the buffer containing pos and decompress up to pos
+		i := sort.Search(len(s.buffers), func(i int) bool {
+			return s.offsets[i]+int64(s.buffers[i].frame.size) > s.pos
+		})
+		s.current = eofCaster{s.buffers[i].Decompress()}
+		s.next = i + 1
+		_, err = io.CopyN(io.Discard, s.current, s.pos-s.offsets[i])
+		if err != nil {
+			return
+		}
+	}
+
+	for {
+		n, err = s.current.Read(p)
+		s.pos += int64(n)
+		if err != io.EOF {
+			return
+		}
+		if s.next == len(s.buffers) {
+			return
+		}
+		err = nil
+		s.current = eofCaster{s.buffers[s.next].Decompress()}
+		s.next++
+		if n != 0 {
+			return
+		}
+	}
+}
+
+func (s *recordReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += s.pos
+	case io.SeekEnd:
+		offset += s.size
+	}
+	if offset < 0 {
+		return s.pos, errors.New("negative position")
+	}
+	if offset != s.pos {
+		s.pos = offset
+		s.current = nil
+	}
+	return offset, nil
+}
+
+// Closable reader of the decompressed content of a record
+type recordDecompressor struct {
+	eofCaster
+	closer io.Closer
+}
+
+func (d recordDecompressor) Close() error {
+	err := d.closer.Close()
+	if err == io.ErrUnexpectedEOF {
+		// Same as with eofCaster
+		err = nil
+	}
+	return err
+}
+
+// Verifies the decompressed content read from it matches a FrameDescriptor.
+// Returns an error wrapping ErrChecksumMismatch instead of io.EOF on mismatch.
+type checksumVerifier struct {
+	io.Reader
+	hasher hash.Hash32
+	got    FrameDescriptor
+	want   FrameDescriptor
+}
+
+func (v *checksumVerifier) Read(p []byte) (n int, err error) {
+	n, err = v.Reader.Read(p)
+	v.hasher.Write(p[:n])
+	v.got.size += uint32(n) // Allowed to overflow, same as the stored size
+	if err == io.EOF {
+		// CRC32 checksums are only used for gzip footers and not computed
+		v.got.checksum = v.hasher.Sum32()
+		if v.got.checksum != v.want.checksum || v.got.size != v.want.size {
+			err = fmt.Errorf(
+				"%w: checksum=%08x size=%d, expected checksum=%08x size=%d",
+				ErrChecksumMismatch,
+				v.got.checksum, v.got.size,
+				v.want.checksum, v.want.size,
+			)
+		}
+	}
+	return
+}
+
+// Verify the decompressed content of deflate compressed data matches want.
+// Returns an error wrapping ErrChecksumMismatch on mismatch.
+func verifyCompressed(data []byte, want FrameDescriptor) error {
+	_, err := io.Copy(io.Discard, &checksumVerifier{
+		Reader: eofCaster{flate.NewReader(bytes.NewReader(data))},
+		hasher: adler32.New(),
+		want:   want,
+	})
+	return err
+}
+
 // Suppresses unexpected EOF errors resulting as a consequence of flate using
 // bufio
 type eofCaster struct {
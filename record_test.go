@@ -0,0 +1,220 @@
+package recache
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"hash/adler32"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestComponents(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache    = NewCache(CacheOptions{})
+		children = cache.NewFrontend(dummyGetter)
+		parents  = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) (err error) {
+				_, err = rw.Write([]byte("abc"))
+				if err != nil {
+					return
+				}
+				return rw.Include(children, "child")
+			},
+		})
+	)
+
+	child, err := children.Get("child")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent, err := parents.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	comps := parent.Components()
+	assertEquals(t, len(comps), 2)
+
+	buf := comps[0]
+	assertEquals(t, buf.Type, BufferComponent)
+	assertEquals(t, buf.Type.String(), "buffer")
+	if buf.Size == 0 {
+		t.Fatal("no buffer size")
+	}
+	assertEquals(t, buf.UncompressedSize, 3)
+	if buf.SHA1 == [sha1.Size]byte{} {
+		t.Fatal("no buffer hash")
+	}
+	if buf.Frontend != nil || buf.Key != nil {
+		t.Fatal("buffer has reference location")
+	}
+	assertEquals(t, buf.Offset, int64(0))
+	assertEquals(t, buf.Length, int64(buf.Size))
+
+	assertEquals(t, comps[1], ComponentInfo{
+		Type:             ReferenceComponent,
+		UncompressedSize: int(child.frame.size),
+		FrameDescriptor:  child.FrameDescriptor(),
+		SHA1:             child.SHA1(),
+		Frontend:         children,
+		Key:              "child",
+		Offset:           buf.Length,
+		Length:           child.length,
+	})
+	assertEquals(t, comps[1].Type.String(), "reference")
+
+	fd := parent.FrameDescriptor()
+	assertEquals(t, fd.Size(), uint32(3)+child.FrameDescriptor().Size())
+	assertEquals(t, fd.Checksum(), adler32.Checksum([]byte("abc\"child\"\n")))
+}
+
+func TestOpen(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache    = NewCache(CacheOptions{})
+		children = cache.NewFrontend(dummyGetter)
+		parents  = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) (err error) {
+				for i := 0; i < 3; i++ {
+					_, err = rw.Write([]byte("abc"))
+					if err != nil {
+						return
+					}
+					err = rw.Include(children, i)
+					if err != nil {
+						return
+					}
+				}
+				return
+			},
+		})
+	)
+
+	rec, err := parents.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, size := rec.Open()
+	defer rc.Close()
+
+	var b bytes.Buffer
+	_, err = b.ReadFrom(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, b.String(), "abc0\nabc1\nabc2\n")
+	assertEquals(t, size, int64(b.Len()))
+	assertEquals(t, rc.Close(), nil)
+}
+
+func TestReadSeeker(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache    = NewCache(CacheOptions{})
+		children = cache.NewFrontend(dummyGetter)
+		parents  = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) (err error) {
+				for i := 0; i < 3; i++ {
+					_, err = rw.Write([]byte("abc"))
+					if err != nil {
+						return
+					}
+					err = rw.Include(children, i)
+					if err != nil {
+						return
+					}
+				}
+				return
+			},
+		})
+	)
+
+	const std = "abc0\nabc1\nabc2\n"
+
+	rec, err := parents.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := rec.NewReadSeeker()
+
+	read := func(t *testing.T, n int) string {
+		t.Helper()
+
+		buf := make([]byte, n)
+		n, err := io.ReadFull(s, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+	seek := func(t *testing.T, offset int64, whence int, pos int64) {
+		t.Helper()
+
+		res, err := s.Seek(offset, whence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEquals(t, res, pos)
+	}
+
+	assertEquals(t, read(t, 100), std)
+	seek(t, 2, io.SeekStart, 2)
+	assertEquals(t, read(t, 5), std[2:7])
+	seek(t, 2, io.SeekCurrent, 9)
+	assertEquals(t, read(t, 2), std[9:11])
+	seek(t, -3, io.SeekEnd, int64(len(std)-3))
+	assertEquals(t, read(t, 100), std[len(std)-3:])
+	seek(t, 0, io.SeekStart, 0)
+	assertEquals(t, read(t, 100), std)
+
+	_, err = s.Seek(-1, io.SeekStart)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestDependencies(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache = NewCache(CacheOptions{})
+		slow  = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				time.Sleep(10 * time.Millisecond)
+				return dummyGetter(k, rw)
+			},
+		})
+		fast    = cache.NewFrontend(dummyGetter)
+		parents = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) (err error) {
+				_, err = rw.Bind(fast, 1)
+				if err != nil {
+					return
+				}
+				return rw.Include(slow, 2)
+			},
+		})
+	)
+
+	rec, err := parents.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deps := rec.Meta().Dependencies
+	assertEquals(t, len(deps), 2)
+	assertEquals(t, deps[0].Frontend, fast)
+	assertEquals(t, deps[0].Key, 1)
+	assertEquals(t, deps[0].Included, false)
+	assertEquals(t, deps[1].Frontend, slow)
+	assertEquals(t, deps[1].Key, 2)
+	assertEquals(t, deps[1].Included, true)
+	if deps[1].Duration < 10*time.Millisecond {
+		t.Fatalf("population time not recorded: %s", deps[1].Duration)
+	}
+}
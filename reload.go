@@ -0,0 +1,363 @@
+package recache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Change of a cache parameter applied by Cache.Reconfigure()
+type ConfigChange struct {
+	// Name of the changed CacheSpec field, like "MemoryLimit"
+	Parameter string
+
+	// Values of the parameter before and after the change
+	Old, New interface{}
+}
+
+func (c ConfigChange) String() string {
+	return fmt.Sprintf("%s: %v -> %v", c.Parameter, c.Old, c.New)
+}
+
+// Parameters of a frontend changeable at runtime with Cache.Reconfigure(). Zero
+// values have the same meaning as in FrontendOptions.
+type frontendTunables struct {
+	holeTTL                    time.Duration
+	adaptiveTTL                *AdaptiveTTLOptions
+	compressionBudget          time.Duration
+	downgradedCompressionLevel int
+	compressionBudgetCooldown  time.Duration
+	canaryRate                 float64
+}
+
+func newFrontendTunables(opts FrontendOptions) frontendTunables {
+	return frontendTunables{
+		holeTTL:                    opts.HoleTTL,
+		adaptiveTTL:                opts.AdaptiveTTL,
+		compressionBudget:          opts.CompressionBudget,
+		downgradedCompressionLevel: opts.DowngradedCompressionLevel,
+		compressionBudgetCooldown:  opts.CompressionBudgetCooldown,
+		canaryRate:                 opts.CanaryRate,
+	}
+}
+
+// Return the current parameters of the frontend changeable with
+// Cache.Reconfigure()
+func (f *Frontend) tunables() frontendTunables {
+	return f.reconfigurable.Load().(frontendTunables)
+}
+
+// Apply the tunable parameters of spec to the running cache and return the
+// applied changes. Lowered memory and LRU limits are enforced immediately by
+// expiring least recently used records.
+//
+// Zero values of all fields keep the current value of the parameter, so
+// parameters can not be reset to their zero value and DebounceEviction can
+// only be enabled. Applies MemoryLimit, LRULimit, DebounceEviction,
+// MaxWeakDependents, EvictionYieldInterval and MaxFrontends.
+//
+// Frontends are matched to existing frontends of the cache by name. Applies
+// their HoleTTL, AdaptiveTTL, CompressionBudget, DowngradedCompressionLevel,
+// CompressionBudgetCooldown and CanaryRate. FrontendSpec.Getter is ignored.
+//
+// Returns an error without applying any changes, if spec changes any other
+// parameter or contains a frontend not in the cache.
+//
+// With CacheOptions.MemoryTuning set, MemoryLimit is clamped to the tuning
+// bounds and tuning continues from the new limit.
+func (c *Cache) Reconfigure(spec CacheSpec) (
+	changes []ConfigChange,
+	err error,
+) {
+	// Expiry hooks must be called without holding the lock
+	var expired []expiry
+	defer func() {
+		for _, e := range expired {
+			e.frontend.opts.OnExpire(e.key, e.reason)
+		}
+	}()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err = c.checkFixedParameters(spec)
+	if err != nil {
+		return
+	}
+	frontends := make([]*Frontend, len(spec.Frontends))
+	for i, fs := range spec.Frontends {
+		if fs.Name == "" {
+			return nil, errors.New("frontend without name")
+		}
+		frontends[i] = c.frontendByNameWithLock(fs.Name)
+		if frontends[i] == nil {
+			return nil, fmt.Errorf("frontend not found: %s", fs.Name)
+		}
+		err = frontends[i].checkFixedParameters(fs)
+		if err != nil {
+			return
+		}
+	}
+
+	setInt := func(name string, dst *int, val int) {
+		if val != 0 && *dst != val {
+			changes = append(changes, ConfigChange{name, *dst, val})
+			*dst = val
+		}
+	}
+
+	memoryLimit := int(spec.MemoryLimit)
+	if c.opts.MemoryTuning != nil && memoryLimit != 0 {
+		tuning := *c.opts.MemoryTuning
+		tuning.setDefaults()
+		memoryLimit = tuning.nextMemoryLimit(memoryLimit, 1, 0)
+	}
+	setInt("MemoryLimit", &c.memoryLimit, memoryLimit)
+
+	lruLimit := time.Duration(spec.LRULimit)
+	if lruLimit != 0 && c.lruLimit != lruLimit {
+		changes = append(changes, ConfigChange{"LRULimit", c.lruLimit, lruLimit})
+		c.lruLimit = lruLimit
+	}
+
+	if spec.DebounceEviction && !c.debounceEviction {
+		changes = append(changes, ConfigChange{"DebounceEviction", false, true})
+		c.debounceEviction = true
+	}
+
+	setInt(
+		"MaxWeakDependents",
+		&c.maxWeakDependents,
+		int(spec.MaxWeakDependents),
+	)
+	setInt(
+		"EvictionYieldInterval",
+		&c.evictionYieldInterval,
+		int(spec.EvictionYieldInterval),
+	)
+	setInt("MaxFrontends", &c.maxFrontends, int(spec.MaxFrontends))
+
+	for i, fs := range spec.Frontends {
+		changes = frontends[i].reconfigure(fs, changes)
+	}
+
+	expired = c.expireOverLimits(expired, time.Now(), -1)
+	return
+}
+
+// Return an error, if spec changes parameters of the cache, that can not be
+// changed at runtime. Requires lock on c.mu.
+func (c *Cache) checkFixedParameters(spec CacheSpec) error {
+	opts := spec.Options()
+	for _, p := range [...]struct {
+		name    string
+		changed bool
+	}{
+		{"Name", opts.Name != "" && opts.Name != c.opts.Name},
+		{
+			"DeadlockThreshold",
+			opts.DeadlockThreshold != 0 &&
+				opts.DeadlockThreshold != c.opts.DeadlockThreshold,
+		},
+		{
+			"MemoryTuning",
+			opts.MemoryTuning != nil &&
+				(c.opts.MemoryTuning == nil ||
+					*opts.MemoryTuning != *c.opts.MemoryTuning),
+		},
+	} {
+		if p.changed {
+			return fmt.Errorf("%s can not be changed at runtime", p.name)
+		}
+	}
+	return nil
+}
+
+// Return an error, if spec changes parameters of the frontend, that can not be
+// changed at runtime
+func (f *Frontend) checkFixedParameters(spec FrontendSpec) error {
+	var (
+		o   = spec.Options(nil)
+		cur = f.opts
+	)
+	for _, p := range [...]struct {
+		name    string
+		changed bool
+	}{
+		{
+			"SlowGetterThreshold",
+			o.SlowGetterThreshold != 0 &&
+				o.SlowGetterThreshold != cur.SlowGetterThreshold,
+		},
+		{
+			"GetterTimeout",
+			o.GetterTimeout != 0 && o.GetterTimeout != cur.GetterTimeout,
+		},
+		{
+			"IncludeTimeout",
+			o.IncludeTimeout != 0 && o.IncludeTimeout != cur.IncludeTimeout,
+		},
+		{
+			"PopulationTimeout",
+			o.PopulationTimeout != 0 &&
+				o.PopulationTimeout != cur.PopulationTimeout,
+		},
+		{
+			"ValidateInterval",
+			o.ValidateInterval != 0 &&
+				o.ValidateInterval != cur.ValidateInterval,
+		},
+		{"WeakDependent", o.WeakDependent && !cur.WeakDependent},
+		{
+			"IncludedETagsHeader",
+			o.IncludedETagsHeader != "" &&
+				o.IncludedETagsHeader != cur.IncludedETagsHeader,
+		},
+		{
+			"StaleWhileRevalidate",
+			o.StaleWhileRevalidate && !cur.StaleWhileRevalidate,
+		},
+		{"VerifyChecksums", o.VerifyChecksums && !cur.VerifyChecksums},
+		{"Brotli", o.Brotli && !cur.Brotli},
+		{
+			"HTTPCachePolicy",
+			o.HTTPCachePolicy != nil &&
+				(cur.HTTPCachePolicy == nil ||
+					*o.HTTPCachePolicy != *cur.HTTPCachePolicy),
+		},
+	} {
+		if p.changed {
+			return fmt.Errorf(
+				"frontend %s: %s can not be changed at runtime",
+				spec.Name,
+				p.name,
+			)
+		}
+	}
+	return nil
+}
+
+// Apply the tunable parameters of spec to the frontend and append the applied
+// changes to changes. Requires lock on f.cache.mu.
+func (f *Frontend) reconfigure(
+	spec FrontendSpec,
+	changes []ConfigChange,
+) []ConfigChange {
+	var (
+		o    = spec.Options(nil)
+		t    = f.tunables()
+		prev = t
+	)
+	change := func(name string, old, new interface{}) {
+		changes = append(changes, ConfigChange{
+			"Frontends." + spec.Name + "." + name,
+			old,
+			new,
+		})
+	}
+	setDuration := func(name string, dst *time.Duration, val time.Duration) {
+		if val != 0 && *dst != val {
+			change(name, *dst, val)
+			*dst = val
+		}
+	}
+
+	setDuration("HoleTTL", &t.holeTTL, o.HoleTTL)
+	setDuration("CompressionBudget", &t.compressionBudget, o.CompressionBudget)
+	setDuration(
+		"CompressionBudgetCooldown",
+		&t.compressionBudgetCooldown,
+		o.CompressionBudgetCooldown,
+	)
+	if l := o.DowngradedCompressionLevel; l != 0 &&
+		l != t.downgradedCompressionLevel {
+		change(
+			"DowngradedCompressionLevel",
+			t.downgradedCompressionLevel,
+			l,
+		)
+		t.downgradedCompressionLevel = l
+	}
+	if r := o.CanaryRate; r != 0 && r != t.canaryRate {
+		change("CanaryRate", t.canaryRate, r)
+		t.canaryRate = r
+	}
+	if a := o.AdaptiveTTL; a != nil &&
+		(t.adaptiveTTL == nil || *a != *t.adaptiveTTL) {
+		var old interface{}
+		if t.adaptiveTTL != nil {
+			old = *t.adaptiveTTL
+		}
+		change("AdaptiveTTL", old, *a)
+		t.adaptiveTTL = a
+	}
+
+	if t != prev {
+		f.reconfigurable.Store(t)
+	}
+	return changes
+}
+
+// Poll source for a cache specification every interval and apply it with
+// Reconfigure(), until ctx is done or the cache is drained or closed. Lets
+// cache limits be tuned at runtime, like during incidents, without
+// redeploying. Blocks until done.
+//
+// onChange is called with each applied change. Defaults to logging changes to
+// the Logger of the cache. Errors returned by source are logged and the
+// current configuration is kept.
+func (c *Cache) WatchSpec(
+	ctx context.Context,
+	interval time.Duration,
+	source func() (CacheSpec, error),
+	onChange func(ConfigChange),
+) {
+	if onChange == nil {
+		onChange = func(change ConfigChange) {
+			c.logger.Printf("cache configuration changed: %s", change)
+		}
+	}
+
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		case <-c.stop:
+			return
+		}
+
+		spec, err := source()
+		if err != nil {
+			c.logger.Printf("reading cache configuration: %s", err)
+			continue
+		}
+		changes, err := c.Reconfigure(spec)
+		if err != nil {
+			c.logger.Printf("applying cache configuration: %s", err)
+			continue
+		}
+		for _, change := range changes {
+			onChange(change)
+		}
+	}
+}
+
+// Return a source for Cache.WatchSpec(), that reads a JSON encoded CacheSpec
+// from the file at path
+func SpecFile(path string) func() (CacheSpec, error) {
+	return func() (spec CacheSpec, err error) {
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return
+		}
+		err = json.Unmarshal(buf, &spec)
+		return
+	}
+}
@@ -0,0 +1,181 @@
+package recache
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReconfigure(t *testing.T) {
+	t.Parallel()
+
+	cache := NewCache(CacheOptions{})
+	f := cache.NewFrontend(dummyGetter)
+	for i := 0; i < 10; i++ {
+		_, err := f.Get(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reconfigure := func(spec CacheSpec) []ConfigChange {
+		t.Helper()
+		changes, err := cache.Reconfigure(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return changes
+	}
+
+	changes := reconfigure(CacheSpec{
+		MemoryLimit: 1,
+		LRULimit:    Duration(time.Hour),
+	})
+	assertEquals(t, changes, []ConfigChange{
+		{"MemoryLimit", 0, 1},
+		{"LRULimit", time.Duration(0), time.Hour},
+	})
+
+	// Lowered limit enforced immediately
+	s := cache.SnapshotStats()
+	if s.MemoryUsed > 1 {
+		t.Fatalf("memory limit not enforced: %d", s.MemoryUsed)
+	}
+	assertEquals(t, s.Expirations, uint64(10))
+	assertConsistency(t, cache)
+
+	// No changes
+	assertEquals(
+		t,
+		len(reconfigure(CacheSpec{
+			MemoryLimit: 1,
+			LRULimit:    Duration(time.Hour),
+		})),
+		0,
+	)
+
+	// Omitted parameters keep their current value
+	assertEquals(
+		t,
+		reconfigure(CacheSpec{MaxFrontends: 3}),
+		[]ConfigChange{{"MaxFrontends", 0, 3}},
+	)
+	conf := cache.Config()
+	assertEquals(t, conf.MemoryLimit, 1)
+	assertEquals(t, conf.LRULimit, time.Hour)
+
+	// Parameters not changeable at runtime are rejected
+	_, err := cache.Reconfigure(CacheSpec{
+		MemoryLimit:       2,
+		DeadlockThreshold: Duration(time.Second),
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	assertEquals(t, cache.Config().MemoryLimit, 1)
+}
+
+func TestReconfigureFrontends(t *testing.T) {
+	t.Parallel()
+
+	cache := NewCache(CacheOptions{})
+	f := cache.NewFrontendWithOptions(FrontendOptions{
+		Name:                 "pages",
+		Get:                  dummyGetter,
+		StaleWhileRevalidate: true,
+		CanaryRate:           0.5,
+	})
+
+	changes, err := cache.Reconfigure(CacheSpec{
+		Frontends: []FrontendSpec{
+			{
+				Name:                 "pages",
+				Getter:               "ignored",
+				StaleWhileRevalidate: true,
+				HoleTTL:              Duration(time.Minute),
+				CanaryRate:           0.1,
+				AdaptiveTTL: &AdaptiveTTLSpec{
+					MaxTTL: Duration(time.Hour),
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, changes, []ConfigChange{
+		{"Frontends.pages.HoleTTL", time.Duration(0), time.Minute},
+		{"Frontends.pages.CanaryRate", 0.5, 0.1},
+		{
+			"Frontends.pages.AdaptiveTTL",
+			nil,
+			AdaptiveTTLOptions{MaxTTL: time.Hour},
+		},
+	})
+	conf := cache.Config().Frontends[0]
+	assertEquals(t, conf.HoleTTL, time.Minute)
+	assertEquals(t, conf.CanaryRate, 0.1)
+	assertEquals(t, conf.AdaptiveTTL.MaxTTL, time.Hour)
+
+	// Omitted parameters keep their current value
+	changes, err = cache.Reconfigure(CacheSpec{
+		Frontends: []FrontendSpec{{Name: "pages"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, len(changes), 0)
+	assertEquals(t, f.tunables().canaryRate, 0.1)
+
+	for _, fs := range [...]FrontendSpec{
+		{Name: "missing"},
+		{},
+		{Name: "pages", WeakDependent: true, HoleTTL: Duration(time.Hour)},
+		{
+			Name:            "pages",
+			HTTPCachePolicy: &HTTPCachePolicySpec{Public: true},
+		},
+	} {
+		_, err = cache.Reconfigure(CacheSpec{
+			Frontends: []FrontendSpec{fs},
+		})
+		if err == nil {
+			t.Fatalf("expected error: %+v", fs)
+		}
+	}
+	assertEquals(t, f.tunables().holeTTL, time.Minute)
+}
+
+func TestWatchSpec(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "cache.json")
+	err := os.WriteFile(path, []byte(`{"MaxFrontends": 3}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := NewCache(CacheOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := make(chan ConfigChange, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cache.WatchSpec(
+			ctx,
+			time.Millisecond,
+			SpecFile(path),
+			func(c ConfigChange) {
+				changes <- c
+			},
+		)
+	}()
+
+	assertEquals(t, <-changes, ConfigChange{"MaxFrontends", 0, 3})
+	assertEquals(t, cache.Config().MaxFrontends, 3)
+
+	cancel()
+	<-done
+}
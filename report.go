@@ -0,0 +1,240 @@
+package recache
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Thresholds of EfficiencyReport suggestions
+const (
+	// Minimum amount of retrievals from a frontend for suggestions based on
+	// its hit rate
+	reportMinRetrievals = 100
+
+	// Hit rate below which caching a frontend is suggested to be
+	// reconsidered
+	reportLowHitRate = 0.1
+
+	// Populations below this average duration are cheap enough to possibly
+	// not be worth caching
+	reportCheapPopulation = 100 * time.Microsecond
+
+	// Populations above this average duration are slow enough to benefit
+	// from stale-while-revalidate
+	reportSlowPopulation = time.Second
+)
+
+// Summary of the efficiency of a cache and its frontends over an interval with
+// suggestions for tuning them. Created with Cache.EfficiencyReport().
+type EfficiencyReport struct {
+	// Start and end of the reported interval
+	Start, End time.Time
+
+	// Overall hit rate of the cache and the memory it uses
+	HitRate    float64
+	MemoryUsed int
+
+	// Reports of frontends, not counting deleted ones, in order of frontend
+	// creation
+	Frontends []FrontendReport
+
+	// Statistics captured at End. Pass to the next Cache.EfficiencyReport()
+	// call to report on the following interval.
+	Stats CacheStats
+}
+
+// Summary of the efficiency of a frontend
+type FrontendReport struct {
+	ID   int
+	Name string
+
+	Records               int
+	MemoryUsed            int
+	Hits, Misses          uint64
+	HitRate               float64
+	AverageRecordSize     int
+	AveragePopulationTime time.Duration
+
+	// Records evicted explicitly, including cascading evictions from included
+	// records, and records expired due to the LRU or memory limits of the
+	// cache
+	ExplicitEvictions, Expirations uint64
+
+	// Human-readable tuning suggestions, if any
+	Suggestions []string
+}
+
+// Return a human-readable name of the frontend for reports
+func (r FrontendReport) label() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return fmt.Sprintf("frontend%d", r.ID)
+}
+
+// Summarize the efficiency of the cache and its frontends since the
+// statistics prev were captured at since with SnapshotStats() or a previous
+// report. Pass zero value statistics to report on the whole lifetime of the
+// cache.
+//
+// Turns raw statistics into actionable tuning suggestions, like not caching
+// frontends with a very low hit rate or raising cache limits, when most
+// evictions are caused by them.
+func (c *Cache) EfficiencyReport(prev CacheStats, since time.Time) (
+	r EfficiencyReport,
+) {
+	r.Start = since
+	r.End = time.Now()
+	r.Stats = c.SnapshotStats()
+	d := r.Stats.Delta(prev)
+	r.HitRate = d.HitRate()
+	r.MemoryUsed = d.MemoryUsed
+
+	c.mu.Lock()
+	frontends := make([]*Frontend, len(c.frontendMeta))
+	for i, m := range c.frontendMeta {
+		frontends[i] = m.instance
+	}
+	c.mu.Unlock()
+
+	for i, s := range d.Frontends {
+		if i >= len(frontends) || frontends[i] == nil {
+			continue // Deleted or created after the snapshot
+		}
+		f := frontends[i]
+		fr := FrontendReport{
+			ID:                    i,
+			Name:                  f.opts.Name,
+			Records:               s.Records,
+			MemoryUsed:            s.MemoryUsed,
+			Hits:                  s.Hits,
+			Misses:                s.Misses,
+			HitRate:               s.HitRate(),
+			AverageRecordSize:     s.AverageRecordSize(),
+			AveragePopulationTime: s.AveragePopulationTime(),
+			ExplicitEvictions:     subCounter(s.Evictions, s.Expirations),
+			Expirations:           s.Expirations,
+		}
+		fr.Suggestions = f.suggest(fr)
+		r.Frontends = append(r.Frontends, fr)
+	}
+	return
+}
+
+// Return tuning suggestions for a frontend based on its report
+func (f *Frontend) suggest(r FrontendReport) (s []string) {
+	retrievals := r.Hits + r.Misses
+	if retrievals >= reportMinRetrievals && r.HitRate < reportLowHitRate {
+		msg := fmt.Sprintf(
+			"%.0f%% hit rate - consider not caching",
+			r.HitRate*100,
+		)
+		if r.Misses != 0 && r.AveragePopulationTime < reportCheapPopulation {
+			msg += fmt.Sprintf(
+				", populations are cheap (%s on average)",
+				r.AveragePopulationTime,
+			)
+		}
+		s = append(s, msg)
+	}
+	if r.Expirations != 0 && r.Expirations > r.ExplicitEvictions {
+		s = append(s, fmt.Sprintf(
+			"%d of %d evictions caused by cache limits - consider raising"+
+				" MemoryLimit or LRULimit",
+			r.Expirations,
+			r.Expirations+r.ExplicitEvictions,
+		))
+	}
+	if !f.opts.StaleWhileRevalidate &&
+		r.AveragePopulationTime > reportSlowPopulation {
+		s = append(s, fmt.Sprintf(
+			"populations are slow (%s on average) - consider"+
+				" StaleWhileRevalidate",
+			r.AveragePopulationTime,
+		))
+	}
+	return
+}
+
+// Format the report as a table of frontends followed by suggestions
+func (r EfficiencyReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(
+		&b,
+		"cache efficiency %s - %s: hit rate %.1f%%, memory used %d\n",
+		r.Start.Format(time.RFC3339),
+		r.End.Format(time.RFC3339),
+		r.HitRate*100,
+		r.MemoryUsed,
+	)
+
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(
+		w,
+		"frontend\trecords\tmemory\thit rate\tavg size\tavg population"+
+			"\tevictions\texpirations",
+	)
+	for _, f := range r.Frontends {
+		fmt.Fprintf(
+			w,
+			"%s\t%d\t%d\t%.1f%%\t%d\t%s\t%d\t%d\n",
+			f.label(),
+			f.Records,
+			f.MemoryUsed,
+			f.HitRate*100,
+			f.AverageRecordSize,
+			f.AveragePopulationTime,
+			f.ExplicitEvictions,
+			f.Expirations,
+		)
+	}
+	w.Flush()
+
+	for _, f := range r.Frontends {
+		for _, s := range f.Suggestions {
+			fmt.Fprintf(&b, "%s: %s\n", f.label(), s)
+		}
+	}
+	return b.String()
+}
+
+// Generate an efficiency report of the cache every interval, until ctx is
+// done or the cache is drained or closed. Each report covers the interval
+// since the previous one. Blocks until done.
+//
+// onReport is called with each report. Defaults to logging reports to the
+// Logger of the cache.
+func (c *Cache) ReportEfficiency(
+	ctx context.Context,
+	interval time.Duration,
+	onReport func(EfficiencyReport),
+) {
+	if onReport == nil {
+		onReport = func(r EfficiencyReport) {
+			c.logger.Printf("%s", r)
+		}
+	}
+
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	prev := c.SnapshotStats()
+	since := time.Now()
+	for {
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		case <-c.stop:
+			return
+		}
+
+		r := c.EfficiencyReport(prev, since)
+		prev = r.Stats
+		since = r.End
+		onReport(r)
+	}
+}
@@ -0,0 +1,88 @@
+package recache
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEfficiencyReport(t *testing.T) {
+	t.Parallel()
+
+	cache := NewCache(CacheOptions{
+		MemoryLimit: 1 << 10,
+	})
+	hot := cache.NewFrontendWithOptions(FrontendOptions{
+		Name: "hot",
+		Get:  dummyGetter,
+	})
+	cold := cache.NewFrontendWithOptions(FrontendOptions{
+		Get: func(k Key, rw *RecordWriter) (err error) {
+			_, err = rw.Write([]byte(strings.Repeat(k.(string), 100)))
+			return
+		},
+	})
+
+	start := time.Now()
+	prev := cache.SnapshotStats()
+	for i := 0; i < 200; i++ {
+		_, err := hot.Get("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = cold.Get(strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := cache.EfficiencyReport(prev, start)
+	assertEquals(t, r.Start, start)
+	assertEquals(t, len(r.Frontends), 2)
+
+	h := r.Frontends[0]
+	assertEquals(t, h.Name, "hot")
+	assertEquals(t, h.Hits, uint64(199))
+	assertEquals(t, h.Misses, uint64(1))
+	assertEquals(t, len(h.Suggestions), 0)
+
+	c := r.Frontends[1]
+	assertEquals(t, c.ID, 1)
+	assertEquals(t, c.Hits, uint64(0))
+	assertEquals(t, c.Misses, uint64(200))
+	if c.AveragePopulationTime <= 0 {
+		t.Fatalf("unexpected population time: %s", c.AveragePopulationTime)
+	}
+	if c.Expirations == 0 {
+		t.Fatal("no expirations")
+	}
+	assertEquals(t, len(c.Suggestions), 2)
+	if !strings.HasPrefix(c.Suggestions[0], "0% hit rate") {
+		t.Fatalf("unexpected suggestion: %s", c.Suggestions[0])
+	}
+	if !strings.Contains(c.Suggestions[1], "cache limits") {
+		t.Fatalf("unexpected suggestion: %s", c.Suggestions[1])
+	}
+
+	s := r.String()
+	for _, sub := range [...]string{
+		"hot ",
+		"frontend1 ",
+		"frontend1: 0% hit rate",
+	} {
+		if !strings.Contains(s, sub) {
+			t.Fatalf("%q not in report:\n%s", sub, s)
+		}
+	}
+
+	// Next report covers only the following interval
+	_, err := hot.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = cache.EfficiencyReport(r.Stats, r.End)
+	assertEquals(t, r.Frontends[0].Hits, uint64(1))
+	assertEquals(t, r.Frontends[1].Misses, uint64(0))
+	assertEquals(t, r.HitRate, float64(1))
+}
@@ -0,0 +1,89 @@
+package recache
+
+import (
+	"bytes"
+	"math"
+)
+
+var (
+	// Amount of bytes at the start of a record to sample for detecting
+	// incompressible data, like images or already compressed data. Records
+	// detected as incompressible are written as stored deflate blocks to save
+	// CPU time. Data written to a RecordWriter is buffered, until the sample
+	// is complete or the data is flushed by an include.
+	//
+	// Zero value disables sampling. Can only be changed before the first
+	// Cache is constructed and must not be mutated after.
+	CompressionSampleSize = 512
+
+	// Magic bytes of common already compressed formats
+	compressedMagic = [...][]byte{
+		{0x1f, 0x8b},                       // gzip
+		{0x28, 0xb5, 0x2f, 0xfd},           // zstd
+		{0xfd, '7', 'z', 'X', 'Z', 0x00},   // xz
+		{'B', 'Z', 'h'},                    // bzip2
+		{'P', 'K', 0x03, 0x04},             // zip
+		{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}, // 7z
+		{0x89, 'P', 'N', 'G'},              // PNG
+		{0xff, 0xd8, 0xff},                 // JPEG
+		{'G', 'I', 'F', '8'},               // GIF
+		{'w', 'O', 'F', '2'},               // WOFF2
+		{'O', 'g', 'g', 'S'},               // Ogg
+		{0x1a, 0x45, 0xdf, 0xa3},           // Matroska and WebM
+	}
+)
+
+// Minimum Shannon entropy in bits per byte of a sample to consider it
+// incompressible
+const incompressibleEntropy = 7.5
+
+// Detect, if data starting with sample is unlikely to benefit from compression
+func incompressible(sample []byte) bool {
+	if CompressionSampleSize == 0 {
+		return false
+	}
+	if len(sample) > CompressionSampleSize {
+		sample = sample[:CompressionSampleSize]
+	}
+
+	for _, m := range compressedMagic {
+		if bytes.HasPrefix(sample, m) {
+			return true
+		}
+	}
+	switch {
+	case len(sample) >= 12 &&
+		bytes.Equal(sample[:4], []byte("RIFF")) &&
+		bytes.Equal(sample[8:12], []byte("WEBP")):
+		return true
+	case len(sample) >= 8 && bytes.Equal(sample[4:8], []byte("ftyp")): // MP4
+		return true
+	}
+
+	// Entropy of short samples is not representative
+	if len(sample) < CompressionSampleSize {
+		return false
+	}
+	var counts [256]int
+	for _, b := range sample {
+		counts[b]++
+	}
+	var (
+		entropy float64
+		symbols int
+		l       = float64(len(sample))
+	)
+	for _, c := range counts {
+		if c != 0 {
+			symbols++
+			p := float64(c) / l
+			entropy -= p * math.Log2(p)
+		}
+	}
+
+	// Miller-Madow correction for the underestimation of entropy from small
+	// samples
+	entropy += float64(symbols-1) / (2 * l * math.Ln2)
+
+	return entropy >= incompressibleEntropy
+}
@@ -0,0 +1,24 @@
+package recache
+
+// Create a cheap, short-lived cache intended to live for a single request or
+// batch job. Selected records can be promoted into a long-lived cache with
+// Frontend.Promote() before the scratch cache is closed with Cache.Close().
+//
+// Scratch caches start no background goroutines, so CacheOptions.MemoryTuning
+// and CacheOptions.DeadlockThreshold are ignored. Records of scratch caches do
+// not register as dependents of records of other caches they include or bind
+// to, to keep records of other caches from referencing them after closing.
+// Records of other caches must not include records of scratch caches.
+func NewScratchCache(opts CacheOptions) *Cache {
+	return newCache(opts, true)
+}
+
+// Retrieve or generate the record by key k of a scratch cache frontend and
+// store a copy of it in frontend dst of another cache with Cache.Adopt()
+func (f *Frontend) Promote(k Key, dst *Frontend) (*Record, error) {
+	rec, err := f.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	return dst.cache.Adopt(rec, dst, k)
+}
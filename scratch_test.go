@@ -0,0 +1,76 @@
+package recache
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestScratchCache(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache  = NewCache(CacheOptions{})
+		config = cache.NewFrontend(dummyGetter)
+		pages  = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				return errors.New("getter called")
+			},
+		})
+
+		scratch      = NewScratchCache(CacheOptions{})
+		scratchPages = scratch.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				return rw.Include(config, k)
+			},
+		})
+	)
+
+	for _, k := range [...]int{1, 2} {
+		_, err := scratchPages.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	rec, err := scratchPages.Promote(1, pages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dst int
+	decodeJSON(t, rec, &dst)
+	assertEquals(t, dst, 1)
+
+	// Only the promoted record depends on the config record
+	cache.mu.Lock()
+	configRec, _ := cache.record(recordLocation{config.id, 1})
+	included := len(configRec.includedIn)
+	cache.mu.Unlock()
+	assertEquals(t, included, 1)
+
+	id := scratch.id
+	scratch.Close()
+	scratch.Close()
+	_, err = scratchPages.Get(1)
+	assertEquals(t, err, ErrCacheClosed)
+	assertEquals(t, len(scratch.frontends[scratchPages.id]), 0)
+	if getCache(id) == scratch {
+		t.Fatal("cache not removed from registry")
+	}
+
+	// Promoted records survive closing
+	rec, err = pages.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodeJSON(t, rec, &dst)
+	assertEquals(t, dst, 1)
+
+	// Promoted records are still evicted with records of other caches they
+	// depend on
+	config.Evict(0, 1)
+	cache.mu.Lock()
+	_, ok := cache.frontends[pages.id][1]
+	cache.mu.Unlock()
+	assertEquals(t, ok, false)
+	assertConsistency(t, cache)
+
+}
@@ -1,6 +1,10 @@
 package recache
 
 import (
+	"bytes"
+	"context"
+	"runtime"
+	"strconv"
 	"sync/atomic"
 )
 
@@ -9,6 +13,7 @@ import (
 // After that all Wait() calls don't block.
 type semaphore struct {
 	finished uint32
+	waiters  int32 // Number of callers currently blocked in Wait()
 	wait     chan struct{}
 }
 
@@ -26,10 +31,53 @@ func (s *semaphore) Unblock() {
 // Wait for the semaphore to be unblocked, if blocked
 func (s *semaphore) Wait() {
 	// Hot path after Unblock() call
-	if atomic.LoadUint32(&s.finished) == 1 {
+	if s.Finished() {
 		return
 	}
 
 	// Block until Unblock() is called
+	atomic.AddInt32(&s.waiters, 1)
 	<-s.wait
+	atomic.AddInt32(&s.waiters, -1)
+}
+
+// Wait for the semaphore to be unblocked, if blocked, or ctx to be done.
+// Returns ctx.Err(), if ctx was done first.
+func (s *semaphore) WaitContext(ctx context.Context) error {
+	// Hot path after Unblock() call
+	if s.Finished() {
+		return nil
+	}
+
+	atomic.AddInt32(&s.waiters, 1)
+	defer atomic.AddInt32(&s.waiters, -1)
+	select {
+	case <-s.wait:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Returns, if Unblock() has already been called
+func (s *semaphore) Finished() bool {
+	return atomic.LoadUint32(&s.finished) == 1
+}
+
+// Return number of callers currently blocked in Wait()
+func (s *semaphore) Waiters() int {
+	return int(atomic.LoadInt32(&s.waiters))
+}
+
+// Return ID of the current goroutine. Parses a stack trace, so should be kept
+// off hot paths.
+func goroutineID() uint64 {
+	var arr [64]byte
+	b := arr[:runtime.Stack(arr[:], false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i != -1 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseUint(string(b), 10, 64)
+	return id
 }
@@ -0,0 +1,131 @@
+package recache
+
+import (
+	"context"
+	"time"
+)
+
+// Minimum amount of read-your-writes windows of a frontend before expired ones
+// are swept
+const minSessionWriteSweep = 64
+
+// Context key of the session attached with WithSession()
+type sessionContextKey struct{}
+
+// Record written by a session with Frontend.MarkWritten()
+type sessionWrite struct {
+	session string
+	key     Key
+}
+
+// Time of a write marked with Frontend.MarkWritten() and the end of its
+// read-your-writes window
+type sessionWriteWindow struct {
+	at, until time.Time
+}
+
+// Attach the ID of a principal, like a user session, to ctx for
+// read-your-writes consistency of records marked with Frontend.MarkWritten().
+// Pass the returned context to Frontend.GetContext() or attach it to requests
+// served with Frontend.WriteHTTP().
+func WithSession(ctx context.Context, session string) context.Context {
+	return context.WithValue(ctx, sessionContextKey{}, session)
+}
+
+// Return the session attached to ctx with WithSession(), if any
+func sessionFromContext(ctx context.Context) (string, bool) {
+	s, ok := ctx.Value(sessionContextKey{}).(string)
+	return s, ok
+}
+
+// Return a context carrying only the session attached to ctx, if any.
+// Used for retrievals, that must not be cancelled with ctx.
+func detachSession(ctx context.Context) context.Context {
+	if s, ok := sessionFromContext(ctx); ok {
+		return WithSession(context.Background(), s)
+	}
+	return context.Background()
+}
+
+// Return ctx with any session attached to it with WithSession() removed
+func withoutSession(ctx context.Context) context.Context {
+	if _, ok := sessionFromContext(ctx); ok {
+		return context.WithValue(ctx, sessionContextKey{}, nil)
+	}
+	return ctx
+}
+
+// Mark the record by key k as written by session for the duration d. During
+// d, retrievals with the session attached with WithSession() regenerate the
+// record privately, if the cached record was created before the write, so
+// that the session sees its own writes. Other retrievals keep being served
+// the cached record until it is evicted.
+//
+// The privately regenerated records are not stored in the cache and include
+// records marked as written by the same session the same way. Records of the
+// cache including the record by k are not affected, so mark their keys as
+// well. Call after the write to the upstream data has completed.
+func (f *Frontend) MarkWritten(session string, k Key, d time.Duration) {
+	c := f.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	m := &c.frontendMeta[f.id]
+	if m.instance != f {
+		return // Deleted
+	}
+
+	// Expired windows are removed lazily on lookup. Windows never looked up
+	// again are swept, once their amount doubles since the last sweep, to
+	// amortize the cost of the sweep over the writes.
+	now := time.Now()
+	if n := len(m.sessionWrites); n >= minSessionWriteSweep &&
+		n >= 2*m.sessionWritesSwept {
+		for w, win := range m.sessionWrites {
+			if !now.Before(win.until) {
+				delete(m.sessionWrites, w)
+			}
+		}
+		m.sessionWritesSwept = len(m.sessionWrites)
+	}
+	if m.sessionWrites == nil {
+		m.sessionWrites = make(map[sessionWrite]sessionWriteWindow)
+	}
+	m.sessionWrites[sessionWrite{session, k}] = sessionWriteWindow{
+		at:    now,
+		until: now.Add(d),
+	}
+}
+
+// Return, if rec is older than a write to the record by key k marked for the
+// session attached to ctx, if any
+func (f *Frontend) predatesSessionWrite(
+	ctx context.Context,
+	k Key,
+	rec *Record,
+) bool {
+	session, ok := sessionFromContext(ctx)
+	if !ok {
+		return false
+	}
+
+	c := f.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	m := &c.frontendMeta[f.id]
+	if m.instance != f {
+		return false
+	}
+	w := sessionWrite{session, k}
+	win, ok := m.sessionWrites[w]
+	switch {
+	case !ok:
+		return false
+	case !time.Now().Before(win.until):
+		delete(m.sessionWrites, w)
+		return false
+	default:
+		return rec.created.Before(win.at)
+	}
+}
@@ -0,0 +1,132 @@
+package recache
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionBypass(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu       sync.Mutex
+		upstream = map[string]string{"a": "1"}
+		cache    = NewCache(CacheOptions{})
+	)
+	children := cache.NewFrontendWithOptions(FrontendOptions{
+		Get: func(k Key, rw *RecordWriter) (err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			_, err = rw.Write([]byte(upstream[k.(string)]))
+			return
+		},
+	})
+	parents := cache.NewFrontendWithOptions(FrontendOptions{
+		Get: func(k Key, rw *RecordWriter) (err error) {
+			_, err = rw.Write([]byte("<"))
+			if err != nil {
+				return
+			}
+			err = rw.Include(children, k)
+			if err != nil {
+				return
+			}
+			_, err = rw.Write([]byte(">"))
+			return
+		},
+	})
+
+	var (
+		alice = WithSession(context.Background(), "alice")
+		bob   = WithSession(context.Background(), "bob")
+	)
+	read := func(ctx context.Context, f *Frontend) string {
+		t.Helper()
+		rec, err := f.GetContext(ctx, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dec bytes.Buffer
+		_, err = dec.ReadFrom(rec.Decompress())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dec.String()
+	}
+
+	assertEquals(t, read(context.Background(), parents), "<1>")
+
+	mu.Lock()
+	upstream["a"] = "2"
+	mu.Unlock()
+	children.MarkWritten("alice", "a", time.Minute)
+
+	assertEquals(t, read(alice, children), "2")
+	assertEquals(t, read(bob, children), "1")
+	assertEquals(t, read(context.Background(), children), "1")
+
+	// Records including the written record are not bypassed, unless marked
+	assertEquals(t, read(alice, parents), "<1>")
+	parents.MarkWritten("alice", "a", time.Minute)
+	assertEquals(t, read(alice, parents), "<2>")
+	assertEquals(t, read(bob, parents), "<1>")
+
+	// Sessions attached to HTTP requests
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil).WithContext(alice)
+	_, err := children.WriteHTTP("a", w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, w.Body.String(), "2")
+
+	// Records regenerated after the write are served from the cache
+	children.Evict(0, "a")
+	cached, err := children.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := children.GetContext(alice, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec != cached {
+		t.Fatal("expected cached record")
+	}
+
+	// Expired windows
+	mu.Lock()
+	upstream["a"] = "3"
+	mu.Unlock()
+	children.MarkWritten("bob", "a", time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	assertEquals(t, read(bob, children), "2")
+	assertConsistency(t, cache)
+}
+
+func TestSessionWriteSweep(t *testing.T) {
+	t.Parallel()
+
+	cache := NewCache(CacheOptions{})
+	f := cache.NewFrontend(dummyGetter)
+	count := func() int {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		return len(cache.frontendMeta[f.id].sessionWrites)
+	}
+
+	// Expired windows not looked up again are kept until the next sweep
+	for i := 0; i < minSessionWriteSweep; i++ {
+		f.MarkWritten("s", i, 0)
+	}
+	assertEquals(t, count(), minSessionWriteSweep)
+
+	f.MarkWritten("s", "live", time.Minute)
+	assertEquals(t, count(), 1)
+	f.MarkWritten("s", "live2", time.Minute)
+	assertEquals(t, count(), 2)
+}
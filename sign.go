@@ -0,0 +1,60 @@
+package recache
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+)
+
+// Record read from a snapshot or L2 cache is not signed with
+// CacheOptions.SigningKey
+var ErrInvalidSignature = errors.New("invalid record signature")
+
+// Writes values to a MAC, prefixing variable-length values with their length
+// to keep the encoding unambiguous
+type macWriter struct {
+	hash.Hash
+}
+
+// Return a new macWriter keyed with CacheOptions.SigningKey. ok=false, if no
+// key is set.
+func (c *Cache) newMAC() (w macWriter, ok bool) {
+	if len(c.opts.SigningKey) == 0 {
+		return
+	}
+	return macWriter{hmac.New(sha256.New, c.opts.SigningKey)}, true
+}
+
+func (w macWriter) int(i int64) {
+	var arr [8]byte
+	binary.LittleEndian.PutUint64(arr[:], uint64(i))
+	w.Write(arr[:])
+}
+
+func (w macWriter) bool(b bool) {
+	if b {
+		w.int(1)
+	} else {
+		w.int(0)
+	}
+}
+
+func (w macWriter) bytes(b []byte) {
+	w.int(int64(len(b)))
+	w.Write(b)
+}
+
+func (w macWriter) string(s string) {
+	w.int(int64(len(s)))
+	w.Write([]byte(s))
+}
+
+// Compare the MAC written so far against mac
+func (w macWriter) verify(mac []byte) error {
+	if !hmac.Equal(w.Sum(nil), mac) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
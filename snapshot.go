@@ -0,0 +1,666 @@
+package recache
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Version of the snapshot format written by Cache.Snapshot()
+const snapshotVersion = 1
+
+var (
+	// Record included or bound by a record restored from a snapshot is not
+	// in the cache
+	errNotRestored = errors.New("dependency not restored")
+
+	// Snapshot passed to Cache.Restore() was written by an incompatible
+	// version of the library
+	ErrSnapshotVersion = errors.New("unsupported snapshot version")
+
+	// Snapshot passed to Cache.Restore() was taken without EnableGzip set,
+	// while EnableGzip is set now
+	ErrSnapshotGzip = errors.New("snapshot taken without gzip checksums")
+)
+
+// Start of a snapshot
+type snapshotHeader struct {
+	Version int
+
+	// EnableGzip was set when taking the snapshot
+	Gzip bool
+
+	// Frontends of the cache, not counting deleted ones
+	Frontends []snapshotFrontend
+
+	// Signature of the header with CacheOptions.SigningKey
+	MAC []byte
+}
+
+// Frontend of a snapshotted cache
+type snapshotFrontend struct {
+	ID   int
+	Name string
+}
+
+// Snapshotted record. Records are written after any records they depend on.
+type snapshotRecord struct {
+	// Location of the record
+	Location snapshotLocation
+
+	// Creation time of the record
+	Created time.Time
+
+	// Time left until eviction or staleness of the record. 0, if none.
+	TTL time.Duration
+
+	CompressionLevel int
+
+	// External resource tokens the record depends on
+	Tokens []string
+
+	// Components of the record in order
+	Components []snapshotComponent
+
+	// Records bound to, but not included, during population
+	Bound []snapshotLocation
+
+	// Signature of the record and snapshot header with
+	// CacheOptions.SigningKey
+	MAC []byte
+}
+
+// Location of a snapshotted record
+type snapshotLocation struct {
+	// ID of the frontend in the snapshotted cache
+	Frontend int
+
+	// Key encoded with FrontendOptions.EncodeKey
+	Key []byte
+}
+
+// Snapshotted record component
+type snapshotComponent struct {
+	// Compressed data and frame descriptor of buffer components
+	Data                  []byte
+	Checksum, CRC32, Size uint32
+
+	// Location of the included record of reference components and if it was
+	// included with RecordWriter.IncludeWeak()
+	Include *snapshotLocation
+	Weak    bool
+
+	// Name of placeholder components
+	Placeholder string
+}
+
+// Write the header, except for its MAC, to mac
+func (h *snapshotHeader) sign(mac macWriter) {
+	mac.int(int64(h.Version))
+	mac.bool(h.Gzip)
+	mac.int(int64(len(h.Frontends)))
+	for _, f := range h.Frontends {
+		mac.int(int64(f.ID))
+		mac.string(f.Name)
+	}
+}
+
+// Write the record, except for its MAC, to mac
+func (sr *snapshotRecord) sign(mac macWriter) {
+	sr.Location.sign(mac)
+	mac.int(sr.Created.Unix())
+	mac.int(int64(sr.Created.Nanosecond()))
+	mac.int(int64(sr.TTL))
+	mac.int(int64(sr.CompressionLevel))
+	mac.int(int64(len(sr.Tokens)))
+	for _, t := range sr.Tokens {
+		mac.string(t)
+	}
+	mac.int(int64(len(sr.Components)))
+	for _, c := range sr.Components {
+		mac.bytes(c.Data)
+		for _, u := range [...]uint32{c.Checksum, c.CRC32, c.Size} {
+			mac.int(int64(u))
+		}
+		mac.bool(c.Include != nil)
+		if c.Include != nil {
+			c.Include.sign(mac)
+		}
+		mac.bool(c.Weak)
+		mac.string(c.Placeholder)
+	}
+	mac.int(int64(len(sr.Bound)))
+	for _, l := range sr.Bound {
+		l.sign(mac)
+	}
+}
+
+func (l *snapshotLocation) sign(mac macWriter) {
+	mac.int(int64(l.Frontend))
+	mac.bytes(l.Key)
+}
+
+// Verify the decompressed data of a buffer component matches its frame
+// descriptor
+func (c *snapshotComponent) verify() error {
+	return verifyCompressed(c.Data, FrameDescriptor{
+		checksum: c.Checksum,
+		size:     c.Size,
+	})
+}
+
+// Record collected for writing to a snapshot
+type snapshotEntry struct {
+	rec    *Record
+	ttl    time.Duration
+	tokens []string
+}
+
+// Write all populated records of the cache to w, so that they can be restored
+// with Cache.Restore() or LoadCache(), like after a process restart. Keys are
+// encoded with FrontendOptions.EncodeKey.
+//
+// Records include their compressed data, frame descriptors, dependencies on
+// other records of the cache and external resource tokens, and any time left
+// until their scheduled eviction or staleness. Stale records, records being
+// populated and records depending on records of other caches are omitted.
+// With CacheOptions.SigningKey set, the snapshot is signed with the key.
+//
+// Records are captured at the start of the call. The cache can be used
+// concurrently with writing the snapshot.
+func (c *Cache) Snapshot(w io.Writer) (err error) {
+	header, entries, locs := c.collectSnapshot()
+
+	s := snapshotWriter{
+		cache:   c,
+		enc:     gob.NewEncoder(w),
+		entries: entries,
+		state:   make(map[recordLocation]uint8, len(entries)),
+	}
+	if mac, ok := c.newMAC(); ok {
+		header.sign(mac)
+		header.MAC = mac.Sum(nil)
+		s.headerMAC = header.MAC
+	}
+	err = s.enc.Encode(header)
+	if err != nil {
+		return
+	}
+	for _, loc := range locs {
+		_, err = s.write(loc)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Collect frontends and records of the cache for writing a snapshot
+func (c *Cache) collectSnapshot() (
+	header snapshotHeader,
+	entries map[recordLocation]snapshotEntry,
+	locs []recordLocation,
+) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	header = snapshotHeader{
+		Version: snapshotVersion,
+		Gzip:    EnableGzip,
+	}
+	entries = make(map[recordLocation]snapshotEntry)
+	now := time.Now()
+
+	for id, m := range c.frontendMeta {
+		if m.instance == nil {
+			continue // Deleted
+		}
+		header.Frontends = append(header.Frontends, snapshotFrontend{
+			ID:   id,
+			Name: m.instance.opts.Name,
+		})
+
+	records:
+		for k, meta := range c.frontends[id] {
+			if !meta.populated ||
+				meta.stale ||
+				meta.epoch != c.epoch ||
+				!meta.rec.semaphore.Finished() ||
+				meta.rec.populationError != nil {
+				continue
+			}
+
+			var ttl time.Duration
+			for _, t := range [...]time.Time{meta.evictAt, meta.staleAt} {
+				if t.IsZero() {
+					continue
+				}
+				d := t.Sub(now)
+				if d <= 0 {
+					continue records
+				}
+				if ttl == 0 || d < ttl {
+					ttl = d
+				}
+			}
+
+			loc := recordLocation{id, k}
+			entries[loc] = snapshotEntry{
+				rec:    meta.rec,
+				ttl:    ttl,
+				tokens: append([]string(nil), meta.tokens...),
+			}
+			locs = append(locs, loc)
+		}
+	}
+	return
+}
+
+// States of records in snapshotWriter
+const (
+	snapshotPending uint8 = iota
+	snapshotVisiting
+	snapshotWritten
+	snapshotOmitted
+)
+
+// Writes records to a snapshot after any records they depend on
+type snapshotWriter struct {
+	cache   *Cache
+	enc     *gob.Encoder
+	entries map[recordLocation]snapshotEntry
+	state   map[recordLocation]uint8
+
+	// Signature of the snapshot header. nil, if not signing.
+	headerMAC []byte
+}
+
+// Write the record at loc after any records it depends on. Returns, if the
+// record has been written.
+func (s *snapshotWriter) write(loc recordLocation) (written bool, err error) {
+	switch s.state[loc] {
+	case snapshotWritten:
+		return true, nil
+	case snapshotVisiting, snapshotOmitted:
+		return false, nil
+	}
+	e := s.entries[loc]
+	s.state[loc] = snapshotVisiting
+	defer func() {
+		if written {
+			s.state[loc] = snapshotWritten
+		} else {
+			s.state[loc] = snapshotOmitted
+		}
+	}()
+
+	f := e.rec.frontend
+	sr := snapshotRecord{
+		Created:          e.rec.created,
+		TTL:              e.ttl,
+		CompressionLevel: e.rec.compressionLevel,
+		Tokens:           e.tokens,
+	}
+	sr.Location, err = s.location(f, loc.key)
+	if err != nil {
+		return
+	}
+
+	for _, d := range e.rec.dependencies {
+		if d.Frontend.cache != s.cache {
+			return
+		}
+		depLoc := recordLocation{d.Frontend.id, d.Key}
+		dep, ok := s.entries[depLoc]
+		if !ok || dep.rec.frontend != d.Frontend {
+			return
+		}
+		ok, err = s.write(depLoc)
+		if err != nil || !ok {
+			return
+		}
+		if !d.Included {
+			var l snapshotLocation
+			l, err = s.location(d.Frontend, d.Key)
+			if err != nil {
+				return
+			}
+			sr.Bound = append(sr.Bound, l)
+		}
+	}
+
+	for n := &e.rec.data; n != nil; n = n.next {
+		var sc snapshotComponent
+		switch c := n.component.(type) {
+		case buffer:
+			sc = snapshotComponent{
+				Data:     c.data,
+				Checksum: c.frame.checksum,
+				CRC32:    c.frame.crc32,
+				Size:     c.frame.size,
+			}
+		case recordReference:
+			var l snapshotLocation
+			l, err = s.location(c.frontend, c.key)
+			if err != nil {
+				return
+			}
+			sc.Include = &l
+			sc.Weak = c.weak
+		case placeholder:
+			sc.Placeholder = c.name
+		}
+		sr.Components = append(sr.Components, sc)
+	}
+
+	if mac, ok := s.cache.newMAC(); ok {
+		mac.bytes(s.headerMAC)
+		sr.sign(mac)
+		sr.MAC = mac.Sum(nil)
+	}
+	err = s.enc.Encode(sr)
+	written = err == nil
+	return
+}
+
+// Return the snapshot location of a record
+func (s *snapshotWriter) location(f *Frontend, k Key) (
+	l snapshotLocation,
+	err error,
+) {
+	l.Frontend = f.id
+	l.Key, err = f.encodeKey(k)
+	if err != nil {
+		err = fmt.Errorf("encoding key %s: %w", f.KeyString(k), err)
+	}
+	return
+}
+
+// Restore records from a snapshot written by Cache.Snapshot() into the cache.
+// Existing records at the same locations are replaced.
+//
+// Records are restored into frontends with the same FrontendOptions.Name as
+// in the snapshotted cache. Records of frontends without a name are restored
+// into the frontend created in the same order. Records of frontends not
+// present in the cache are skipped. Keys are decoded with
+// FrontendOptions.DecodeKey.
+//
+// Restored records retain their creation time, so FrontendOptions.Validate
+// can lazily discard records that became invalid while the process was not
+// running.
+//
+// The checksums of all records are verified before restoring them. With
+// CacheOptions.SigningKey set, snapshots not signed with the same key are
+// rejected with ErrInvalidSignature. Records failing verification and records
+// including or bound to records not restored are logged and skipped.
+func (c *Cache) Restore(r io.Reader) (err error) {
+	dec := gob.NewDecoder(r)
+	var header snapshotHeader
+	err = dec.Decode(&header)
+	if err != nil {
+		return
+	}
+	switch {
+	case header.Version != snapshotVersion:
+		return ErrSnapshotVersion
+	case EnableGzip && !header.Gzip:
+		return ErrSnapshotGzip
+	}
+	if mac, ok := c.newMAC(); ok {
+		header.sign(mac)
+		err = mac.verify(header.MAC)
+		if err != nil {
+			return
+		}
+	}
+
+	s := snapshotReader{
+		cache:     c,
+		frontends: c.snapshotFrontends(header.Frontends),
+		headerMAC: header.MAC,
+	}
+	for {
+		var sr snapshotRecord
+		err = dec.Decode(&sr)
+		switch err {
+		case nil:
+			err = s.restore(sr)
+			if err != nil {
+				return
+			}
+		case io.EOF:
+			return nil
+		default:
+			return
+		}
+	}
+}
+
+// Map IDs of frontends in a snapshot to frontends of c
+func (c *Cache) snapshotFrontends(src []snapshotFrontend) map[int]*Frontend {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	byName := make(map[string]*Frontend)
+	for _, m := range c.frontendMeta {
+		if m.instance != nil && m.instance.opts.Name != "" {
+			byName[m.instance.opts.Name] = m.instance
+		}
+	}
+
+	frontends := make(map[int]*Frontend, len(src))
+	for _, sf := range src {
+		var f *Frontend
+		if sf.Name != "" {
+			f = byName[sf.Name]
+		} else if sf.ID < len(c.frontendMeta) {
+			f = c.frontendMeta[sf.ID].instance
+			if f != nil && f.opts.Name != "" {
+				f = nil
+			}
+		}
+		if f != nil {
+			frontends[sf.ID] = f
+		}
+	}
+	return frontends
+}
+
+// Restores records read from a snapshot
+type snapshotReader struct {
+	cache *Cache
+
+	// Frontends of the cache by snapshot frontend ID
+	frontends map[int]*Frontend
+
+	// Signature of the snapshot header
+	headerMAC []byte
+}
+
+// Restore a record read from a snapshot. Records that fail verification,
+// have undecodable keys or depend on records not in the cache are logged and
+// skipped. Getters are not called for missing dependencies.
+func (s *snapshotReader) restore(sr snapshotRecord) (err error) {
+	err = s.verify(sr)
+	if err != nil {
+		s.cache.logger.Printf("skipped snapshot record: %s", err)
+		return nil
+	}
+
+	f, k, ok, err := s.resolve(sr.Location)
+	if err != nil {
+		s.cache.logger.Printf("skipped snapshot record: %s", err)
+		return nil
+	}
+	if !ok {
+		return
+	}
+
+	rec, wait, err := s.cache.beginAdoption(f, k)
+	if err != nil || wait != nil {
+		// Keep records being populated concurrently
+		return
+	}
+	f.completePopulation(k, rec, func(rw *RecordWriter) (err error) {
+		rw.restoring = true
+		rw.level = sr.CompressionLevel
+		rw.created = sr.Created
+		rw.ttl = sr.TTL
+		for _, t := range sr.Tokens {
+			rw.DependOn(t)
+		}
+
+		for _, sc := range sr.Components {
+			if sc.Placeholder != "" {
+				rw.append(newPlaceholder(sc.Placeholder))
+				continue
+			}
+			if sc.Include == nil {
+				rw.append(buffer{
+					componentCommon: componentCommon{
+						hash: sha1.Sum(sc.Data),
+					},
+					frame: FrameDescriptor{
+						checksum: sc.Checksum,
+						crc32:    sc.CRC32,
+						size:     sc.Size,
+					},
+					data: sc.Data,
+				})
+				continue
+			}
+
+			f, k, err := s.resolveDependency(*sc.Include)
+			if err != nil {
+				return err
+			}
+			err = rw.include(f, k, sc.Weak)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, l := range sr.Bound {
+			f, k, err := s.resolveDependency(l)
+			if err != nil {
+				return err
+			}
+			_, err = rw.Bind(f, k)
+			if err != nil {
+				return err
+			}
+		}
+		return
+	})
+	if rec.populationError != nil {
+		s.cache.logger.Printf(
+			"skipped snapshot record: key=%s: %s",
+			f.KeyString(k), rec.populationError,
+		)
+	}
+	return
+}
+
+// Verify the signature and checksums of a record read from a snapshot
+func (s *snapshotReader) verify(sr snapshotRecord) (err error) {
+	if mac, ok := s.cache.newMAC(); ok {
+		mac.bytes(s.headerMAC)
+		sr.sign(mac)
+		err = mac.verify(sr.MAC)
+		if err != nil {
+			return
+		}
+	}
+	for _, sc := range sr.Components {
+		if sc.Include == nil && sc.Placeholder == "" {
+			err = sc.verify()
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Resolve the frontend and key of a snapshot location. ok=false, if the
+// frontend is not present in the cache.
+func (s *snapshotReader) resolve(l snapshotLocation) (
+	f *Frontend,
+	k Key,
+	ok bool,
+	err error,
+) {
+	f = s.frontends[l.Frontend]
+	if f == nil {
+		return
+	}
+	k, err = f.decodeKey(l.Key)
+	if err != nil {
+		err = fmt.Errorf("decoding key: %w", err)
+		return
+	}
+	ok = true
+	return
+}
+
+// Same as resolve(), but returns an error for frontends not present in the
+// cache
+func (s *snapshotReader) resolveDependency(l snapshotLocation) (
+	f *Frontend,
+	k Key,
+	err error,
+) {
+	f, k, ok, err := s.resolve(l)
+	if err == nil && !ok {
+		err = fmt.Errorf("frontend of dependency not restored: %d", l.Frontend)
+	}
+	return
+}
+
+// Create a cache with opts and frontends with the passed options in order,
+// then restore records from a snapshot read from r into it with
+// Cache.Restore().
+func LoadCache(
+	r io.Reader,
+	opts CacheOptions,
+	frontends ...FrontendOptions,
+) (c *Cache, fs []*Frontend, err error) {
+	c = NewCache(opts)
+	fs = make([]*Frontend, len(frontends))
+	for i, o := range frontends {
+		fs[i], err = c.TryNewFrontend(o)
+		if err != nil {
+			c.Close()
+			return nil, nil, err
+		}
+	}
+	err = c.Restore(r)
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	return
+}
+
+// Encode key with FrontendOptions.EncodeKey
+func (f *Frontend) encodeKey(k Key) ([]byte, error) {
+	if f.opts.EncodeKey != nil {
+		return f.opts.EncodeKey(k)
+	}
+	var w bytes.Buffer
+	err := gob.NewEncoder(&w).Encode(&k)
+	return w.Bytes(), err
+}
+
+// Decode key with FrontendOptions.DecodeKey
+func (f *Frontend) decodeKey(buf []byte) (k Key, err error) {
+	if f.opts.DecodeKey != nil {
+		return f.opts.DecodeKey(buf)
+	}
+	err = gob.NewDecoder(bytes.NewReader(buf)).Decode(&k)
+	return
+}
@@ -0,0 +1,305 @@
+package recache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	t.Parallel()
+
+	type point struct{ X, Y int }
+
+	var (
+		generate          = true
+		children, points  *Frontend
+		childrenOpts      FrontendOptions
+		pointsOpts        FrontendOptions
+		parentsOpts       FrontendOptions
+		allowRegeneration = func(fn Getter) Getter {
+			return func(k Key, rw *RecordWriter) error {
+				if !generate {
+					return fmt.Errorf("record regenerated: %#v", k)
+				}
+				return fn(k, rw)
+			}
+		}
+	)
+	childrenOpts = FrontendOptions{
+		Name: "children",
+		Get: allowRegeneration(func(k Key, rw *RecordWriter) error {
+			if k.(string) == "ttl" {
+				rw.SetTTL(time.Hour)
+			}
+			rw.DependOn("token")
+			return dummyGetter(k, rw)
+		}),
+	}
+	pointsOpts = FrontendOptions{
+		Name: "points",
+		Get: allowRegeneration(func(k Key, rw *RecordWriter) error {
+			p := k.(point)
+			_, err := fmt.Fprintf(rw, "(%d,%d)", p.X, p.Y)
+			return err
+		}),
+		EncodeKey: func(k Key) ([]byte, error) {
+			p := k.(point)
+			return []byte(fmt.Sprintf("%d,%d", p.X, p.Y)), nil
+		},
+		DecodeKey: func(buf []byte) (Key, error) {
+			var p point
+			_, err := fmt.Sscanf(string(buf), "%d,%d", &p.X, &p.Y)
+			return p, err
+		},
+	}
+	parentsOpts = FrontendOptions{
+		Name: "parents",
+		Get: allowRegeneration(func(k Key, rw *RecordWriter) (err error) {
+			_, err = rw.Write([]byte("<"))
+			if err != nil {
+				return
+			}
+			err = rw.Include(children, k)
+			if err != nil {
+				return
+			}
+			_, err = rw.Bind(points, point{1, 2})
+			if err != nil {
+				return
+			}
+			err = rw.Include(points, point{3, 4})
+			if err != nil {
+				return
+			}
+			_, err = rw.Write([]byte(">"))
+			return
+		}),
+	}
+
+	src := NewCache(CacheOptions{})
+	// Restored by name regardless of creation order
+	parents := src.NewFrontendWithOptions(parentsOpts)
+	children = src.NewFrontendWithOptions(childrenOpts)
+	points = src.NewFrontendWithOptions(pointsOpts)
+
+	keys := [...]string{"a", "ttl"}
+	var std [len(keys)]*Record
+	for i, k := range keys {
+		rec, err := parents.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		std[i] = rec
+	}
+
+	var buf bytes.Buffer
+	err := src.Snapshot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	generate = false
+	cache, fs, err := LoadCache(
+		&buf,
+		CacheOptions{},
+		childrenOpts,
+		pointsOpts,
+		parentsOpts,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	children, points, parents = fs[0], fs[1], fs[2]
+
+	for i, k := range keys {
+		rec, err := parents.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEquals(t, rec.ETag(), std[i].ETag())
+		assertEquals(t, rec.FrameDescriptor(), std[i].FrameDescriptor())
+		assertEquals(t, rec.Meta().Created.Equal(std[i].Meta().Created), true)
+		assertEquals(t, rec.Meta().CompressionLevel, CompressionLevel)
+		assertEquals(t, len(rec.Meta().Dependencies), 3)
+
+		var dec bytes.Buffer
+		_, err = dec.ReadFrom(rec.Decompress())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEquals(t, dec.String(), fmt.Sprintf("<\"%s\"\n(3,4)>", k))
+	}
+	assertEquals(t, cache.SnapshotStats().Records, 2+2+2)
+	assertConsistency(t, cache)
+
+	// TTL restored
+	_, ok := children.ExpiresAt("a")
+	assertEquals(t, ok, false)
+	exp, ok := children.ExpiresAt("ttl")
+	assertEquals(t, ok, true)
+	if d := time.Until(exp); d < 59*time.Minute || d > time.Hour {
+		t.Fatalf("unexpected expiry in %s", d)
+	}
+
+	// Dependencies restored
+	contains := func(f *Frontend, k Key) bool {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		_, ok := cache.frontends[f.id][k]
+		return ok
+	}
+	points.Evict(0, point{1, 2})
+	for _, k := range keys {
+		assertEquals(t, contains(parents, k), false)
+	}
+	assertEquals(t, contains(children, "a"), true)
+	cache.InvalidateToken("token")
+	assertEquals(t, contains(children, "a"), false)
+	assertConsistency(t, cache)
+}
+
+func TestSnapshotSigned(t *testing.T) {
+	t.Parallel()
+
+	opts := FrontendOptions{
+		Name: "signed",
+		Get:  dummyGetter,
+	}
+	snapshot := func(key string) *bytes.Buffer {
+		t.Helper()
+		f := NewCache(CacheOptions{
+			SigningKey: []byte(key),
+		}).NewFrontendWithOptions(opts)
+		_, err := f.Get(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		err = f.cache.Snapshot(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &buf
+	}
+
+	cases := [...]struct {
+		name, signedWith string
+		err              error
+	}{
+		{"same key", "key", nil},
+		{"other key", "other", ErrInvalidSignature},
+		{"unsigned", "", ErrInvalidSignature},
+	}
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			cache, _, err := LoadCache(
+				snapshot(c.signedWith),
+				CacheOptions{
+					SigningKey: []byte("key"),
+				},
+				opts,
+			)
+			if !errors.Is(err, c.err) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err == nil {
+				assertEquals(t, cache.SnapshotStats().Records, 1)
+			}
+		})
+	}
+}
+
+func TestSnapshotChecksum(t *testing.T) {
+	t.Parallel()
+
+	opts := FrontendOptions{
+		Name: "corrupt",
+		Get:  dummyGetter,
+	}
+	f := NewCache(CacheOptions{}).NewFrontendWithOptions(opts)
+	rec, err := f.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := rec.data.component.(buffer)
+	b.frame.checksum++
+	rec.data.component = b
+
+	var buf bytes.Buffer
+	err = f.cache.Snapshot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, fs, err := LoadCache(&buf, CacheOptions{}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok := fs[0].Peek(1)
+	assertEquals(t, ok, false)
+}
+
+func TestSnapshotMissingDependency(t *testing.T) {
+	t.Parallel()
+
+	var (
+		childPopulations int32
+		childOpts        = FrontendOptions{
+			Name: "children",
+			Get: func(k Key, rw *RecordWriter) error {
+				atomic.AddInt32(&childPopulations, 1)
+				return dummyGetter(k, rw)
+			},
+		}
+	)
+	newParentOpts := func(children *Frontend) FrontendOptions {
+		return FrontendOptions{
+			Name: "parents",
+			Get: func(k Key, rw *RecordWriter) error {
+				return rw.Include(children, k)
+			},
+		}
+	}
+
+	cache := NewCache(CacheOptions{})
+	children := cache.NewFrontendWithOptions(childOpts)
+	parents := cache.NewFrontendWithOptions(newParentOpts(children))
+	_, err := parents.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the included record, so that it is skipped on restore
+	rec, ok := children.Peek(1)
+	assertEquals(t, ok, true)
+	b := rec.data.component.(buffer)
+	b.frame.checksum++
+	rec.data.component = b
+
+	var buf bytes.Buffer
+	err = cache.Snapshot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&childPopulations, 0)
+
+	dst := NewCache(CacheOptions{})
+	children = dst.NewFrontendWithOptions(childOpts)
+	parents = dst.NewFrontendWithOptions(newParentOpts(children))
+	err = dst.Restore(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok = parents.Peek(1)
+	assertEquals(t, ok, false)
+	_, ok = children.Peek(1)
+	assertEquals(t, ok, false)
+	assertEquals(t, atomic.LoadInt32(&childPopulations), int32(0))
+	assertConsistency(t, dst)
+}
@@ -0,0 +1,220 @@
+package recache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Declarative specification of a cache and its frontends for constructing
+// them with NewCacheFromSpec(). Lets applications with many frontends keep
+// their tuning outside code, like in a JSON configuration file.
+//
+// See CacheOptions and FrontendOptions for the meaning of fields.
+type CacheSpec struct {
+	Name                  string
+	MemoryLimit           uint
+	LRULimit              Duration
+	DebounceEviction      bool
+	MaxWeakDependents     uint
+	EvictionYieldInterval uint
+	DeadlockThreshold     Duration
+	MaxFrontends          uint
+	MemoryTuning          *MemoryTuningSpec
+
+	// Frontends to create in order
+	Frontends []FrontendSpec
+}
+
+// Declarative specification of MemoryTuningOptions
+type MemoryTuningSpec struct {
+	MinMemoryLimit, MaxMemoryLimit uint
+	Interval                       Duration
+	Step                           float64
+	TargetHitRate                  float64
+	MaxGCPauseFraction             float64
+}
+
+// Declarative specification of a frontend
+type FrontendSpec struct {
+	// Unique name of the frontend. Required.
+	Name string
+
+	// Name of the Getter of the frontend, as passed to NewCacheFromSpec().
+	// Required.
+	Getter string
+
+	SlowGetterThreshold        Duration
+	GetterTimeout              Duration
+	IncludeTimeout             Duration
+	PopulationTimeout          Duration
+	ValidateInterval           Duration
+	WeakDependent              bool
+	IncludedETagsHeader        string
+	StaleWhileRevalidate       bool
+	VerifyChecksums            bool
+	Brotli                     bool
+	CompressionBudget          Duration
+	DowngradedCompressionLevel int
+	CompressionBudgetCooldown  Duration
+	HoleTTL                    Duration
+	CanaryRate                 float64
+	AdaptiveTTL                *AdaptiveTTLSpec
+	HTTPCachePolicy            *HTTPCachePolicySpec
+}
+
+// Declarative specification of AdaptiveTTLOptions
+type AdaptiveTTLSpec struct {
+	MinTTL, MaxTTL Duration
+	TargetHits     uint
+}
+
+// Declarative specification of HTTPCachePolicy
+type HTTPCachePolicySpec struct {
+	MaxAge, SharedMaxAge, StaleWhileRevalidate Duration
+	Public, Private, NoCache, Immutable        bool
+	MaxAgeFromTTL                              bool
+	Expires                                    bool
+}
+
+// time.Duration encoded in JSON as a string parsed by time.ParseDuration(),
+// like "1m30s". Numbers are decoded as nanoseconds.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(buf []byte) (err error) {
+	var v interface{}
+	err = json.Unmarshal(buf, &v)
+	if err != nil {
+		return
+	}
+	switch v := v.(type) {
+	case float64:
+		*d = Duration(v)
+	case string:
+		var dur time.Duration
+		dur, err = time.ParseDuration(v)
+		if err != nil {
+			return
+		}
+		*d = Duration(dur)
+	default:
+		err = fmt.Errorf("invalid duration: %s", buf)
+	}
+	return
+}
+
+// Return the CacheOptions described by the specification
+func (s CacheSpec) Options() CacheOptions {
+	opts := CacheOptions{
+		Name:                  s.Name,
+		MemoryLimit:           s.MemoryLimit,
+		LRULimit:              time.Duration(s.LRULimit),
+		DebounceEviction:      s.DebounceEviction,
+		MaxWeakDependents:     s.MaxWeakDependents,
+		EvictionYieldInterval: s.EvictionYieldInterval,
+		DeadlockThreshold:     time.Duration(s.DeadlockThreshold),
+		MaxFrontends:          s.MaxFrontends,
+	}
+	if t := s.MemoryTuning; t != nil {
+		opts.MemoryTuning = &MemoryTuningOptions{
+			MinMemoryLimit:     t.MinMemoryLimit,
+			MaxMemoryLimit:     t.MaxMemoryLimit,
+			Interval:           time.Duration(t.Interval),
+			Step:               t.Step,
+			TargetHitRate:      t.TargetHitRate,
+			MaxGCPauseFraction: t.MaxGCPauseFraction,
+		}
+	}
+	return opts
+}
+
+// Return the FrontendOptions described by the specification with get as the
+// Getter. Callbacks, like Validate, can be set on the returned options before
+// creating the frontend.
+func (s FrontendSpec) Options(get Getter) FrontendOptions {
+	opts := FrontendOptions{
+		Get:                        get,
+		Name:                       s.Name,
+		SlowGetterThreshold:        time.Duration(s.SlowGetterThreshold),
+		GetterTimeout:              time.Duration(s.GetterTimeout),
+		IncludeTimeout:             time.Duration(s.IncludeTimeout),
+		PopulationTimeout:          time.Duration(s.PopulationTimeout),
+		ValidateInterval:           time.Duration(s.ValidateInterval),
+		WeakDependent:              s.WeakDependent,
+		IncludedETagsHeader:        s.IncludedETagsHeader,
+		StaleWhileRevalidate:       s.StaleWhileRevalidate,
+		VerifyChecksums:            s.VerifyChecksums,
+		Brotli:                     s.Brotli,
+		CompressionBudget:          time.Duration(s.CompressionBudget),
+		DowngradedCompressionLevel: s.DowngradedCompressionLevel,
+		CompressionBudgetCooldown:  time.Duration(s.CompressionBudgetCooldown),
+		HoleTTL:                    time.Duration(s.HoleTTL),
+		CanaryRate:                 s.CanaryRate,
+	}
+	if a := s.AdaptiveTTL; a != nil {
+		opts.AdaptiveTTL = &AdaptiveTTLOptions{
+			MinTTL:     time.Duration(a.MinTTL),
+			MaxTTL:     time.Duration(a.MaxTTL),
+			TargetHits: a.TargetHits,
+		}
+	}
+	if p := s.HTTPCachePolicy; p != nil {
+		opts.HTTPCachePolicy = &HTTPCachePolicy{
+			MaxAge:               time.Duration(p.MaxAge),
+			SharedMaxAge:         time.Duration(p.SharedMaxAge),
+			StaleWhileRevalidate: time.Duration(p.StaleWhileRevalidate),
+			Public:               p.Public,
+			Private:              p.Private,
+			NoCache:              p.NoCache,
+			Immutable:            p.Immutable,
+			MaxAgeFromTTL:        p.MaxAgeFromTTL,
+			Expires:              p.Expires,
+		}
+	}
+	return opts
+}
+
+// Create a cache and its frontends from a declarative specification.
+// getters maps the names of getters referenced by FrontendSpec.Getter to their
+// implementations.
+//
+// Returns the created frontends by name. Returns an error without creating the
+// cache, if the specification references unknown getters or contains
+// duplicate or empty frontend names.
+func NewCacheFromSpec(spec CacheSpec, getters map[string]Getter) (
+	*Cache, map[string]*Frontend, error,
+) {
+	seen := make(map[string]bool, len(spec.Frontends))
+	for _, fs := range spec.Frontends {
+		switch {
+		case fs.Name == "":
+			return nil, nil, errors.New("frontend without name")
+		case seen[fs.Name]:
+			return nil, nil, fmt.Errorf("duplicate frontend name: %s", fs.Name)
+		case getters[fs.Getter] == nil:
+			return nil, nil, fmt.Errorf(
+				"unknown getter of frontend %s: %s",
+				fs.Name,
+				fs.Getter,
+			)
+		}
+		seen[fs.Name] = true
+	}
+
+	c := NewCache(spec.Options())
+	frontends := make(map[string]*Frontend, len(spec.Frontends))
+	for _, fs := range spec.Frontends {
+		f, err := c.TryNewFrontend(fs.Options(getters[fs.Getter]))
+		if err != nil {
+			c.Close()
+			return nil, nil, fmt.Errorf("frontend %s: %w", fs.Name, err)
+		}
+		frontends[fs.Name] = f
+	}
+	return c, frontends, nil
+}
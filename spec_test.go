@@ -0,0 +1,93 @@
+package recache
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestNewCacheFromSpec(t *testing.T) {
+	t.Parallel()
+
+	const src = `{
+	"Name": "pages",
+	"MemoryLimit": 1048576,
+	"LRULimit": "1h",
+	"Frontends": [
+		{
+			"Name": "articles",
+			"Getter": "dummy",
+			"GetterTimeout": "1.5s",
+			"HoleTTL": 1000,
+			"AdaptiveTTL": {"MaxTTL": "1h"}
+		}
+	]
+}`
+
+	var spec CacheSpec
+	err := json.Unmarshal([]byte(src), &spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getters := map[string]Getter{"dummy": dummyGetter}
+	cache, frontends, err := NewCacheFromSpec(spec, getters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	conf := cache.Config()
+	assertEquals(t, conf.Name, "pages")
+	assertEquals(t, conf.MemoryLimit, 1<<20)
+	assertEquals(t, conf.LRULimit, time.Hour)
+	assertEquals(t, len(conf.Frontends), 1)
+	assertEquals(t, conf.Frontends[0].Name, "articles")
+	assertEquals(t, conf.Frontends[0].GetterTimeout, 1500*time.Millisecond)
+	assertEquals(t, conf.Frontends[0].HoleTTL, time.Microsecond)
+	assertEquals(t, conf.Frontends[0].AdaptiveTTL, &AdaptiveTTLOptions{
+		MaxTTL:     time.Hour,
+		TargetHits: 10,
+	})
+
+	rec, err := frontends["articles"].Get("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJsonStringEquals(t, rec, "foo")
+
+	buf, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded CacheSpec
+	err = json.Unmarshal(buf, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, decoded, spec)
+
+	for _, fs := range [...]FrontendSpec{
+		{Getter: "dummy"},
+		{Name: "articles", Getter: "unknown"},
+	} {
+		_, _, err = NewCacheFromSpec(
+			CacheSpec{Frontends: []FrontendSpec{fs}},
+			getters,
+		)
+		if err == nil {
+			t.Fatalf("no error for invalid frontend spec: %+v", fs)
+		}
+	}
+	_, _, err = NewCacheFromSpec(
+		CacheSpec{
+			Frontends: []FrontendSpec{
+				{Name: "a", Getter: "dummy"},
+				{Name: "a", Getter: "dummy"},
+			},
+		},
+		getters,
+	)
+	if err == nil {
+		t.Fatal("no error for duplicate frontend names")
+	}
+}
@@ -0,0 +1,402 @@
+package recache
+
+import (
+	"math"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// Point-in-time statistics of a Cache
+type CacheStats struct {
+	// Total amount of records stored in the cache
+	Records int
+
+	// Total memory used by records in the cache
+	MemoryUsed int
+
+	// Memory limit of the cache. 0, if not limited.
+	MemoryLimit int
+
+	// Amount of frontends of the cache, not counting deleted ones, and their
+	// limit. MaxFrontends is 0, if not limited.
+	FrontendCount, MaxFrontends int
+
+	// Total amount of record retrievals served from the cache and requiring
+	// population since cache creation
+	Hits, Misses uint64
+
+	// Total amount of records evicted from frontends not deleted and the
+	// amount of those expired due to the LRU or memory limits of the cache
+	Evictions, Expirations uint64
+
+	// Statistics of each frontend, indexed in order of frontend creation.
+	// Deleted frontends have zero value statistics and their indices are
+	// reused by frontends created after.
+	Frontends []FrontendStats
+}
+
+// Point-in-time statistics of a Frontend
+type FrontendStats struct {
+	// Amount of records stored in the frontend
+	Records int
+
+	// Memory used by records of the frontend
+	MemoryUsed int
+
+	// Total amount of bytes written by Record.WriteTo() and
+	// Frontend.WriteHTTP() from records of the frontend, not counting
+	// records included from other frontends
+	BytesServed uint64
+
+	// Total amount of record retrievals from the frontend served from the
+	// cache and requiring population
+	Hits, Misses uint64
+
+	// Total amount of records of the frontend evicted and the amount of those
+	// expired due to the LRU or memory limits of the cache
+	Evictions, Expirations uint64
+
+	// Total amount of successful record populations of the frontend and the
+	// time spent on them
+	Populations    uint64
+	PopulationTime time.Duration
+
+	// Total amount of canary populations with FrontendOptions.CanaryRate
+	// compared to cached records and the amount of those, whose content
+	// differed from the cached record
+	CanaryChecks, CanaryMismatches uint64
+
+	// Amount of records of the frontend by memory used in power of two
+	// buckets. Bucket 0 counts records using no memory and bucket i > 0
+	// counts records using [2^(i-1), 2^i) bytes. Trailing empty buckets are
+	// omitted.
+	SizeHistogram []int
+
+	// Total amount of bytes counted in BytesServed by age of the served
+	// record at serve time in power of two buckets of seconds. Bucket 0
+	// counts bytes served from records younger than a second and bucket i > 0
+	// from records aged [2^(i-1), 2^i) seconds. Trailing empty buckets are
+	// omitted.
+	AgeHistogram []uint64
+}
+
+// Amount of FrontendStats.AgeHistogram buckets
+const ageBuckets = 32
+
+// Return the age bucket index of a record aged age
+func ageBucket(age time.Duration) int {
+	if age < 0 {
+		age = 0
+	}
+	i := bits.Len64(uint64(age / time.Second))
+	if i >= ageBuckets {
+		i = ageBuckets - 1
+	}
+	return i
+}
+
+// Return the upper bound of the age of records in age bucket i
+func ageBucketLimit(i int) time.Duration {
+	return time.Second << uint(i)
+}
+
+// Return the size bucket index of a record using size bytes of memory
+func sizeBucket(size int) int {
+	return bits.Len(uint(size))
+}
+
+// Return approximate memory used by records of the frontend at percentile p,
+// with p in range [0, 1]. The returned value is the upper bound of the
+// histogram bucket containing the percentile.
+//
+// Returns 0, if there are no records.
+func (s FrontendStats) SizePercentile(p float64) int {
+	total := 0
+	for _, n := range s.SizeHistogram {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+
+	target := int(math.Ceil(p * float64(total)))
+	if target < 1 {
+		target = 1
+	}
+	seen := 0
+	for i, n := range s.SizeHistogram {
+		seen += n
+		if seen >= target {
+			if i == 0 {
+				return 0
+			}
+			return 1<<uint(i) - 1
+		}
+	}
+	return 1<<uint(len(s.SizeHistogram)-1) - 1
+}
+
+// Return the age of records bytes were served from at percentile p of bytes
+// served, with p in range [0, 1]. The returned value is the upper bound of the
+// histogram bucket containing the percentile, so p of bytes were served from
+// records younger than it.
+//
+// Returns 0, if no bytes were served.
+func (s FrontendStats) AgePercentile(p float64) time.Duration {
+	var total uint64
+	for _, n := range s.AgeHistogram {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+
+	target := uint64(math.Ceil(p * float64(total)))
+	if target < 1 {
+		target = 1
+	}
+	var seen uint64
+	for i, n := range s.AgeHistogram {
+		seen += n
+		if seen >= target {
+			return ageBucketLimit(i)
+		}
+	}
+	return ageBucketLimit(len(s.AgeHistogram) - 1)
+}
+
+// Return the ratio of bytes served from records younger than age to all
+// bytes served. Only histogram buckets with an upper bound not exceeding age
+// are counted, so the returned ratio is a lower bound.
+//
+// Returns 0, if no bytes were served.
+func (s FrontendStats) ServedYoungerThan(age time.Duration) float64 {
+	var total, younger uint64
+	for i, n := range s.AgeHistogram {
+		total += n
+		if ageBucketLimit(i) <= age {
+			younger += n
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(younger) / float64(total)
+}
+
+// Return average memory used by a record of the frontend.
+// Returns 0, if there are no records.
+func (s FrontendStats) AverageRecordSize() int {
+	return averageRecordSize(s.MemoryUsed, s.Records)
+}
+
+// Return ratio of bytes served to memory used by the frontend, indicating how
+// much use the frontend gets out of the memory it occupies.
+// Returns 0, if the frontend uses no memory.
+func (s FrontendStats) Leverage() float64 {
+	if s.MemoryUsed == 0 {
+		return 0
+	}
+	return float64(s.BytesServed) / float64(s.MemoryUsed)
+}
+
+// Return average time spent populating a record of the frontend.
+// Returns 0, if there were no populations.
+func (s FrontendStats) AveragePopulationTime() time.Duration {
+	if s.Populations == 0 {
+		return 0
+	}
+	return s.PopulationTime / time.Duration(s.Populations)
+}
+
+// Return ratio of record retrievals from the frontend served from the cache
+// to all record retrievals. Returns 0, if there were no retrievals.
+func (s FrontendStats) HitRate() float64 {
+	return hitRate(s.Hits, s.Misses)
+}
+
+// Return average memory used by a record of the cache.
+// Returns 0, if there are no records.
+func (s CacheStats) AverageRecordSize() int {
+	return averageRecordSize(s.MemoryUsed, s.Records)
+}
+
+func averageRecordSize(memoryUsed, records int) int {
+	if records == 0 {
+		return 0
+	}
+	return memoryUsed / records
+}
+
+// Return ratio of record retrievals served from the cache to all record
+// retrievals. Returns 0, if there were no retrievals.
+func (s CacheStats) HitRate() float64 {
+	return hitRate(s.Hits, s.Misses)
+}
+
+func hitRate(hits, misses uint64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// Return statistics of the interval between the snapshot prev and s, both
+// captured from the same cache with prev captured first. Counters, like Hits,
+// Evictions and FrontendStats.BytesServed, are set to their increase since
+// prev. All other values are those of s.
+//
+// Useful for computing rates, like the hit rate, per scrape window of a
+// metrics collector instead of since cache creation.
+func (s CacheStats) Delta(prev CacheStats) CacheStats {
+	d := s
+	d.Hits -= prev.Hits
+	d.Misses -= prev.Misses
+	d.Evictions = subCounter(s.Evictions, prev.Evictions)
+	d.Expirations = subCounter(s.Expirations, prev.Expirations)
+	d.Frontends = append([]FrontendStats(nil), s.Frontends...)
+	for i := range d.Frontends {
+		if i >= len(prev.Frontends) {
+			break
+		}
+		f, p := &d.Frontends[i], prev.Frontends[i]
+		f.BytesServed = subCounter(f.BytesServed, p.BytesServed)
+		f.Hits = subCounter(f.Hits, p.Hits)
+		f.Misses = subCounter(f.Misses, p.Misses)
+		f.Evictions = subCounter(f.Evictions, p.Evictions)
+		f.Expirations = subCounter(f.Expirations, p.Expirations)
+		f.Populations = subCounter(f.Populations, p.Populations)
+		f.PopulationTime = time.Duration(subCounter(
+			uint64(f.PopulationTime),
+			uint64(p.PopulationTime),
+		))
+		f.CanaryChecks = subCounter(f.CanaryChecks, p.CanaryChecks)
+		f.CanaryMismatches = subCounter(
+			f.CanaryMismatches,
+			p.CanaryMismatches,
+		)
+		f.AgeHistogram = subHistogram(f.AgeHistogram, p.AgeHistogram)
+	}
+	return d
+}
+
+// Return the increase of a counter from prev to n. Counters of deleted
+// frontends are dropped and their indices might have been reused by newer
+// frontends with smaller counters, in which case n is returned.
+func subCounter(n, prev uint64) uint64 {
+	if prev > n {
+		return n
+	}
+	return n - prev
+}
+
+// Return the increase of each bucket of a histogram of counters from prev to
+// hist with trailing empty buckets omitted
+func subHistogram(hist, prev []uint64) (d []uint64) {
+	if len(hist) == 0 {
+		return nil
+	}
+	d = make([]uint64, len(hist))
+	for i, n := range hist {
+		if i < len(prev) {
+			n = subCounter(n, prev[i])
+		}
+		d[i] = n
+	}
+	return trimHistogram(d)
+}
+
+// Return hist with trailing empty buckets omitted or nil, if all are empty
+func trimHistogram(hist []uint64) []uint64 {
+	for len(hist) != 0 && hist[len(hist)-1] == 0 {
+		hist = hist[:len(hist)-1]
+	}
+	if len(hist) == 0 {
+		return nil
+	}
+	return hist
+}
+
+// Capture statistics of the cache and all its frontends as a consistent
+// snapshot.
+//
+// Requires only a short lock on the cache, so is suitable for frequent
+// periodic reporting.
+func (c *Cache) SnapshotStats() (s CacheStats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s = CacheStats{
+		MemoryUsed:  c.memoryUsed,
+		MemoryLimit: c.memoryLimit,
+
+		FrontendCount: c.frontendCount(),
+		MaxFrontends:  c.maxFrontends,
+
+		Hits:   c.hits,
+		Misses: c.misses,
+
+		Frontends: make([]FrontendStats, len(c.frontends)),
+	}
+	for i := range c.frontends {
+		if c.frontendMeta[i].instance == nil {
+			continue // Deleted
+		}
+		f := c.frontendStats(i)
+		s.Frontends[i] = f
+		s.Records += f.Records
+		s.Evictions += f.Evictions
+		s.Expirations += f.Expirations
+	}
+	return
+}
+
+// Capture statistics of the frontend. Returns zero value statistics, if the
+// frontend has been deleted.
+func (f *Frontend) Stats() FrontendStats {
+	f.cache.mu.Lock()
+	defer f.cache.mu.Unlock()
+
+	if f.cache.frontendMeta[f.id].instance != f {
+		return FrontendStats{}
+	}
+	return f.cache.frontendStats(f.id)
+}
+
+// Capture statistics of a frontend. Requires lock on c.mu.
+func (c *Cache) frontendStats(frontend int) (s FrontendStats) {
+	meta := &c.frontendMeta[frontend]
+	s = FrontendStats{
+		Records:     len(c.frontends[frontend]),
+		MemoryUsed:  meta.memoryUsed,
+		BytesServed: atomic.LoadUint64(&meta.instance.bytesServed),
+		Hits:        meta.hits,
+		Misses:      meta.misses,
+		Evictions:   meta.evictions,
+		Expirations: meta.expirations,
+
+		Populations: atomic.LoadUint64(&meta.instance.populations),
+		PopulationTime: time.Duration(
+			atomic.LoadUint64(&meta.instance.populationTime),
+		),
+
+		CanaryChecks:     atomic.LoadUint64(&meta.instance.canaries),
+		CanaryMismatches: atomic.LoadUint64(&meta.instance.canaryMismatches),
+	}
+
+	var ages [ageBuckets]uint64
+	for i := range ages {
+		ages[i] = atomic.LoadUint64(&meta.instance.ageHistogram[i])
+	}
+	s.AgeHistogram = trimHistogram(append([]uint64(nil), ages[:]...))
+
+	hist := meta.sizeHistogram[:]
+	for len(hist) != 0 && hist[len(hist)-1] == 0 {
+		hist = hist[:len(hist)-1]
+	}
+	if len(hist) != 0 {
+		s.SizeHistogram = append([]int(nil), hist...)
+	}
+	return
+}
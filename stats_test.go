@@ -0,0 +1,271 @@
+package recache
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSnapshotStats(t *testing.T) {
+	t.Parallel()
+
+	cache := NewCache(CacheOptions{
+		MemoryLimit: 1 << 20,
+	})
+	var frontends [2]*Frontend
+	for i := range frontends {
+		frontends[i] = cache.NewFrontend(dummyGetter)
+	}
+
+	for i, f := range frontends {
+		for j := 0; j <= i; j++ {
+			_, err := f.Get(j)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	s := cache.SnapshotStats()
+	assertEquals(t, s.Records, 3)
+	assertEquals(t, s.MemoryLimit, 1<<20)
+	assertEquals(t, len(s.Frontends), 2)
+	for i, f := range s.Frontends {
+		assertEquals(t, f.Records, i+1)
+		if f.MemoryUsed == 0 {
+			t.Fatal("no memory used")
+		}
+	}
+	assertEquals(
+		t,
+		s.MemoryUsed,
+		s.Frontends[0].MemoryUsed+s.Frontends[1].MemoryUsed,
+	)
+
+	res := frontends[1].EvictAll(0)
+	assertEquals(t, res.MemoryBefore, s.Frontends[1].MemoryUsed)
+	assertEquals(t, res.MemoryAfter, 0)
+	assertEquals(t, res.Reclaimed(), s.Frontends[1].MemoryUsed)
+
+	s = cache.SnapshotStats()
+	assertEquals(t, s.Records, 1)
+	if s.Frontends[1].PopulationTime <= 0 {
+		t.Fatal("no population time")
+	}
+	assertEquals(t, s.Frontends[1], FrontendStats{
+		Misses:         2,
+		Evictions:      2,
+		Populations:    2,
+		PopulationTime: s.Frontends[1].PopulationTime,
+	})
+	assertEquals(t, s.Evictions, uint64(2))
+	assertEquals(t, s.AverageRecordSize(), s.Frontends[0].MemoryUsed)
+	assertEquals(t, frontends[1].Stats(), s.Frontends[1])
+	assertEquals(t, frontends[0].Stats(), s.Frontends[0])
+
+	res = cache.EvictAll(0)
+	assertEquals(t, res.Reclaimed(), s.MemoryUsed)
+	assertEquals(t, res.MemoryAfter, 0)
+	assertEquals(
+		t,
+		s.Frontends[0].AverageRecordSize(),
+		s.Frontends[0].MemoryUsed,
+	)
+	assertEquals(t, s.MemoryUsed, s.Frontends[0].MemoryUsed)
+}
+
+func TestBytesServed(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache    = NewCache(CacheOptions{})
+		children = cache.NewFrontend(dummyGetter)
+		parents  = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				return rw.Include(children, k)
+			},
+		})
+	)
+
+	rec, err := parents.Get("key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var w bytes.Buffer
+	n, err := rec.WriteTo(&w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "deflate")
+	m, err := parents.WriteHTTP("key1", httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n += m
+
+	s := cache.SnapshotStats()
+	assertEquals(t, s.Frontends[children.id].BytesServed, uint64(0))
+	assertEquals(t, s.Frontends[children.id].Leverage(), float64(0))
+	assertEquals(t, s.Frontends[parents.id].BytesServed, uint64(n))
+
+	m, err = children.WriteHTTP(
+		"key1",
+		httptest.NewRecorder(),
+		httptest.NewRequest("GET", "/", nil),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = cache.SnapshotStats()
+	child := s.Frontends[children.id]
+	assertEquals(t, child.BytesServed, uint64(m))
+	assertEquals(
+		t,
+		child.Leverage(),
+		float64(child.BytesServed)/float64(child.MemoryUsed),
+	)
+}
+
+func TestSizeHistogram(t *testing.T) {
+	t.Parallel()
+
+	cache := NewCache(CacheOptions{})
+	f := cache.NewFrontendWithOptions(FrontendOptions{
+		Get: func(k Key, rw *RecordWriter) (err error) {
+			// Incompressible data of the specified size
+			buf := make([]byte, k.(int))
+			_, err = rand.Read(buf)
+			if err != nil {
+				return
+			}
+			_, err = rw.Write(buf)
+			return
+		},
+	})
+
+	for _, size := range [...]int{10, 20, 30, 1000} {
+		_, err := f.Get(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := cache.SnapshotStats().Frontends[0]
+	total := 0
+	for _, n := range s.SizeHistogram {
+		total += n
+	}
+	assertEquals(t, total, 4)
+	if last := s.SizeHistogram[len(s.SizeHistogram)-1]; last != 1 {
+		t.Fatalf("unexpected last bucket count: %d", last)
+	}
+
+	// Compression overhead makes exact sizes unpredictable
+	if p := s.SizePercentile(0.5); p < 31 || p > 63 {
+		t.Fatalf("unexpected median size: %d", p)
+	}
+	if p := s.SizePercentile(1); p < 1023 || p > 2047 {
+		t.Fatalf("unexpected max size: %d", p)
+	}
+	assertEquals(t, FrontendStats{}.SizePercentile(0.5), 0)
+}
+
+func TestAgeHistogram(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache = NewCache(CacheOptions{})
+		f     = cache.NewFrontend(dummyGetter)
+	)
+
+	serve := func(k int, age time.Duration) int64 {
+		t.Helper()
+
+		rec, err := f.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec.created = time.Now().Add(-age)
+		n, err := rec.WriteTo(io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	var fresh, old int64
+	for i := 0; i < 9; i++ {
+		fresh += serve(1, 0)
+	}
+	old = serve(2, 40*time.Second)
+
+	s := f.Stats()
+	assertEquals(t, s.AgeHistogram, []uint64{
+		uint64(fresh), 0, 0, 0, 0, 0, uint64(old),
+	})
+	assertEquals(t, s.AgePercentile(0.5), time.Second)
+	assertEquals(t, s.AgePercentile(1), 64*time.Second)
+	assertEquals(
+		t,
+		s.ServedYoungerThan(30*time.Second),
+		float64(fresh)/float64(fresh+old),
+	)
+	assertEquals(t, s.ServedYoungerThan(2*time.Minute), float64(1))
+	assertEquals(t, FrontendStats{}.AgePercentile(0.5), time.Duration(0))
+	assertEquals(t, FrontendStats{}.ServedYoungerThan(time.Minute), float64(0))
+
+	prev := cache.SnapshotStats()
+	serve(1, 0)
+	d := cache.SnapshotStats().Delta(prev).Frontends[0]
+	assertEquals(t, d.AgeHistogram, []uint64{uint64(fresh / 9)})
+}
+
+func TestStatsDelta(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache = NewCache(CacheOptions{})
+		f     = cache.NewFrontend(dummyGetter)
+	)
+
+	get := func(k int) {
+		t.Helper()
+
+		rec, err := f.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = rec.WriteTo(io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get(1)
+	get(1)
+	prev := cache.SnapshotStats()
+	assertEquals(t, prev.Hits, uint64(1))
+	assertEquals(t, prev.Misses, uint64(1))
+	assertEquals(t, prev.HitRate(), 0.5)
+
+	for i := 0; i < 3; i++ {
+		get(1)
+	}
+	s := cache.SnapshotStats()
+	d := s.Delta(prev)
+	assertEquals(t, d.Hits, uint64(3))
+	assertEquals(t, d.Misses, uint64(0))
+	assertEquals(t, d.HitRate(), float64(1))
+	assertEquals(t, d.Records, 1)
+	assertEquals(
+		t,
+		d.Frontends[0].BytesServed,
+		s.Frontends[0].BytesServed*3/5,
+	)
+	assertEquals(t, CacheStats{}.HitRate(), float64(0))
+}
@@ -0,0 +1,39 @@
+package recache
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+)
+
+// Return a template.FuncMap with a "cachefrag" function for declaring fragment
+// caching in templates. `{{cachefrag "name" key}}` includes the record by key
+// from the frontend registered under "name" in frontends into the record
+// being written to rw, as with RecordWriter.Include().
+//
+// Templates must be parsed with functions returned for a nil rw and have the
+// functions of the RecordWriter of the current population bound before
+// execution:
+//
+//	t, err := base.Clone()
+//	if err != nil {
+//		return err
+//	}
+//	return t.Funcs(recache.TemplateFuncs(rw, frontends)).Execute(rw, data)
+func TemplateFuncs(
+	rw *RecordWriter,
+	frontends map[string]*Frontend,
+) template.FuncMap {
+	return template.FuncMap{
+		"cachefrag": func(name string, k Key) (template.HTML, error) {
+			f, ok := frontends[name]
+			if !ok {
+				return "", fmt.Errorf("unknown frontend: %s", name)
+			}
+			if rw == nil {
+				return "", errors.New("template not bound to RecordWriter")
+			}
+			return "", rw.Include(f, k)
+		},
+	}
+}
@@ -0,0 +1,68 @@
+package recache
+
+import (
+	"bytes"
+	"html/template"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestTemplateFuncs(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache     = NewCache(CacheOptions{})
+		frontends = make(map[string]*Frontend)
+		base      = template.Must(
+			template.New("page").
+				Funcs(TemplateFuncs(nil, frontends)).
+				Parse(`<p>{{.}}</p>{{cachefrag "fragments" .}}<p>end</p>`),
+		)
+		pages = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				t, err := base.Clone()
+				if err != nil {
+					return err
+				}
+				return t.Funcs(TemplateFuncs(rw, frontends)).Execute(rw, k)
+			},
+		})
+	)
+	frontends["fragments"] = cache.NewFrontendWithOptions(FrontendOptions{
+		Get: func(k Key, rw *RecordWriter) (err error) {
+			_, err = rw.Write([]byte("<b>" + k.(string) + "</b>"))
+			return
+		},
+	})
+
+	rec, err := pages.Get("<a>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	_, err = io.Copy(&b, rec.Decompress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, b.String(), "<p>&lt;a&gt;</p><b><a></b><p>end</p>")
+	assertEquals(t, len(rec.Components()), 3)
+
+	// Fragment is bound to the page
+	frontends["fragments"].Evict(0, "<a>")
+	assertEquals(t, pages.Touch("<a>"), false)
+
+	t.Run("unknown frontend", func(t *testing.T) {
+		t.Parallel()
+
+		var b bytes.Buffer
+		err := template.Must(
+			template.New("").
+				Funcs(TemplateFuncs(nil, frontends)).
+				Parse(`{{cachefrag "missing" 1}}`),
+		).Execute(&b, nil)
+		if err == nil || !strings.Contains(err.Error(), "unknown frontend") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
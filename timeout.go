@@ -0,0 +1,125 @@
+package recache
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Population of a record or retrieval of an included record exceeded its time
+// budget
+type TimeoutError struct {
+	// Time budget that was exceeded
+	Budget time.Duration
+
+	// Budget was set by the including record with
+	// FrontendOptions.IncludeTimeout or RecordWriter.SplitTimeout(), rather
+	// than with FrontendOptions.GetterTimeout of the record's frontend
+	Include bool
+
+	// Error the population failed with
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	kind := "getter"
+	if e.Include {
+		kind = "include"
+	}
+	return fmt.Sprintf("%s timeout of %s exceeded: %s", kind, e.Budget, e.Err)
+}
+
+// Return the error the population failed with
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Divide the remaining time until the deadline of the population context
+// evenly among the next n records included or bound by rw. Time left unused
+// by a record carries over to the following ones. Keeps one slow included
+// record from consuming the time budget of the rest.
+//
+// Has no effect, if the population context has no deadline, like one set with
+// FrontendOptions.GetterTimeout.
+func (rw *RecordWriter) SplitTimeout(n int) {
+	rw.split = n
+}
+
+// Populate a record with FrontendOptions.Get bounded by
+// FrontendOptions.GetterTimeout
+func (f *Frontend) get(k Key, rw *RecordWriter) (err error) {
+	if f.opts.GetterTimeout == 0 {
+		return f.opts.Get(k, rw)
+	}
+
+	parent := rw.ctx
+	ctx, cancel := context.WithTimeout(parent, f.opts.GetterTimeout)
+	defer cancel()
+	rw.ctx = ctx
+
+	err = f.opts.Get(k, rw)
+	if err != nil &&
+		ctx.Err() == context.DeadlineExceeded &&
+		parent.Err() == nil {
+		err = &TimeoutError{
+			Budget: f.opts.GetterTimeout,
+			Err:    err,
+		}
+	}
+	return
+}
+
+// Return the context to retrieve the next included or bound record with and
+// its time budget. budget=0, if no budget is set for the record.
+func (rw *RecordWriter) includeContext() (
+	ctx context.Context,
+	budget time.Duration,
+	cancel context.CancelFunc,
+) {
+	if rw.split > 0 {
+		if deadline, ok := rw.ctx.Deadline(); ok {
+			budget = time.Until(deadline) / time.Duration(rw.split)
+		}
+		rw.split--
+	}
+	if rw.includeTimeout != 0 &&
+		(budget <= 0 || rw.includeTimeout < budget) {
+		budget = rw.includeTimeout
+	}
+	if budget <= 0 {
+		return rw.ctx, 0, func() {}
+	}
+	ctx, cancel = context.WithTimeout(rw.ctx, budget)
+	return
+}
+
+// Wait for rec to be populated or ctx to be done. With
+// FrontendOptions.PopulationTimeout set, evicts rec and returns
+// ErrPopulationTimeout, once its population exceeds the timeout.
+func (f *Frontend) waitPopulation(ctx context.Context, k Key, rec *Record) (
+	err error,
+) {
+	timeout := f.opts.PopulationTimeout
+	if timeout == 0 || rec.semaphore.Finished() {
+		return rec.semaphore.WaitContext(ctx)
+	}
+
+	// Population might not have started yet
+	deadline := time.Now().Add(timeout)
+	if started := atomic.LoadInt64(&rec.populationStarted); started != 0 {
+		deadline = time.Unix(0, started).Add(timeout)
+	}
+	wctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	err = rec.semaphore.WaitContext(wctx)
+	if err != nil && ctx.Err() == nil {
+		if rec.semaphore.Finished() {
+			return nil
+		}
+		f.cache.abortPopulation(recordLocation{f.id, k}, rec)
+		err = ErrPopulationTimeout
+	}
+	return
+}
@@ -0,0 +1,115 @@
+package recache
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// Serve-time transformation of the decompressed content of records. See
+// FrontendOptions.Transform.
+type Transform func(w io.Writer, r *http.Request, k Key) io.WriteCloser
+
+// Return a Transform replacing all occurrences of placeholder in the content
+// with the result of value for the request, like a CSRF token or a nonce.
+// value is called once per response.
+//
+// Content is streamed with at most len(placeholder)-1 bytes buffered between
+// writes.
+func ReplaceTransform(
+	placeholder []byte,
+	value func(r *http.Request, k Key) []byte,
+) Transform {
+	placeholder = append([]byte(nil), placeholder...)
+	return func(w io.Writer, r *http.Request, k Key) io.WriteCloser {
+		return &replaceWriter{
+			w:   w,
+			old: placeholder,
+			new: value(r, k),
+		}
+	}
+}
+
+// Streams data to w with all occurrences of old replaced with new
+type replaceWriter struct {
+	w        io.Writer
+	old, new []byte
+
+	// Data not yet written, that might contain the start of old
+	buf []byte
+}
+
+func (rw *replaceWriter) Write(p []byte) (n int, err error) {
+	n = len(p)
+	if len(rw.old) == 0 {
+		_, err = rw.w.Write(p)
+		return
+	}
+
+	rw.buf = append(rw.buf, p...)
+	data := rw.buf
+	for {
+		i := bytes.Index(data, rw.old)
+		if i == -1 {
+			break
+		}
+		_, err = rw.w.Write(data[:i])
+		if err != nil {
+			return
+		}
+		_, err = rw.w.Write(rw.new)
+		if err != nil {
+			return
+		}
+		data = data[i+len(rw.old):]
+	}
+
+	// Keep a possible partial match at the end for the next write
+	keep := len(rw.old) - 1
+	if keep > len(data) {
+		keep = len(data)
+	}
+	_, err = rw.w.Write(data[:len(data)-keep])
+	if err != nil {
+		return
+	}
+	rw.buf = rw.buf[:copy(rw.buf, data[len(data)-keep:])]
+	return
+}
+
+// Write any buffered data
+func (rw *replaceWriter) Close() (err error) {
+	if len(rw.buf) != 0 {
+		_, err = rw.w.Write(rw.buf)
+		rw.buf = rw.buf[:0]
+	}
+	return
+}
+
+// Serve the decompressed content of rec by key k transformed with the
+// FrontendOptions.Transform of the frontend. Returns false, if the transform
+// declined the request.
+func (f *Frontend) writeTransformed(
+	k Key,
+	rec *Record,
+	w http.ResponseWriter,
+	r *http.Request,
+) (n int64, ok bool, err error) {
+	cw := countingResponseWriter{ResponseWriter: w}
+	tw := f.opts.Transform(&cw, r, k)
+	if tw == nil {
+		return
+	}
+	ok = true
+	defer func() {
+		n = cw.n
+	}()
+
+	_, err = io.Copy(tw, rec.Decompress())
+	if err != nil {
+		tw.Close()
+		return
+	}
+	err = tw.Close()
+	return
+}
@@ -0,0 +1,137 @@
+package recache
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReplaceTransform(t *testing.T) {
+	t.Parallel()
+
+	cases := [...]struct {
+		name, placeholder, value string
+		chunks                   []string
+		expected                 string
+	}{
+		{
+			name:        "single write",
+			placeholder: "{{csrf}}",
+			value:       "abc",
+			chunks:      []string{"<p>{{csrf}}</p><i>{{csrf}}</i>"},
+			expected:    "<p>abc</p><i>abc</i>",
+		},
+		{
+			name:        "split placeholder",
+			placeholder: "{{csrf}}",
+			value:       "abc",
+			chunks:      []string{"<p>{{cs", "r", "f}}</p>{", "{"},
+			expected:    "<p>abc</p>{{",
+		},
+		{
+			name:        "no match",
+			placeholder: "{{csrf}}",
+			value:       "abc",
+			chunks:      []string{"{{", "csr", "x}}"},
+			expected:    "{{csrx}}",
+		},
+		{
+			name:        "empty placeholder",
+			placeholder: "",
+			value:       "abc",
+			chunks:      []string{"foo", "bar"},
+			expected:    "foobar",
+		},
+	}
+
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			tr := ReplaceTransform(
+				[]byte(c.placeholder),
+				func(_ *http.Request, _ Key) []byte {
+					return []byte(c.value)
+				},
+			)
+			var buf bytes.Buffer
+			w := tr(&buf, nil, nil)
+			for _, ch := range c.chunks {
+				n, err := w.Write([]byte(ch))
+				if err != nil {
+					t.Fatal(err)
+				}
+				assertEquals(t, n, len(ch))
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			assertEquals(t, buf.String(), c.expected)
+		})
+	}
+}
+
+func TestTransform(t *testing.T) {
+	t.Parallel()
+
+	cache := NewCache(CacheOptions{})
+	f := cache.NewFrontendWithOptions(FrontendOptions{
+		Get: func(k Key, rw *RecordWriter) error {
+			_, err := rw.Write([]byte("<form>{{csrf}}</form>"))
+			return err
+		},
+		HTTPCachePolicy: &HTTPCachePolicy{Private: true},
+		Transform: func() Transform {
+			replace := ReplaceTransform(
+				[]byte("{{csrf}}"),
+				func(r *http.Request, _ Key) []byte {
+					return []byte(r.Header.Get("X-User"))
+				},
+			)
+			return func(w io.Writer, r *http.Request, k Key) io.WriteCloser {
+				if r.Header.Get("X-User") == "" {
+					return nil
+				}
+				return replace(w, r, k)
+			}
+		}(),
+	})
+
+	serve := func(user string) (*httptest.ResponseRecorder, int64) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", "deflate")
+		if user != "" {
+			r.Header.Set("X-User", user)
+		}
+		n, err := f.WriteHTTP("a", w, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w, n
+	}
+
+	for _, user := range [...]string{"alice", "bob"} {
+		w, n := serve(user)
+		expected := "<form>" + user + "</form>"
+		assertEquals(t, w.Body.String(), expected)
+		assertEquals(t, n, int64(len(expected)))
+		assertEquals(t, w.Header().Get("Content-Encoding"), "")
+		assertEquals(t, w.Header().Get("ETag"), "")
+		assertEquals(t, w.Header().Get("Cache-Control"), "private")
+	}
+	assertEquals(t, f.Stats().Populations, uint64(1))
+
+	// Declined transforms serve the record as is
+	w, _ := serve("")
+	assertEquals(t, w.Header().Get("Content-Encoding"), "deflate")
+	if w.Header().Get("ETag") == "" {
+		t.Fatal("no ETag")
+	}
+	assertEquals(t, strings.Contains(w.Body.String(), "alice"), false)
+}
@@ -0,0 +1,132 @@
+package recache
+
+import (
+	"runtime"
+	"time"
+)
+
+// Options for automatic tuning of the memory limit of a cache.
+//
+// The tuner periodically grows the memory limit, while the cache hit rate is
+// below TargetHitRate, and shrinks it, while the fraction of time spent in
+// garbage collection pauses exceeds MaxGCPauseFraction. The memory limit is
+// always kept within [MinMemoryLimit, MaxMemoryLimit].
+type MemoryTuningOptions struct {
+	// Bounds of the memory limit. MaxMemoryLimit is required.
+	//
+	// MinMemoryLimit is treated as at least 1, as a zero memory limit would
+	// disable memory-based eviction.
+	MinMemoryLimit, MaxMemoryLimit uint
+
+	// Interval between adjustments. Defaults to 10 seconds.
+	Interval time.Duration
+
+	// Fraction of the memory limit to grow or shrink it by on each
+	// adjustment. Defaults to 0.1.
+	Step float64
+
+	// Hit rate below which the memory limit is grown. Defaults to 0.9.
+	TargetHitRate float64
+
+	// Fraction of wall time spent in garbage collection pauses, above which
+	// the memory limit is shrunk. Takes priority over TargetHitRate.
+	// Defaults to 0.05.
+	MaxGCPauseFraction float64
+}
+
+// Fill in default values of unset options
+func (o *MemoryTuningOptions) setDefaults() {
+	if o.Interval == 0 {
+		o.Interval = time.Second * 10
+	}
+	if o.Step == 0 {
+		o.Step = 0.1
+	}
+	if o.TargetHitRate == 0 {
+		o.TargetHitRate = 0.9
+	}
+	if o.MaxGCPauseFraction == 0 {
+		o.MaxGCPauseFraction = 0.05
+	}
+	if o.MinMemoryLimit == 0 {
+		o.MinMemoryLimit = 1
+	}
+}
+
+// Compute the next memory limit from the current one and the hit rate and
+// GC pause fraction observed over the last interval
+func (o MemoryTuningOptions) nextMemoryLimit(
+	current int,
+	hitRate, gcPauseFraction float64,
+) (next int) {
+	step := int(float64(current) * o.Step)
+	if step < 1 {
+		step = 1
+	}
+
+	next = current
+	switch {
+	case gcPauseFraction > o.MaxGCPauseFraction:
+		next -= step
+	case hitRate < o.TargetHitRate:
+		next += step
+	}
+
+	if min := int(o.MinMemoryLimit); next < min {
+		next = min
+	}
+	if max := int(o.MaxMemoryLimit); next > max {
+		next = max
+	}
+	return
+}
+
+// Periodically adjust the memory limit of the cache
+func (c *Cache) tuneMemoryLimit(opts MemoryTuningOptions) {
+	var (
+		stats                runtime.MemStats
+		lastHits, lastMisses uint64
+		lastTime             = time.Now()
+		tick                 = time.NewTicker(opts.Interval)
+	)
+	defer tick.Stop()
+
+	runtime.ReadMemStats(&stats)
+	lastPauseNs := stats.PauseTotalNs
+
+	for {
+		var now time.Time
+		select {
+		case now = <-tick.C:
+		case <-c.stop:
+			return
+		}
+
+		runtime.ReadMemStats(&stats)
+		gcPauseFraction := float64(stats.PauseTotalNs-lastPauseNs) /
+			float64(now.Sub(lastTime))
+		lastPauseNs = stats.PauseTotalNs
+		lastTime = now
+
+		c.mu.Lock()
+
+		hits := c.hits - lastHits
+		misses := c.misses - lastMisses
+		lastHits = c.hits
+		lastMisses = c.misses
+
+		// No traffic means nothing to grow the memory limit for
+		hitRate := 1.0
+		if hits+misses != 0 {
+			hitRate = float64(hits) / float64(hits+misses)
+		}
+
+		c.memoryLimit = opts.nextMemoryLimit(
+			c.memoryLimit,
+			hitRate,
+			gcPauseFraction,
+		)
+
+		c.mu.Unlock()
+	}
+}
@@ -0,0 +1,73 @@
+package recache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextMemoryLimit(t *testing.T) {
+	t.Parallel()
+
+	opts := MemoryTuningOptions{
+		MinMemoryLimit: 50,
+		MaxMemoryLimit: 150,
+	}
+	opts.setDefaults()
+
+	cases := [...]struct {
+		name                     string
+		current                  int
+		hitRate, gcPauseFraction float64
+		next                     int
+	}{
+		{"steady", 100, 0.95, 0.01, 100},
+		{"low hit rate", 100, 0.5, 0.01, 110},
+		{"GC pressure", 100, 0.95, 0.1, 90},
+		{"GC pressure and low hit rate", 100, 0.5, 0.1, 90},
+		{"upper bound", 145, 0.5, 0, 150},
+		{"lower bound", 52, 1, 0.5, 50},
+		{"out of bounds", 1000, 1, 0, 150},
+	}
+
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			assertEquals(
+				t,
+				opts.nextMemoryLimit(c.current, c.hitRate, c.gcPauseFraction),
+				c.next,
+			)
+		})
+	}
+}
+
+func TestMemoryTuning(t *testing.T) {
+	t.Parallel()
+
+	cache := NewCache(CacheOptions{
+		MemoryTuning: &MemoryTuningOptions{
+			MaxMemoryLimit:     1 << 20,
+			Interval:           time.Millisecond * 10,
+			MaxGCPauseFraction: 1, // Never shrink
+		},
+	})
+	f := cache.NewFrontend(dummyGetter)
+
+	// Initialized to the maximum without a MemoryLimit set
+	assertEquals(t, cache.SnapshotStats().MemoryLimit, 1<<20)
+
+	for i := 0; i < 10; i++ {
+		_, err := f.Get(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only misses. Memory limit can not grow above the maximum.
+	time.Sleep(time.Millisecond * 50)
+	assertEquals(t, cache.SnapshotStats().MemoryLimit, 1<<20)
+	assertEquals(t, cache.hits, uint64(0))
+	assertEquals(t, cache.misses, uint64(10))
+}
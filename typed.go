@@ -0,0 +1,95 @@
+package recache
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+)
+
+// Encodes values of typed frontends into records and decodes them back
+type Codec[V any] interface {
+	Encode(w io.Writer, v V) error
+	Decode(r io.Reader) (V, error)
+}
+
+// Codec encoding values as JSON
+type JSONCodec[V any] struct{}
+
+func (JSONCodec[V]) Encode(w io.Writer, v V) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+func (JSONCodec[V]) Decode(r io.Reader) (v V, err error) {
+	err = json.NewDecoder(r).Decode(&v)
+	return
+}
+
+// Generates fresh values for the given key. ctx is the context of the
+// retrieval that started the population.
+// TypedGetter must be thread-safe.
+type TypedGetter[K comparable, V any] func(ctx context.Context, k K) (V, error)
+
+// Options for new typed frontend creation
+type TypedFrontendOptions[K comparable, V any] struct {
+	// Generates fresh values for the given key. Required.
+	Get TypedGetter[K, V]
+
+	// Encodes values into records and decodes them back.
+	//
+	// Defaults to JSONCodec.
+	Codec Codec[V]
+
+	// Options of the underlying Frontend. FrontendOptions.Get is ignored.
+	Frontend FrontendOptions
+}
+
+// Frontend for caching values of type V by keys of type K without dealing with
+// RecordWriter. The underlying Frontend is still available for streaming
+// access, eviction and inclusion of the encoded records into other records.
+type TypedFrontend[K comparable, V any] struct {
+	*Frontend
+	codec Codec[V]
+}
+
+// Create new TypedFrontend for accessing the cache
+func NewTypedFrontend[K comparable, V any](
+	c *Cache,
+	opts TypedFrontendOptions[K, V],
+) *TypedFrontend[K, V] {
+	codec := opts.Codec
+	if codec == nil {
+		codec = JSONCodec[V]{}
+	}
+	get := opts.Get
+	fopts := opts.Frontend
+	fopts.Get = func(k Key, rw *RecordWriter) error {
+		v, err := get(rw.ctx, k.(K))
+		if err != nil {
+			return err
+		}
+		return codec.Encode(rw, v)
+	}
+	return &TypedFrontend[K, V]{
+		Frontend: c.NewFrontendWithOptions(fopts),
+		codec:    codec,
+	}
+}
+
+// Retrieve or generate a value by key
+func (f *TypedFrontend[K, V]) Get(ctx context.Context, k K) (v V, err error) {
+	v, _, err = f.GetRecord(ctx, k)
+	return
+}
+
+// Same as Get(), but also returns the record the value was decoded from, for
+// access to its ETag and metadata or serving it over HTTP without re-encoding
+func (f *TypedFrontend[K, V]) GetRecord(ctx context.Context, k K) (
+	v V, rec *Record, err error,
+) {
+	rec, err = f.getGeneratedRecord(ctx, k)
+	if err != nil {
+		return
+	}
+	v, err = f.codec.Decode(rec.Decompress())
+	return
+}
@@ -0,0 +1,97 @@
+package recache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+type testContextKey struct{}
+
+// Encodes values as fmt formatted strings
+type stringCodec struct{}
+
+func (stringCodec) Encode(w io.Writer, v string) error {
+	_, err := fmt.Fprint(w, v)
+	return err
+}
+
+func (stringCodec) Decode(r io.Reader) (string, error) {
+	var b bytes.Buffer
+	_, err := b.ReadFrom(r)
+	return b.String(), err
+}
+
+func TestTypedFrontend(t *testing.T) {
+	t.Parallel()
+
+	type value struct {
+		Key     int
+		Context string
+	}
+
+	var (
+		errOdd = errors.New("odd key")
+		cache  = NewCache(CacheOptions{})
+		f      = NewTypedFrontend(cache, TypedFrontendOptions[int, value]{
+			Get: func(ctx context.Context, k int) (v value, err error) {
+				if k%2 != 0 {
+					err = errOdd
+					return
+				}
+				v.Key = k
+				v.Context, _ = ctx.Value(testContextKey{}).(string)
+				return
+			},
+		})
+		parents = NewTypedFrontend(cache, TypedFrontendOptions[string, string]{
+			Get: func(ctx context.Context, k string) (string, error) {
+				return "parent " + k, nil
+			},
+			Codec: stringCodec{},
+		})
+	)
+
+	ctx := context.WithValue(context.Background(), testContextKey{}, "foo")
+	for i := 0; i < 2; i++ {
+		v, err := f.Get(ctx, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEquals(t, v, value{2, "foo"})
+	}
+
+	_, err := f.Get(ctx, 1)
+	assertEquals(t, err, errOdd)
+
+	// Encoded record is accessible through the untyped Frontend
+	rec, err := f.Frontend.Get(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v value
+	decodeJSON(t, rec, &v)
+	assertEquals(t, v, value{2, "foo"})
+
+	s, err := parents.Get(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, s, "parent a")
+
+	s, rec, err = parents.GetRecord(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, s, "parent a")
+	std, err := parents.Frontend.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, rec.ETag(), std.ETag())
+
+	assertConsistency(t, cache)
+}
@@ -1,7 +1,9 @@
 package recache
 
 import (
+	"fmt"
 	"reflect"
+	"sync"
 	"testing"
 )
 
@@ -37,3 +39,22 @@ func assertJsonStringEquals(t *testing.T, src *Record, std string) {
 	decodeJSON(t, src, &res)
 	assertEquals(t, res, std)
 }
+
+// Logger that records all logged messages
+type testLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *testLogger) Printf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, args...))
+}
+
+// Return a copy of all logged messages
+func (l *testLogger) Messages() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.messages...)
+}
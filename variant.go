@@ -0,0 +1,160 @@
+package recache
+
+import (
+	"context"
+	"sync"
+)
+
+// Key of a variant record of a VariantFrontend
+type VariantKey[K, V comparable] struct {
+	Key     K
+	Variant V
+}
+
+// Options for new variant frontend creation
+type VariantFrontendOptions[K, V comparable, D any] struct {
+	// Fetches the upstream data shared by all variants of the given key.
+	// ctx is the context of the retrieval that started the population.
+	// Must be thread-safe. Required.
+	Fetch func(ctx context.Context, k K) (D, error)
+
+	// Writes the variant v of the record by key k generated from the fetched
+	// data to rw. Must not modify data. Must be thread-safe. Required.
+	Render func(rw *RecordWriter, k K, v V, data D) error
+
+	// Variants populated in the background together with any variant of a
+	// key, like all supported locales
+	Variants []V
+
+	// Options of the underlying Frontend. FrontendOptions.Get is ignored.
+	Frontend FrontendOptions
+}
+
+// Frontend for caching multiple variants of records of the same key, like
+// per-locale renderings of a page, populated from a single upstream fetch.
+// Keys of the underlying Frontend are of type VariantKey[K, V].
+//
+// Populations of variants of the same key running concurrently share the
+// fetched data. A variant population that fetched the data also starts
+// populations of all VariantFrontendOptions.Variants of the key not yet
+// cached, that reuse the fetched data.
+type VariantFrontend[K, V comparable, D any] struct {
+	*Frontend
+	opts VariantFrontendOptions[K, V, D]
+
+	mu      sync.Mutex
+	fetches map[K]*variantFetch[D]
+}
+
+// Upstream data fetch shared by variant populations of a key
+type variantFetch[D any] struct {
+	done chan struct{} // Closed, when data has been fetched
+	data D
+	err  error
+
+	// Amount of populations using the fetch. Requires lock on
+	// VariantFrontend.mu.
+	refs int
+}
+
+// Create new VariantFrontend for accessing the cache
+func NewVariantFrontend[K, V comparable, D any](
+	c *Cache,
+	opts VariantFrontendOptions[K, V, D],
+) *VariantFrontend[K, V, D] {
+	f := &VariantFrontend[K, V, D]{
+		opts:    opts,
+		fetches: make(map[K]*variantFetch[D]),
+	}
+	fopts := opts.Frontend
+	fopts.Get = f.get
+	f.Frontend = c.NewFrontendWithOptions(fopts)
+	return f
+}
+
+// Retrieve or generate the variant v of the record by key k
+func (f *VariantFrontend[K, V, D]) Get(ctx context.Context, k K, v V) (
+	*Record, error,
+) {
+	return f.getGeneratedRecord(ctx, VariantKey[K, V]{k, v})
+}
+
+// Getter of the underlying Frontend
+func (f *VariantFrontend[K, V, D]) get(key Key, rw *RecordWriter) error {
+	vk := key.(VariantKey[K, V])
+	fetch, started := f.acquire(vk.Key)
+	defer f.release(vk.Key)
+
+	if started {
+		fetch.data, fetch.err = f.opts.Fetch(rw.ctx, vk.Key)
+		close(fetch.done)
+		if fetch.err == nil {
+			f.fanOut(vk)
+		}
+	} else {
+		select {
+		case <-fetch.done:
+		case <-rw.ctx.Done():
+			return rw.ctx.Err()
+		}
+	}
+	if fetch.err != nil {
+		return fetch.err
+	}
+	return f.opts.Render(rw, vk.Key, vk.Variant, fetch.data)
+}
+
+// Return the fetch of key k in progress, or start a new one with
+// started=true
+func (f *VariantFrontend[K, V, D]) acquire(k K) (
+	fetch *variantFetch[D],
+	started bool,
+) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fetch, ok := f.fetches[k]
+	if !ok {
+		fetch = &variantFetch[D]{
+			done: make(chan struct{}),
+		}
+		f.fetches[k] = fetch
+		started = true
+	}
+	fetch.refs++
+	return
+}
+
+// Release a reference to the fetch of key k. Fetches are discarded, once not
+// used by any population.
+func (f *VariantFrontend[K, V, D]) release(k K) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fetch := f.fetches[k]
+	fetch.refs--
+	if fetch.refs == 0 {
+		delete(f.fetches, k)
+	}
+}
+
+// Populate all variants of the key of vk, other than vk, not yet cached with
+// the data fetched for vk
+func (f *VariantFrontend[K, V, D]) fanOut(vk VariantKey[K, V]) {
+	for _, v := range f.opts.Variants {
+		other := VariantKey[K, V]{vk.Key, v}
+		if v == vk.Variant {
+			continue
+		}
+		if _, ok := f.Peek(other); ok {
+			continue
+		}
+
+		// Keep the fetch referenced until the population completes
+		f.acquire(vk.Key)
+		go func() {
+			defer f.release(vk.Key)
+			f.Frontend.Get(other)
+		}()
+	}
+}
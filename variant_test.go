@@ -0,0 +1,121 @@
+package recache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestVariantFrontend(t *testing.T) {
+	t.Parallel()
+
+	var (
+		fetches int32
+		errOdd  = errors.New("odd key")
+		cache   = NewCache(CacheOptions{})
+		f       = NewVariantFrontend(
+			cache,
+			VariantFrontendOptions[int, string, []string]{
+				Fetch: func(ctx context.Context, k int) ([]string, error) {
+					atomic.AddInt32(&fetches, 1)
+					if k%2 != 0 {
+						return nil, errOdd
+					}
+					return []string{"row1", "row2"}, nil
+				},
+				Render: func(
+					rw *RecordWriter,
+					k int,
+					v string,
+					data []string,
+				) error {
+					_, err := fmt.Fprintf(rw, "%s:%d:%v", v, k, data)
+					return err
+				},
+				Variants: []string{"en", "fr", "de"},
+			},
+		)
+	)
+
+	read := func(k int, v string) string {
+		t.Helper()
+		rec, err := f.Get(context.Background(), k, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b stringCodec
+		s, err := b.Decode(rec.Decompress())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	waitCached := func(k int, variants ...string) {
+		t.Helper()
+		for _, v := range variants {
+			for i := 0; ; i++ {
+				if _, ok := f.Peek(VariantKey[int, string]{k, v}); ok {
+					break
+				}
+				if i == 1000 {
+					t.Fatalf("variant not populated: %d %s", k, v)
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+
+	// Other variants populated from the same fetch
+	assertEquals(t, read(0, "en"), "en:0:[row1 row2]")
+	waitCached(0, "fr", "de")
+	assertEquals(t, read(0, "fr"), "fr:0:[row1 row2]")
+	assertEquals(t, read(0, "de"), "de:0:[row1 row2]")
+	assertEquals(t, atomic.LoadInt32(&fetches), int32(1))
+
+	// Variants not in VariantFrontendOptions.Variants are still supported
+	assertEquals(t, read(0, "pl"), "pl:0:[row1 row2]")
+	assertEquals(t, atomic.LoadInt32(&fetches), int32(2))
+
+	// Concurrent populations share the fetch
+	var wg sync.WaitGroup
+	for _, v := range f.opts.Variants {
+		wg.Add(1)
+		go func(v string) {
+			defer wg.Done()
+			_, err := f.Get(context.Background(), 2, v)
+			if err != nil {
+				t.Error(err)
+			}
+		}(v)
+	}
+	wg.Wait()
+	assertEquals(t, atomic.LoadInt32(&fetches), int32(3))
+
+	// Fetch errors are not cached
+	for i := 0; i < 2; i++ {
+		_, err := f.Get(context.Background(), 1, "en")
+		if !errors.Is(err, errOdd) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	assertEquals(t, atomic.LoadInt32(&fetches), int32(5))
+
+	// Fetches are discarded after use
+	for i := 0; ; i++ {
+		f.mu.Lock()
+		n := len(f.fetches)
+		f.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if i == 1000 {
+			t.Fatalf("fetches not discarded: %d", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assertConsistency(t, cache)
+}
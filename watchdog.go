@@ -0,0 +1,111 @@
+package recache
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Population with waiters blocked on it for too long
+type blockedPopulation struct {
+	frontend  *Frontend
+	key       Key
+	populator uint64
+	waiters   int
+	duration  time.Duration
+}
+
+// Periodically report populations, that have had waiters blocked on them for
+// longer than threshold. Each population is only reported once.
+func (c *Cache) watchPopulations(threshold time.Duration) {
+	var (
+		reported = make(map[*Record]struct{})
+		blocked  []blockedPopulation
+		tick     = time.NewTicker(threshold / 2)
+	)
+	defer tick.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case now = <-tick.C:
+		case <-c.stop:
+			return
+		}
+
+		blocked = blocked[:0]
+
+		c.mu.Lock()
+		for rec := range reported {
+			if rec.semaphore.Finished() {
+				delete(reported, rec)
+			}
+		}
+		for r, loc := range c.populating {
+			if r.semaphore.Waiters() == 0 || !c.isPopulating(loc, r) {
+				continue
+			}
+			if _, ok := reported[r]; ok {
+				continue
+			}
+			started := atomic.LoadInt64(&r.populationStarted)
+			if started == 0 {
+				continue
+			}
+			dur := now.Sub(time.Unix(0, started))
+			if dur < threshold {
+				continue
+			}
+			reported[r] = struct{}{}
+			blocked = append(blocked, blockedPopulation{
+				frontend:  c.frontendMeta[loc.frontend].instance,
+				key:       loc.key,
+				populator: atomic.LoadUint64(&r.populator),
+				waiters:   r.semaphore.Waiters(),
+				duration:  dur,
+			})
+		}
+		c.mu.Unlock()
+
+		if len(blocked) == 0 {
+			continue
+		}
+		stacks := allStacks()
+		for _, b := range blocked {
+			c.logger.Printf(
+				"blocked population: key=%s duration=%s waiters=%d\n%s",
+				b.frontend.KeyString(b.key), b.duration, b.waiters,
+				goroutineStack(stacks, b.populator),
+			)
+		}
+	}
+}
+
+// Return stack traces of all goroutines
+func allStacks() []byte {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, len(buf)*2)
+	}
+}
+
+// Extract the stack trace of goroutine with the passed ID from the stack
+// traces of all goroutines
+func goroutineStack(stacks []byte, id uint64) []byte {
+	header := []byte("goroutine " + strconv.FormatUint(id, 10) + " [")
+	i := bytes.Index(stacks, header)
+	if i == -1 {
+		return nil
+	}
+	stack := stacks[i:]
+	if i := bytes.Index(stack, []byte("\n\n")); i != -1 {
+		stack = stack[:i]
+	}
+	return stack
+}
@@ -0,0 +1,146 @@
+package recache
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeadlockWatchdog(t *testing.T) {
+	t.Parallel()
+
+	var (
+		wg      sync.WaitGroup
+		log     testLogger
+		started = make(chan struct{})
+		release = make(chan struct{})
+		cache   = NewCache(CacheOptions{
+			Logger:            &log,
+			DeadlockThreshold: 10 * time.Millisecond,
+		})
+		f = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				close(started)
+				<-release
+				return dummyGetter(k, rw)
+			},
+		})
+	)
+
+	get := func() {
+		defer wg.Done()
+		_, err := f.Get("key1")
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	wg.Add(2)
+	go get()
+	<-started
+	go get()
+
+	for i := 0; len(log.Messages()) == 0; i++ {
+		if i == 1000 {
+			t.Fatal("blocked population not reported")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Only reported once
+	time.Sleep(50 * time.Millisecond)
+	msgs := log.Messages()
+	assertEquals(t, len(msgs), 1)
+
+	close(release)
+	wg.Wait()
+
+	for _, s := range [...]string{
+		`blocked population: key="key1"`,
+		"waiters=1",
+		"TestDeadlockWatchdog",
+	} {
+		if !strings.Contains(msgs[0], s) {
+			t.Fatalf("%q not in report: %s", s, msgs[0])
+		}
+	}
+}
+
+func TestDeadlockWatchdogPending(t *testing.T) {
+	t.Parallel()
+
+	var (
+		wg      sync.WaitGroup
+		log     testLogger
+		started = make(chan struct{})
+		release = make(chan struct{})
+		cache   = NewCache(CacheOptions{
+			Logger:            &log,
+			DeadlockThreshold: 10 * time.Millisecond,
+		})
+		f = cache.NewFrontend(dummyGetter)
+	)
+	_, err := f.Get("key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replacement records populated by Append() block concurrent appends
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, err := f.Append("key1", func(rw *RecordWriter) error {
+			close(started)
+			<-release
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	<-started
+	go func() {
+		defer wg.Done()
+		_, err := f.Append("key1", func(rw *RecordWriter) error {
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	for i := 0; len(log.Messages()) == 0; i++ {
+		if i == 1000 {
+			t.Fatal("blocked population not reported")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assertEquals(t, f.InFlight(), map[Key]int{"key1": 1})
+
+	close(release)
+	wg.Wait()
+
+	msgs := log.Messages()
+	assertEquals(t, len(msgs), 1)
+	for _, s := range [...]string{
+		`blocked population: key="key1"`,
+		"waiters=1",
+		"TestDeadlockWatchdogPending",
+	} {
+		if !strings.Contains(msgs[0], s) {
+			t.Fatalf("%q not in report: %s", s, msgs[0])
+		}
+	}
+	assertEquals(t, f.InFlight(), map[Key]int{})
+}
+
+func TestGoroutineStack(t *testing.T) {
+	t.Parallel()
+
+	stack := string(goroutineStack(allStacks(), goroutineID()))
+	if !strings.Contains(stack, "TestGoroutineStack") {
+		t.Fatalf("unexpected stack: %s", stack)
+	}
+	assertEquals(t, len(goroutineStack(allStacks(), 1<<62)), 0)
+}
@@ -3,20 +3,50 @@ package recache
 import (
 	"bytes"
 	"compress/flate"
+	"context"
 	"crypto/sha1"
+	"errors"
+	"fmt"
 	"hash"
 	"hash/adler32"
+	"hash/crc32"
+	"html"
 	"io"
+	"strings"
+	"time"
 )
 
-// Describes a single constituent deflate-compressed frame of a record
-type frameDescriptor struct {
+// Describes a single constituent deflate-compressed frame of a record or
+// component. Useful for stitching deflate frames together externally.
+type FrameDescriptor struct {
 	checksum uint32 // Adler32 checksum
+	crc32    uint32 // CRC32 checksum. Only computed with EnableGzip.
 	size     uint32 // Uncompressed size
 }
 
-// Appending another frameDescriptor onto f
-func (f *frameDescriptor) append(rhs frameDescriptor) {
+// Return the Adler32 checksum of the uncompressed data of the frame
+func (f FrameDescriptor) Checksum() uint32 {
+	return f.checksum
+}
+
+// Return the CRC32 checksum of the uncompressed data of the frame. Always 0,
+// unless EnableGzip is set.
+func (f FrameDescriptor) CRC32() uint32 {
+	return f.crc32
+}
+
+// Return the size of the uncompressed data of the frame. Overflows for frames
+// larger than 4 GiB, same as the ISIZE field of gzip.
+func (f FrameDescriptor) Size() uint32 {
+	return f.size
+}
+
+// Append the descriptor of the frame directly following the frame described
+// by f onto f. The result describes the concatenation of both frames.
+func (f *FrameDescriptor) Append(rhs FrameDescriptor) {
+	if EnableGzip {
+		f.crc32 = crc32Combine(f.crc32, rhs.crc32, rhs.size)
+	}
 	f.size += rhs.size // Allowed to overflow
 
 	// Merge Adler32 checksums. Based on adler32_combine() from zlib.
@@ -45,19 +75,130 @@ func (f *frameDescriptor) append(rhs frameDescriptor) {
 	f.checksum = sum1 | (sum2 << 16)
 }
 
+// Merge CRC32 checksum crc2 of a len2 byte long block into the checksum crc1
+// of the preceding block. Based on crc32_combine() from zlib.
+// Copyright (C) 1995-2006, 2010, 2011, 2012, 2016 Mark Adler
+func crc32Combine(crc1, crc2, len2 uint32) uint32 {
+	if len2 == 0 {
+		return crc1
+	}
+
+	var even, odd [32]uint32 // even and odd power-of-two zeros operators
+
+	// Put operator for one zero bit in odd
+	odd[0] = crc32.IEEE
+	row := uint32(1)
+	for n := 1; n < 32; n++ {
+		odd[n] = row
+		row <<= 1
+	}
+
+	gf2MatrixSquare(&even, &odd) // put operator for two zero bits in even
+	gf2MatrixSquare(&odd, &even) // put operator for four zero bits in odd
+
+	// Apply len2 zeros to crc1. First square will put the operator for one
+	// zero byte, eight zero bits, in even.
+	for {
+		gf2MatrixSquare(&even, &odd)
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(&even, crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+
+		gf2MatrixSquare(&odd, &even)
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(&odd, crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+	}
+
+	return crc1 ^ crc2
+}
+
+func gf2MatrixTimes(mat *[32]uint32, vec uint32) (sum uint32) {
+	for i := 0; vec != 0; i++ {
+		if vec&1 != 0 {
+			sum ^= mat[i]
+		}
+		vec >>= 1
+	}
+	return
+}
+
+func gf2MatrixSquare(square, mat *[32]uint32) {
+	for n := range mat {
+		square[n] = gf2MatrixTimes(mat, mat[n])
+	}
+}
+
 // Provides utility methods for building record buffers and recursive record
 // trees
 type RecordWriter struct {
 	compressing     bool // Currently compressing data into a buffer
+	weakDependent   bool // Register as weak dependent of included records
+	scratch         bool // Populating a record of a scratch cache
+	detached        bool // Populating a record not stored in the cache
 	cache, frontend int
 	key             Key
 
+	// Index of segment being regenerated by Frontend.Rebuild()
+	segment int
+
+	// Context of the retrieval that started the population
+	ctx context.Context
+
+	// Syntax of edge include tags to emit instead of embedding included
+	// records
+	edgeIncludes EdgeIncludeSyntax
+
+	// Records bound or included during population
+	dependencies []Dependency
+
+	// Failed includes replaced with fallback data
+	holes []Hole
+
+	// Time to live of the record set with SetTTL()
+	ttl time.Duration
+
+	// Creation time of a record restored from a snapshot. Zero for new
+	// records.
+	created time.Time
+
+	// Record was populated from FrontendOptions.L2
+	fromL2 bool
+
+	// Value set with SetAttachment()
+	attachment interface{}
+
+	// Restoring a record from a snapshot. Only records already in the cache
+	// can be included or bound.
+	restoring bool
+
+	// Stale record being regenerated, if any
+	previous *Record
+
+	// Time budget of each included or bound record
+	includeTimeout time.Duration
+
+	// Amount of following includes to split the remaining time budget among
+	split int
+
+	level      int    // Deflate compression level
+	sampled    bool   // Record data sampled for compressibility
+	sample     []byte // Data buffered for sampling compressibility
 	compressor *flate.Writer
 	current    struct { // Deflate frame currently being compressed
 		bytes.Buffer
 		size uint32
 	}
 	hasher hash.Hash32 // Adler32 checksum builder
+	crc    hash.Hash32 // CRC32 checksum builder. Only used with EnableGzip.
 
 	data componentNode
 	last *componentNode
@@ -65,19 +206,68 @@ type RecordWriter struct {
 
 // Write non-compressed data to the record for storage
 func (rw *RecordWriter) Write(p []byte) (n int, err error) {
+	if !rw.sampled {
+		if CompressionSampleSize == 0 {
+			rw.sampled = true
+		} else {
+			// Buffer writes, until enough data is collected to decide on the
+			// compression level
+			if rw.sample == nil {
+				rw.sample = make([]byte, 0, CompressionSampleSize)
+			}
+			i := CompressionSampleSize - len(rw.sample)
+			if i > len(p) {
+				i = len(p)
+			}
+			rw.sample = append(rw.sample, p[:i]...)
+			if len(rw.sample) < CompressionSampleSize {
+				return len(p), nil
+			}
+			err = rw.endSampling()
+			if err != nil {
+				return
+			}
+			n, err = rw.write(p[i:])
+			n += i
+			return
+		}
+	}
+	return rw.write(p)
+}
+
+// Detect, if the data sampled from the start of the record is
+// incompressible, and write the sample to the record
+func (rw *RecordWriter) endSampling() (err error) {
+	rw.sampled = true
+	if incompressible(rw.sample) {
+		rw.level = flate.NoCompression
+	}
+	_, err = rw.write(rw.sample)
+	rw.sample = nil
+	return
+}
+
+// Compress p into the current deflate frame
+func (rw *RecordWriter) write(p []byte) (n int, err error) {
 	if !rw.compressing {
 		// Initialize or reset pipeline state.
 		// Reuse allocated resources, if possible.
 		if rw.compressor == nil {
-			rw.compressor, err = flate.NewWriter(&rw.current, CompressionLevel)
+			rw.compressor, err = flate.NewWriter(&rw.current, rw.level)
 			if err != nil {
 				return
 			}
 			rw.hasher = adler32.New()
+			if EnableGzip {
+				rw.crc = crc32.NewIEEE()
+			}
 		} else {
 			rw.current.Reset()
 			rw.current.size = 0
 			rw.hasher.Reset()
+			if rw.crc != nil {
+				rw.crc.Reset()
+			}
 			rw.compressor.Reset(&rw.current)
 		}
 		rw.compressing = true
@@ -89,6 +279,12 @@ func (rw *RecordWriter) Write(p []byte) (n int, err error) {
 	}
 	rw.current.size += uint32(n)
 	_, err = rw.hasher.Write(p)
+	if err != nil {
+		return
+	}
+	if rw.crc != nil {
+		_, err = rw.crc.Write(p)
+	}
 	return
 }
 
@@ -120,35 +316,183 @@ func (rw *RecordWriter) ReadFrom(r io.Reader) (n int64, err error) {
 // Include data from passed frontend by key and bind it to rw.
 // The record generated by rw will automatically be evicted from its parent
 // cache on eviction of the included record.
-func (rw *RecordWriter) Include(f *Frontend, k Key) (err error) {
-	rec, err := rw.bind(f, k)
+//
+// If FrontendOptions.EdgeIncludes is set on the frontend of rw and
+// FrontendOptions.URL on f, writes an edge include tag instead.
+func (rw *RecordWriter) Include(f *Frontend, k Key) error {
+	return rw.include(f, k, false)
+}
+
+// Include data from passed frontend by key like Include(), but without
+// evicting the record generated by rw on eviction of the included record.
+// The record keeps embedding the content of the included record it was
+// populated with, until it is evicted by other means.
+//
+// Useful for cheap, frequently evicted fragments of expensive records, that
+// can tolerate serving outdated fragments, such as with a TTL of their own.
+// Unlike FrontendOptions.WeakDependent, no dependency is registered at all.
+func (rw *RecordWriter) IncludeWeak(f *Frontend, k Key) error {
+	return rw.include(f, k, true)
+}
+
+func (rw *RecordWriter) include(f *Frontend, k Key, weak bool) (err error) {
+	if rw.edgeIncludes != NoEdgeIncludes && f.opts.URL != nil {
+		return rw.writeEdgeInclude(f.opts.URL(k))
+	}
+
+	rec, err := rw.bind(f, k, weak)
 	if err != nil {
 		return
 	}
+	rw.dependencies[len(rw.dependencies)-1].Included = true
 
 	rw.append(recordReference{
 		componentCommon: componentCommon{
 			hash: rec.hash,
 		},
-		Record: rec,
+		Record:   rec,
+		frontend: f,
+		key:      k,
+		weak:     weak,
 	})
 
 	return
 }
 
-func (rw *RecordWriter) bind(f *Frontend, k Key) (rec *Record, err error) {
+// Include data from passed frontend by key like Include(). If retrieving the
+// included record fails, writes fallback instead and still caches the record
+// with the failed include as a hole. Records with holes are evicted after
+// FrontendOptions.HoleTTL of the frontend of rw to retry the failed includes.
+//
+// Useful for pages composed of many independent fragments, where a single
+// failing fragment should not fail the entire page.
+//
+// Errors not caused by retrieving the included record, like cancellation of
+// the population context, are returned as is.
+func (rw *RecordWriter) IncludeOrFallback(
+	f *Frontend,
+	k Key,
+	fallback []byte,
+) (err error) {
+	err = rw.Include(f, k)
+	if err == nil {
+		return
+	}
+	var ie *IncludeError
+	if !errors.As(err, &ie) || rw.ctx.Err() != nil {
+		return
+	}
+
+	rw.holes = append(rw.holes, Hole{
+		Frontend: f,
+		Key:      k,
+		Err:      err,
+	})
+	_, err = rw.Write(fallback)
+	return
+}
+
+// Write a named placeholder to be filled at serve time by
+// FrontendOptions.FillPlaceholder of the frontend serving the record, or a
+// record including it. Allows caching the rest of a page with parts varying by
+// request ("donut caching"). name must not be empty.
+func (rw *RecordWriter) Placeholder(name string) (err error) {
+	if name == "" {
+		return errors.New("empty placeholder name")
+	}
+	err = rw.flush(false)
+	if err != nil {
+		return
+	}
+	rw.append(newPlaceholder(name))
+	return
+}
+
+// Write edge include tag referencing url
+func (rw *RecordWriter) writeEdgeInclude(url string) (err error) {
+	url = html.EscapeString(url)
+	switch rw.edgeIncludes {
+	case ESIIncludes:
+		_, err = fmt.Fprintf(rw, `<esi:include src="%s"/>`, url)
+	case SSIIncludes:
+		_, err = fmt.Fprintf(rw, `<!--#include virtual="%s" -->`, url)
+	default:
+		err = fmt.Errorf("unknown edge include syntax: %d", rw.edgeIncludes)
+	}
+	return
+}
+
+// Retrieve the record by key k of f and register the record generated by rw
+// as its dependent, unless weak
+func (rw *RecordWriter) bind(
+	f *Frontend,
+	k Key,
+	weak bool,
+) (rec *Record, err error) {
 	// Finish any previous buffer writes
 	err = rw.flush(false)
 	if err != nil {
 		return
 	}
 
-	rec, err = f.getGeneratedRecord(k)
+	// Do not start child retrievals for abandoned parents
+	err = rw.ctx.Err()
 	if err != nil {
 		return
 	}
 
-	registerDependance(
+	ctx, budget, cancel := rw.includeContext()
+	defer cancel()
+	if !rw.detached {
+		// Records shared by all sessions must not include records
+		// regenerated privately for a session
+		ctx = withoutSession(ctx)
+	}
+
+	start := time.Now()
+	if rw.restoring {
+		var ok bool
+		rec, ok = f.Peek(k)
+		if !ok {
+			err = errNotRestored
+		}
+	} else {
+		rec, err = f.getGeneratedRecord(ctx, k)
+	}
+	if err != nil {
+		if budget != 0 &&
+			ctx.Err() == context.DeadlineExceeded &&
+			rw.ctx.Err() == nil {
+			err = &TimeoutError{
+				Budget:  budget,
+				Include: true,
+				Err:     err,
+			}
+		}
+		err = &IncludeError{
+			Frontend: f,
+			Key:      k,
+			Err:      err,
+		}
+		return
+	}
+	rw.dependencies = append(rw.dependencies, Dependency{
+		Frontend: f,
+		Key:      k,
+		Duration: time.Since(start),
+		Weak:     weak,
+	})
+
+	// Scratch caches are short-lived and must not be referenced from other
+	// caches after being closed
+	if weak || rw.detached || (rw.scratch && f.cache.id != rw.cache) {
+		return
+	}
+	f.cache.registerDependance(
+		recordLocation{
+			frontend: f.id,
+			key:      k,
+		},
 		intercacheRecordLocation{
 			cache: rw.cache,
 			recordLocation: recordLocation{
@@ -156,24 +500,66 @@ func (rw *RecordWriter) bind(f *Frontend, k Key) (rec *Record, err error) {
 				key:      rw.key,
 			},
 		},
-		intercacheRecordLocation{
-			cache: f.cache.id,
-			recordLocation: recordLocation{
-				frontend: f.id,
-				key:      k,
-			},
-		},
+		rw.weakDependent,
 	)
 
 	return
 }
 
+// Error returned from RecordWriter.Include() and RecordWriter.Bind(), when
+// retrieving the included or bound record fails. Errors of nested includes
+// are chained, so that the error message contains the full path to the
+// failing record.
+type IncludeError struct {
+	// Frontend and key of the record that failed to be retrieved
+	Frontend *Frontend
+	Key      Key
+
+	// Error the record failed with. Can be another *IncludeError.
+	Err error
+}
+
+// Format error as the path of records from the outermost include to the
+// failing record followed by the original error. For example:
+//
+//	cache1/frontend2/key("x") → cache1/frontend3/key(1): some error
+func (e *IncludeError) Error() string {
+	var (
+		w   strings.Builder
+		err error = e
+	)
+	for {
+		ie, ok := err.(*IncludeError)
+		if !ok {
+			break
+		}
+		if w.Len() != 0 {
+			w.WriteString(" → ")
+		}
+		fmt.Fprintf(
+			&w,
+			"cache%d/frontend%d/key(%s)",
+			ie.Frontend.cache.id,
+			ie.Frontend.id,
+			ie.Frontend.KeyString(ie.Key),
+		)
+		err = ie.Err
+	}
+	fmt.Fprintf(&w, ": %s", err)
+	return w.String()
+}
+
+// Return the error the record failed with
+func (e *IncludeError) Unwrap() error {
+	return e.Err
+}
+
 // Bind to record from passed frontend by key and return the retrieved record.
 //
 // The record generated by rw will automatically be evicted from its parent
 // cache on eviction of the included record.
 func (rw *RecordWriter) Bind(f *Frontend, k Key) (*Record, error) {
-	return rw.bind(f, k)
+	return rw.bind(f, k, false)
 }
 
 // Bind to record from passed frontend by key and decode it as JSON into dst.
@@ -192,10 +578,89 @@ func (rw *RecordWriter) BindJSON(
 	return s.DecodeJSON(dst)
 }
 
+// Register a dependency on an arbitrary external resource identified by token,
+// like a database table or feature flag.
+//
+// The record generated by rw will automatically be evicted from its parent
+// cache on a call to Cache.InvalidateToken() with the same token.
+func (rw *RecordWriter) DependOn(token string) {
+	if rw.detached {
+		return
+	}
+	c := getCache(rw.cache)
+	if c == nil {
+		return // Closed cache
+	}
+	c.registerTokenDependance(
+		recordLocation{
+			frontend: rw.frontend,
+			key:      rw.key,
+		},
+		token,
+	)
+}
+
+// Set the time to live of the record independently of CacheOptions.LRULimit.
+// The record is scheduled for eviction d after its population completes, same
+// as with Frontend.Evict(). Records including the record are evicted with it.
+//
+// With FrontendOptions.StaleWhileRevalidate set, the record is instead
+// considered stale after d and regenerated in the background on its next
+// retrieval.
+//
+// Zero value disables the TTL. The last call takes effect.
+func (rw *RecordWriter) SetTTL(d time.Duration) {
+	rw.ttl = d
+}
+
+// Attach an arbitrary value to the record, like response headers of an
+// upstream server, to be retrieved with Record.Attachment(). Unlike data
+// written to the record, the attachment does not affect its ETag and is not
+// stored in FrontendOptions.L2 or snapshots. The last call takes effect.
+//
+// A regenerated record with content identical to the record it replaces
+// retains the replaced record, but takes over the new attachment.
+func (rw *RecordWriter) SetAttachment(v interface{}) {
+	rw.attachment = v
+}
+
+// Return the context of the retrieval that started the population of the
+// record. Getters should abort slow population, once it is done.
+//
+// Returns context.Background() for populations not started by
+// Frontend.GetContext() or TypedFrontend.Get().
+func (rw *RecordWriter) Context() context.Context {
+	return rw.ctx
+}
+
+// Return the index of the segment currently being regenerated, when called
+// from the callback passed to Frontend.Rebuild(). Returns 0 otherwise.
+func (rw *RecordWriter) Segment() int {
+	return rw.segment
+}
+
+// Return the stale record being replaced by the record being populated, like
+// a record marked stale with Frontend.MarkStale(), failing
+// FrontendOptions.Validate or past its stale-while-revalidate TTL. Lets
+// Getters generate the record from the previous one, like by re-rendering only
+// changed sections or making a conditional request upstream with its ETag.
+//
+// The previous record is populated and must not be modified. Returns nil, if
+// the record is populated for the first time or after being evicted.
+func (rw *RecordWriter) Previous() *Record {
+	return rw.previous
+}
+
 // Flush the current deflate stream, if any.
 //
 // final: this is the final flush and copying of buffer is not required
 func (rw *RecordWriter) flush(final bool) (err error) {
+	if !rw.sampled && rw.sample != nil {
+		err = rw.endSampling()
+		if err != nil {
+			return
+		}
+	}
 	if rw.compressing {
 		err = rw.compressor.Flush()
 		if err != nil {
@@ -203,15 +668,18 @@ func (rw *RecordWriter) flush(final bool) (err error) {
 		}
 
 		var buf buffer
-		if final {
+		if final && !EnableArenas && !offHeap {
 			buf.data = rw.current.Bytes()
 		} else {
-			buf.data = make([]byte, rw.current.Len())
+			buf.data, buf.mem = allocate(rw.current.Len())
 			copy(buf.data, rw.current.Bytes())
 		}
 		buf.hash = sha1.Sum(buf.data)
-		buf.size = rw.current.size
-		buf.frameDescriptor.checksum = rw.hasher.Sum32()
+		buf.frame.size = rw.current.size
+		buf.frame.checksum = rw.hasher.Sum32()
+		if rw.crc != nil {
+			buf.frame.crc32 = rw.crc.Sum32()
+		}
 
 		rw.append(buf)
 		rw.compressing = false
@@ -1,30 +1,41 @@
 package recache
 
 import (
+	"bytes"
+	"compress/flate"
 	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hash/adler32"
+	"hash/crc32"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestBindJSON(t *testing.T) {
 	cache := NewCache(CacheOptions{})
 	var f *Frontend
-	f = cache.NewFrontend(func(k Key, rw *RecordWriter) (err error) {
-		switch k.(int) {
-		case 0:
-			var data string
-			err = rw.BindJSON(f, 1, &data)
-			if err != nil {
-				return
+	f = cache.NewFrontendWithOptions(FrontendOptions{
+		Get: func(k Key, rw *RecordWriter) (err error) {
+			switch k.(int) {
+			case 0:
+				var data string
+				err = rw.BindJSON(f, 1, &data)
+				if err != nil {
+					return
+				}
+				return json.NewEncoder(rw).Encode(data)
+			case 1:
+				return json.NewEncoder(rw).Encode("foo")
+			default:
+				return fmt.Errorf("unknown key: %d", k.(int))
 			}
-			return json.NewEncoder(rw).Encode(data)
-		case 1:
-			return json.NewEncoder(rw).Encode("foo")
-		default:
-			return fmt.Errorf("unknown key: %d", k.(int))
-		}
+		},
 	})
 
 	run := func() {
@@ -57,8 +68,8 @@ func TestAdlerAppend(t *testing.T) {
 		}
 	}
 
-	genDesc := func(b []byte) frameDescriptor {
-		return frameDescriptor{
+	genDesc := func(b []byte) FrameDescriptor {
+		return FrameDescriptor{
 			size:     uint32(len(b)),
 			checksum: adler32.Checksum(b),
 		}
@@ -67,9 +78,425 @@ func TestAdlerAppend(t *testing.T) {
 	fd1 := genDesc(buf1)
 	fd2 := genDesc(buf2)
 	appended := fd1
-	appended.append(fd2)
+	appended.Append(fd2)
 	combined := genDesc(append(buf1, buf2...))
 	if appended != combined {
 		t.Fatalf("descriptors don't match: %+v != %+v", appended, combined)
 	}
 }
+
+func TestCRC32Combine(t *testing.T) {
+	t.Parallel()
+
+	buf := make([]byte, 300)
+	_, err := rand.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	std := crc32.ChecksumIEEE(buf)
+	for _, i := range [...]int{0, 1, 128, 299, 300} {
+		res := crc32Combine(
+			crc32.ChecksumIEEE(buf[:i]),
+			crc32.ChecksumIEEE(buf[i:]),
+			uint32(len(buf)-i),
+		)
+		if res != std {
+			t.Fatalf("checksums don't match at split %d: %d != %d", i, res, std)
+		}
+	}
+}
+
+func TestIncludeError(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache    = NewCache(CacheOptions{})
+		children = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				return errSample
+			},
+		})
+		parents = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				return rw.Include(children, k)
+			},
+		})
+		grandparents = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				return rw.Include(parents, k)
+			},
+		})
+	)
+
+	_, err := grandparents.Get("x")
+	if !errors.Is(err, errSample) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var ie *IncludeError
+	if !errors.As(err, &ie) {
+		t.Fatalf("unexpected error type: %T", err)
+	}
+	assertEquals(t, ie.Frontend, parents)
+	assertEquals(t, ie.Key, "x")
+	assertEquals(
+		t,
+		err.Error(),
+		fmt.Sprintf(
+			`cache%d/frontend1/key("x") → cache%[1]d/frontend0/key("x"): %s`,
+			cache.id,
+			errSample,
+		),
+	)
+}
+
+func TestIncludeOrFallback(t *testing.T) {
+	t.Parallel()
+
+	var (
+		cache    = NewCache(CacheOptions{})
+		children = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) error {
+				if k.(int)%2 != 0 {
+					return errSample
+				}
+				_, err := fmt.Fprint(rw, k)
+				return err
+			},
+		})
+		parents = cache.NewFrontendWithOptions(FrontendOptions{
+			Get: func(k Key, rw *RecordWriter) (err error) {
+				for i := 0; i < 4; i++ {
+					err = rw.IncludeOrFallback(children, i, []byte("-"))
+					if err != nil {
+						return
+					}
+				}
+				return
+			},
+			HoleTTL: 10 * time.Millisecond,
+		})
+	)
+
+	rec, err := parents.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	_, err = buf.ReadFrom(rec.Decompress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, buf.String(), "0-2-")
+
+	holes := rec.Meta().Holes
+	assertEquals(t, len(holes), 2)
+	for i, h := range holes {
+		assertEquals(t, h.Frontend, children)
+		assertEquals(t, h.Key, i*2+1)
+		if !errors.Is(h.Err, errSample) {
+			t.Fatalf("unexpected error: %v", h.Err)
+		}
+	}
+
+	contains := func() bool {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		_, ok := cache.frontends[parents.id][nil]
+		return ok
+	}
+	for deadline := time.Now().Add(5 * time.Second); contains(); {
+		if time.Now().After(deadline) {
+			t.Fatal("record with holes not evicted after HoleTTL")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertConsistency(t, cache)
+}
+
+func TestEdgeIncludes(t *testing.T) {
+	t.Parallel()
+
+	cases := [...]struct {
+		name   string
+		syntax EdgeIncludeSyntax
+		std    string
+	}{
+		{
+			"embedded",
+			NoEdgeIncludes,
+			"<p>fragment a&amp;b</p>",
+		},
+		{
+			"ESI",
+			ESIIncludes,
+			`<p><esi:include src="/fragments/a&amp;b"/></p>`,
+		},
+		{
+			"SSI",
+			SSIIncludes,
+			`<p><!--#include virtual="/fragments/a&amp;b" --></p>`,
+		},
+	}
+
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			var (
+				cache     = NewCache(CacheOptions{})
+				fragments = cache.NewFrontendWithOptions(FrontendOptions{
+					Get: func(k Key, rw *RecordWriter) (err error) {
+						_, err = rw.Write([]byte("fragment a&amp;b"))
+						return
+					},
+					URL: func(k Key) string {
+						return "/fragments/" + k.(string)
+					},
+				})
+				pages = cache.NewFrontendWithOptions(FrontendOptions{
+					Get: func(k Key, rw *RecordWriter) (err error) {
+						_, err = rw.Write([]byte("<p>"))
+						if err != nil {
+							return
+						}
+						err = rw.Include(fragments, "a&b")
+						if err != nil {
+							return
+						}
+						_, err = rw.Write([]byte("</p>"))
+						return
+					},
+					EdgeIncludes: c.syntax,
+				})
+			)
+
+			rec, err := pages.Get(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var b strings.Builder
+			_, err = io.Copy(&b, rec.Decompress())
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEquals(t, b.String(), c.std)
+
+			// Records included as edge includes are not populated
+			assertEquals(t, fragments.Touch("a&b"), c.syntax == NoEdgeIncludes)
+		})
+	}
+}
+
+func TestIncompressibleSampling(t *testing.T) {
+	t.Parallel()
+
+	random := make([]byte, 4<<10)
+	_, err := rand.Read(random)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text := bytes.Repeat([]byte("abcdefgh "), 512)
+	cases := [...]struct {
+		name  string
+		data  []byte
+		level int
+
+		// Size of chunks to write data in. 0 writes data at once.
+		chunk int
+	}{
+		{"text", text, CompressionLevel, 0},
+		{"random", random, flate.NoCompression, 0},
+		{"gzip magic", []byte{0x1f, 0x8b, 0x08, 0x00}, flate.NoCompression, 0},
+		{"short", []byte("abc"), CompressionLevel, 0},
+		{"text small writes", text, CompressionLevel, 7},
+		{"random small writes", random, flate.NoCompression, 7},
+		{
+			"gzip magic small writes",
+			append([]byte{0x1f, 0x8b, 0x08, 0x00}, text...),
+			flate.NoCompression,
+			1,
+		},
+	}
+
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			cache := NewCache(CacheOptions{})
+			f := cache.NewFrontendWithOptions(FrontendOptions{
+				Get: func(_ Key, rw *RecordWriter) (err error) {
+					if c.chunk == 0 {
+						_, err = rw.Write(c.data)
+						return
+					}
+					for d := c.data; len(d) != 0; {
+						n := c.chunk
+						if n > len(d) {
+							n = len(d)
+						}
+						_, err = rw.Write(d[:n])
+						if err != nil {
+							return
+						}
+						d = d[n:]
+					}
+					return
+				},
+			})
+
+			rec, err := f.Get(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEquals(t, rec.Meta().CompressionLevel, c.level)
+
+			var buf bytes.Buffer
+			_, err = buf.ReadFrom(rec.Decompress())
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEquals(t, buf.Bytes(), c.data)
+		})
+	}
+}
+
+func TestIncludeWeak(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu       sync.Mutex
+		upstream = "1"
+		children *Frontend
+	)
+	childrenOpts := FrontendOptions{
+		Name: "children",
+		Get: func(k Key, rw *RecordWriter) (err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			_, err = rw.Write([]byte(upstream))
+			return
+		},
+	}
+	parentsOpts := FrontendOptions{
+		Name: "parents",
+		Get: func(k Key, rw *RecordWriter) (err error) {
+			_, err = rw.Write([]byte("<"))
+			if err != nil {
+				return
+			}
+			err = rw.IncludeWeak(children, k)
+			if err != nil {
+				return
+			}
+			_, err = rw.Write([]byte(">"))
+			return
+		},
+	}
+
+	src := NewCache(CacheOptions{})
+	children = src.NewFrontendWithOptions(childrenOpts)
+	parents := src.NewFrontendWithOptions(parentsOpts)
+
+	read := func(f *Frontend) string {
+		t.Helper()
+		rec, err := f.Get("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dec bytes.Buffer
+		_, err = dec.ReadFrom(rec.Decompress())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dec.String()
+	}
+	contains := func(f *Frontend) bool {
+		f.cache.mu.Lock()
+		defer f.cache.mu.Unlock()
+		_, ok := f.cache.frontends[f.id]["a"]
+		return ok
+	}
+
+	assertEquals(t, read(parents), "<1>")
+	rec, err := parents.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deps := rec.Meta().Dependencies
+	assertEquals(t, len(deps), 1)
+	assertEquals(t, deps[0].Included, true)
+	assertEquals(t, deps[0].Weak, true)
+
+	// Evicting the included record does not evict the parent
+	var buf bytes.Buffer
+	err = src.Snapshot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	upstream = "2"
+	mu.Unlock()
+	children.Evict(0, "a")
+	assertEquals(t, contains(parents), true)
+	assertEquals(t, read(parents), "<1>")
+	assertEquals(t, read(children), "2")
+	assertConsistency(t, src)
+
+	// Weak includes restored from snapshots
+	cache, fs, err := LoadCache(
+		&buf,
+		CacheOptions{},
+		childrenOpts,
+		parentsOpts,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	children, parents = fs[0], fs[1]
+	assertEquals(t, read(parents), "<1>")
+	children.Evict(0, "a")
+	assertEquals(t, contains(parents), true)
+	assertConsistency(t, cache)
+}
+
+func TestSetAttachment(t *testing.T) {
+	t.Parallel()
+
+	var populations int32
+	f := NewCache(CacheOptions{}).NewFrontendWithOptions(FrontendOptions{
+		Get: func(k Key, rw *RecordWriter) error {
+			n := atomic.AddInt32(&populations, 1)
+			if k.(int) != 0 {
+				rw.SetAttachment(n)
+			}
+			return dummyGetter(k, rw)
+		},
+	})
+
+	rec, err := f.Get(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, rec.Attachment(), nil)
+
+	rec, err = f.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, rec.Attachment(), int32(2))
+
+	// Identical content retains the replaced record with the new attachment
+	assertEquals(t, f.MarkStale(1), true)
+	_, err = f.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, rec.Attachment(), int32(3))
+	cached, ok := f.Peek(1)
+	assertEquals(t, ok, true)
+	assertEquals(t, cached, rec)
+}